@@ -0,0 +1,222 @@
+// Package agent runs on launched instances and stops them once their jobs
+// have finished and nobody is logged in, reporting its status in tags.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+/* ---
+ * What the agent saw in one check. Job is true when a watched process or
+ * the job directory was active.
+ * --- */
+type Activity struct {
+	Job     bool
+	Users   int
+	Reasons []string
+}
+
+func (a Activity) Busy() bool {
+	return a.Job || a.Users > 0
+}
+
+/* ---
+ * The agent for one instance. The probes find running processes, logged in
+ * users and the latest write to the job directory; they default to the
+ * Linux implementations in this package and can be replaced for testing.
+ * --- */
+type Agent struct {
+	EC2        ec2iface.EC2API
+	InstanceID string
+	Config     datamodels.AgentConfig
+	Out        io.Writer
+	DryRun     bool
+
+	Processes   func() ([]string, error)
+	Users       func(ctx context.Context) (int, error)
+	LatestWrite func(dir string) (time.Time, error)
+	Now         func() time.Time
+
+	// When the instance was last busy, and whether a job has been seen.
+	lastBusy time.Time
+	jobSeen  bool
+}
+
+/* ---
+ * Create an agent for the instance with the default probes.
+ * --- */
+func New(client ec2iface.EC2API, instanceID string, config datamodels.AgentConfig, out io.Writer) *Agent {
+	return &Agent{
+		EC2:         client,
+		InstanceID:  instanceID,
+		Config:      config,
+		Out:         out,
+		Processes:   RunningProcesses,
+		Users:       LoggedInUsers,
+		LatestWrite: LatestWrite,
+		Now:         time.Now,
+	}
+}
+
+/* ---
+ * Check the instance every interval until ctx is cancelled or the agent
+ * stops the instance.
+ * --- */
+func (a *Agent) Run(ctx context.Context) error {
+	a.logf("Agent started on %s: %s", a.InstanceID, a.describeConfig())
+	for {
+		stopped, err := a.Check(ctx)
+		if err != nil {
+			a.logf("Warning: %s", err)
+		}
+		if stopped {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.Config.Interval):
+		}
+	}
+}
+
+/* ---
+ * Check the instance once: send a heartbeat and stop the instance if it
+ * has been idle for long enough. Returns true if the instance is being
+ * stopped.
+ * --- */
+func (a *Agent) Check(ctx context.Context) (bool, error) {
+	now := a.Now()
+	if a.lastBusy.IsZero() {
+		// Give jobs and users the full idle time from when the agent starts.
+		a.lastBusy = now
+	}
+
+	activity := a.observe(ctx, now)
+	if activity.Busy() {
+		a.lastBusy = now
+	}
+	if activity.Job {
+		a.jobSeen = true
+	}
+
+	status := "busy"
+	detail := strings.Join(activity.Reasons, "; ")
+	idleFor := now.Sub(a.lastBusy)
+	stop := false
+	if !activity.Busy() {
+		status = "idle"
+		switch {
+		case a.Config.RequireJob && !a.jobSeen:
+			detail = "waiting for a job to start"
+		case idleFor >= a.Config.IdleAfter:
+			status = "stopping"
+			detail = fmt.Sprintf("idle for %s", idleFor.Truncate(time.Second))
+			stop = true
+		default:
+			detail = fmt.Sprintf("idle for %s, stopping after %s", idleFor.Truncate(time.Second), a.Config.IdleAfter)
+		}
+	}
+	a.logf("%s: %s", status, detail)
+
+	err := a.heartbeat(ctx, now, status, detail)
+	if !stop {
+		return false, err
+	}
+	if a.DryRun {
+		a.logf("Dry run, not stopping %s", a.InstanceID)
+		return false, err
+	}
+	if _, stopErr := a.EC2.StopInstancesWithContext(ctx, utils.CreateEC2StopInstanceParams([]string{a.InstanceID}, false, false, false)); stopErr != nil {
+		return false, fmt.Errorf("unable to stop %s: %s", a.InstanceID, utils.ErrorSummary(stopErr))
+	}
+	a.logf("Stopping %s", a.InstanceID)
+	return true, err
+}
+
+/* ---
+ * Look for running jobs and logged in users. A probe that fails is logged
+ * and counted as busy, so a broken probe never stops an instance.
+ * --- */
+func (a *Agent) observe(ctx context.Context, now time.Time) Activity {
+	activity := Activity{Reasons: make([]string, 0)}
+
+	if len(a.Config.Processes) > 0 {
+		running, err := a.Processes()
+		if err != nil {
+			activity.Job = true
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("unable to list processes: %s", err))
+		} else if matched := matchProcesses(running, a.Config.Processes); len(matched) > 0 {
+			activity.Job = true
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("running %s", strings.Join(matched, ",")))
+		}
+	}
+
+	if a.Config.JobDir != "" {
+		latest, err := a.LatestWrite(a.Config.JobDir)
+		switch {
+		case err != nil:
+			activity.Job = true
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("unable to check %s: %s", a.Config.JobDir, err))
+		case now.Sub(latest) < a.Config.QuietPeriod:
+			activity.Job = true
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("%s written %s ago", a.Config.JobDir, now.Sub(latest).Truncate(time.Second)))
+		}
+	}
+
+	if a.Config.CheckUsers {
+		users, err := a.Users(ctx)
+		if err != nil {
+			activity.Users = 1
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("unable to list users: %s", err))
+		} else if users > 0 {
+			activity.Users = users
+			activity.Reasons = append(activity.Reasons, fmt.Sprintf("%d users logged in", users))
+		}
+	}
+	return activity
+}
+
+/* ---
+ * Record the agent's status in the instance's tags.
+ * --- */
+func (a *Agent) heartbeat(ctx context.Context, now time.Time, status, detail string) error {
+	if len(detail) > 256 {
+		detail = detail[:256]
+	}
+	tags := map[string]string{
+		utils.TagAgentHeartbeat: now.UTC().Format(time.RFC3339),
+		utils.TagAgentStatus:    status,
+		utils.TagAgentDetail:    detail,
+	}
+	if _, err := a.EC2.CreateTagsWithContext(ctx, utils.CreateEC2SetTagsParams([]string{a.InstanceID}, tags)); err != nil {
+		return fmt.Errorf("unable to send heartbeat: %s", utils.ErrorSummary(err))
+	}
+	return nil
+}
+
+func (a *Agent) describeConfig() string {
+	parts := make([]string, 0)
+	if len(a.Config.Processes) > 0 {
+		parts = append(parts, fmt.Sprintf("processes %s", strings.Join(a.Config.Processes, ",")))
+	}
+	if a.Config.JobDir != "" {
+		parts = append(parts, fmt.Sprintf("job directory %s (quiet after %s)", a.Config.JobDir, a.Config.QuietPeriod))
+	}
+	if a.Config.CheckUsers {
+		parts = append(parts, "logged in users")
+	}
+	return fmt.Sprintf("watching %s, stopping after %s idle", strings.Join(parts, ", "), a.Config.IdleAfter)
+}
+
+func (a *Agent) logf(format string, args ...interface{}) {
+	fmt.Fprintf(a.Out, "%s %s\n", a.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// An EC2 client that records the heartbeat tags and stop calls it is sent.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	tags    map[string]string
+	stopped []string
+	tagErr  error
+}
+
+func (f *fakeEC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	if f.tagErr != nil {
+		return nil, f.tagErr
+	}
+	f.tags = make(map[string]string)
+	for _, tag := range input.Tags {
+		f.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) StopInstancesWithContext(ctx aws.Context, input *ec2.StopInstancesInput, opts ...request.Option) (*ec2.StopInstancesOutput, error) {
+	f.stopped = append(f.stopped, aws.StringValueSlice(input.InstanceIds)...)
+	return &ec2.StopInstancesOutput{}, nil
+}
+
+/* ---
+ * An agent with probes reporting what the test sets: the running
+ * processes, logged in users and the last write to the job directory. The
+ * clock starts at 09:00 and is moved on by checkAfter.
+ * --- */
+type testAgent struct {
+	*Agent
+	client     *fakeEC2
+	now        time.Time
+	processes  []string
+	processErr error
+	users      int
+	lastWrite  time.Time
+}
+
+func newTestAgent(config datamodels.AgentConfig) *testAgent {
+	test := &testAgent{client: &fakeEC2{}, now: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)}
+	test.lastWrite = test.now.Add(-24 * time.Hour)
+	test.Agent = New(test.client, "i-0123", config, &bytes.Buffer{})
+	test.Processes = func() ([]string, error) { return test.processes, test.processErr }
+	test.Users = func(ctx context.Context) (int, error) { return test.users, nil }
+	test.LatestWrite = func(dir string) (time.Time, error) { return test.lastWrite, nil }
+	test.Now = func() time.Time { return test.now }
+	return test
+}
+
+/* ---
+ * Move the clock on and check once, failing the test on an error.
+ * --- */
+func (test *testAgent) checkAfter(t *testing.T, elapsed time.Duration) bool {
+	test.now = test.now.Add(elapsed)
+	stopped, err := test.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stopped
+}
+
+func (test *testAgent) status() string {
+	return test.client.tags[utils.TagAgentStatus]
+}
+
+func TestCheckStopsAfterIdle(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{Processes: []string{"nextflow"}, IdleAfter: 30 * time.Minute})
+	test.processes = []string{"bash", "java", "nextflow"}
+
+	if test.checkAfter(t, 0) || test.status() != "busy" {
+		t.Fatalf("got status %q, want busy while nextflow runs", test.status())
+	}
+	if detail := test.client.tags[utils.TagAgentDetail]; detail != "running nextflow" {
+		t.Errorf("got detail %q", detail)
+	}
+	if test.client.tags[utils.TagAgentHeartbeat] != "2024-03-04T09:00:00Z" {
+		t.Errorf("got heartbeat %q", test.client.tags[utils.TagAgentHeartbeat])
+	}
+
+	// The job finishes; the idle time counts from the last busy check.
+	test.processes = []string{"bash"}
+	if test.checkAfter(t, 10*time.Minute) || test.status() != "idle" {
+		t.Fatalf("got status %q, want idle", test.status())
+	}
+	if test.checkAfter(t, 19*time.Minute) {
+		t.Fatal("stopped before idle_after")
+	}
+	if !test.checkAfter(t, time.Minute) || test.status() != "stopping" {
+		t.Fatalf("got status %q, want stopping after 30m idle", test.status())
+	}
+	if len(test.client.stopped) != 1 || test.client.stopped[0] != "i-0123" {
+		t.Errorf("got stop calls %v, want i-0123", test.client.stopped)
+	}
+}
+
+func TestCheckRequireJob(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{Processes: []string{"nextflow"}, IdleAfter: 30 * time.Minute, RequireJob: true})
+
+	// No job has run yet, so the instance is never stopped.
+	for idx := 0; idx < 5; idx++ {
+		if test.checkAfter(t, time.Hour) {
+			t.Fatal("stopped before a job was seen")
+		}
+	}
+	if test.status() != "idle" || test.client.tags[utils.TagAgentDetail] != "waiting for a job to start" {
+		t.Errorf("got %q: %q, want waiting for a job", test.status(), test.client.tags[utils.TagAgentDetail])
+	}
+
+	test.processes = []string{"nextflow"}
+	test.checkAfter(t, time.Hour)
+	test.processes = nil
+	if test.checkAfter(t, 20*time.Minute) {
+		t.Fatal("stopped before idle_after once the job finished")
+	}
+	if !test.checkAfter(t, 10*time.Minute) {
+		t.Error("not stopped 30m after the job finished")
+	}
+}
+
+func TestCheckJobDir(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{JobDir: "/data/run", QuietPeriod: 10 * time.Minute, IdleAfter: 30 * time.Minute})
+
+	test.lastWrite = test.now.Add(-5 * time.Minute)
+	if test.checkAfter(t, 0) || test.status() != "busy" {
+		t.Fatalf("got status %q, want busy while the job directory is written to", test.status())
+	}
+	if detail := test.client.tags[utils.TagAgentDetail]; !strings.HasPrefix(detail, "/data/run written 5m0s ago") {
+		t.Errorf("got detail %q", detail)
+	}
+	if test.checkAfter(t, 10*time.Minute) || test.status() != "idle" {
+		t.Errorf("got status %q, want idle after the quiet period", test.status())
+	}
+}
+
+func TestCheckFailingProbeCountsAsBusy(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{Processes: []string{"nextflow"}, CheckUsers: true, IdleAfter: time.Minute})
+	test.processErr = errors.New("/proc not mounted")
+	test.Users = func(ctx context.Context) (int, error) { return 0, errors.New("who: not found") }
+
+	for idx := 0; idx < 3; idx++ {
+		if test.checkAfter(t, time.Hour) {
+			t.Fatal("stopped while probes were failing")
+		}
+	}
+	detail := test.client.tags[utils.TagAgentDetail]
+	if test.status() != "busy" || !strings.Contains(detail, "unable to list processes") || !strings.Contains(detail, "unable to list users") {
+		t.Errorf("got %q: %q, want busy with both probe errors", test.status(), detail)
+	}
+}
+
+func TestCheckUsers(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{CheckUsers: true, IdleAfter: 30 * time.Minute})
+	test.users = 2
+	if test.checkAfter(t, time.Hour) || test.status() != "busy" || test.client.tags[utils.TagAgentDetail] != "2 users logged in" {
+		t.Fatalf("got %q: %q, want busy with 2 users", test.status(), test.client.tags[utils.TagAgentDetail])
+	}
+	test.users = 0
+	if !test.checkAfter(t, 30*time.Minute) {
+		t.Error("not stopped 30m after the users logged out")
+	}
+}
+
+func TestCheckDryRun(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{CheckUsers: true, IdleAfter: 30 * time.Minute})
+	test.DryRun = true
+	// The idle time counts from the agent's first check.
+	if test.checkAfter(t, 0) || test.status() != "idle" {
+		t.Fatalf("got status %q on the first check, want idle", test.status())
+	}
+	if test.checkAfter(t, time.Hour) {
+		t.Error("dry run reported the instance as stopping")
+	}
+	if len(test.client.stopped) != 0 {
+		t.Errorf("dry run stopped %v", test.client.stopped)
+	}
+	if test.status() != "stopping" {
+		t.Errorf("got status %q, want the heartbeat to show it would stop", test.status())
+	}
+	if out := test.Out.(*bytes.Buffer).String(); !strings.Contains(out, "Dry run, not stopping i-0123") {
+		t.Errorf("dry run not logged: %q", out)
+	}
+}
+
+func TestCheckHeartbeatError(t *testing.T) {
+	test := newTestAgent(datamodels.AgentConfig{CheckUsers: true, IdleAfter: 30 * time.Minute})
+	test.client.tagErr = awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+
+	stopped, err := test.Check(context.Background())
+	if stopped || err == nil || !strings.Contains(err.Error(), "unable to send heartbeat") {
+		t.Errorf("got %t, %v, want the heartbeat error", stopped, err)
+	}
+
+	// A failed heartbeat does not keep an idle instance running.
+	test.now = test.now.Add(time.Hour)
+	if stopped, _ := test.Check(context.Background()); !stopped {
+		t.Error("not stopped when the heartbeat failed")
+	}
+}
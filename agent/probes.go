@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Most entries LatestWrite looks at before giving up on finding a recent
+// write, so huge work directories do not make checks slow.
+const maxWalkEntries = 200000
+
+var errWalkLimit = errors.New("walk limit reached")
+
+/* ---
+ * List the names of running processes from /proc: each process's command
+ * name and the base names of its first two arguments (so scripts run by an
+ * interpreter, such as nextflow under java or bash, are found too).
+ * --- */
+func RunningProcesses() ([]string, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.Trim(entry.Name(), "0123456789") != "" {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+		if comm, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			names = append(names, strings.TrimSpace(string(comm)))
+		}
+		if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+			args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+			for idx := 0; idx < len(args) && idx < 2; idx++ {
+				if len(args[idx]) > 0 {
+					names = append(names, filepath.Base(string(args[idx])))
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+/* ---
+ * Count the login sessions reported by who.
+ * --- */
+func LoggedInUsers(ctx context.Context) (int, error) {
+	output, err := exec.CommandContext(ctx, "who").Output()
+	if err != nil {
+		return 0, err
+	}
+	sessions := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			sessions++
+		}
+	}
+	return sessions, nil
+}
+
+/* ---
+ * Get the latest modification time of anything in dir. Gives up after
+ * maxWalkEntries entries, returning the latest seen so far.
+ * --- */
+func LatestWrite(dir string) (time.Time, error) {
+	var latest time.Time
+	seen := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can vanish while a job runs.
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		seen++
+		if seen >= maxWalkEntries {
+			return errWalkLimit
+		}
+		return nil
+	})
+	if err != nil && err != errWalkLimit {
+		return latest, err
+	}
+	return latest, nil
+}
+
+/* ---
+ * Get the watched names that appear among the running processes.
+ * --- */
+func matchProcesses(running, watched []string) []string {
+	present := make(map[string]bool)
+	for _, name := range running {
+		present[name] = true
+	}
+	matched := make([]string, 0)
+	for _, name := range watched {
+		if present[name] {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,76 @@
+// cloud_control_agent runs on an EC2 instance, reports what the instance is
+// doing in its tags and stops it once its jobs have finished and nobody is
+// logged in. It is normally installed by the user data mdibl_cloud_control
+// writes when a launch config sets agent_url, and uses the instance's IAM
+// role (which needs ec2:CreateTags and ec2:StopInstances on the instance).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/agent"
+	"mdibl_cloud_control/utils"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func main() {
+	configPath := flag.String("config", utils.AgentConfigPath, "Agent config file")
+	once := flag.Bool("once", false, "Check once, send a heartbeat and exit")
+	dryRun := flag.Bool("dry-run", false, "Report idle instances without stopping them")
+	version := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("cloud_control_agent %s\n", utils.ToolVersion)
+		return
+	}
+	if err := run(*configPath, *once, *dryRun); err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, once, dryRun bool) error {
+	config, err := utils.LoadAgentConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// The instance's identity and credentials come from the instance
+	// metadata service.
+	mySession, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+	identity, err := ec2metadata.New(mySession).GetInstanceIdentityDocumentWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to read instance identity, is this an EC2 instance? %s", err)
+	}
+	client := ec2.New(mySession, request.WithRetryer(aws.NewConfig().WithRegion(identity.Region), utils.NewRetryPolicy(utils.DefaultMaxAttempts, os.Stderr)))
+
+	a := agent.New(client, identity.InstanceID, config, os.Stdout)
+	a.DryRun = dryRun
+	if once {
+		_, err := a.Check(ctx)
+		return err
+	}
+	return a.Run(ctx)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/utils"
+	"os"
+	"time"
+)
+
+var agentsCommand = &command{
+	Name:    "agents",
+	Summary: "Check the on-instance auto-shutdown agents",
+	Subcommands: []*command{
+		agentsStatusCommand,
+	},
+}
+
+var agentsStatusCommand = &command{
+	Name:    "status",
+	Args:    "[<instance_report>]",
+	Summary: "Show the status each agent last reported",
+	Description: "List the busy, idle or stopping status and last heartbeat the agent on each instance reported\n" +
+		"in its tags. Shows every instance with an agent unless an instance report, --instance or\n" +
+		"--filter is given. Running instances whose agent has not reported within --stale are stale.",
+	Examples: []string{
+		programName + " agents status",
+		programName + " agents status --filter 'tag:Project=rnaseq' --stale 30m",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		stale := fs.Duration("stale", 15*time.Minute, "Report agents without a heartbeat for this long as stale")
+		selection := selectionFlags(fs, "")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			statuses, err := c.AgentStatus(ctx, selection(args), *stale)
+			if err != nil {
+				return err
+			}
+			if len(statuses) == 0 {
+				fmt.Println("No agents have reported")
+				return nil
+			}
+			utils.FprintAgentStatuses(os.Stdout, statuses, time.Now())
+			return nil
+		}
+	},
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/notify"
+	"mdibl_cloud_control/utils"
+	"os"
+)
+
+var eventsCommand = &command{
+	Name:    "events",
+	Summary: "List scheduled maintenance events and notify owners",
+	Description: "List the reboots, retirements and other maintenance AWS has scheduled on instances, with the\n" +
+		"event type, deadline and affected instance, soonest first. Checks the current region unless\n" +
+		"--region or --all-regions is given. With --notify, the owner of each instance (from its Owner\n" +
+		"tag) is sent one notice per event through the channels in the [notify] section of --config,\n" +
+		"which must set at least one channel.",
+	Examples: []string{
+		programName + " events --all-regions",
+		programName + " events --region us-east-1 --region us-west-2 --notify --config reaper.config --non-interactive",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		regions := repeatedList{}
+		fs.Var(&regions, "region", "Region to check (repeatable)")
+		allRegions := fs.Bool("all-regions", false, "Check every region enabled in the account")
+		notifyOwners := fs.Bool("notify", false, "Notify instance owners of events they have not been told about")
+		configPath := fs.String("config", "", "Config file with a [notify] section, such as reaper.config")
+
+		return func(ctx context.Context, args []string) error {
+			if *allRegions && len(regions) > 0 {
+				return fmt.Errorf("Use either --region or --all-regions, not both")
+			}
+			options := controller.EventOptions{Regions: regions, AllRegions: *allRegions}
+			if *notifyOwners {
+				// Events are tagged as notified, so a notice only printed
+				// here would never reach the owner.
+				if *configPath == "" {
+					return fmt.Errorf("--notify needs a --config file with a [notify] channel")
+				}
+				config, err := utils.LoadNotifyConfig(*configPath)
+				if err != nil {
+					return err
+				}
+				if !config.HasChannel() {
+					return fmt.Errorf("%s has no [notify] channel: set log_file, smtp_server or webhook_url", *configPath)
+				}
+				if options.Notifier, err = notify.New(config, os.Stdout); err != nil {
+					return err
+				}
+			}
+
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.ScheduledEvents(ctx, options)
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
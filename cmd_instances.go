@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/remote"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"time"
+)
+
+var instancesCommand = &command{
+	Name:    "instances",
+	Summary: "List, start, stop, launch and terminate EC2 instances",
+	Subcommands: []*command{
+		instancesListCommand,
+		instancesStartCommand,
+		instancesStopCommand,
+		instancesRebootCommand,
+		instancesResizeCommand,
+		instancesIdleCheckCommand,
+		instancesHealthCommand,
+		instancesConsoleCommand,
+		instancesExecCommand,
+		instancesPushCommand,
+		instancesPullCommand,
+		instancesLaunchCommand,
+		instancesTerminateCommand,
+	},
+}
+
+var instancesListCommand = &command{
+	Name:    "list",
+	Summary: "List instances and write an instance report",
+	Description: "List EC2 instances in the configured region and write them to an instance report.\n" +
+		"By default instances that are running, stopped or pending are listed.",
+	Examples: []string{
+		programName + " instances list",
+		programName + " instances list --state running",
+		programName + " instances list --profile lab --report-dir /shared/reports",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		states := stringList{}
+		fs.Var(&states, "state", "Instance states to list, comma separated (default stopped,running,pending)")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+
+			report, outputFileName, err := c.ListInstances(ctx, states)
+			if err != nil {
+				return err
+			}
+
+			// Print instance details to screen
+			utils.PrintEC2InstanceReport(report)
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+			return nil
+		}
+	},
+}
+
+var instancesStartCommand = &command{
+	Name:    "start",
+	Args:    "[<instance_report>]",
+	Summary: "Start stopped instances",
+	Description: "Start the instances in an instance report, the instances given with --instance or\n" +
+		"matching --filter, or every stopped instance with --all. This will not create new instances.\n" +
+		"Reports are acted on in the region they were created in.",
+	Examples: []string{
+		programName + " instances start reports/us-east-2/latest_all_instance_details.json",
+		programName + " instances start --instance analysis-01 --instance i-0123456789abcdef0",
+		programName + " instances start --all",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return stateChangeCommand(fs, opts, (*controller.Controller).Start, "stopped")
+	},
+}
+
+var instancesStopCommand = &command{
+	Name:    "stop",
+	Args:    "[<instance_report>]",
+	Summary: "Stop running instances",
+	Description: "Stop the instances in an instance report, the instances given with --instance or\n" +
+		"matching --filter, or every running instance with --all. --hibernate saves memory to\n" +
+		"disk so it is restored on start; --force stops instances that are stuck shutting down.\n" +
+		"Reports are acted on in the region they were created in.",
+	Examples: []string{
+		programName + " instances stop reports/us-east-2/latest_all_instance_details.json",
+		programName + " instances stop --instance analysis-01",
+		programName + " instances stop --all --dry-run",
+		programName + " instances stop --filter 'tag:Project=rnaseq' --hibernate",
+		programName + " instances stop --instance i-0123456789abcdef0 --force",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		options := controller.StopOptions{}
+		fs.BoolVar(&options.Hibernate, "hibernate", false, "Hibernate instead of stopping (instances must be launched with hibernation enabled)")
+		fs.BoolVar(&options.Force, "force", false, "Force instances to stop without a clean shutdown, for stuck instances")
+		stop := func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.StateChangeReport, string, error) {
+			options.DryRun = dryRun
+			return c.StopWithOptions(ctx, selection, options)
+		}
+		return stateChangeCommand(fs, opts, stop, "running")
+	},
+}
+
+var instancesRebootCommand = &command{
+	Name:    "reboot",
+	Args:    "[<instance_report>]",
+	Summary: "Reboot running instances",
+	Description: "Reboot the instances in an instance report, the instances given with --instance or\n" +
+		"matching --filter, or every running instance with --all.\n" +
+		"Reports are acted on in the region they were created in.",
+	Examples: []string{
+		programName + " instances reboot reports/us-east-2/latest_all_instance_details.json",
+		programName + " instances reboot --filter 'name=analysis-*' --filter state=running",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return stateChangeCommand(fs, opts, (*controller.Controller).Reboot, "running")
+	},
+}
+
+var instancesResizeCommand = &command{
+	Name:    "resize",
+	Args:    "[<instance_report>] --type <instance_type>",
+	Summary: "Change the instance type of instances",
+	Description: "Change the instance type of the instances in an instance report, given with --instance\n" +
+		"or matching --filter. The new type must be offered in the region and support the\n" +
+		"instance's architecture, virtualization type, boot mode, ENA and NVMe requirements.\n" +
+		"Running instances are stopped, resized and started again; stopped instances stay stopped.",
+	Examples: []string{
+		programName + " instances resize --instance analysis-01 --type r5.4xlarge",
+		programName + " instances resize --filter 'tag:Project=rnaseq' --type m5.2xlarge --dry-run",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		options := controller.ResizeOptions{}
+		fs.StringVar(&options.InstanceType, "type", "", "Instance type to change to")
+		fs.BoolVar(&options.DryRun, "dry-run", false, "Check permissions without changing any instances")
+		fs.BoolVar(&options.SkipChecks, "skip-checks", false, "Skip the architecture, boot mode, ENA and NVMe compatibility checks")
+		selection := selectionFlags(fs, "")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.Resize(ctx, selection(args), options)
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
+
+var instancesIdleCheckCommand = &command{
+	Name:    "idle-check",
+	Args:    "[<instance_report>]",
+	Summary: "Find (and optionally stop) idle instances",
+	Description: "Check the CloudWatch CPU and network metrics of running instances and report those that\n" +
+		"stayed below the thresholds in every period of the window. Checks every running instance\n" +
+		"unless an instance report, --instance or --filter is given. With --stop, idle instances are\n" +
+		"stopped after confirmation. Instances running for less than the window are never idle.",
+	Examples: []string{
+		programName + " instances idle-check",
+		programName + " instances idle-check --filter 'tag:Project=rnaseq' --cpu 2 --window 6h --stop",
+		"*/30 * * * * cd /opt/cloud_control && ./" + programName + " instances idle-check --stop --non-interactive >> idle.log 2>&1",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		thresholds := datamodels.IdleThresholds{}
+		fs.Float64Var(&thresholds.CPUPercent, "cpu", utils.DefaultIdleCPUPercent, "Idle below this average CPU percent")
+		network := fs.Float64("network", utils.DefaultIdleNetworkPerSec/1024, "Idle below this much network traffic (in plus out), in KiB/s")
+		fs.DurationVar(&thresholds.Window, "window", utils.DefaultIdleWindow, "How long instances must have been idle")
+		fs.DurationVar(&thresholds.Period, "period", utils.DefaultIdlePeriod, "Length of each metric period in the window")
+		stop := fs.Bool("stop", false, "Stop idle instances rather than only reporting them")
+		selection := selectionFlags(fs, "")
+
+		return func(ctx context.Context, args []string) error {
+			thresholds.NetworkBytesPerSecond = *network * 1024
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.CheckIdle(ctx, selection(args), controller.IdleOptions{Thresholds: thresholds, Stop: *stop})
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
+
+var instancesHealthCommand = &command{
+	Name:    "health",
+	Args:    "[<instance_report>]",
+	Summary: "Show status checks and scheduled maintenance events",
+	Description: "Show the system and instance status checks and any scheduled maintenance events of the\n" +
+		"instances in an instance report, given with --instance or matching --filter, or of every\n" +
+		"running instance. Running instances failing their checks for --unreachable-after are flagged\n" +
+		"unreachable. Exits 0 when all is well, 2 when an instance is impaired, unreachable or has a\n" +
+		"scheduled event, and 1 on error.",
+	Examples: []string{
+		programName + " instances health",
+		programName + " instances health --filter 'tag:Project=rnaseq' --unreachable-after 5m || notify-team",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		unreachableAfter := fs.Duration("unreachable-after", 15*time.Minute, "Flag running instances failing status checks for this long as unreachable")
+		selection := selectionFlags(fs, "")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			report, outputFileName, err := c.Health(ctx, selection(args), *unreachableAfter)
+			if err != nil {
+				return err
+			}
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			if report.HasProblems() {
+				return exitCodeError{code: 2}
+			}
+			return nil
+		}
+	},
+}
+
+var instancesConsoleCommand = &command{
+	Name:    "console",
+	Args:    "[<instance_report>]",
+	Summary: "Show console output and highlight boot failures",
+	Description: "Fetch the console output of the instances in an instance report, given with --instance or\n" +
+		"matching --filter, and save it beside the report. The last --lines lines are printed with\n" +
+		"lines showing cloud-init failures, kernel panics, user-data script errors and boot problems\n" +
+		"marked '!!'. With --screenshot, a screenshot of each console is saved where the instance type\n" +
+		"supports it. Exits 0 when no problems are found, 2 when some are, and 1 on error.",
+	Examples: []string{
+		programName + " instances console --instance web-1",
+		programName + " instances console --lines 0 reports/us-east-1/latest_launch_instance_details.json",
+		programName + " instances console --filter 'tag:Project=rnaseq' --latest --screenshot",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		options := controller.ConsoleOptions{}
+		fs.BoolVar(&options.Latest, "latest", false, "Get the most recent output rather than the boot output (Nitro instances only)")
+		fs.BoolVar(&options.Screenshot, "screenshot", false, "Also save a screenshot of each console")
+		fs.IntVar(&options.Lines, "lines", 40, "Print this many lines of output per instance (0 for all)")
+		selection := selectionFlags(fs, "")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			report, outputFileName, err := c.Console(ctx, selection(args), options)
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			if err != nil {
+				return err
+			}
+			if report.HasProblems() {
+				return exitCodeError{code: 2}
+			}
+			return nil
+		}
+	},
+}
+
+var instancesExecCommand = &command{
+	Name:    "exec",
+	Args:    "[<instance_report>] -- <command>...",
+	Summary: "Run a command on instances over SSH",
+	Description: "Run a shell command over SSH on the running instances in an instance report, given with\n" +
+		"--instance or matching --filter, or every running instance with --all, at most --parallel at\n" +
+		"a time. Output is streamed with each line prefixed by the instance's name, and exit codes are\n" +
+		"saved in an exec_results report. The user and key file of each instance are worked out as for\n" +
+		"'report export'; keys not found in --key-dir are taken from the SSH agent. Put -- before the\n" +
+		"command when giving a report. Exits 1 if the command failed on any instance.",
+	Examples: []string{
+		programName + " instances exec reports/us-east-1/latest_launch_instance_details.json -- df -h /data",
+		programName + " instances exec --filter 'tag:Project=rnaseq' --parallel 20 -- 'docker pull ghcr.io/mdibl/rnaseq:latest'",
+		programName + " instances exec --all --user ubuntu --strict-host-keys yes -- uptime",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		options := controller.ExecOptions{}
+		fs.IntVar(&options.Parallel, "parallel", controller.DefaultParallel, "Number of instances to run on at once")
+		fs.DurationVar(&options.CommandTimeout, "command-timeout", 0, "Time limit on the command on each instance (0 for none)")
+		ssh := sshFlags(fs)
+		selection := selectionFlags(fs, "running")
+
+		return func(ctx context.Context, args []string) error {
+			var command []string
+			args, command = splitCommandArgs(args)
+			if len(command) == 0 {
+				return fmt.Errorf("Command to run required but not supplied")
+			}
+			options.Command = strings.Join(command, " ")
+			var err error
+			if options.Hosts, options.SSH, err = ssh(); err != nil {
+				return err
+			}
+
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.Exec(ctx, selection(args), options)
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
+
+var instancesPushCommand = &command{
+	Name:    "push",
+	Args:    "[<instance_report>] <local_path> <remote_path>",
+	Summary: "Copy files to instances over SFTP",
+	Description: "Copy a local file or directory to the same path on the running instances in an instance\n" +
+		"report, given with --instance or matching --filter, or every running instance with --all, at\n" +
+		"most --parallel at a time. A file is copied to the remote path, or into it if it is a\n" +
+		"directory; a directory is copied to the remote path with its contents. Interrupted copies\n" +
+		"resume where they stopped, files already up to date are skipped and every copy is checked\n" +
+		"against the local file's sha256. Instances are reached as for 'instances exec'.",
+	Examples: []string{
+		programName + " instances push reports/us-east-1/latest_launch_instance_details.json references/GRCh38 /data/references/GRCh38",
+		programName + " instances push --filter 'tag:Project=rnaseq' samples.tsv /data/",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return transferCommand(fs, opts, "push")
+	},
+}
+
+var instancesPullCommand = &command{
+	Name:    "pull",
+	Args:    "[<instance_report>] <remote_path> <local_dir>",
+	Summary: "Copy files from instances over SFTP",
+	Description: "Copy a file or directory from the running instances in an instance report, given with\n" +
+		"--instance or matching --filter, or every running instance with --all, to\n" +
+		"<local_dir>/<instance name>/<name of remote path>, at most --parallel at a time.\n" +
+		"Interrupted copies resume where they stopped, files already up to date are skipped and\n" +
+		"every copy is checked against the remote file's sha256. Instances are reached as for\n" +
+		"'instances exec'.",
+	Examples: []string{
+		programName + " instances pull reports/us-east-1/latest_launch_instance_details.json /data/results results/",
+		programName + " instances pull --instance analysis-1 /var/log/cloud-init-output.log logs/",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return transferCommand(fs, opts, "pull")
+	},
+}
+
+var instancesTerminateCommand = &command{
+	Name:    "terminate",
+	Args:    "[<instance_report>]",
+	Summary: "Terminate instances",
+	Description: "Terminate the instances in an instance report, given with --instance or matching --filter.\n" +
+		"Terminated instances and their delete-on-termination volumes can not be recovered.",
+	Examples: []string{
+		programName + " instances terminate reports/us-east-2/2020-06-01/launch_instance_details_2020-06-01T09-12-44.json",
+		programName + " instances terminate --instance i-0123456789abcdef0",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return stateChangeCommand(fs, opts, (*controller.Controller).Terminate, "")
+	},
+}
+
+var instancesLaunchCommand = &command{
+	Name:    "launch",
+	Args:    "<instance_config>",
+	Summary: "Launch instances from a config file",
+	Description: "Launch instances described by a launch config file and write a launch report.\n" +
+		"See instance.config for the config file format.",
+	Examples: []string{
+		programName + " instances launch instance.config",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Instance config file required but not supplied")
+			}
+
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+
+			_, outputFileName, err := c.Launch(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+			fmt.Println("Done!")
+			return nil
+		}
+	},
+}
+
+// A controller operation that changes the state of selected instances.
+type stateChangeOperation func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.StateChangeReport, string, error)
+
+/* ---
+ * Set up a start, stop, reboot or terminate command running the given
+ * controller operation. Commands that can act on every instance in allState
+ * offer --all.
+ * --- */
+func stateChangeCommand(fs *flag.FlagSet, opts *globalOptions, operation stateChangeOperation, allState string) func(ctx context.Context, args []string) error {
+	dryRun := fs.Bool("dry-run", false, "Check permissions without changing any instances")
+	selection := selectionFlags(fs, allState)
+
+	return func(ctx context.Context, args []string) error {
+		c, err := opts.controller(ctx)
+		if err != nil {
+			return err
+		}
+		_, outputFileName, err := operation(c, ctx, selection(args), *dryRun)
+		if outputFileName != "" {
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+		}
+		return err
+	}
+}
+
+/* ---
+ * Register the flags that select instances: --instance, --filter and, if
+ * allState is set, --all. The returned function builds the selection once
+ * flags are parsed, taking an instance report from the first argument.
+ * --- */
+func selectionFlags(fs *flag.FlagSet, allState string) func(args []string) controller.Selection {
+	selection := controller.Selection{}
+	instances := stringList{}
+	filters := repeatedList{}
+	fs.Var(&instances, "instance", "Instance ID or Name tag to act on (repeatable)")
+	fs.Var(&filters, "filter", "Act on instances matching a filter expression such as 'name=web-*' (repeatable)")
+	if allState != "" {
+		fs.BoolVar(&selection.All, "all", false, fmt.Sprintf("Act on every %s instance", allState))
+	}
+
+	return func(args []string) controller.Selection {
+		if len(args) > 0 {
+			selection.Report = args[0]
+		}
+		selection.Instances = instances
+		selection.Filters = filters
+		return selection
+	}
+}
+
+/* ---
+ * Set up a push or pull command. The last two arguments are the source and
+ * destination; an instance report may come before them.
+ * --- */
+func transferCommand(fs *flag.FlagSet, opts *globalOptions, direction string) func(ctx context.Context, args []string) error {
+	options := controller.TransferOptions{Direction: direction}
+	fs.IntVar(&options.Parallel, "parallel", controller.DefaultParallel, "Number of instances to copy to or from at once")
+	ssh := sshFlags(fs)
+	selection := selectionFlags(fs, "running")
+
+	return func(ctx context.Context, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("Source and destination paths required but not supplied")
+		}
+		options.Source, options.Destination = args[len(args)-2], args[len(args)-1]
+		var err error
+		if options.Hosts, options.SSH, err = ssh(); err != nil {
+			return err
+		}
+
+		c, err := opts.controller(ctx)
+		if err != nil {
+			return err
+		}
+		_, outputFileName, err := c.Transfer(ctx, selection(args[:len(args)-2]), options)
+		if outputFileName != "" {
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+		}
+		return err
+	}
+}
+
+/* ---
+ * Register the flags that say how to reach instances over SSH. The returned
+ * function builds the host options and SSH config once flags are parsed.
+ * --- */
+func sshFlags(fs *flag.FlagSet) func() (datamodels.ExportOptions, remote.Config, error) {
+	hosts := datamodels.ExportOptions{}
+	config := remote.Config{}
+	fs.StringVar(&hosts.User, "user", "", "SSH user for every instance rather than inferring it from the AMI")
+	fs.StringVar(&hosts.KeyDir, "key-dir", "~/.ssh", "Directory holding <key name>.pem key files")
+	fs.StringVar(&hosts.Address, "address", "auto", "Address to connect to: auto (public if any), public or private")
+	fs.IntVar(&config.Port, "port", remote.DefaultPort, "SSH port")
+	fs.DurationVar(&config.ConnectTimeout, "connect-timeout", remote.DefaultConnectTimeout, "Time limit on connecting to each instance")
+	hostKeys := fs.String("strict-host-keys", "accept-new", fmt.Sprintf("Host key checking: %s", strings.Join(remote.HostKeyModes, ", ")))
+	knownHosts := fs.String("known-hosts", "~/.ssh/known_hosts", "Known hosts file to check host keys against")
+
+	return func() (datamodels.ExportOptions, remote.Config, error) {
+		if hosts.Address != "auto" && hosts.Address != "public" && hosts.Address != "private" {
+			return hosts, config, fmt.Errorf("--address must be auto, public or private")
+		}
+		var err error
+		if config.HostKeyCallback, err = remote.HostKeyCallback(*hostKeys, *knownHosts); err != nil {
+			return hosts, config, err
+		}
+		config.Auth = remote.AgentAuth()
+		return hosts, config, nil
+	}
+}
+
+/* ---
+ * Split arguments at "--" into the instance report (if any) and a command.
+ * The flag parser drops a "--" that comes before any other argument, so
+ * without one every argument is the command.
+ * --- */
+func splitCommandArgs(args []string) ([]string, []string) {
+	for idx, arg := range args {
+		if arg == "--" {
+			return args[:idx], args[idx+1:]
+		}
+	}
+	return nil, args
+}
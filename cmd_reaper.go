@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/notify"
+	"mdibl_cloud_control/utils"
+	"os"
+	"time"
+)
+
+var reaperCommand = &command{
+	Name:    "reaper",
+	Summary: "Stop or terminate instances past their Expiry tag",
+	Description: "Find instances whose Expiry tag has passed and stop or terminate them, warning their\n" +
+		"owners (from the Owner tag) beforehand. An instance's ExpiryAction tag (stop or terminate)\n" +
+		"overrides the default action. Notification channels and policy are read from a reaper\n" +
+		"config file; see reaper.config. Use --non-interactive to run from cron.",
+	Examples: []string{
+		programName + " reaper --dry-run",
+		programName + " reaper --config reaper.config --non-interactive",
+		"0 * * * * cd /opt/cloud_control && ./" + programName + " reaper --config reaper.config --non-interactive >> reaper.log 2>&1",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		configPath := fs.String("config", "", "Reaper config file with the policy and notification settings")
+		action := fs.String("action", "", "Action for expired instances, stop or terminate (default from config, or stop)")
+		warnBefore := fs.String("warn-before", "", "Warn owners this long before expiry, e.g. 2d or 12h (default from config, or 1d)")
+		dryRun := fs.Bool("dry-run", false, "Show what would be done without warning anyone or changing instances")
+
+		return func(ctx context.Context, args []string) error {
+			config := datamodels.ReaperConfig{Action: "stop", WarnBefore: 24 * time.Hour}
+			var err error
+			if *configPath != "" {
+				config, err = utils.LoadReaperConfig(*configPath)
+				if err != nil {
+					return err
+				}
+			}
+			if *action != "" {
+				config.Action = *action
+			}
+			if *warnBefore != "" {
+				config.WarnBefore, err = utils.ParseDays(*warnBefore)
+				if err != nil {
+					return fmt.Errorf("Invalid --warn-before: %s", err)
+				}
+			}
+			notifier, err := notify.New(config.Notify, os.Stdout)
+			if err != nil {
+				return err
+			}
+
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.Reap(ctx, controller.ReapOptions{
+				Action:     config.Action,
+				WarnBefore: config.WarnBefore,
+				DryRun:     *dryRun,
+				Notifier:   notifier,
+			})
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"os"
+	"sort"
+	"strings"
+)
+
+var reportCommand = &command{
+	Name:    "report",
+	Summary: "Compare, filter, merge, split and migrate instance reports",
+	Subcommands: []*command{
+		reportDiffCommand,
+		reportFilterCommand,
+		reportSelectCommand,
+		reportMergeCommand,
+		reportSplitCommand,
+		reportMigrateCommand,
+		reportExportCommand,
+	},
+}
+
+var reportDiffCommand = &command{
+	Name:    "diff",
+	Args:    "<baseline_report>",
+	Summary: "Compare a baseline report against live instances",
+	Description: "Compare a saved baseline report against the instances currently in the baseline's\n" +
+		"region and report missing, extra, state-changed, retyped and IP-changed instances.\n" +
+		"Only instances matching --filter count as extra; without --filter, the Project and Owner\n" +
+		"tags shared by every baseline instance scope the check. Exits 0 when there is no drift,\n" +
+		"2 when there is drift and 1 on error.",
+	Examples: []string{
+		programName + " report diff baselines/project_x.json || notify-team",
+		programName + " report diff --filter tag:Project=project_x --filter 'name=px-*' baselines/project_x.json",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		filters := repeatedList{}
+		fs.Var(&filters, "filter", "Only count instances matching a filter expression as extra (repeatable)")
+
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Baseline instance report file required but not supplied")
+			}
+
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+
+			drift, outputFileName, err := c.Diff(ctx, args[0], filters)
+			if err != nil {
+				return err
+			}
+			utils.FprintDriftReport(c.Out, drift)
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+
+			if drift.HasDrift() {
+				return exitCodeError{code: 2}
+			}
+			return nil
+		}
+	},
+}
+
+var reportFilterCommand = &command{
+	Name:    "filter",
+	Args:    "<instance_report> <expr>...",
+	Summary: "Keep the instances matching filter expressions",
+	Description: "Write a report of the instances matching every filter expression.\n" +
+		"Expressions have the form <field>=<patterns> or <field>!=<patterns>, where field is one\n" +
+		"of name, id, state, type, az or tag:<key>. Patterns are shell globs and a comma\n" +
+		"separated list matches any of them.",
+	Examples: []string{
+		programName + " report filter reports/us-east-2/latest_all_instance_details.json 'name=analysis-*' state=stopped",
+		programName + " report filter report.json tag:Project=rnaseq 'type!=t2.*'",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Instance report file required but not supplied")
+			}
+			report, err := utils.LoadInstanceReport(args[0])
+			if err != nil {
+				return err
+			}
+			filters, err := utils.ParseInstanceFilters(args[1:])
+			if err != nil {
+				return err
+			}
+			return writeDerivedReport(opts, utils.FilterInstanceReport(report, filters), "filtered")
+		}
+	},
+}
+
+var reportSelectCommand = &command{
+	Name:        "select",
+	Args:        "<instance_report>",
+	Summary:     "Interactively pick instances from a report",
+	Description: "List the instances in a report and write a report of the ones picked by index.",
+	Examples: []string{
+		programName + " report select reports/us-east-2/latest_all_instance_details.json",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Instance report file required but not supplied")
+			}
+			report, err := utils.LoadInstanceReport(args[0])
+			if err != nil {
+				return err
+			}
+
+			c, err := opts.localController()
+			if err != nil {
+				return err
+			}
+			selected, err := c.SelectInstances(ctx, report)
+			if err != nil {
+				return err
+			}
+			_, err = c.WriteDerivedReport(selected, "selected")
+			return err
+		}
+	},
+}
+
+var reportMergeCommand = &command{
+	Name:    "merge",
+	Args:    "<instance_report> <instance_report>...",
+	Summary: "Merge reports, de-duplicating by instance ID",
+	Description: "Merge several reports into one. When an instance appears in more than one report\n" +
+		"the copy from the last report wins. Reports from different regions or accounts, or\n" +
+		"reports without metadata alongside reports with it, are not merged unless --force is\n" +
+		"given; a forced merge of reports from different regions or accounts has no metadata.",
+	Examples: []string{
+		programName + " report merge project_a.json project_b.json",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		force := fs.Bool("force", false, "Merge reports whose regions or accounts differ or are unknown")
+
+		return func(ctx context.Context, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("At least two instance report files required")
+			}
+
+			reports := make([]datamodels.EC2InstanceReport, 0)
+			for _, instanceReport := range args {
+				report, err := utils.LoadInstanceReport(instanceReport)
+				if err != nil {
+					return err
+				}
+				reports = append(reports, report)
+			}
+
+			merged, err := utils.MergeInstanceReports(reports, *force)
+			if err != nil {
+				return err
+			}
+			return writeDerivedReport(opts, merged, "merged")
+		}
+	},
+}
+
+var reportSplitCommand = &command{
+	Name:        "split",
+	Args:        "<instance_report> <type|tag:KEY>",
+	Summary:     "Split a report by instance type or tag value",
+	Description: "Write one report per instance type or tag value. Instances without the tag are grouped under \"untagged\".",
+	Examples: []string{
+		programName + " report split reports/us-east-2/latest_all_instance_details.json tag:Project",
+		programName + " report split report.json type",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("Instance report file and split key (type or tag:<key>) required")
+			}
+			report, err := utils.LoadInstanceReport(args[0])
+			if err != nil {
+				return err
+			}
+			parts, err := utils.SplitInstanceReport(report, args[1])
+			if err != nil {
+				return err
+			}
+			names := utils.SplitReportNames(parts)
+			keys := make([]string, 0, len(parts))
+			for key := range parts {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if err := writeDerivedReport(opts, parts[key], fmt.Sprintf("split_%s", names[key])); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	},
+}
+
+var reportMigrateCommand = &command{
+	Name:    "migrate",
+	Args:    "<instance_report>...",
+	Summary: "Upgrade reports to the current report format",
+	Description: "Rewrite instance reports in the current report format. The original of each\n" +
+		"upgraded report is kept beside it as <report>.v<version>.bak.",
+	Examples: []string{
+		programName + " report migrate /shared/reports/*.json",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Instance report file required but not supplied")
+			}
+
+			// Migrating only touches the given files, so no aws config is needed.
+			c := &controller.Controller{In: os.Stdin, Out: os.Stdout}
+			return c.MigrateReports(args)
+		}
+	},
+}
+
+var reportExportCommand = &command{
+	Name:    "export",
+	Args:    "<instance_report> <ssh-config|ansible|hosts|csv>",
+	Summary: "Export a report as ssh_config, Ansible inventory, hosts entries or CSV",
+	Description: "Write the instances in a report as ssh_config Host blocks, an INI Ansible inventory grouped\n" +
+		"by tag, /etc/hosts entries or a CSV roster, to standard output or --output. Hosts use their\n" +
+		"public IP if they have one (see --address) and are named by their Name tag. The SSH user is\n" +
+		"taken from --user, the instance's SSHUser tag or its AMI family (looked up unless --offline),\n" +
+		"and the key file is the instance's key pair name in --key-dir.",
+	Examples: []string{
+		programName + " report export reports/us-east-1/latest_launch_instance_details.json ssh-config --output ~/.ssh/config.d/project_x",
+		programName + " report export report.json ansible --tag Project --tag Role > inventory.ini",
+		programName + " report export report.json csv --tag Owner --offline",
+	},
+	Complete: func(opts *globalOptions, args []string) []string {
+		if len(args) == 1 {
+			return utils.ExportFormats
+		}
+		return nil
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		options := datamodels.ExportOptions{}
+		tags := repeatedList{}
+		output := fs.String("output", "", "Write to this file rather than standard output")
+		fs.StringVar(&options.Address, "address", "auto", "Address to connect to: auto (public if any), public or private")
+		fs.StringVar(&options.User, "user", "", "SSH user for every host rather than inferring it")
+		fs.StringVar(&options.KeyDir, "key-dir", "~/.ssh", "Directory holding <key name>.pem key files (empty for no key file)")
+		fs.Var(&tags, "tag", "Tag key to group Ansible hosts by and add as a CSV column (repeatable)")
+		offline := fs.Bool("offline", false, "Do not look up AMIs to infer SSH users")
+
+		return func(ctx context.Context, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("Instance report file and export format (%s) required", strings.Join(utils.ExportFormats, ", "))
+			}
+			if options.Address != "auto" && options.Address != "public" && options.Address != "private" {
+				return fmt.Errorf("--address must be auto, public or private")
+			}
+			options.Tags = tags
+
+			var c *controller.Controller
+			var err error
+			if *offline || options.User != "" {
+				c, err = opts.localController()
+			} else {
+				c, err = opts.controller(ctx)
+			}
+			if err != nil {
+				return err
+			}
+			// Keep warnings out of the export.
+			c.Out = os.Stderr
+
+			data, err := c.ExportReport(ctx, args[0], args[1], options)
+			if err != nil {
+				return err
+			}
+			if *output == "" {
+				_, err = os.Stdout.Write(data)
+				return err
+			}
+			if err := utils.WriteSecureFile(*output, data); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Output written to %s\n", *output)
+			return nil
+		}
+	},
+}
+
+/* ---
+ * Write a report derived from another report with a local controller.
+ * --- */
+func writeDerivedReport(opts *globalOptions, report datamodels.EC2InstanceReport, reportType string) error {
+	c, err := opts.localController()
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteDerivedReport(report, reportType)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/datamodels"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+/* ---
+ * An EC2 client whose DescribeInstances returns a fixed set of instances.
+ * --- */
+type fakeEC2 struct {
+	ec2iface.EC2API
+	instances []*ec2.Instance
+}
+
+func (f *fakeEC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, options ...request.Option) error {
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: f.instances}}}, true)
+	return nil
+}
+
+func newInstance(id, name, project string) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId:   aws.String(id),
+		InstanceType: aws.String("t3.micro"),
+		State:        &ec2.InstanceState{Name: aws.String("running")},
+		Tags:         []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}, {Key: aws.String("Project"), Value: aws.String(project)}},
+	}
+}
+
+/* ---
+ * Options that run commands against client, writing reports to a temporary
+ * directory.
+ * --- */
+func testOptions(t *testing.T, client ec2iface.EC2API) *globalOptions {
+	return &globalOptions{
+		reportDir: t.TempDir(),
+		connect: func(ctx context.Context, config controller.Config) (*controller.Controller, error) {
+			return &controller.Controller{
+				EC2:       client,
+				Region:    "us-east-1",
+				AccountID: "123456789012",
+				ReportDir: config.ReportDir,
+				In:        strings.NewReader(""),
+				Out:       &bytes.Buffer{},
+			}, nil
+		},
+	}
+}
+
+func TestReportDiffScope(t *testing.T) {
+	client := &fakeEC2{instances: []*ec2.Instance{
+		newInstance("i-01", "px-1", "project_x"),
+		newInstance("i-02", "px-2", "project_x"),
+		newInstance("i-03", "shared", "other"),
+	}}
+	data, err := json.Marshal(datamodels.EC2InstanceReport{
+		SchemaVersion: datamodels.EC2InstanceReportSchemaVersion,
+		Metadata:      &datamodels.ReportMetadata{Region: "us-east-1", AccountID: "123456789012"},
+		Instances: []datamodels.EC2InstanceDetails{
+			{InstanceID: "i-01", Name: "px-1", InstanceType: "t3.micro", InstanceState: "running", Tags: map[string]string{"Name": "px-1", "Project": "project_x"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := filepath.Join(t.TempDir(), "project_x.json")
+	if err := ioutil.WriteFile(baseline, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args  []string
+		scope string
+		extra string
+	}{
+		{[]string{baseline}, "tag:Project=project_x", "i-02"},
+		{[]string{"--filter", "name=shared", baseline}, "name=shared", "i-03"},
+		{[]string{baseline, "--filter", "name=shared"}, "name=shared", "i-03"},
+		{[]string{baseline, "--filter", "name=px-*", "--filter", "tag:Project=other"}, "name=px-* tag:Project=other", ""},
+	}
+	for _, test := range tests {
+		opts := testOptions(t, client)
+		root := (&command{Name: programName, Subcommands: []*command{reportCommand}}).link()
+		err := root.execute(context.Background(), opts, append([]string{"report", "diff"}, test.args...))
+		if code, ok := err.(exitCodeError); test.extra != "" && (!ok || code.code != 2) {
+			t.Errorf("%q: got error %v, want exit status 2", test.args, err)
+		} else if test.extra == "" && err != nil {
+			t.Errorf("%q: got error %v, want no drift", test.args, err)
+		}
+
+		reports, _ := filepath.Glob(filepath.Join(opts.reportDir, "us-east-1", "*", "drift_report_*.json"))
+		if len(reports) != 1 {
+			t.Fatalf("%q: got drift reports %v, want one", test.args, reports)
+		}
+		data, err := ioutil.ReadFile(reports[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var drift datamodels.DriftReport
+		if err := json.Unmarshal(data, &drift); err != nil {
+			t.Fatal(err)
+		}
+		extra := make([]string, 0)
+		for _, instance := range drift.Extra {
+			extra = append(extra, instance.InstanceID)
+		}
+		if got := strings.Join(drift.Scope, " "); got != test.scope {
+			t.Errorf("%q: got scope %q, want %q", test.args, got, test.scope)
+		}
+		if got := strings.Join(extra, ","); got != test.extra {
+			t.Errorf("%q: got extra %q, want %q", test.args, got, test.extra)
+		}
+	}
+}
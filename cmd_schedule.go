@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/utils"
+	"os"
+)
+
+var scheduleCommand = &command{
+	Name:    "schedule",
+	Summary: "Start and stop instances on office-hours schedules",
+	Subcommands: []*command{
+		scheduleRunCommand,
+		scheduleStatusCommand,
+	},
+}
+
+var scheduleRunCommand = &command{
+	Name:    "run",
+	Args:    "--config <schedule_config>",
+	Summary: "Run the schedule daemon",
+	Description: "Start and stop instances at the times given by their schedule, checking every interval until\n" +
+		"interrupted. An instance follows the schedule its Schedule tag names (or defines inline, e.g.\n" +
+		"\"start=0 8 * * mon-fri; stop=0 19 * * mon-fri; tz=America/New_York\"), or the first schedule in\n" +
+		"the config whose filters it matches. Each event is acted on once, so instances started or\n" +
+		"stopped by hand are left alone until the next event. See schedule.config for the format.",
+	Examples: []string{
+		programName + " schedule run --config schedule.config",
+		programName + " schedule run --config schedule.config --once --dry-run",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		configPath := fs.String("config", "schedule.config", "Schedule config file")
+		once := fs.Bool("once", false, "Check instances once and exit, e.g. to run from cron")
+		dryRun := fs.Bool("dry-run", false, "Log the actions without starting or stopping anything")
+
+		return func(ctx context.Context, args []string) error {
+			config, err := utils.LoadSchedulerConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			return c.RunScheduler(ctx, controller.SchedulerOptions{Config: config, DryRun: *dryRun, Once: *once})
+		}
+	},
+}
+
+var scheduleStatusCommand = &command{
+	Name:        "status",
+	Args:        "--config <schedule_config>",
+	Summary:     "Show scheduled instances and their next events",
+	Description: "List the instances that follow a schedule, with the last and next start or stop event.",
+	Examples: []string{
+		programName + " schedule status --config schedule.config",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		configPath := fs.String("config", "schedule.config", "Schedule config file")
+
+		return func(ctx context.Context, args []string) error {
+			config, err := utils.LoadSchedulerConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			schedules, err := c.ScheduleStatus(ctx, config)
+			if err != nil {
+				return err
+			}
+			if len(schedules) == 0 {
+				fmt.Println("No instances have a schedule")
+				return nil
+			}
+			utils.FprintInstanceSchedules(os.Stdout, schedules)
+			return nil
+		}
+	},
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+)
+
+var tagsCommand = &command{
+	Name:    "tags",
+	Summary: "Add, remove, rename and import instance tags",
+	Subcommands: []*command{
+		tagsAddCommand,
+		tagsRemoveCommand,
+		tagsRenameCommand,
+		tagsImportCommand,
+	},
+}
+
+var tagsAddCommand = &command{
+	Name:    "add",
+	Args:    "[<instance_report>] --tag KEY=VALUE...",
+	Summary: "Set tags on instances",
+	Description: "Set tags on the instances in an instance report, given with --instance or matching --filter.\n" +
+		"Existing tags with the same key are overwritten. The changes are shown before they are made.",
+	Examples: []string{
+		programName + " tags add --instance i-0123456789abcdef0 --tag Name=analysis-01",
+		programName + " tags add --filter 'name=analysis-*' --tag Project=rnaseq --tag Owner=jsmith --dry-run",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		assignments := repeatedList{}
+		fs.Var(&assignments, "tag", "Tag to set as KEY=VALUE (repeatable)")
+		return tagChangeCommand(fs, opts, func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.TagChangeReport, string, error) {
+			tags, err := utils.ParseTagAssignments(assignments)
+			if err != nil {
+				return datamodels.TagChangeReport{}, "", err
+			}
+			return c.AddTags(ctx, selection, tags, dryRun)
+		})
+	},
+}
+
+var tagsRemoveCommand = &command{
+	Name:        "remove",
+	Args:        "[<instance_report>] --key KEY...",
+	Summary:     "Remove tags from instances",
+	Description: "Remove tags from the instances in an instance report, given with --instance or matching --filter.",
+	Examples: []string{
+		programName + " tags remove --filter tag:Project=old --key Project",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		keys := repeatedList{}
+		fs.Var(&keys, "key", "Tag key to remove (repeatable)")
+		return tagChangeCommand(fs, opts, func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.TagChangeReport, string, error) {
+			return c.RemoveTags(ctx, selection, keys, dryRun)
+		})
+	},
+}
+
+var tagsRenameCommand = &command{
+	Name:    "rename",
+	Args:    "[<instance_report>] --from KEY --to KEY",
+	Summary: "Rename a tag key on instances",
+	Description: "Rename a tag key on the instances in an instance report, given with --instance or matching\n" +
+		"--filter, keeping each instance's value. Instances without the tag are left alone.",
+	Examples: []string{
+		programName + " tags rename --filter 'tag:project=*' --from project --to Project",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		from := fs.String("from", "", "Tag key to rename")
+		to := fs.String("to", "", "New tag key")
+		return tagChangeCommand(fs, opts, func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.TagChangeReport, string, error) {
+			if *from == "" || *to == "" {
+				return datamodels.TagChangeReport{}, "", fmt.Errorf("Both --from and --to are required")
+			}
+			return c.RenameTag(ctx, selection, *from, *to, dryRun)
+		})
+	},
+}
+
+var tagsImportCommand = &command{
+	Name:    "import",
+	Args:    "<tags_csv>",
+	Summary: "Set tags from a CSV file",
+	Description: "Set tags from a CSV file with a header row of tag keys and one row per instance.\n" +
+		"Instance IDs go in a column named instance_id (or the first column). Empty cells leave\n" +
+		"that tag unchanged. The changes are shown before they are made.",
+	Examples: []string{
+		programName + " tags import project_tags.csv --dry-run",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		dryRun := fs.Bool("dry-run", false, "Show the changes without making them")
+
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Tag CSV file required but not supplied")
+			}
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+			_, outputFileName, err := c.ImportTags(ctx, args[0], *dryRun)
+			if outputFileName != "" {
+				fmt.Printf("\nOutput written to %s\n", outputFileName)
+			}
+			return err
+		}
+	},
+}
+
+// A controller operation that changes tags on selected instances.
+type tagChangeOperation func(c *controller.Controller, ctx context.Context, selection controller.Selection, dryRun bool) (datamodels.TagChangeReport, string, error)
+
+/* ---
+ * Set up a tags command running the given controller operation on instances
+ * selected by report, --instance or --filter.
+ * --- */
+func tagChangeCommand(fs *flag.FlagSet, opts *globalOptions, operation tagChangeOperation) func(ctx context.Context, args []string) error {
+	dryRun := fs.Bool("dry-run", false, "Show the changes without making them")
+	selection := selectionFlags(fs, "")
+
+	return func(ctx context.Context, args []string) error {
+		c, err := opts.controller(ctx)
+		if err != nil {
+			return err
+		}
+		_, outputFileName, err := operation(c, ctx, selection(args), *dryRun)
+		if outputFileName != "" {
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+		}
+		return err
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+var typesCommand = &command{
+	Name:    "types",
+	Summary: "Work with EC2 instance types",
+	Subcommands: []*command{
+		typesListCommand,
+	},
+}
+
+var typesListCommand = &command{
+	Name:        "list",
+	Summary:     "List instance types offered in the region",
+	Description: "List all instance types offered in the configured region and write them to the report directory.",
+	Examples: []string{
+		programName + " types list",
+		programName + " types list --profile lab",
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		dryRun := fs.Bool("dry-run", false, "Check permissions without listing instance types")
+
+		return func(ctx context.Context, args []string) error {
+			c, err := opts.controller(ctx)
+			if err != nil {
+				return err
+			}
+
+			_, outputFileName, err := c.ListInstanceTypes(ctx, *dryRun)
+			if err != nil || outputFileName == "" {
+				return err
+			}
+			fmt.Printf("\nOutput written to %s\n", outputFileName)
+			return nil
+		}
+	},
+}
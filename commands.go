@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mdibl_cloud_control/controller"
+	"mdibl_cloud_control/utils"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const programName = "mdibl_cloud_control"
+
+/* ---
+ * A command or group of commands. Group commands have Subcommands and no
+ * Setup. Leaf commands register their flags in Setup and return the function
+ * that runs them with the remaining positional arguments. Complete, if set,
+ * gives shell completion candidates for positional arguments.
+ * --- */
+type command struct {
+	Name        string
+	Args        string
+	Summary     string
+	Description string
+	Examples    []string
+	Hidden      bool
+	Subcommands []*command
+	Setup       func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error
+	Complete    func(opts *globalOptions, args []string) []string
+
+	parent *command
+}
+
+/* ---
+ * Error that makes main exit with a specific code, e.g., 2 for drift.
+ * --- */
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+/* ---
+ * Flags shared by every command.
+ * --- */
+type globalOptions struct {
+	awsConf   string
+	profile   string
+	reportDir string
+	timeout   time.Duration
+	attempts  int
+	assumeYes bool
+
+	// Creates the controller for commands that use AWS. Set in tests to
+	// use fake clients; controller.New if nil.
+	connect func(ctx context.Context, config controller.Config) (*controller.Controller, error)
+}
+
+func (opts *globalOptions) register(fs *flag.FlagSet) {
+	// Use the current values as defaults so flags given before the
+	// subcommand are not reset when the subcommand registers them again.
+	fs.StringVar(&opts.awsConf, "aws-config", opts.awsConf, "Path to aws config file.")
+	fs.StringVar(&opts.profile, "profile", opts.profile, "Profile in the aws config file to use.")
+	fs.StringVar(&opts.reportDir, "report-dir", opts.reportDir, "Directory reports are written to.")
+	fs.DurationVar(&opts.timeout, "timeout", opts.timeout, "Time limit on each AWS operation, e.g. 30s or 10m (0 for no limit).")
+	fs.IntVar(&opts.attempts, "max-attempts", opts.attempts, "Attempts made at each AWS call before giving up on throttling and capacity errors.")
+	fs.BoolVar(&opts.assumeYes, "non-interactive", opts.assumeYes, "Answer yes to confirmation prompts, for running from cron.")
+}
+
+func (opts *globalOptions) config() controller.Config {
+	return controller.Config{
+		AWSConfig:   opts.awsConf,
+		Profile:     opts.profile,
+		ReportDir:   opts.reportDir,
+		Timeout:     opts.timeout,
+		MaxAttempts: opts.attempts,
+		AssumeYes:   opts.assumeYes,
+	}
+}
+
+/* ---
+ * Get the configured region without connecting to AWS.
+ * --- */
+func (opts *globalOptions) localRegion() (string, error) {
+	return utils.DefaultAWSRegion(opts.awsConf, opts.profile)
+}
+
+/* ---
+ * Create a controller connected to AWS.
+ * --- */
+func (opts *globalOptions) controller(ctx context.Context) (*controller.Controller, error) {
+	if opts.connect != nil {
+		return opts.connect(ctx, opts.config())
+	}
+	return controller.New(ctx, opts.config())
+}
+
+/* ---
+ * Create a controller for commands that only work with local reports.
+ * --- */
+func (opts *globalOptions) localController() (*controller.Controller, error) {
+	return controller.NewLocal(opts.config())
+}
+
+/* -----------------------------------------------------------------------------
+ * Command tree helpers
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Set parent links so commands can print their full path.
+ * --- */
+func (c *command) link() *command {
+	for _, sub := range c.Subcommands {
+		sub.parent = c
+		sub.link()
+	}
+	return c
+}
+
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.Name
+	}
+	return c.parent.path() + " " + c.Name
+}
+
+func (c *command) find(name string) *command {
+	for _, sub := range c.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+/* ---
+ * Create the flag set for a leaf command, with the global flags, and the
+ * function that runs it.
+ * --- */
+func (c *command) flagSet(opts *globalOptions) (*flag.FlagSet, func(ctx context.Context, args []string) error) {
+	fs := flag.NewFlagSet(c.path(), flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var run func(ctx context.Context, args []string) error
+	if c.Setup != nil {
+		run = c.Setup(fs, opts)
+	}
+	opts.register(fs)
+	return fs, run
+}
+
+/* ---
+ * Print help for a command: usage, description, subcommands or flags, and
+ * examples.
+ * --- */
+func (c *command) printHelp(opts *globalOptions) {
+	out := os.Stdout
+	if c.Subcommands != nil {
+		fmt.Fprintf(out, "Usage: %s <command> [flags] [args]\n", c.path())
+	} else {
+		fmt.Fprintf(out, "Usage: %s [flags] %s\n", c.path(), c.Args)
+	}
+	if c.Description != "" {
+		fmt.Fprintf(out, "\n%s\n", c.Description)
+	} else if c.Summary != "" {
+		fmt.Fprintf(out, "\n%s\n", c.Summary)
+	}
+
+	if c.Subcommands != nil {
+		fmt.Fprintf(out, "\nCommands:\n")
+		writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, sub := range c.Subcommands {
+			if !sub.Hidden {
+				fmt.Fprintf(writer, "  %s\t%s\n", sub.Name, sub.Summary)
+			}
+		}
+		writer.Flush()
+		fmt.Fprintf(out, "\nRun '%s <command>' for more information on a command.\n", strings.Replace(c.path(), programName, programName+" help", 1))
+	} else {
+		copied := *opts
+		fs, _ := c.flagSet(&copied)
+		fmt.Fprintf(out, "\nFlags:\n")
+		fs.SetOutput(out)
+		fs.PrintDefaults()
+	}
+
+	if len(c.Examples) > 0 {
+		fmt.Fprintf(out, "\nExamples:\n")
+		for _, example := range c.Examples {
+			fmt.Fprintf(out, "  %s\n", example)
+		}
+	}
+}
+
+/* ---
+ * Walk args down the command tree and run the command found. Returns the
+ * error from the command.
+ * --- */
+func (c *command) execute(ctx context.Context, opts *globalOptions, args []string) error {
+	if c.Subcommands != nil {
+		if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "-help" {
+			c.printHelp(opts)
+			return nil
+		}
+		sub := c.find(args[0])
+		if sub == nil {
+			c.printHelp(opts)
+			return exitCodeError{code: 1, err: fmt.Errorf("Unknown command %q", strings.TrimSpace(c.path()+" "+args[0]))}
+		}
+		return sub.execute(ctx, opts, args[1:])
+	}
+
+	fs, run := c.flagSet(opts)
+	if err := fs.Parse(flagsFirst(fs, args)); err != nil {
+		if err == flag.ErrHelp {
+			c.printHelp(opts)
+			return nil
+		}
+		return exitCodeError{code: 1, err: fmt.Errorf("%s\nRun '%s --help' for usage.", err, c.path())}
+	}
+	return run(ctx, fs.Args())
+}
+
+/* ---
+ * Move flags given after positional arguments in front of them, so
+ * 'tags import tags.csv --dry-run' is parsed like 'tags import --dry-run
+ * tags.csv'. Arguments after a "--" separator are left alone, as are values
+ * of flags that take one.
+ * --- */
+func flagsFirst(fs *flag.FlagSet, args []string) []string {
+	flags := make([]string, 0, len(args))
+	positional := make([]string, 0, len(args))
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if arg == "--" {
+			positional = append(positional, args[idx:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		// A flag's value is the next argument unless it is a boolean flag.
+		// Unknown flags are left for fs.Parse to report.
+		found := fs.Lookup(name)
+		if found == nil {
+			continue
+		}
+		if boolFlag, ok := found.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			continue
+		}
+		if idx+1 < len(args) {
+			idx++
+			flags = append(flags, args[idx])
+		}
+	}
+	if len(positional) > 0 && positional[0] != "--" {
+		// Stop fs.Parse at the first positional argument even if it
+		// starts with a dash, e.g. "-" for standard input.
+		flags = append(flags, "--")
+	}
+	return append(flags, positional...)
+}
+
+/* ---
+ * A flag.Value that collects repeated and comma separated values.
+ * --- */
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, elem := range strings.Split(value, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			*l = append(*l, elem)
+		}
+	}
+	return nil
+}
+
+/* ---
+ * A flag.Value that collects repeated values as given. Used where values may
+ * themselves contain commas, such as filter expressions.
+ * --- */
+type repeatedList []string
+
+func (l *repeatedList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
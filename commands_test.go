@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFlagsFirst(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("dry-run", false, "")
+	fs.String("output", "", "")
+	fs.Var(&repeatedList{}, "filter", "")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"a.csv", "--dry-run"}, "--dry-run -- a.csv"},
+		{[]string{"--dry-run", "a.csv"}, "--dry-run -- a.csv"},
+		{[]string{"report", "csv", "--output", "-", "--filter", "name=web-*"}, "--output - --filter name=web-* -- report csv"},
+		{[]string{"report", "--output=hosts", "--dry-run=false"}, "--output=hosts --dry-run=false -- report"},
+		{[]string{"report", "--", "ls", "--dry-run"}, "-- report -- ls --dry-run"},
+		{[]string{"--dry-run", "--", "ls", "-la"}, "--dry-run -- ls -la"},
+		{[]string{"report", "--unknown", "value"}, "--unknown -- report value"},
+		{[]string{"-", "--dry-run"}, "--dry-run -- -"},
+		{[]string{}, ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(flagsFirst(fs, test.args), " "); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+/* ---
+ * Run a leaf command with a --dry-run and an --output flag and return what
+ * its run function saw.
+ * --- */
+func executeTestCommand(t *testing.T, args ...string) (string, error) {
+	var got string
+	leaf := &command{
+		Name: "leaf",
+		Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+			dryRun := fs.Bool("dry-run", false, "")
+			output := fs.String("output", "", "")
+			return func(ctx context.Context, args []string) error {
+				got = fmt.Sprintf("dry-run=%t output=%s args=%q", *dryRun, *output, args)
+				return nil
+			}
+		},
+	}
+	root := (&command{Name: "test", Subcommands: []*command{leaf}}).link()
+	err := root.execute(context.Background(), &globalOptions{}, append([]string{"leaf"}, args...))
+	return got, err
+}
+
+func TestExecuteFlagsAfterArgs(t *testing.T) {
+	got, err := executeTestCommand(t, "report.json", "csv", "--dry-run", "--output", "hosts.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `dry-run=true output=hosts.csv args=["report.json" "csv"]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := executeTestCommand(t, "report.json", "--dryrun"); err == nil || !strings.Contains(err.Error(), "dryrun") {
+		t.Errorf("got error %v, want the unknown flag reported", err)
+	}
+}
+
+func TestTagsImportTrailingDryRun(t *testing.T) {
+	fs, _ := tagsImportCommand.flagSet(&globalOptions{})
+	if err := fs.Parse(flagsFirst(fs, []string{"project_tags.csv", "--dry-run"})); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Lookup("dry-run").Value.String() != "true" {
+		t.Error("trailing --dry-run ignored")
+	}
+	if args := fs.Args(); len(args) != 1 || args[0] != "project_tags.csv" {
+		t.Errorf("got args %q, want [project_tags.csv]", args)
+	}
+}
+
+/* ---
+ * Split an example command line into arguments, honouring single and double
+ * quotes and stopping at a shell redirect or pipe. Cron examples are cut
+ * down to the command run.
+ * --- */
+func splitExample(example string) []string {
+	args := make([]string, 0)
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	for _, char := range example {
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(char)
+		case char == '\'' || char == '"':
+			quote = char
+			inArg = true
+		case char == ' ':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	for idx, arg := range args {
+		if arg == "./"+programName {
+			args[idx] = programName
+			args = args[idx:]
+			break
+		}
+	}
+	for idx, arg := range args {
+		if arg == ">" || arg == ">>" || arg == "|" || arg == "<" {
+			return args[:idx]
+		}
+	}
+	return args
+}
+
+func TestExamplesParse(t *testing.T) {
+	root := &command{Name: programName, Subcommands: []*command{
+		instancesCommand, typesCommand, tagsCommand, reaperCommand, eventsCommand,
+		scheduleCommand, agentsCommand, reportCommand,
+	}}
+	var check func(c *command)
+	check = func(c *command) {
+		for _, sub := range c.Subcommands {
+			sub.parent = c
+			check(sub)
+		}
+		for _, example := range c.Examples {
+			args := splitExample(example)
+			if len(args) == 0 || args[0] != programName {
+				t.Errorf("%s: example does not start with %s: %s", c.path(), programName, example)
+				continue
+			}
+			// Walk down to the command the example runs.
+			found := root
+			args = args[1:]
+			for found.Subcommands != nil && len(args) > 0 && found.find(args[0]) != nil {
+				found = found.find(args[0])
+				args = args[1:]
+			}
+			if found.Setup == nil {
+				t.Errorf("%s: example does not name a command: %s", c.path(), example)
+				continue
+			}
+			fs, _ := found.flagSet(&globalOptions{})
+			if err := fs.Parse(flagsFirst(fs, args)); err != nil {
+				t.Errorf("%s: %s: %s", found.path(), example, err)
+			}
+		}
+	}
+	check(root)
+}
+
+func TestReportExportTrailingFlags(t *testing.T) {
+	fs, _ := reportExportCommand.flagSet(&globalOptions{})
+	args := []string{"report.json", "csv", "--output", "roster.csv", "--tag", "Owner", "--offline"}
+	if err := fs.Parse(flagsFirst(fs, args)); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"output": "roster.csv", "tag": "Owner", "offline": "true"} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got := fs.Args(); len(got) != 2 || got[0] != "report.json" || got[1] != "csv" {
+		t.Errorf("got args %q, want [report.json csv]", got)
+	}
+}
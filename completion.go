@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mdibl_cloud_control/utils"
+	"sort"
+	"strings"
+
+	"github.com/vaughan0/go-ini"
+)
+
+var completionCommand = &command{
+	Name:    "completion",
+	Args:    "<bash|zsh|fish>",
+	Summary: "Print a shell completion script",
+	Description: "Print a completion script for bash, zsh or fish. Instance names and IDs are completed\n" +
+		"from the latest \"all\" instance report for the region, so run 'instances list' to refresh them.",
+	Examples: []string{
+		"source <(" + programName + " completion bash)",
+		programName + " completion zsh > \"${fpath[1]}/_" + programName + "\"",
+		programName + " completion fish > ~/.config/fish/completions/" + programName + ".fish",
+	},
+	Complete: func(opts *globalOptions, args []string) []string {
+		return []string{"bash", "zsh", "fish"}
+	},
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("Shell (bash, zsh or fish) required but not supplied")
+			}
+			script, ok := completionScripts[args[0]]
+			if !ok {
+				return fmt.Errorf("Unsupported shell %q: expected bash, zsh or fish", args[0])
+			}
+			fmt.Print(strings.Replace(script, "PROG", programName, -1))
+			return nil
+		}
+	},
+}
+
+/* ---
+ * Hidden command the completion scripts call with the words on the command
+ * line. Prints one candidate per line. Printing nothing tells the shell to
+ * fall back to completing file names.
+ * --- */
+var completeCommand = &command{
+	Name:   "__complete",
+	Hidden: true,
+	Setup: func(fs *flag.FlagSet, opts *globalOptions) func(ctx context.Context, args []string) error {
+		return func(ctx context.Context, args []string) error {
+			for _, candidate := range completeWords(opts, args) {
+				fmt.Println(candidate)
+			}
+			return nil
+		}
+	},
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for PROG
+_PROG() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local IFS=$'\n'
+    local candidates=($("${COMP_WORDS[0]}" __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+    if [ ${#candidates[@]} -eq 0 ]; then
+        COMPREPLY=($(compgen -f -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "${candidates[*]}" -- "$cur"))
+    fi
+}
+complete -o filenames -F _PROG PROG
+`,
+	"zsh": `#compdef PROG
+# zsh completion for PROG
+_PROG() {
+    local -a candidates
+    candidates=("${(@f)$(${words[1]} __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ -z "${candidates[*]}" ]]; then
+        _files
+    else
+        compadd -- $candidates
+    fi
+}
+compdef _PROG PROG
+`,
+	"fish": `# fish completion for PROG
+function __PROG_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    set -l candidates (PROG __complete -- $tokens[2..-1] 2>/dev/null)
+    if test (count $candidates) -eq 0
+        __fish_complete_path (commandline -ct)
+    else
+        printf '%s\n' $candidates
+    end
+end
+complete -c PROG -f -a '(__PROG_complete)'
+`,
+}
+
+/* ---
+ * Work out completion candidates for the words after the program name. The
+ * last word is the one being completed.
+ * --- */
+func completeWords(opts *globalOptions, words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+
+	// Walk the command tree, skipping flags and their values. Global flags
+	// are applied so completion reads reports from the right place.
+	cmd := rootCommand
+	var fs *flag.FlagSet
+	args := make([]string, 0)
+	pendingFlag := ""
+	for _, word := range words[:len(words)-1] {
+		if pendingFlag != "" {
+			setGlobalOption(opts, pendingFlag, word)
+			pendingFlag = ""
+			continue
+		}
+		if strings.HasPrefix(word, "-") {
+			name := strings.TrimLeft(word, "-")
+			if idx := strings.Index(name, "="); idx >= 0 {
+				setGlobalOption(opts, name[:idx], name[idx+1:])
+			} else if takesValue(fs, name) {
+				pendingFlag = name
+			}
+			continue
+		}
+		if cmd.Subcommands != nil {
+			if sub := cmd.find(word); sub != nil {
+				cmd = sub
+				if cmd.Subcommands == nil {
+					fs, _ = cmd.flagSet(&globalOptions{})
+				}
+			}
+			continue
+		}
+		args = append(args, word)
+	}
+
+	// Complete the value of a flag.
+	if pendingFlag != "" {
+		switch pendingFlag {
+		case "instance":
+			return instanceCandidates(opts)
+		case "state":
+			return []string{"pending", "running", "shutting-down", "stopping", "stopped", "terminated"}
+		case "profile":
+			return profileCandidates(opts)
+		case "type":
+			return instanceTypeCandidates(opts)
+		}
+		return nil
+	}
+
+	// Complete flag names.
+	if strings.HasPrefix(current, "-") {
+		if fs == nil {
+			return []string{"--help"}
+		}
+		candidates := make([]string, 0)
+		fs.VisitAll(func(f *flag.Flag) {
+			candidates = append(candidates, "--"+f.Name)
+		})
+		sort.Strings(candidates)
+		return candidates
+	}
+
+	// Complete subcommands or arguments.
+	if cmd.Subcommands != nil {
+		candidates := make([]string, 0)
+		for _, sub := range cmd.Subcommands {
+			if !sub.Hidden {
+				candidates = append(candidates, sub.Name)
+			}
+		}
+		return candidates
+	}
+	if cmd.Complete != nil {
+		return cmd.Complete(opts, args)
+	}
+	return nil
+}
+
+/* ---
+ * Check if a flag of the command being completed takes a value. Global flags
+ * always do.
+ * --- */
+func takesValue(fs *flag.FlagSet, name string) bool {
+	if name == "aws-config" || name == "profile" || name == "report-dir" || name == "timeout" || name == "max-attempts" {
+		return true
+	}
+	if fs == nil {
+		return false
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+func setGlobalOption(opts *globalOptions, name, value string) {
+	switch name {
+	case "aws-config":
+		opts.awsConf = value
+	case "profile":
+		opts.profile = value
+	case "report-dir":
+		opts.reportDir = value
+	}
+}
+
+/* ---
+ * Instance IDs and names from the latest "all" report for the region.
+ * --- */
+func instanceCandidates(opts *globalOptions) []string {
+	region, err := opts.localRegion()
+	if err != nil {
+		return nil
+	}
+	report, err := utils.LoadInstanceReport(utils.LatestReportPath(opts.reportDir, region, "all_instance_details.json"))
+	if err != nil {
+		return nil
+	}
+
+	candidates := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, instance := range report.Instances {
+		for _, candidate := range []string{instance.InstanceID, instance.Name} {
+			if candidate != "" && candidate != "None" && !seen[candidate] {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	return candidates
+}
+
+/* ---
+ * Instance types from the latest "types list" output for the region.
+ * --- */
+func instanceTypeCandidates(opts *globalOptions) []string {
+	region, err := opts.localRegion()
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(utils.LatestReportPath(opts.reportDir, region, "instance_types.txt"))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+/* ---
+ * Profile names in the aws config file.
+ * --- */
+func profileCandidates(opts *globalOptions) []string {
+	configFile, err := ini.LoadFile(opts.awsConf)
+	if err != nil {
+		return nil
+	}
+	candidates := make([]string, 0)
+	for profile := range configFile {
+		if profile != "" {
+			candidates = append(candidates, profile)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+/* ---
+ * Get the agent status of the selected instances, or of every instance an
+ * agent has reported from if none are selected. Agents that have not sent
+ * a heartbeat within stale are reported as stale.
+ * --- */
+func (c *Controller) AgentStatus(ctx aws.Context, selection Selection, stale time.Duration) ([]datamodels.AgentStatus, error) {
+	var report datamodels.EC2InstanceReport
+	var err error
+	if selection.Report == "" && len(selection.Instances) == 0 && len(selection.Filters) == 0 {
+		callCtx, cancel := c.callContext(ctx)
+		defer cancel()
+		report, err = utils.DescribeEC2Instances(callCtx, c.EC2, utils.CreateEC2InstanceFilterParams("tag-key", []string{utils.TagAgentHeartbeat}))
+	} else {
+		var t target
+		t, err = c.resolve(ctx, selection, "")
+		report = t.report
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]datamodels.AgentStatus, 0)
+	for _, instance := range report.Instances {
+		status := datamodels.AgentStatus{
+			InstanceID: instance.InstanceID,
+			Name:       instance.Name,
+			State:      instance.InstanceState,
+			Status:     "none",
+			Detail:     instance.Tags[utils.TagAgentDetail],
+		}
+		if heartbeat, err := time.Parse(time.RFC3339, instance.Tags[utils.TagAgentHeartbeat]); err == nil {
+			status.LastHeartbeat = heartbeat
+			status.Status = instance.Tags[utils.TagAgentStatus]
+
+			// A stopped instance's agent is expected to be quiet.
+			if now.Sub(heartbeat) > stale && instance.InstanceState == "running" {
+				status.Status = "stale"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+		return statuses[i].InstanceID < statuses[j].InstanceID
+	})
+	return statuses, nil
+}
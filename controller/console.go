@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+/* ---
+ * What to fetch from instance consoles. Latest asks for current output
+ * rather than the boot buffer (Nitro instances only); Screenshot also saves
+ * a screenshot of each console. Lines is how much output to print per
+ * instance (all of it if zero or less).
+ * --- */
+type ConsoleOptions struct {
+	Latest     bool
+	Screenshot bool
+	Lines      int
+}
+
+/* ---
+ * Fetch and decode the console output of the selected instances, save it
+ * (and optionally a screenshot) beside the report, and highlight lines
+ * showing cloud-init failures, kernel panics, user-data script errors and
+ * boot problems. Writes a console_output report.
+ * --- */
+func (c *Controller) Console(ctx aws.Context, selection Selection, options ConsoleOptions) (datamodels.ConsoleReport, string, error) {
+	report := datamodels.ConsoleReport{Instances: make([]datamodels.InstanceConsole, 0)}
+	t, err := c.resolve(ctx, selection, "")
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(t.region)
+	if len(t.report.Instances) == 0 {
+		c.printf("No matching instances\n")
+		return report, "", nil
+	}
+
+	failed := 0
+	for _, instance := range t.report.Instances {
+		if ctx.Err() != nil {
+			break
+		}
+		console := c.instanceConsole(ctx, t.client, t.region, instance, options)
+		if console.Error != "" {
+			failed++
+		}
+		report.Instances = append(report.Instances, console)
+	}
+
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, t.region, "console_output", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed > 0 {
+		return report, outputFileName, fmt.Errorf("Unable to get console output for %d of %d instances", failed, len(report.Instances))
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Fetch, save and print one instance's console.
+ * --- */
+func (c *Controller) instanceConsole(ctx aws.Context, client ec2iface.EC2API, region string, instance datamodels.EC2InstanceDetails, options ConsoleOptions) datamodels.InstanceConsole {
+	console := datamodels.InstanceConsole{InstanceID: instance.InstanceID, Name: instance.Name, Findings: make([]datamodels.ConsoleFinding, 0)}
+	title := fmt.Sprintf("%s (%s)", instance.Name, instance.InstanceID)
+	c.printf("\n%s\n%s\n", title, strings.Repeat("-", len(title)))
+
+	callCtx, cancel := c.callContext(ctx)
+	output, err := client.GetConsoleOutputWithContext(callCtx, utils.CreateEC2GetConsoleOutputParams(instance.InstanceID, options.Latest))
+	cancel()
+	if err != nil {
+		console.Error = utils.ErrorSummary(err)
+		c.printf("Unable to get console output: %s\n", console.Error)
+		return console
+	}
+	console.Timestamp = aws.TimeValue(output.Timestamp)
+
+	if aws.StringValue(output.Output) == "" {
+		// Output appears a few minutes after launch and is kept for a while
+		// after the instance stops.
+		c.printf("No console output available yet\n")
+	} else {
+		text, err := utils.DecodeConsoleOutput(aws.StringValue(output.Output))
+		if err != nil {
+			console.Error = err.Error()
+			c.printf("%s\n", err)
+			return console
+		}
+		if console.OutputFile, err = utils.WriteReportData(c.ReportDir, region, "console_"+instance.InstanceID, "log", []byte(text)); err != nil {
+			console.Error = err.Error()
+			c.printf("Unable to save console output: %s\n", err)
+		}
+		console.Findings = utils.FindConsoleProblems(text)
+		utils.FprintConsoleOutput(c.Out, text, console.Findings, options.Lines)
+		c.printf("\n")
+		utils.FprintConsoleFindings(c.Out, console)
+	}
+
+	if options.Screenshot {
+		c.saveScreenshot(ctx, client, region, &console)
+	}
+	return console
+}
+
+/* ---
+ * Save a screenshot of an instance's console. Not every instance type
+ * supports screenshots, so failures are recorded but are not errors.
+ * --- */
+func (c *Controller) saveScreenshot(ctx aws.Context, client ec2iface.EC2API, region string, console *datamodels.InstanceConsole) {
+	callCtx, cancel := c.callContext(ctx)
+	output, err := client.GetConsoleScreenshotWithContext(callCtx, utils.CreateEC2GetConsoleScreenshotParams(console.InstanceID))
+	cancel()
+	if err == nil {
+		var image []byte
+		if image, err = utils.DecodeConsoleScreenshot(aws.StringValue(output.ImageData)); err == nil {
+			console.ScreenshotFile, err = utils.WriteReportData(c.ReportDir, region, "console_"+console.InstanceID, "jpg", image)
+		}
+	}
+	if err != nil {
+		console.ScreenshotError = utils.ErrorSummary(err)
+		c.printf("No screenshot: %s\n", console.ScreenshotError)
+		return
+	}
+	c.printf("Screenshot saved to %s\n", console.ScreenshotFile)
+}
@@ -0,0 +1,259 @@
+// Package controller implements the operations behind the mdibl_cloud_control
+// commands so they can be embedded in other Go programs. A Controller never
+// exits the process; failures are returned as errors, and prompts are read
+// from and written to the Controller's In and Out.
+package controller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Returned when the user answers no to a confirmation prompt.
+var ErrAborted = errors.New("aborted by user")
+
+/* ---
+ * Where to find AWS credentials and write reports.
+ * --- */
+type Config struct {
+	AWSConfig string
+	Profile   string
+	ReportDir string
+	Timeout   time.Duration
+
+	// Attempts made at each EC2 call before giving up on retryable errors
+	// such as throttling. Zero means utils.DefaultMaxAttempts.
+	MaxAttempts int
+
+	// Skip confirmation prompts (see Controller.AssumeYes).
+	AssumeYes bool
+}
+
+/* ---
+ * Runs EC2 operations for one account. EC2 is the client for Region; clients
+ * for other regions (e.g., when acting on a report from another region) are
+ * made with NewEC2Client. CloudWatch and NewCloudWatchClient do the same for
+ * CloudWatch.
+ * --- */
+type Controller struct {
+	EC2          ec2iface.EC2API
+	NewEC2Client func(region string) ec2iface.EC2API
+	Region       string
+	AccountID    string
+	CallerARN    string
+	Profile      string
+	ReportDir    string
+
+	CloudWatch          cloudwatchiface.CloudWatchAPI
+	NewCloudWatchClient func(region string) cloudwatchiface.CloudWatchAPI
+
+	// Limit on each AWS operation (including all pages of a paginated
+	// call). Zero means no limit beyond the context passed in.
+	Timeout time.Duration
+
+	// Prompts are written to Out and answers read from In. With AssumeYes
+	// set, confirmation prompts are skipped and treated as answered yes.
+	In        io.Reader
+	Out       io.Writer
+	AssumeYes bool
+
+	reader *bufio.Reader
+}
+
+/* ---
+ * Create a Controller from an aws config file. Connects to STS to find the
+ * account the credentials belong to.
+ * --- */
+func New(ctx aws.Context, config Config) (*Controller, error) {
+	// Get the default AWS region
+	region, err := utils.DefaultAWSRegion(config.AWSConfig, config.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create new EC2 client with specified credentials
+	creds, err := utils.CreateNewEC2ClientCredentials(config.AWSConfig, config.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retries are logged to stderr so they do not mix with prompts and
+	// command output.
+	maxAttempts := config.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = utils.DefaultMaxAttempts
+	}
+	retryer := utils.NewRetryPolicy(maxAttempts, os.Stderr)
+
+	c := &Controller{
+		EC2: utils.CreateNewEC2Client(creds, region, retryer),
+		NewEC2Client: func(region string) ec2iface.EC2API {
+			return utils.CreateNewEC2Client(creds, region, retryer)
+		},
+		CloudWatch: utils.CreateNewCloudWatchClient(creds, region, retryer),
+		NewCloudWatchClient: func(region string) cloudwatchiface.CloudWatchAPI {
+			return utils.CreateNewCloudWatchClient(creds, region, retryer)
+		},
+		Region:    region,
+		Profile:   config.Profile,
+		ReportDir: config.ReportDir,
+		Timeout:   config.Timeout,
+		In:        os.Stdin,
+		Out:       os.Stdout,
+		AssumeYes: config.AssumeYes,
+	}
+
+	// Look up the account the credentials belong to. Reports record it and
+	// it is used to make sure reports are not acted on in the wrong account.
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	c.AccountID, c.CallerARN, err = utils.GetAWSCallerIdentity(callCtx, creds, region)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fmt.Fprintf(os.Stderr, "Warning: unable to determine AWS account ID: %s\n", err)
+	}
+	return c, nil
+}
+
+/* ---
+ * Create a Controller for working with local reports only. It has no AWS
+ * clients.
+ * --- */
+func NewLocal(config Config) (*Controller, error) {
+	region, err := utils.DefaultAWSRegion(config.AWSConfig, config.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return &Controller{
+		Region:    region,
+		Profile:   config.Profile,
+		ReportDir: config.ReportDir,
+		In:        os.Stdin,
+		Out:       os.Stdout,
+	}, nil
+}
+
+/* ---
+ * Print to the controller's output.
+ * --- */
+func (c *Controller) printf(format string, args ...interface{}) {
+	fmt.Fprintf(c.Out, format, args...)
+}
+
+/* ---
+ * Get the context for a single AWS operation, limited by the controller's
+ * timeout.
+ * --- */
+func (c *Controller) callContext(ctx aws.Context) (aws.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+/* ---
+ * Read a line of input from the user. Gives up if the context is cancelled
+ * (e.g., Ctrl-C at a prompt).
+ * --- */
+func (c *Controller) readLine(ctx aws.Context) (string, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.In)
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result, 1)
+	go func() {
+		line, err := c.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		lines <- result{strings.TrimSpace(line), err}
+	}()
+
+	select {
+	case r := <-lines:
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+/* ---
+ * Ask a yes/no question. Anything but "y" is a no.
+ * --- */
+func (c *Controller) confirm(ctx aws.Context) bool {
+	if c.AssumeYes {
+		return true
+	}
+	c.printf("\nContinue: (y/n) ")
+	response, _ := c.readLine(ctx)
+	return strings.ToLower(response) == "y"
+}
+
+/* ---
+ * Ask the user to confirm an action on the instances in a report.
+ * --- */
+func (c *Controller) confirmInstances(ctx aws.Context, action string, report datamodels.EC2InstanceReport) bool {
+	title := fmt.Sprintf("The following instances will be %s:", action)
+	c.printf("\n%s\n", title)
+	c.printf("%s\n\n", strings.Repeat("-", len(title)))
+	for _, instance := range report.Instances {
+		c.printf("Name: %s, ID: %s, Instance type: %s\n", instance.Name, instance.InstanceID, instance.InstanceType)
+	}
+	return c.confirm(ctx)
+}
+
+/* ---
+ * Get the EC2 client for a region.
+ * --- */
+func (c *Controller) clientFor(region string) ec2iface.EC2API {
+	if region == c.Region || region == "" || c.NewEC2Client == nil {
+		return c.EC2
+	}
+	return c.NewEC2Client(region)
+}
+
+/* ---
+ * Get the CloudWatch client for a region.
+ * --- */
+func (c *Controller) cloudWatchFor(region string) cloudwatchiface.CloudWatchAPI {
+	if region == c.Region || region == "" || c.NewCloudWatchClient == nil {
+		return c.CloudWatch
+	}
+	return c.NewCloudWatchClient(region)
+}
+
+/* ---
+ * Metadata for a report produced in the given region.
+ * --- */
+func (c *Controller) metadata(region string) *datamodels.ReportMetadata {
+	return utils.NewReportMetadata(region, c.AccountID, c.Profile)
+}
+
+/* ---
+ * Collect the instance IDs of a report.
+ * --- */
+func instanceIDs(report datamodels.EC2InstanceReport) []string {
+	ids := make([]string, 0)
+	for _, instance := range report.Instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	return ids
+}
@@ -0,0 +1,342 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// An in-memory EC2 holding a fixed set of instances. Calls the tests do not
+// set up panic through the embedded nil interface.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	mu        sync.Mutex
+	instances []*ec2.Instance
+
+	// Instance IDs sent in each start call, and the error to return for a
+	// call (nil to start the instances).
+	startCalls [][]string
+	startErr   func(ids []string) error
+
+	// Instance status returned by status calls, or the error they fail with.
+	statuses  []*ec2.InstanceStatus
+	statusErr error
+
+	// Instance IDs sent in each terminate call.
+	terminateCalls [][]string
+
+	runInstances func(ctx aws.Context, input *ec2.RunInstancesInput) (*ec2.Reservation, error)
+}
+
+func newInstance(id, name, state string, tags map[string]string) *ec2.Instance {
+	instance := &ec2.Instance{
+		InstanceId:   aws.String(id),
+		InstanceType: aws.String("t3.micro"),
+		State:        &ec2.InstanceState{Name: aws.String(state)},
+		Tags:         []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+	for key, value := range tags {
+		instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return instance
+}
+
+func (f *fakeEC2) matches(instance *ec2.Instance, input *ec2.DescribeInstancesInput) bool {
+	if len(input.InstanceIds) > 0 {
+		found := false
+		for _, id := range input.InstanceIds {
+			found = found || aws.StringValue(id) == aws.StringValue(instance.InstanceId)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, filter := range input.Filters {
+		value := ""
+		name := aws.StringValue(filter.Name)
+		switch {
+		case name == "instance-state-name":
+			value = aws.StringValue(instance.State.Name)
+		case name == "client-token":
+			value = aws.StringValue(instance.ClientToken)
+		case name == "tag-key":
+			for _, tag := range instance.Tags {
+				for _, want := range filter.Values {
+					if aws.StringValue(tag.Key) == aws.StringValue(want) {
+						value = aws.StringValue(want)
+					}
+				}
+			}
+		case strings.HasPrefix(name, "tag:"):
+			for _, tag := range instance.Tags {
+				if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") {
+					value = aws.StringValue(tag.Value)
+				}
+			}
+		}
+		found := false
+		for _, want := range filter.Values {
+			found = found || aws.StringValue(want) == value
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeEC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reservation := &ec2.Reservation{}
+	for _, instance := range f.instances {
+		if f.matches(instance, input) {
+			reservation.Instances = append(reservation.Instances, instance)
+		}
+	}
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeInstanceStatusPagesWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, fn func(*ec2.DescribeInstanceStatusOutput, bool) bool, opts ...request.Option) error {
+	if f.statusErr != nil {
+		return f.statusErr
+	}
+	fn(&ec2.DescribeInstanceStatusOutput{InstanceStatuses: f.statuses}, true)
+	return nil
+}
+
+func (f *fakeEC2) StartInstancesWithContext(ctx aws.Context, input *ec2.StartInstancesInput, opts ...request.Option) (*ec2.StartInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := aws.StringValueSlice(input.InstanceIds)
+	f.startCalls = append(f.startCalls, ids)
+	if f.startErr != nil {
+		if err := f.startErr(ids); err != nil {
+			return nil, err
+		}
+	}
+	output := &ec2.StartInstancesOutput{}
+	for _, id := range ids {
+		output.StartingInstances = append(output.StartingInstances, &ec2.InstanceStateChange{
+			InstanceId:    aws.String(id),
+			PreviousState: &ec2.InstanceState{Name: aws.String("stopped")},
+			CurrentState:  &ec2.InstanceState{Name: aws.String("pending")},
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := aws.StringValueSlice(input.InstanceIds)
+	f.terminateCalls = append(f.terminateCalls, ids)
+	output := &ec2.TerminateInstancesOutput{}
+	for _, id := range ids {
+		output.TerminatingInstances = append(output.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:    aws.String(id),
+			PreviousState: &ec2.InstanceState{Name: aws.String("running")},
+			CurrentState:  &ec2.InstanceState{Name: aws.String("shutting-down")},
+		})
+	}
+	return output, nil
+}
+
+// Tags are applied to the fake's instances so later calls see them.
+func (f *fakeEC2) CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, instance := range f.instances {
+		for _, id := range input.Resources {
+			if aws.StringValue(id) != aws.StringValue(instance.InstanceId) {
+				continue
+			}
+			for _, tag := range input.Tags {
+				replaced := false
+				for _, existing := range instance.Tags {
+					if aws.StringValue(existing.Key) == aws.StringValue(tag.Key) {
+						existing.Value = tag.Value
+						replaced = true
+					}
+				}
+				if !replaced {
+					instance.Tags = append(instance.Tags, &ec2.Tag{Key: tag.Key, Value: tag.Value})
+				}
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) RunInstancesWithContext(ctx aws.Context, input *ec2.RunInstancesInput, opts ...request.Option) (*ec2.Reservation, error) {
+	return f.runInstances(ctx, input)
+}
+
+/* ---
+ * Make a controller for region us-east-1 whose prompts read answers from
+ * input, with reports written to a temporary directory.
+ * --- */
+func newTestController(t *testing.T, client ec2iface.EC2API, input string) (*Controller, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	c := &Controller{
+		EC2:       client,
+		Region:    "us-east-1",
+		AccountID: "123456789012",
+		ReportDir: t.TempDir(),
+		In:        strings.NewReader(input),
+		Out:       out,
+	}
+	return c, out
+}
+
+/* ---
+ * Write an instance report to a temporary file and return its path.
+ * --- */
+func writeTestReport(t *testing.T, report datamodels.EC2InstanceReport) string {
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResolveReportUsesReportRegion(t *testing.T) {
+	local := &fakeEC2{}
+	remote := &fakeEC2{}
+	c, out := newTestController(t, local, "")
+	c.NewEC2Client = func(region string) ec2iface.EC2API {
+		if region != "eu-west-1" {
+			t.Errorf("client requested for region %s", region)
+		}
+		return remote
+	}
+
+	path := writeTestReport(t, datamodels.EC2InstanceReport{
+		SchemaVersion: datamodels.EC2InstanceReportSchemaVersion,
+		Metadata:      &datamodels.ReportMetadata{Region: "eu-west-1", AccountID: "123456789012"},
+		Instances: []datamodels.EC2InstanceDetails{
+			{InstanceID: "i-01", Name: "web", InstanceState: "running"},
+			{InstanceID: "i-02", Name: "db", InstanceState: "running"},
+		},
+	})
+	tgt, err := c.resolve(aws.BackgroundContext(), Selection{Report: path, Filters: []string{"name=web"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt.region != "eu-west-1" || tgt.client != remote {
+		t.Errorf("got region %s, want eu-west-1 with the eu-west-1 client", tgt.region)
+	}
+	if ids := instanceIDs(tgt.report); len(ids) != 1 || ids[0] != "i-01" {
+		t.Errorf("got instances %v, want [i-01]", ids)
+	}
+	if !strings.Contains(out.String(), "Using region eu-west-1") {
+		t.Errorf("region change not reported: %q", out.String())
+	}
+}
+
+func TestResolveReportFromOtherAccount(t *testing.T) {
+	c, _ := newTestController(t, &fakeEC2{}, "")
+	path := writeTestReport(t, datamodels.EC2InstanceReport{
+		Metadata:  &datamodels.ReportMetadata{Region: "us-east-1", AccountID: "999999999999"},
+		Instances: []datamodels.EC2InstanceDetails{{InstanceID: "i-01"}},
+	})
+	if _, err := c.resolve(aws.BackgroundContext(), Selection{Report: path}, ""); err == nil {
+		t.Fatal("expected an error for a report from another account")
+	}
+}
+
+func TestResolveNeedsOneSource(t *testing.T) {
+	c, _ := newTestController(t, &fakeEC2{}, "")
+	for _, selection := range []Selection{
+		{},
+		{Report: "report.json", Instances: []string{"i-01"}},
+		{Instances: []string{"i-01"}, All: true},
+	} {
+		if _, err := c.resolve(aws.BackgroundContext(), selection, "stopped"); err == nil {
+			t.Errorf("expected an error for selection %+v", selection)
+		}
+	}
+}
+
+func TestResolveAllUsesState(t *testing.T) {
+	client := &fakeEC2{instances: []*ec2.Instance{
+		newInstance("i-01", "web", "stopped", nil),
+		newInstance("i-02", "db", "running", nil),
+	}}
+	c, _ := newTestController(t, client, "")
+	tgt, err := c.resolve(aws.BackgroundContext(), Selection{All: true}, "stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := instanceIDs(tgt.report); len(ids) != 1 || ids[0] != "i-01" {
+		t.Errorf("got instances %v, want [i-01]", ids)
+	}
+}
+
+func TestPrepareConfirm(t *testing.T) {
+	client := &fakeEC2{instances: []*ec2.Instance{newInstance("i-01", "web", "stopped", nil)}}
+
+	c, out := newTestController(t, client, "n\n")
+	_, err := c.prepare(aws.BackgroundContext(), Selection{Instances: []string{"web"}}, "", "started", nil)
+	if err != ErrAborted {
+		t.Errorf("got error %v, want ErrAborted", err)
+	}
+	if !strings.Contains(out.String(), "The following instances will be started:") || !strings.Contains(out.String(), "ID: i-01") {
+		t.Errorf("instances not listed before the prompt: %q", out.String())
+	}
+
+	c, _ = newTestController(t, client, "y\n")
+	tgt, err := c.prepare(aws.BackgroundContext(), Selection{Instances: []string{"web"}}, "", "started", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.report.Instances) != 1 {
+		t.Errorf("got %d instances, want 1", len(tgt.report.Instances))
+	}
+}
+
+func TestPrepareNoInstancesSkipsPrompt(t *testing.T) {
+	c, out := newTestController(t, &fakeEC2{}, "")
+	checked := false
+	check := func(ctx aws.Context, tgt target) error {
+		checked = true
+		return nil
+	}
+	tgt, err := c.prepare(aws.BackgroundContext(), Selection{Filters: []string{"name=web"}}, "", "started", check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.report.Instances) != 0 || checked {
+		t.Errorf("got %d instances (checked %t), want none and no check", len(tgt.report.Instances), checked)
+	}
+	if !strings.Contains(out.String(), "No matching instances") {
+		t.Errorf("empty selection not reported: %q", out.String())
+	}
+}
+
+func TestStartAborted(t *testing.T) {
+	client := &fakeEC2{instances: []*ec2.Instance{newInstance("i-01", "web", "stopped", nil)}}
+	c, _ := newTestController(t, client, "no\n")
+	if _, _, err := c.Start(aws.BackgroundContext(), Selection{Instances: []string{"i-01"}}, false); err != ErrAborted {
+		t.Errorf("got error %v, want ErrAborted", err)
+	}
+	if len(client.startCalls) != 0 {
+		t.Errorf("instances were started after the user declined: %v", client.startCalls)
+	}
+}
@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/notify"
+	"mdibl_cloud_control/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+/* ---
+ * Where to look for scheduled events and who to tell. With no Regions, the
+ * controller's region is checked; with AllRegions, every region enabled in
+ * the account. With a Notifier, owners are sent one notice per event.
+ * --- */
+type EventOptions struct {
+	Regions    []string
+	AllRegions bool
+	Notifier   notify.Notifier
+}
+
+/* ---
+ * List scheduled maintenance events (reboots, retirements, etc.) on
+ * instances across regions, soonest first, and optionally notify the
+ * instances' owners. Writes a scheduled_events report. A region that can
+ * not be checked is recorded in the report and the rest are still checked;
+ * an error is returned at the end.
+ * --- */
+func (c *Controller) ScheduledEvents(ctx aws.Context, options EventOptions) (datamodels.ScheduledEventsReport, string, error) {
+	report := datamodels.ScheduledEventsReport{Metadata: c.metadata(c.Region), Events: make([]datamodels.ScheduledEvent, 0)}
+	regions := options.Regions
+	if options.AllRegions {
+		var err error
+		if regions, err = c.enabledRegions(ctx); err != nil {
+			return report, "", err
+		}
+	}
+	if len(regions) == 0 {
+		regions = []string{c.Region}
+	}
+	report.Regions = regions
+
+	instances := make(map[string]datamodels.EC2InstanceDetails)
+	checked := make([]string, 0, len(regions))
+	for _, region := range regions {
+		events, found, err := c.regionEvents(ctx, region)
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, "", ctx.Err()
+			}
+			if report.RegionErrors == nil {
+				report.RegionErrors = make(map[string]string)
+			}
+			report.RegionErrors[region] = utils.ErrorSummary(err)
+			c.printf("Warning: unable to check events in %s: %s\n", region, utils.ErrorSummary(err))
+			continue
+		}
+		checked = append(checked, region)
+		report.Events = append(report.Events, events...)
+		for id, instance := range found {
+			instances[id] = instance
+		}
+	}
+	sort.Slice(report.Events, func(i, j int) bool { return report.Events[i].NotBefore.Before(report.Events[j].NotBefore) })
+
+	now := time.Now()
+	if len(report.Events) == 0 {
+		if len(checked) > 0 {
+			c.printf("No scheduled events in %s\n", strings.Join(checked, ", "))
+		}
+	} else {
+		if options.Notifier != nil {
+			c.notifyEventOwners(ctx, options.Notifier, &report, instances)
+		}
+		utils.FprintScheduledEvents(c.Out, report.Events, now)
+	}
+
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, c.Region, "scheduled_events", report)
+	if err != nil {
+		return report, "", err
+	}
+	failed := 0
+	for _, event := range report.Events {
+		if event.Error != "" {
+			failed++
+		}
+	}
+	problems := make([]string, 0)
+	if len(report.RegionErrors) > 0 {
+		failedRegions := make([]string, 0, len(report.RegionErrors))
+		for region := range report.RegionErrors {
+			failedRegions = append(failedRegions, region)
+		}
+		sort.Strings(failedRegions)
+		problems = append(problems, fmt.Sprintf("events could not be checked in %s", strings.Join(failedRegions, ", ")))
+	}
+	if failed > 0 {
+		problems = append(problems, fmt.Sprintf("%d event notices could not be sent", failed))
+	}
+	if len(problems) > 0 {
+		return report, outputFileName, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Get the regions enabled in the account.
+ * --- */
+func (c *Controller) enabledRegions(ctx aws.Context) ([]string, error) {
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	output, err := c.EC2.DescribeRegionsWithContext(callCtx, utils.CreateEC2DescribeRegionsParams())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list regions: %s", utils.ErrorSummary(err))
+	}
+	regions := make([]string, 0, len(output.Regions))
+	for _, region := range output.Regions {
+		regions = append(regions, aws.StringValue(region.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+/* ---
+ * Get the scheduled events in a region along with the instances they
+ * affect.
+ * --- */
+func (c *Controller) regionEvents(ctx aws.Context, region string) ([]datamodels.ScheduledEvent, map[string]datamodels.EC2InstanceDetails, error) {
+	client := c.clientFor(region)
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	health := make([]datamodels.InstanceHealth, 0)
+	err := client.DescribeInstanceStatusPagesWithContext(callCtx, utils.CreateEC2DescribeEventStatusParams(), func(page *ec2.DescribeInstanceStatusOutput, lastPage bool) bool {
+		for _, status := range page.InstanceStatuses {
+			if h := utils.ParseInstanceStatus(status, 0, time.Now()); len(h.Events) > 0 {
+				health = append(health, h)
+			}
+		}
+		return true
+	})
+	if err != nil || len(health) == 0 {
+		return nil, nil, err
+	}
+
+	ids := make([]string, 0, len(health))
+	for _, h := range health {
+		ids = append(ids, h.InstanceID)
+	}
+	details, err := utils.DescribeEC2Instances(callCtx, client, utils.CreateEC2InstanceIDFilterParams(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	instances := make(map[string]datamodels.EC2InstanceDetails)
+	for _, instance := range details.Instances {
+		instances[instance.InstanceID] = instance
+	}
+
+	events := make([]datamodels.ScheduledEvent, 0)
+	for _, h := range health {
+		instance := instances[h.InstanceID]
+		for _, event := range h.Events {
+			events = append(events, datamodels.ScheduledEvent{
+				Region:      region,
+				InstanceID:  h.InstanceID,
+				Name:        instance.Name,
+				Owner:       instance.Tags[utils.TagOwner],
+				State:       h.State,
+				Code:        event.Code,
+				Description: event.Description,
+				NotBefore:   event.NotBefore,
+				NotAfter:    event.NotAfter,
+			})
+		}
+	}
+	return events, instances, nil
+}
+
+/* ---
+ * Send each owner one notice listing their instances' new events, then tag
+ * the instances with the events notified so owners are not told twice.
+ * Events on instances without an Owner tag are not notified.
+ * --- */
+func (c *Controller) notifyEventOwners(ctx aws.Context, notifier notify.Notifier, report *datamodels.ScheduledEventsReport, instances map[string]datamodels.EC2InstanceDetails) {
+	pending := make(map[string][]int)
+	for idx, event := range report.Events {
+		notified := strings.Fields(instances[event.InstanceID].Tags[utils.TagEventNotified])
+		if event.Owner == "" || containsKey(notified, utils.ScheduledEventKey(event)) {
+			continue
+		}
+		pending[event.Owner] = append(pending[event.Owner], idx)
+	}
+
+	owners := make([]string, 0, len(pending))
+	for owner := range pending {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		lines := make([]string, 0)
+		for _, idx := range pending[owner] {
+			event := report.Events[idx]
+			lines = append(lines, fmt.Sprintf("  %s (%s) in %s: %s from %s\n    %s", event.Name, event.InstanceID, event.Region, event.Code,
+				event.NotBefore.UTC().Format(time.RFC1123), event.Description))
+		}
+		message := notify.Message{
+			Owner:   owner,
+			Subject: fmt.Sprintf("AWS has scheduled maintenance on %d of your EC2 instances", len(pending[owner])),
+			Body: fmt.Sprintf("AWS has scheduled the following events:\n\n%s\n\n"+
+				"Reboots happen at the scheduled time unless you reboot the instance yourself first. Instances due for\n"+
+				"retirement or stop must be stopped and started (not rebooted) before the deadline to move to new hardware.\n",
+				strings.Join(lines, "\n")),
+		}
+		if err := notifier.Notify(ctx, message); err != nil {
+			for _, idx := range pending[owner] {
+				report.Events[idx].Error = err.Error()
+			}
+			continue
+		}
+		for _, idx := range pending[owner] {
+			report.Events[idx].Notified = true
+		}
+	}
+
+	// Record every current event on each notified instance; events that
+	// have passed drop out of the tag.
+	current := make(map[string][]string)
+	regions := make(map[string]string)
+	tagged := make(map[string]bool)
+	for _, event := range report.Events {
+		current[event.InstanceID] = append(current[event.InstanceID], utils.ScheduledEventKey(event))
+		regions[event.InstanceID] = event.Region
+		if event.Notified {
+			tagged[event.InstanceID] = true
+		}
+	}
+	clients := make(map[string]ec2iface.EC2API)
+	for id := range tagged {
+		region := regions[id]
+		if clients[region] == nil {
+			clients[region] = c.clientFor(region)
+		}
+		callCtx, cancel := c.callContext(ctx)
+		_, err := clients[region].CreateTagsWithContext(callCtx, utils.CreateEC2CreateTagsParams([]string{id}, utils.TagEventNotified, strings.Join(current[id], " ")))
+		cancel()
+		if err != nil {
+			c.printf("Warning: notified the owner of %s but could not tag it: %s\n", id, utils.ErrorSummary(err))
+		}
+	}
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
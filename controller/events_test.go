@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestScheduledEventsContinuesPastFailedRegion(t *testing.T) {
+	healthy := &fakeEC2{
+		instances: []*ec2.Instance{newInstance("i-01", "web", "running", map[string]string{"Owner": "jsmith"})},
+		statuses: []*ec2.InstanceStatus{{
+			InstanceId:    aws.String("i-01"),
+			InstanceState: &ec2.InstanceState{Name: aws.String("running")},
+			Events: []*ec2.InstanceStatusEvent{{
+				Code:        aws.String("system-reboot"),
+				Description: aws.String("scheduled reboot"),
+				NotBefore:   aws.Time(time.Now().Add(48 * time.Hour)),
+			}},
+		}},
+	}
+	denied := &fakeEC2{statusErr: awserr.New("AuthFailure", "AWS was not able to validate the provided access credentials", nil)}
+	c, out := newTestController(t, healthy, "")
+	c.NewEC2Client = func(region string) ec2iface.EC2API {
+		if region == "ap-east-1" {
+			return denied
+		}
+		return healthy
+	}
+
+	report, outputFileName, err := c.ScheduledEvents(aws.BackgroundContext(), EventOptions{Regions: []string{"ap-east-1", "us-east-1"}})
+	if err == nil || !strings.Contains(err.Error(), "ap-east-1") {
+		t.Errorf("got error %v, want one naming ap-east-1", err)
+	}
+	if outputFileName == "" {
+		t.Error("no report written")
+	}
+	if len(report.Events) != 1 || report.Events[0].InstanceID != "i-01" || report.Events[0].Owner != "jsmith" {
+		t.Errorf("got events %+v, want the reboot on i-01", report.Events)
+	}
+	if !strings.Contains(report.RegionErrors["ap-east-1"], "AuthFailure") || len(report.RegionErrors) != 1 {
+		t.Errorf("got region errors %v, want ap-east-1 only", report.RegionErrors)
+	}
+	if !strings.Contains(out.String(), "Warning: unable to check events in ap-east-1") {
+		t.Errorf("failed region not warned about: %q", out.String())
+	}
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/remote"
+	"mdibl_cloud_control/utils"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// How much of each instance's output is kept in the exec report.
+const execOutputLimit = 4096
+
+/* ---
+ * How to run a command across instances. Hosts picks the address, user and
+ * key file of each instance as for report export. CommandTimeout limits how
+ * long the command may run on each instance (no limit if zero).
+ * --- */
+type ExecOptions struct {
+	Command        string
+	Parallel       int
+	CommandTimeout time.Duration
+	Hosts          datamodels.ExportOptions
+	SSH            remote.Config
+}
+
+/* ---
+ * Run a command over SSH on the selected running instances, at most
+ * options.Parallel at a time, streaming output prefixed with each
+ * instance's name. Writes an exec_results report of exit codes and the end
+ * of each instance's output.
+ * --- */
+func (c *Controller) Exec(ctx aws.Context, selection Selection, options ExecOptions) (datamodels.ExecReport, string, error) {
+	report := datamodels.ExecReport{Command: options.Command, Results: make([]datamodels.ExecResult, 0)}
+	if options.Command == "" {
+		return report, "", fmt.Errorf("No command given")
+	}
+	hosts, region, err := c.sshHosts(ctx, selection, options.Hosts)
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(region)
+	if len(hosts) == 0 {
+		c.printf("No instances to run on\n")
+		return report, "", nil
+	}
+
+	width := 0
+	for _, host := range hosts {
+		if len(host.Alias) > width {
+			width = len(host.Alias)
+		}
+	}
+	var outputLock sync.Mutex
+	report.Results = make([]datamodels.ExecResult, len(hosts))
+	forEachHost(ctx, hosts, options.Parallel, func(idx int, host datamodels.ExportHost) {
+		report.Results[idx] = c.execOne(ctx, host, fmt.Sprintf("%-*s | ", width, host.Alias), &outputLock, options)
+	})
+
+	// Hosts skipped after an interrupt have no result.
+	results := make([]datamodels.ExecResult, 0, len(hosts))
+	for _, result := range report.Results {
+		if result.InstanceID != "" {
+			results = append(results, result)
+		}
+	}
+	report.Results = results
+
+	c.printf("\n")
+	utils.FprintExecResults(c.Out, report)
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, region, "exec_results", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("Command failed on %d of %d instances", failed, len(report.Results))
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Run the command on one host, writing its output to c.Out with each line
+ * prefixed. Stdout and stderr are written by separate goroutines, so each
+ * has its own writer; lock keeps lines from different writers whole.
+ * --- */
+func (c *Controller) execOne(ctx aws.Context, host datamodels.ExportHost, prefix string, lock sync.Locker, options ExecOptions) (result datamodels.ExecResult) {
+	result = datamodels.ExecResult{
+		InstanceID: host.Instance.InstanceID,
+		Name:       host.Instance.Name,
+		Address:    host.Address,
+		User:       host.User,
+		StartedAt:  time.Now(),
+		ExitCode:   -1,
+	}
+	out := remote.NewPrefixWriter(c.Out, prefix, lock)
+	errOut := remote.NewPrefixWriter(c.Out, prefix, lock)
+	tail := &remote.TailBuffer{Limit: execOutputLimit}
+	defer func() {
+		errOut.Flush()
+		out.Flush()
+		result.Duration = time.Since(result.StartedAt).Truncate(time.Millisecond).String()
+		result.Output = tail.String()
+	}()
+
+	client, err := remote.Connect(ctx, options.SSH, remote.Host{Name: host.Alias, Address: host.Address, User: host.User, IdentityFile: host.IdentityFile})
+	if err != nil {
+		result.Error = err.Error()
+		fmt.Fprintf(out, "unable to connect: %s\n", err)
+		return result
+	}
+	defer client.Close()
+
+	runCtx := ctx
+	if options.CommandTimeout > 0 {
+		var cancel func()
+		runCtx, cancel = context.WithTimeout(ctx, options.CommandTimeout)
+		defer cancel()
+	}
+	result.ExitCode, err = remote.Run(runCtx, client, options.Command, io.MultiWriter(out, tail), io.MultiWriter(errOut, tail))
+	if err != nil {
+		if runCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("command timed out after %s", options.CommandTimeout)
+		}
+		result.Error = err.Error()
+		fmt.Fprintf(out, "%s\n", err)
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+/* ---
+ * Get the status checks and scheduled events of the selected instances, or
+ * of every running instance if none are selected. Running instances whose
+ * checks have failed for unreachableAfter are flagged unreachable. Writes a
+ * health_report.
+ * --- */
+func (c *Controller) Health(ctx aws.Context, selection Selection, unreachableAfter time.Duration) (datamodels.HealthReport, string, error) {
+	report := datamodels.HealthReport{UnreachableAfter: unreachableAfter.String(), Instances: make([]datamodels.InstanceHealth, 0)}
+	if selection.Report == "" && len(selection.Instances) == 0 {
+		selection.All = true
+	}
+	t, err := c.resolve(ctx, selection, "running")
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(t.region)
+	if len(t.report.Instances) == 0 {
+		c.printf("No matching instances\n")
+		return report, "", nil
+	}
+
+	now := time.Now()
+	health := make(map[string]datamodels.InstanceHealth)
+	for _, batch := range utils.BatchInstanceIDs(instanceIDs(t.report), utils.InstanceStatusBatchSize) {
+		callCtx, cancel := c.callContext(ctx)
+		err := t.client.DescribeInstanceStatusPagesWithContext(callCtx, utils.CreateEC2DescribeInstanceStatusParams(batch), func(page *ec2.DescribeInstanceStatusOutput, lastPage bool) bool {
+			for _, status := range page.InstanceStatuses {
+				h := utils.ParseInstanceStatus(status, unreachableAfter, now)
+				health[h.InstanceID] = h
+			}
+			return true
+		})
+		cancel()
+		if err != nil {
+			return report, "", err
+		}
+	}
+
+	for _, instance := range t.report.Instances {
+		h, ok := health[instance.InstanceID]
+		if !ok {
+			// Terminated instances have no status.
+			h = datamodels.InstanceHealth{InstanceID: instance.InstanceID, State: instance.InstanceState, SystemStatus: "not-applicable", InstanceStatus: "not-applicable", Events: make([]datamodels.MaintenanceEvent, 0)}
+		}
+		h.Name = instance.Name
+		report.Instances = append(report.Instances, h)
+	}
+
+	utils.FprintHealthReport(c.Out, report, now)
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, t.region, "health_report", report)
+	return report, outputFileName, err
+}
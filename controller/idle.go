@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+/* ---
+ * How to check for idle instances. With Stop, idle instances are stopped
+ * after confirmation; otherwise they are only reported. Now is the end of
+ * the window (the current time if zero).
+ * --- */
+type IdleOptions struct {
+	Thresholds datamodels.IdleThresholds
+	Stop       bool
+	Now        time.Time
+}
+
+/* ---
+ * Find running instances whose CloudWatch CPU and network metrics have
+ * stayed below the thresholds for the whole window, and optionally stop
+ * them. With no instances selected, every running instance is checked.
+ * Writes an idle_check report.
+ * --- */
+func (c *Controller) CheckIdle(ctx aws.Context, selection Selection, options IdleOptions) (datamodels.IdleReport, string, error) {
+	thresholds := options.Thresholds
+	report := datamodels.IdleReport{
+		CPUPercent:            thresholds.CPUPercent,
+		NetworkBytesPerSecond: thresholds.NetworkBytesPerSecond,
+		Window:                thresholds.Window.String(),
+		Period:                thresholds.Period.String(),
+		Stop:                  options.Stop,
+		Results:               make([]datamodels.InstanceIdleResult, 0),
+	}
+	if thresholds.Period < time.Minute || thresholds.Period%time.Minute != 0 {
+		return report, "", fmt.Errorf("The period must be a whole number of minutes")
+	}
+	if thresholds.Window < thresholds.Period {
+		return report, "", fmt.Errorf("The window must be at least one period (%s)", thresholds.Period)
+	}
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	if selection.Report == "" && len(selection.Instances) == 0 {
+		selection.All = true
+	}
+	t, err := c.resolve(ctx, selection, "running")
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(t.region)
+	running := make([]datamodels.EC2InstanceDetails, 0)
+	for _, instance := range t.report.Instances {
+		if instance.InstanceState == "running" {
+			running = append(running, instance)
+		}
+	}
+	if len(running) == 0 {
+		c.printf("No running instances to check\n")
+		return report, "", nil
+	}
+
+	metrics, err := c.idleMetrics(ctx, t.region, instanceIDs(datamodels.EC2InstanceReport{Instances: running}), now, thresholds)
+	if err != nil {
+		return report, "", err
+	}
+	idle := make([]datamodels.EC2InstanceDetails, 0)
+	for _, instance := range running {
+		result := utils.ClassifyIdle(instance, metrics[instance.InstanceID], thresholds, now)
+		if result.Idle {
+			idle = append(idle, instance)
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	title := fmt.Sprintf("Idle check (CPU below %g%% and network below %s/s for %s):", thresholds.CPUPercent, utils.FormatBytes(thresholds.NetworkBytesPerSecond), thresholds.Window)
+	c.printf("\n%s\n%s\n\n", title, strings.Repeat("-", len(title)))
+	utils.FprintIdleReport(c.Out, report)
+	c.printf("\n%d of %d instances are idle\n", len(idle), len(running))
+
+	if options.Stop && len(idle) > 0 {
+		if !c.confirm(ctx) {
+			return report, "", ErrAborted
+		}
+		errs := c.applyAction(ctx, target{client: t.client, region: t.region, report: datamodels.EC2InstanceReport{Instances: idle}}, "stop")
+		for idx := range report.Results {
+			if report.Results[idx].Idle {
+				report.Results[idx].Action = "stop"
+				report.Results[idx].Error = errs[report.Results[idx].InstanceID]
+			}
+		}
+		c.printf("\nResults\n-------\n")
+		utils.FprintIdleReport(c.Out, report)
+	}
+
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, t.region, "idle_check", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("%d of %d idle instances could not be stopped", failed, len(idle))
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Fetch CPU and network metrics for the window ending at now, in batches.
+ * --- */
+func (c *Controller) idleMetrics(ctx aws.Context, region string, ids []string, now time.Time, thresholds datamodels.IdleThresholds) (map[string]*utils.InstanceMetrics, error) {
+	client := c.cloudWatchFor(region)
+	if client == nil {
+		return nil, fmt.Errorf("No CloudWatch client available")
+	}
+
+	// Whole periods only, so a partly filled current period does not look
+	// quieter than it was.
+	end := now.Truncate(thresholds.Period)
+	start := end.Add(-thresholds.Window)
+	metrics := make(map[string]*utils.InstanceMetrics)
+	for _, batch := range utils.BatchInstanceIDs(ids, utils.IdleMetricBatchSize) {
+		callCtx, cancel := c.callContext(ctx)
+		err := client.GetMetricDataPagesWithContext(callCtx, utils.CreateGetMetricDataParams(batch, start, end, thresholds.Period), func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+			utils.AddMetricDataResults(metrics, batch, page.MetricDataResults)
+			return true
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get CloudWatch metrics: %s", utils.ErrorSummary(err))
+		}
+	}
+	return metrics, nil
+}
+
+/* ---
+ * Install an alarm on each launched instance that stops it once it has been
+ * idle for the configured time. Failures are printed; the number of
+ * instances left without an alarm is returned as an error.
+ * --- */
+func (c *Controller) installIdleAlarms(ctx aws.Context, region string, config datamodels.LaunchConfig, report datamodels.EC2InstanceReport) error {
+	client := c.cloudWatchFor(region)
+	if client == nil {
+		return fmt.Errorf("No CloudWatch client available to install idle stop alarms")
+	}
+	failed := 0
+	for _, instance := range report.Instances {
+		callCtx, cancel := c.callContext(ctx)
+		_, err := client.PutMetricAlarmWithContext(callCtx, utils.CreateIdleStopAlarmParams(region, instance.InstanceID, config.IdleStopCPU, config.IdleStopAfter))
+		cancel()
+		if err != nil {
+			c.printf("Warning: unable to install idle stop alarm on %s: %s\n", instance.InstanceID, utils.ErrorSummary(err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d instances have no idle stop alarm", failed, len(report.Instances))
+	}
+	c.printf("Installed idle stop alarms (CPU below %g%% for %s)\n", config.IdleStopCPU, config.IdleStopAfter)
+	return nil
+}
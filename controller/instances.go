@@ -0,0 +1,703 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// States listed when no states are asked for.
+var DefaultListStates = []string{"stopped", "running", "pending"}
+
+// How long to spend looking for instances created by an interrupted launch.
+const partialReportTimeout = 30 * time.Second
+
+/* ---
+ * Which instances an operation acts on. At most one of Report (path to an
+ * instance report), Instances (IDs or Name tags) or All should be set.
+ * Filters (see utils.ParseInstanceFilter) narrow the selection; on their own
+ * they select from every instance that is not terminated.
+ * --- */
+type Selection struct {
+	Report    string
+	Instances []string
+	All       bool
+	Filters   []string
+}
+
+/* ---
+ * Options for stopping instances. Hibernate requires instances launched with
+ * hibernation enabled. Force skips the guest shutdown, for stuck instances.
+ * --- */
+type StopOptions struct {
+	DryRun    bool
+	Force     bool
+	Hibernate bool
+}
+
+/* ---
+ * Instances an operation resolved to, with the client and region to use.
+ * --- */
+type target struct {
+	report datamodels.EC2InstanceReport
+	client ec2iface.EC2API
+	region string
+}
+
+/* ---
+ * List instances in the given states (DefaultListStates if none) and write
+ * an instance report. An unfiltered listing is written as the "all" report.
+ * --- */
+func (c *Controller) ListInstances(ctx aws.Context, states []string) (datamodels.EC2InstanceReport, string, error) {
+	reportType := "list"
+	if len(states) == 0 {
+		states = DefaultListStates
+		reportType = "all"
+	}
+
+	// Query AWS for all instances that match the filter params
+	params := utils.CreateEC2InstanceFilterParams("instance-state-name", states)
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	report, err := utils.DescribeEC2Instances(callCtx, c.EC2, params)
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(c.Region)
+
+	// Write instance report to file
+	outputFileName, err := utils.WriteInstanceDetailsReport(c.ReportDir, c.Region, report, reportType)
+	return report, outputFileName, err
+}
+
+/* ---
+ * List the instance types offered in the region and write them to the
+ * report directory. A dry run only checks permissions and writes nothing.
+ * --- */
+func (c *Controller) ListInstanceTypes(ctx aws.Context, dryRun bool) ([]string, string, error) {
+	params := utils.CreateInstanceTypeOfferingFilterParams(dryRun)
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	describeInstanceTypeOutput, err := c.EC2.DescribeInstanceTypeOfferingsWithContext(callCtx, params)
+	if dryRun {
+		// A successful dry run is reported as a DryRunOperation error.
+		if err != nil && !strings.Contains(err.Error(), "DryRunOperation") {
+			return nil, "", err
+		}
+		c.printf("Permission check passed\n")
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	offerings := utils.ParseInstanceTypeOfferings(describeInstanceTypeOutput)
+	outputFileName, err := utils.WriteInstanceTypeOfferings(c.ReportDir, c.Region, offerings)
+	return offerings, outputFileName, err
+}
+
+/* ---
+ * Start the selected instances. With All, every stopped instance is
+ * started. This will not create new instances.
+ * --- */
+func (c *Controller) Start(ctx aws.Context, selection Selection, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	t, err := c.prepare(ctx, selection, "stopped", "started", nil)
+	if err != nil || len(t.report.Instances) == 0 {
+		return datamodels.StateChangeReport{}, "", err
+	}
+
+	c.printf("Starting instances...\n")
+	return c.changeState(ctx, t, "started", "start_results", dryRun, func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		output, err := t.client.StartInstancesWithContext(ctx, utils.CreateEC2StartInstanceParams(ids, dryRun))
+		if err != nil {
+			return nil, err
+		}
+		return output.StartingInstances, nil
+	})
+}
+
+/* ---
+ * Stop the selected instances. With All, every running instance is stopped.
+ * --- */
+func (c *Controller) Stop(ctx aws.Context, selection Selection, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	return c.StopWithOptions(ctx, selection, StopOptions{DryRun: dryRun})
+}
+
+/* ---
+ * Stop the selected instances, hibernating or forcing them as asked. Before
+ * hibernating, checks that every instance was launched with hibernation
+ * enabled.
+ * --- */
+func (c *Controller) StopWithOptions(ctx aws.Context, selection Selection, options StopOptions) (datamodels.StateChangeReport, string, error) {
+	var check func(ctx aws.Context, t target) error
+	action := "stopped"
+	if options.Hibernate {
+		check = c.checkHibernation
+		action = "hibernated"
+	}
+	t, err := c.prepare(ctx, selection, "running", action, check)
+	if err != nil || len(t.report.Instances) == 0 {
+		return datamodels.StateChangeReport{}, "", err
+	}
+
+	c.printf("Stopping instances...\n")
+	return c.changeState(ctx, t, action, "stop_results", options.DryRun, func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		output, err := t.client.StopInstancesWithContext(ctx, utils.CreateEC2StopInstanceParams(ids, options.DryRun, options.Force, options.Hibernate))
+		if err != nil {
+			return nil, err
+		}
+		return output.StoppingInstances, nil
+	})
+}
+
+/* ---
+ * Terminate the selected instances. All is not allowed.
+ * --- */
+func (c *Controller) Terminate(ctx aws.Context, selection Selection, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	if selection.All {
+		return datamodels.StateChangeReport{}, "", fmt.Errorf("Terminating all instances is not supported")
+	}
+	t, err := c.prepare(ctx, selection, "", "terminated", nil)
+	if err != nil || len(t.report.Instances) == 0 {
+		return datamodels.StateChangeReport{}, "", err
+	}
+
+	c.printf("Terminating instances...\n")
+	return c.changeState(ctx, t, "terminated", "terminate_results", dryRun, func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		output, err := t.client.TerminateInstancesWithContext(ctx, utils.CreateEC2TerminateInstanceParams(ids, dryRun))
+		if err != nil {
+			return nil, err
+		}
+		return output.TerminatingInstances, nil
+	})
+}
+
+/* ---
+ * Reboot the selected instances. With All, every running instance is
+ * rebooted. AWS reports no state change for a reboot, so the results show
+ * the state the instance was in.
+ * --- */
+func (c *Controller) Reboot(ctx aws.Context, selection Selection, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	t, err := c.prepare(ctx, selection, "running", "rebooted", nil)
+	if err != nil || len(t.report.Instances) == 0 {
+		return datamodels.StateChangeReport{}, "", err
+	}
+
+	states := make(map[string]string)
+	for _, instance := range t.report.Instances {
+		states[instance.InstanceID] = instance.InstanceState
+	}
+
+	c.printf("Rebooting instances...\n")
+	return c.changeState(ctx, t, "rebooted", "reboot_results", dryRun, func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		_, err := t.client.RebootInstancesWithContext(ctx, utils.CreateEC2RebootInstanceParams(ids, dryRun))
+		if err != nil {
+			return nil, err
+		}
+		changes := make([]*ec2.InstanceStateChange, 0)
+		for _, id := range ids {
+			state := &ec2.InstanceState{Name: aws.String(states[id])}
+			changes = append(changes, &ec2.InstanceStateChange{InstanceId: aws.String(id), PreviousState: state, CurrentState: state})
+		}
+		return changes, nil
+	})
+}
+
+/* ---
+ * Start the instances in a report.
+ * --- */
+func (c *Controller) StartFromReport(ctx aws.Context, path string, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	return c.Start(ctx, Selection{Report: path}, dryRun)
+}
+
+/* ---
+ * Stop the instances in a report.
+ * --- */
+func (c *Controller) StopFromReport(ctx aws.Context, path string, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	return c.Stop(ctx, Selection{Report: path}, dryRun)
+}
+
+/* ---
+ * Start every stopped instance in the region.
+ * --- */
+func (c *Controller) StartAll(ctx aws.Context, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	return c.Start(ctx, Selection{All: true}, dryRun)
+}
+
+/* ---
+ * Stop every running instance in the region.
+ * --- */
+func (c *Controller) StopAll(ctx aws.Context, dryRun bool) (datamodels.StateChangeReport, string, error) {
+	return c.Stop(ctx, Selection{All: true}, dryRun)
+}
+
+// Sends one start, stop or terminate request for a batch of instance IDs and
+// returns the state changes from the response.
+type stateChangeCall func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error)
+
+/* ---
+ * Run a state change on the target instances and print and write a report of
+ * the results. An error is returned if any instance failed. Dry runs write
+ * no report.
+ * --- */
+func (c *Controller) changeState(ctx aws.Context, t target, action, reportName string, dryRun bool, call stateChangeCall) (datamodels.StateChangeReport, string, error) {
+	report := datamodels.StateChangeReport{Metadata: c.metadata(t.region), Action: action}
+	results, err := c.sendStateChanges(ctx, t, dryRun, call)
+	if err != nil {
+		return report, "", c.done(err)
+	}
+	report.Results = results
+
+	utils.FprintStateChangeReport(c.Out, report)
+	// A dry run changes nothing, so there is nothing to record. This is
+	// only reached when no IDs were sent, e.g., when every ID is malformed.
+	outputFileName := ""
+	if !dryRun {
+		if outputFileName, err = utils.WriteJSONReport(c.ReportDir, t.region, reportName, report); err != nil {
+			return report, "", err
+		}
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("%d of %d instances could not be %s", failed, len(report.Results), action)
+	}
+	c.printf("Done!\n")
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Launch the instances described by a launch config file and write a launch
+ * report. Instances are launched in the config's region if it sets one.
+ * --- */
+func (c *Controller) Launch(ctx aws.Context, configPath string) (datamodels.EC2InstanceReport, string, error) {
+	report := datamodels.EC2InstanceReport{}
+	config, err := utils.LoadLaunchConfig(configPath)
+	if err != nil {
+		return report, "", err
+	}
+	region := c.Region
+	if config.Region != "" {
+		region = config.Region
+	}
+
+	// Tag instances from the start with who launched them, why, and the
+	// report that records them. The report name is fixed now so it can be
+	// tagged before the report is written.
+	now := time.Now()
+	tags, err := c.launchTags(config, now)
+	if err != nil {
+		return report, "", err
+	}
+
+	// Display launch request to user
+	c.printf("\nLaunch request details:\n")
+	c.printf("-----------------------\n\n")
+	c.printf("AMI Name: %s\nInstance type: %s\nRegion: %s\nCount: %d\n", config.AMIName, config.InstanceType, region, config.Count)
+	c.printf("Tags:\n")
+	for _, key := range []string{utils.TagName, utils.TagOwner, utils.TagProject, utils.TagExpiry, utils.TagCreatedBy, utils.TagLaunchReport} {
+		if tags[key] != "" {
+			c.printf("  %s: %s\n", key, tags[key])
+		}
+	}
+	if config.IdleStopAfter > 0 {
+		c.printf("Idle stop: when CPU is below %g%% for %s\n", config.IdleStopCPU, config.IdleStopAfter)
+	}
+	if config.AgentURL != "" {
+		c.printf("Agent: installed from %s, stopping after %s idle\n", config.AgentURL, config.Agent.IdleAfter)
+	}
+	if !c.confirm(ctx) {
+		return report, "", ErrAborted
+	}
+
+	// Create specified instances. The client token makes the request
+	// idempotent and lets us find the instances it created if we are
+	// interrupted before the response arrives.
+	clientToken, err := utils.NewClientToken()
+	if err != nil {
+		return report, "", err
+	}
+	client := c.clientFor(region)
+	createInstanceParams := utils.CreateEC2RunInstanceParams(config.AMIID, config.InstanceType, config.Count, clientToken, tags)
+	if config.InstanceProfile != "" {
+		createInstanceParams.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: aws.String(config.InstanceProfile)}
+	}
+	if config.AgentURL != "" {
+		createInstanceParams.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(utils.AgentUserData(config.AgentURL, config.Agent))))
+	}
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	runResponse, err := client.RunInstancesWithContext(callCtx, createInstanceParams)
+	if err != nil {
+		if callCtx.Err() != nil {
+			return c.writePartialLaunchReport(client, region, clientToken, now, err)
+		}
+		return report, "", err
+	}
+
+	// Generate a launch report and write it to disk.
+	report = utils.GetInstanceDetails(runResponse)
+	report.Metadata = c.metadata(region)
+	outputFileName, err := utils.WriteJSONReportAt(c.ReportDir, region, "launch_instance_details", report, now)
+	if err != nil {
+		return report, outputFileName, err
+	}
+	// The instances are running either way, so a missing alarm is only
+	// worth a warning.
+	if config.IdleStopAfter > 0 {
+		if err := c.installIdleAlarms(ctx, region, config, report); err != nil {
+			c.printf("Warning: %s\n", err)
+		}
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Work out the tags for a launch. The owner defaults to the caller's AWS
+ * identity and the expiry is stored as an absolute UTC time.
+ * --- */
+func (c *Controller) launchTags(config datamodels.LaunchConfig, now time.Time) (map[string]string, error) {
+	tags := map[string]string{
+		utils.TagName:         config.Name,
+		utils.TagOwner:        config.Owner,
+		utils.TagProject:      config.Project,
+		utils.TagCreatedBy:    fmt.Sprintf("mdibl_cloud_control %s", utils.ToolVersion),
+		utils.TagLaunchReport: utils.ReportFileName("launch_instance_details", now),
+	}
+	if tags[utils.TagOwner] == "" && c.CallerARN != "" {
+		tags[utils.TagOwner] = utils.OwnerFromARN(c.CallerARN)
+	}
+	if config.Expiry != "" {
+		expiry, err := utils.ParseExpiry(config.Expiry, now)
+		if err != nil {
+			return nil, err
+		}
+		tags[utils.TagExpiry] = expiry.UTC().Format(time.RFC3339)
+	}
+	return tags, nil
+}
+
+/* ---
+ * After a launch is interrupted or times out, find any instances the request
+ * created and write them to a partial launch report, under the name their
+ * LaunchReport tag gives. Uses a fresh context since the launch context is
+ * already done. Returns the original error.
+ * --- */
+func (c *Controller) writePartialLaunchReport(client ec2iface.EC2API, region, clientToken string, now time.Time, launchErr error) (datamodels.EC2InstanceReport, string, error) {
+	recoverCtx, cancel := context.WithTimeout(context.Background(), partialReportTimeout)
+	defer cancel()
+
+	params := utils.CreateEC2InstanceFilterParams("client-token", []string{clientToken})
+	report, err := utils.DescribeEC2Instances(recoverCtx, client, params)
+	if err != nil {
+		return report, "", fmt.Errorf("%s (unable to check for instances created by client token %s: %s)", launchErr, clientToken, err)
+	}
+	if len(report.Instances) == 0 {
+		return report, "", fmt.Errorf("%s (no instances were created)", launchErr)
+	}
+
+	report.Metadata = c.metadata(region)
+	outputFileName, err := utils.WriteJSONReportAt(c.ReportDir, region, "launch_instance_details", report, now)
+	if err != nil {
+		return report, "", fmt.Errorf("%s (%d instances were created but the partial launch report could not be written: %s)", launchErr, len(report.Instances), err)
+	}
+	return report, outputFileName, fmt.Errorf("%s (%d instances were created, partial launch report written to %s)", launchErr, len(report.Instances), outputFileName)
+}
+
+/* ---
+ * Work out which instances an operation acts on. allState is the state All
+ * selects; operations that do not support All pass "".
+ * --- */
+func (c *Controller) resolve(ctx aws.Context, selection Selection, allState string) (target, error) {
+	t := target{client: c.EC2, region: c.Region}
+
+	sources := 0
+	for _, given := range []bool{selection.Report != "", len(selection.Instances) > 0, selection.All} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 || (sources == 0 && len(selection.Filters) == 0) {
+		if allState == "" {
+			return t, fmt.Errorf("Specify either an instance report, instances or filters")
+		}
+		return t, fmt.Errorf("Specify exactly one of an instance report, instances or all, or filters")
+	}
+	filters, err := utils.ParseInstanceFilters(selection.Filters)
+	if err != nil {
+		return t, err
+	}
+
+	switch {
+	case selection.Report != "":
+		t.report, err = utils.LoadInstanceReport(selection.Report)
+		if err != nil {
+			return t, err
+		}
+
+		// Act in the region the report was created in.
+		t.region, err = utils.ReportRegion(t.report, c.Region, c.AccountID)
+		if err != nil {
+			return t, err
+		}
+		if t.report.Metadata == nil {
+			c.printf("Warning: report has no metadata, assuming region %s\n", c.Region)
+		} else if t.region != c.Region {
+			c.printf("Using region %s from instance report\n", t.region)
+		}
+		t.client = c.clientFor(t.region)
+
+	case len(selection.Instances) > 0:
+		t.report, err = c.DescribeNamedInstances(ctx, selection.Instances)
+
+	default:
+		states := []string{allState}
+		if !selection.All {
+			states = []string{"pending", "running", "shutting-down", "stopping", "stopped"}
+		}
+		params := utils.CreateEC2InstanceFilterParams("instance-state-name", states)
+		callCtx, cancel := c.callContext(ctx)
+		defer cancel()
+		t.report, err = utils.DescribeEC2Instances(callCtx, c.EC2, params)
+	}
+	if err != nil {
+		return t, err
+	}
+	t.report = utils.FilterInstanceReport(t.report, filters)
+	return t, nil
+}
+
+/* ---
+ * Look up instances by ID (i-...) or Name tag. Terminated instances are
+ * ignored when matching by name.
+ * --- */
+func (c *Controller) DescribeNamedInstances(ctx aws.Context, instances []string) (datamodels.EC2InstanceReport, error) {
+	ids := make([]string, 0)
+	names := make([]string, 0)
+	for _, instance := range instances {
+		if strings.HasPrefix(instance, "i-") {
+			ids = append(ids, instance)
+		} else {
+			names = append(names, instance)
+		}
+	}
+
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	reports := make([]datamodels.EC2InstanceReport, 0)
+	if len(ids) > 0 {
+		report, err := utils.DescribeEC2Instances(callCtx, c.EC2, utils.CreateEC2InstanceIDFilterParams(ids))
+		if err != nil {
+			return report, err
+		}
+		reports = append(reports, report)
+	}
+	if len(names) > 0 {
+		report, err := utils.DescribeEC2Instances(callCtx, c.EC2, utils.CreateEC2InstanceFilterParams("tag:Name", names))
+		if err != nil {
+			return report, err
+		}
+		filters, _ := utils.ParseInstanceFilters([]string{"state!=terminated"})
+		report = utils.FilterInstanceReport(report, filters)
+
+		// Every name must match at least one instance.
+		for _, name := range names {
+			found := false
+			for _, instance := range report.Instances {
+				found = found || instance.Name == name
+			}
+			if !found {
+				return report, fmt.Errorf("No instance named %s", name)
+			}
+		}
+		reports = append(reports, report)
+	}
+	return utils.MergeInstanceReports(reports, false)
+}
+
+/* ---
+ * Resolve the instances an operation acts on, run the operation's check on
+ * them (if any) and ask the user to confirm. Returns ErrAborted if the user
+ * declines. An empty report means there was nothing to act on.
+ * --- */
+func (c *Controller) prepare(ctx aws.Context, selection Selection, allState, action string, check func(ctx aws.Context, t target) error) (target, error) {
+	t, err := c.resolve(ctx, selection, allState)
+	if err != nil {
+		return t, err
+	}
+	if len(t.report.Instances) == 0 {
+		c.printf("No matching instances\n")
+		return t, nil
+	}
+	if check != nil {
+		if err := check(ctx, t); err != nil {
+			return t, err
+		}
+	}
+	if !c.confirmInstances(ctx, action, t.report) {
+		return t, ErrAborted
+	}
+	return t, nil
+}
+
+/* ---
+ * Send a state change for the target instances in batches and collect a
+ * result for every instance, in the order they were selected. When AWS
+ * rejects a batch because of particular instances (unknown IDs, wrong
+ * state), those instances are marked failed and the rest of the batch is
+ * sent again. Malformed IDs are marked failed without being sent. For a dry
+ * run the first response is returned as the error.
+ * --- */
+func (c *Controller) sendStateChanges(ctx aws.Context, t target, dryRun bool, call stateChangeCall) ([]datamodels.InstanceStateResult, error) {
+	results := make(map[string]datamodels.InstanceStateResult)
+	fail := func(ids []string, err error) {
+		for _, id := range ids {
+			results[id] = datamodels.InstanceStateResult{InstanceID: id, Error: utils.ErrorSummary(err)}
+		}
+	}
+
+	ids := instanceIDs(t.report)
+	valid, malformed := utils.SplitMalformedInstanceIDs(ids)
+	for _, id := range malformed {
+		results[id] = datamodels.InstanceStateResult{InstanceID: id, Error: fmt.Sprintf("malformed instance ID %q", id)}
+	}
+	for _, batch := range utils.BatchInstanceIDs(valid, utils.InstanceBatchSize) {
+		remaining := batch
+		for len(remaining) > 0 {
+			if ctx.Err() != nil {
+				fail(remaining, ctx.Err())
+				break
+			}
+
+			callCtx, cancel := c.callContext(ctx)
+			changes, err := call(callCtx, remaining)
+			cancel()
+			if err == nil {
+				for id, result := range utils.ParseStateChanges(changes) {
+					results[id] = result
+				}
+				break
+			}
+			if dryRun {
+				return nil, err
+			}
+
+			// Drop the instances AWS named and try the rest again.
+			failed := make(map[string]bool)
+			for _, id := range utils.FailedInstanceIDs(err) {
+				failed[id] = true
+			}
+			retry := make([]string, 0)
+			for _, id := range remaining {
+				if failed[id] {
+					fail([]string{id}, err)
+				} else {
+					retry = append(retry, id)
+				}
+			}
+			if len(retry) == len(remaining) {
+				fail(remaining, err)
+				break
+			}
+			remaining = retry
+		}
+	}
+
+	names := make(map[string]string)
+	for _, instance := range t.report.Instances {
+		names[instance.InstanceID] = instance.Name
+	}
+	ordered := make([]datamodels.InstanceStateResult, 0, len(ids))
+	for _, id := range ids {
+		result, ok := results[id]
+		if !ok {
+			result = datamodels.InstanceStateResult{InstanceID: id, Error: "no state change returned"}
+		}
+		result.Name = names[id]
+		ordered = append(ordered, result)
+	}
+	return ordered, nil
+}
+
+/* ---
+ * Start, stop or terminate the target instances without prompting or
+ * printing, for operations that report results their own way. Returns
+ * errors by instance ID.
+ * --- */
+func (c *Controller) applyAction(ctx aws.Context, t target, action string) map[string]string {
+	call := func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		output, err := t.client.StopInstancesWithContext(ctx, utils.CreateEC2StopInstanceParams(ids, false, false, false))
+		if err != nil {
+			return nil, err
+		}
+		return output.StoppingInstances, nil
+	}
+	switch action {
+	case "start":
+		call = func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+			output, err := t.client.StartInstancesWithContext(ctx, utils.CreateEC2StartInstanceParams(ids, false))
+			if err != nil {
+				return nil, err
+			}
+			return output.StartingInstances, nil
+		}
+	case "terminate":
+		call = func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+			output, err := t.client.TerminateInstancesWithContext(ctx, utils.CreateEC2TerminateInstanceParams(ids, false))
+			if err != nil {
+				return nil, err
+			}
+			return output.TerminatingInstances, nil
+		}
+	}
+
+	errs := make(map[string]string)
+	results, err := c.sendStateChanges(ctx, t, false, call)
+	if err != nil {
+		for _, id := range instanceIDs(t.report) {
+			errs[id] = utils.ErrorSummary(err)
+		}
+		return errs
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			errs[result.InstanceID] = result.Error
+		}
+	}
+	return errs
+}
+
+/* ---
+ * Make sure every target instance was launched with hibernation enabled;
+ * AWS can not hibernate other instances.
+ * --- */
+func (c *Controller) checkHibernation(ctx aws.Context, t target) error {
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	notConfigured, err := utils.HibernationNotConfigured(callCtx, t.client, instanceIDs(t.report))
+	if err != nil {
+		return err
+	}
+	if len(notConfigured) > 0 {
+		return fmt.Errorf("Hibernation is not enabled for instances: %s", strings.Join(notConfigured, ", "))
+	}
+	return nil
+}
+
+/* ---
+ * Finish an operation. A successful dry run is reported by AWS as a
+ * DryRunOperation error.
+ * --- */
+func (c *Controller) done(err error) error {
+	if err != nil && !strings.Contains(err.Error(), "DryRunOperation") {
+		return err
+	}
+	c.printf("Done!\n")
+	return nil
+}
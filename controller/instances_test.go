@@ -0,0 +1,289 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+/* ---
+ * A target holding count instances with IDs i-000 upwards.
+ * --- */
+func testTarget(client *fakeEC2, count int) target {
+	report := datamodels.EC2InstanceReport{}
+	for idx := 0; idx < count; idx++ {
+		id := fmt.Sprintf("i-%03x", idx)
+		report.Instances = append(report.Instances, datamodels.EC2InstanceDetails{InstanceID: id, Name: "node" + id})
+	}
+	return target{report: report, client: client, region: "us-east-1"}
+}
+
+func startCall(tgt target, dryRun bool) stateChangeCall {
+	return func(ctx aws.Context, ids []string) ([]*ec2.InstanceStateChange, error) {
+		output, err := tgt.client.StartInstancesWithContext(ctx, utils.CreateEC2StartInstanceParams(ids, dryRun))
+		if err != nil {
+			return nil, err
+		}
+		return output.StartingInstances, nil
+	}
+}
+
+func TestSendStateChangesBatches(t *testing.T) {
+	client := &fakeEC2{}
+	c, _ := newTestController(t, client, "")
+	tgt := testTarget(client, 450)
+
+	results, err := c.sendStateChanges(aws.BackgroundContext(), tgt, false, startCall(tgt, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make([]int, 0)
+	for _, call := range client.startCalls {
+		sizes = append(sizes, len(call))
+	}
+	if fmt.Sprint(sizes) != "[200 200 50]" {
+		t.Errorf("got batches of %v, want [200 200 50]", sizes)
+	}
+	if len(results) != 450 {
+		t.Fatalf("got %d results, want 450", len(results))
+	}
+	for idx, result := range results {
+		if result.InstanceID != tgt.report.Instances[idx].InstanceID || result.Name != tgt.report.Instances[idx].Name {
+			t.Fatalf("result %d is for %s (%s), want selection order", idx, result.InstanceID, result.Name)
+		}
+		if result.Error != "" || result.CurrentState != "pending" {
+			t.Fatalf("result %d: got state %q error %q", idx, result.CurrentState, result.Error)
+		}
+	}
+}
+
+func TestSendStateChangesRetriesWithoutFailedInstances(t *testing.T) {
+	client := &fakeEC2{}
+	client.startErr = func(ids []string) error {
+		for _, id := range ids {
+			if id == "i-001" || id == "i-003" {
+				return awserr.New("IncorrectInstanceState", "The instances 'i-001, i-003' are not in a state from which they can be started.", nil)
+			}
+		}
+		return nil
+	}
+	c, _ := newTestController(t, client, "")
+	tgt := testTarget(client, 5)
+	tgt.report.Instances = append(tgt.report.Instances, datamodels.EC2InstanceDetails{InstanceID: "web-1"})
+
+	results, err := c.sendStateChanges(aws.BackgroundContext(), tgt, false, startCall(tgt, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.startCalls) != 2 || fmt.Sprint(client.startCalls[1]) != "[i-000 i-002 i-004]" {
+		t.Errorf("got calls %v, want a retry with [i-000 i-002 i-004]", client.startCalls)
+	}
+	for _, call := range client.startCalls {
+		for _, id := range call {
+			if id == "web-1" {
+				t.Errorf("malformed ID sent to AWS: %v", call)
+			}
+		}
+	}
+
+	failed := make(map[string]string)
+	for _, result := range results {
+		if result.Error != "" {
+			failed[result.InstanceID] = result.Error
+		}
+	}
+	if len(failed) != 3 {
+		t.Errorf("got failures %v, want i-001, i-003 and web-1", failed)
+	}
+	if !strings.Contains(failed["i-001"], "IncorrectInstanceState") {
+		t.Errorf("i-001: got error %q", failed["i-001"])
+	}
+	if !strings.Contains(failed["web-1"], "malformed instance ID") {
+		t.Errorf("web-1: got error %q", failed["web-1"])
+	}
+}
+
+func TestSendStateChangesFailsWholeBatch(t *testing.T) {
+	client := &fakeEC2{}
+	client.startErr = func(ids []string) error {
+		return awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	}
+	c, _ := newTestController(t, client, "")
+	tgt := testTarget(client, 3)
+
+	results, err := c.sendStateChanges(aws.BackgroundContext(), tgt, false, startCall(tgt, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.startCalls) != 1 {
+		t.Errorf("got %d calls, want 1 with no retry", len(client.startCalls))
+	}
+	for _, result := range results {
+		if !strings.Contains(result.Error, "UnauthorizedOperation") {
+			t.Errorf("%s: got error %q", result.InstanceID, result.Error)
+		}
+	}
+}
+
+func TestSendStateChangesDryRun(t *testing.T) {
+	client := &fakeEC2{}
+	client.startErr = func(ids []string) error {
+		return awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+	}
+	c, _ := newTestController(t, client, "")
+	tgt := testTarget(client, 3)
+
+	_, err := c.sendStateChanges(aws.BackgroundContext(), tgt, true, startCall(tgt, true))
+	if err == nil || !strings.Contains(err.Error(), "DryRunOperation") {
+		t.Errorf("got error %v, want the DryRunOperation response", err)
+	}
+	if c.done(err) != nil {
+		t.Errorf("a passed dry run should not be an error")
+	}
+}
+
+func TestChangeStateDryRunWritesNoReport(t *testing.T) {
+	client := &fakeEC2{}
+	c, out := newTestController(t, client, "")
+	tgt := testTarget(client, 0)
+	tgt.report.Instances = []datamodels.EC2InstanceDetails{{InstanceID: "i-XYZ", Name: "typo"}, {InstanceID: "analysis", Name: "name"}}
+
+	_, outputFileName, err := c.changeState(aws.BackgroundContext(), tgt, "started", "start_results", true, startCall(tgt, true))
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 instances could not be started") {
+		t.Errorf("got error %v, want the malformed IDs reported", err)
+	}
+	if len(client.startCalls) != 0 {
+		t.Errorf("got start calls %v, want none", client.startCalls)
+	}
+	if !strings.Contains(out.String(), `malformed instance ID "i-XYZ"`) {
+		t.Errorf("malformed IDs not printed: %q", out.String())
+	}
+	if reports, _ := filepath.Glob(filepath.Join(c.ReportDir, "*", "*", "start_results_*.json")); outputFileName != "" || len(reports) != 0 {
+		t.Errorf("dry run wrote %q %v", outputFileName, reports)
+	}
+}
+
+func TestLaunchWritesPartialReportUnderTaggedName(t *testing.T) {
+	client := &fakeEC2{}
+	client.runInstances = func(ctx aws.Context, input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		// Create the instances but time out before the response arrives.
+		instance := newInstance("i-0a", "analysis", "pending", nil)
+		instance.ClientToken = input.ClientToken
+		for _, spec := range input.TagSpecifications {
+			instance.Tags = append(instance.Tags, spec.Tags...)
+		}
+		client.mu.Lock()
+		client.instances = append(client.instances, instance)
+		client.mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client.instances = []*ec2.Instance{newInstance("i-0b", "other", "running", nil)}
+	c, _ := newTestController(t, client, "")
+	c.AssumeYes = true
+	c.Timeout = 50 * time.Millisecond
+
+	configPath := filepath.Join(t.TempDir(), "instance.config")
+	config := "[instance]\nami_id=ami-0123\ninstance_type=t3.micro\ncount=1\nname=analysis\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, outputFileName, err := c.Launch(aws.BackgroundContext(), configPath)
+	if err == nil || !strings.Contains(err.Error(), "1 instances were created") {
+		t.Fatalf("got error %v, want the timeout with the instances created", err)
+	}
+	if ids := instanceIDs(report); len(ids) != 1 || ids[0] != "i-0a" {
+		t.Fatalf("got instances %v, want [i-0a]", ids)
+	}
+	if outputFileName == "" {
+		t.Fatal("no partial report written")
+	}
+	if tag := report.Instances[0].Tags[utils.TagLaunchReport]; tag != filepath.Base(outputFileName) {
+		t.Errorf("report written to %s but instances are tagged %s", filepath.Base(outputFileName), tag)
+	}
+	saved, err := utils.LoadInstanceReport(outputFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Instances) != 1 || saved.Metadata == nil || saved.Metadata.Region != "us-east-1" {
+		t.Errorf("partial report: got %+v", saved)
+	}
+}
+
+func TestLaunchAborted(t *testing.T) {
+	client := &fakeEC2{}
+	client.runInstances = func(ctx aws.Context, input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		t.Error("instances launched after the user declined")
+		return &ec2.Reservation{}, nil
+	}
+	c, out := newTestController(t, client, "n\n")
+
+	configPath := filepath.Join(t.TempDir(), "instance.config")
+	config := "[instance]\nami_id=ami-0123\ninstance_type=t3.micro\ncount=2\nname=analysis\nexpiry=7d\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Launch(aws.BackgroundContext(), configPath); err != ErrAborted {
+		t.Errorf("got error %v, want ErrAborted", err)
+	}
+	for _, want := range []string{"Count: 2", "Name: analysis", "Expiry: ", "LaunchReport: launch_instance_details_"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("launch request does not show %q: %q", want, out.String())
+		}
+	}
+}
+
+// A CloudWatch client whose alarm calls fail.
+type failingCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	alarms int
+}
+
+func (f *failingCloudWatch) PutMetricAlarmWithContext(ctx aws.Context, input *cloudwatch.PutMetricAlarmInput, opts ...request.Option) (*cloudwatch.PutMetricAlarmOutput, error) {
+	f.alarms++
+	return nil, awserr.New("AccessDenied", "User is not authorized to perform: cloudwatch:PutMetricAlarm", nil)
+}
+
+func TestLaunchWarnsWhenIdleAlarmsFail(t *testing.T) {
+	client := &fakeEC2{}
+	client.runInstances = func(ctx aws.Context, input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+		return &ec2.Reservation{Instances: []*ec2.Instance{newInstance("i-0a", "analysis", "pending", nil)}}, nil
+	}
+	c, out := newTestController(t, client, "")
+	cloudWatch := &failingCloudWatch{}
+	c.CloudWatch = cloudWatch
+	c.AssumeYes = true
+
+	configPath := filepath.Join(t.TempDir(), "instance.config")
+	config := "[instance]\nami_id=ami-0123\ninstance_type=t3.micro\ncount=1\nname=analysis\nidle_stop_after=2h\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, outputFileName, err := c.Launch(aws.BackgroundContext(), configPath)
+	if err != nil {
+		t.Fatalf("got error %v, want the launch to succeed", err)
+	}
+	if len(report.Instances) != 1 || outputFileName == "" {
+		t.Errorf("got %d instances written to %q, want the launch report", len(report.Instances), outputFileName)
+	}
+	if cloudWatch.alarms != 1 {
+		t.Errorf("got %d alarm calls, want 1", cloudWatch.alarms)
+	}
+	if !strings.Contains(out.String(), "Warning: 1 of 1 instances have no idle stop alarm") {
+		t.Errorf("no warning printed: %q", out.String())
+	}
+}
@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/notify"
+	"mdibl_cloud_control/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+/* ---
+ * What the reaper does. Action ("stop" or "terminate") is applied to expired
+ * instances unless their ExpiryAction tag says otherwise; owners are warned
+ * through Notifier (written to Out if nil) when their instances expire
+ * within WarnBefore. Now is the time to reap at (the current time if zero).
+ * --- */
+type ReapOptions struct {
+	Action     string
+	WarnBefore time.Duration
+	DryRun     bool
+	Notifier   notify.Notifier
+	Now        time.Time
+}
+
+/* ---
+ * Find instances with an Expiry tag, warn the owners of those expiring soon
+ * and stop or terminate those that have expired. An instance is only
+ * terminated once its owner has been warned about its current expiry at
+ * least WarnBefore earlier; until then it is warned about instead. Meant to
+ * run unattended (with AssumeYes) from cron. Writes a report of the actions
+ * taken.
+ * --- */
+func (c *Controller) Reap(ctx aws.Context, options ReapOptions) (datamodels.ReaperReport, string, error) {
+	report := datamodels.ReaperReport{Metadata: c.metadata(c.Region), DryRun: options.DryRun, Entries: make([]datamodels.ReaperEntry, 0)}
+	if err := utils.ValidateReaperAction(options.Action); err != nil {
+		return report, "", err
+	}
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	notifier := options.Notifier
+	if notifier == nil {
+		notifier = &notify.Log{W: c.Out}
+	}
+
+	// Only instances that carry an expiry are considered.
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	instances, err := utils.DescribeEC2Instances(callCtx, c.EC2, utils.CreateEC2InstanceFilterParams("tag-key", []string{utils.TagExpiry}))
+	if err != nil {
+		return report, "", err
+	}
+
+	planned := make(map[string][]datamodels.EC2InstanceDetails)
+	for _, instance := range instances.Instances {
+		entry := datamodels.ReaperEntry{
+			InstanceID: instance.InstanceID,
+			Name:       instance.Name,
+			Owner:      instance.Tags[utils.TagOwner],
+			Expiry:     instance.Tags[utils.TagExpiry],
+			State:      instance.InstanceState,
+		}
+		expiry, err := utils.ParseExpiryTime(entry.Expiry)
+		if err != nil {
+			c.printf("Warning: skipping %s: %s\n", instance.InstanceID, err)
+			continue
+		}
+
+		action := reaperAction(instance, options.Action)
+		switch {
+		case !expiry.After(now):
+			// Already in (or heading to) the state the action would leave it in.
+			if instance.InstanceState == "terminated" || instance.InstanceState == "shutting-down" ||
+				(action == "stop" && (instance.InstanceState == "stopped" || instance.InstanceState == "stopping")) {
+				continue
+			}
+			entry.Action = action
+
+			// Termination can not be undone, so the owner must have had a
+			// warning, and the time to act on it, first.
+			if action == "terminate" {
+				warnedAt, warned := expiryWarnedAt(instance)
+				if !warned {
+					entry.Action = "warn"
+				} else if warnedAt.Add(options.WarnBefore).After(now) {
+					continue
+				}
+			}
+		case expiry.Sub(now) <= options.WarnBefore && instance.Tags[utils.TagExpiryWarned] != entry.Expiry:
+			if instance.InstanceState == "terminated" || instance.InstanceState == "shutting-down" {
+				continue
+			}
+			entry.Action = "warn"
+		default:
+			continue
+		}
+		report.Entries = append(report.Entries, entry)
+		planned[entry.Action] = append(planned[entry.Action], instance)
+	}
+
+	if len(report.Entries) == 0 {
+		c.printf("No instances have expired or are about to expire\n")
+		return report, "", nil
+	}
+
+	title := "Reaper actions:"
+	if options.DryRun {
+		title = "Reaper actions (dry run, nothing will be changed):"
+	}
+	c.printf("\n%s\n%s\n\n", title, strings.Repeat("-", len(title)))
+	utils.FprintReaperReport(c.Out, report)
+	if options.DryRun {
+		return report, "", nil
+	}
+	if !c.confirm(ctx) {
+		return report, "", ErrAborted
+	}
+
+	errs := make(map[string]string)
+	c.warnOwners(ctx, notifier, planned["warn"], now, options.WarnBefore, errs)
+	for _, action := range []string{"stop", "terminate"} {
+		c.reapInstances(ctx, action, planned[action], errs)
+	}
+	c.noticeReaped(ctx, notifier, planned, errs)
+	for idx := range report.Entries {
+		report.Entries[idx].Error = errs[report.Entries[idx].InstanceID]
+	}
+
+	c.printf("\nResults\n-------\n")
+	utils.FprintReaperReport(c.Out, report)
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, c.Region, "reaper", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("%d of %d reaper actions failed", failed, len(report.Entries))
+	}
+	c.printf("Done!\n")
+	return report, outputFileName, nil
+}
+
+/* ---
+ * The action for an expired instance: its ExpiryAction tag if valid, or the
+ * reaper's default.
+ * --- */
+func reaperAction(instance datamodels.EC2InstanceDetails, defaultAction string) string {
+	action := strings.ToLower(instance.Tags[utils.TagExpiryAction])
+	if utils.ValidateReaperAction(action) == nil {
+		return action
+	}
+	return defaultAction
+}
+
+/* ---
+ * When the owner of an instance was warned about its current expiry. False
+ * if they were not, or the time of the warning was not recorded.
+ * --- */
+func expiryWarnedAt(instance datamodels.EC2InstanceDetails) (time.Time, bool) {
+	if instance.Tags[utils.TagExpiryWarned] != instance.Tags[utils.TagExpiry] {
+		return time.Time{}, false
+	}
+	warnedAt, err := time.Parse(time.RFC3339, instance.Tags[utils.TagExpiryWarnedAt])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return warnedAt, true
+}
+
+/* ---
+ * Send each owner one warning listing their expiring instances, then tag
+ * the instances with the expiry and time they were warned about so they
+ * are not warned again for the same expiry. Instances that have already
+ * expired are reaped no sooner than warnBefore after the warning.
+ * --- */
+func (c *Controller) warnOwners(ctx aws.Context, notifier notify.Notifier, instances []datamodels.EC2InstanceDetails, now time.Time, warnBefore time.Duration, errs map[string]string) {
+	for owner, owned := range groupByOwner(instances) {
+		lines := make([]string, 0)
+		for _, instance := range owned {
+			line := fmt.Sprintf("  %s (%s) expires %s", instance.Name, instance.InstanceID, instance.Tags[utils.TagExpiry])
+			if expiry, err := utils.ParseExpiryTime(instance.Tags[utils.TagExpiry]); err == nil && !expiry.After(now) {
+				line = fmt.Sprintf("  %s (%s) expired %s and will be reaped after %s", instance.Name, instance.InstanceID,
+					instance.Tags[utils.TagExpiry], now.Add(warnBefore).UTC().Format(time.RFC3339))
+			}
+			lines = append(lines, line)
+		}
+		message := notify.Message{
+			Owner:   owner,
+			Subject: fmt.Sprintf("%d EC2 instances in %s expire soon", len(owned), c.Region),
+			Body: fmt.Sprintf("The following instances will be acted on by the reaper when they expire:\n\n%s\n\n"+
+				"To keep them, change their %s tag, e.g.:\n  mdibl_cloud_control tags add --instance <id> --tag %s=<date>\n",
+				strings.Join(lines, "\n"), utils.TagExpiry, utils.TagExpiry),
+		}
+		if err := notifier.Notify(ctx, message); err != nil {
+			for _, instance := range owned {
+				errs[instance.InstanceID] = fmt.Sprintf("warning not sent: %s", err)
+			}
+			continue
+		}
+
+		for _, instance := range owned {
+			callCtx, cancel := c.callContext(ctx)
+			_, err := c.EC2.CreateTagsWithContext(callCtx, utils.CreateEC2SetTagsParams([]string{instance.InstanceID}, map[string]string{
+				utils.TagExpiryWarned:   instance.Tags[utils.TagExpiry],
+				utils.TagExpiryWarnedAt: now.UTC().Format(time.RFC3339),
+			}))
+			cancel()
+			if err != nil {
+				errs[instance.InstanceID] = fmt.Sprintf("warned but not tagged: %s", utils.ErrorSummary(err))
+			}
+		}
+	}
+}
+
+/* ---
+ * Stop or terminate expired instances, recording any failures.
+ * --- */
+func (c *Controller) reapInstances(ctx aws.Context, action string, instances []datamodels.EC2InstanceDetails, errs map[string]string) {
+	if len(instances) == 0 {
+		return
+	}
+	t := target{
+		report: datamodels.EC2InstanceReport{SchemaVersion: datamodels.EC2InstanceReportSchemaVersion, Instances: instances},
+		client: c.EC2,
+		region: c.Region,
+	}
+	for id, err := range c.applyAction(ctx, t, action) {
+		errs[id] = err
+	}
+}
+
+/* ---
+ * Tell owners which of their instances the reaper stopped or terminated.
+ * --- */
+func (c *Controller) noticeReaped(ctx aws.Context, notifier notify.Notifier, planned map[string][]datamodels.EC2InstanceDetails, errs map[string]string) {
+	reaped := make([]datamodels.EC2InstanceDetails, 0)
+	actions := make(map[string]string)
+	for _, action := range []string{"stop", "terminate"} {
+		for _, instance := range planned[action] {
+			if errs[instance.InstanceID] == "" {
+				reaped = append(reaped, instance)
+				actions[instance.InstanceID] = action
+			}
+		}
+	}
+
+	for owner, owned := range groupByOwner(reaped) {
+		lines := make([]string, 0)
+		for _, instance := range owned {
+			verb := "stopped"
+			if actions[instance.InstanceID] == "terminate" {
+				verb = "terminated"
+			}
+			lines = append(lines, fmt.Sprintf("  %s (%s) %s, expired %s", instance.Name, instance.InstanceID, verb, instance.Tags[utils.TagExpiry]))
+		}
+		message := notify.Message{
+			Owner:   owner,
+			Subject: fmt.Sprintf("%d expired EC2 instances in %s were reaped", len(owned), c.Region),
+			Body:    fmt.Sprintf("The following instances passed their expiry:\n\n%s\n", strings.Join(lines, "\n")),
+		}
+		if err := notifier.Notify(ctx, message); err != nil {
+			c.printf("Warning: unable to notify %s: %s\n", owner, err)
+		}
+	}
+}
+
+/* ---
+ * Group instances by their Owner tag. Instances without one are grouped
+ * under "unknown".
+ * --- */
+func groupByOwner(instances []datamodels.EC2InstanceDetails) map[string][]datamodels.EC2InstanceDetails {
+	owners := make(map[string][]datamodels.EC2InstanceDetails)
+	for _, instance := range instances {
+		owner := instance.Tags[utils.TagOwner]
+		if owner == "" {
+			owner = "unknown"
+		}
+		owners[owner] = append(owners[owner], instance)
+	}
+	for _, owned := range owners {
+		sort.Slice(owned, func(i, j int) bool { return owned[i].InstanceID < owned[j].InstanceID })
+	}
+	return owners
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"mdibl_cloud_control/notify"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Records the messages it is asked to send, failing them all if err is set.
+type fakeNotifier struct {
+	messages []notify.Message
+	err      error
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, message notify.Message) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func TestReapWarnsBeforeTerminating(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	client := &fakeEC2{instances: []*ec2.Instance{
+		// Already expired when the reaper first sees it.
+		newInstance("i-01", "analysis", "running", map[string]string{
+			utils.TagOwner:  "jsmith",
+			utils.TagExpiry: start.Add(-time.Hour).Format(time.RFC3339),
+		}),
+	}}
+	c, _ := newTestController(t, client, "")
+	c.AssumeYes = true
+	notifier := &fakeNotifier{}
+	reap := func(now time.Time) []string {
+		report, _, err := c.Reap(aws.BackgroundContext(), ReapOptions{Action: "terminate", WarnBefore: 24 * time.Hour, Notifier: notifier, Now: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions := make([]string, 0)
+		for _, entry := range report.Entries {
+			actions = append(actions, entry.Action)
+		}
+		return actions
+	}
+
+	if actions := reap(start); len(actions) != 1 || actions[0] != "warn" {
+		t.Fatalf("first run: got actions %v, want [warn]", actions)
+	}
+	if len(notifier.messages) != 1 || !strings.Contains(notifier.messages[0].Body, "will be reaped after") {
+		t.Errorf("first run: got messages %+v", notifier.messages)
+	}
+
+	// Within the warning window of the warning nothing more happens.
+	if actions := reap(start.Add(time.Hour)); len(actions) != 0 {
+		t.Errorf("second run: got actions %v, want none", actions)
+	}
+	if len(client.terminateCalls) != 0 {
+		t.Fatalf("terminated before the owner had time to act: %v", client.terminateCalls)
+	}
+
+	if actions := reap(start.Add(25 * time.Hour)); len(actions) != 1 || actions[0] != "terminate" {
+		t.Errorf("third run: got actions %v, want [terminate]", actions)
+	}
+	if len(client.terminateCalls) != 1 {
+		t.Errorf("got terminate calls %v, want one", client.terminateCalls)
+	}
+}
+
+func TestReapFailedWarningDelaysTermination(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	client := &fakeEC2{instances: []*ec2.Instance{
+		newInstance("i-01", "analysis", "running", map[string]string{
+			utils.TagOwner:        "jsmith",
+			utils.TagExpiry:       start.Add(time.Hour).Format(time.RFC3339),
+			utils.TagExpiryAction: "terminate",
+		}),
+	}}
+	c, _ := newTestController(t, client, "")
+	c.AssumeYes = true
+	notifier := &fakeNotifier{err: errors.New("mail server down")}
+
+	report, _, err := c.Reap(aws.BackgroundContext(), ReapOptions{Action: "stop", WarnBefore: 24 * time.Hour, Notifier: notifier, Now: start})
+	if err == nil || len(report.Entries) != 1 || !strings.Contains(report.Entries[0].Error, "warning not sent") {
+		t.Fatalf("got %+v (%v), want a failed warning", report.Entries, err)
+	}
+
+	// Past the expiry the warning is sent again instead of terminating.
+	notifier.err = nil
+	report, _, err = c.Reap(aws.BackgroundContext(), ReapOptions{Action: "stop", WarnBefore: 24 * time.Hour, Notifier: notifier, Now: start.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Action != "warn" || len(client.terminateCalls) != 0 {
+		t.Errorf("got %+v with terminate calls %v, want a warning only", report.Entries, client.terminateCalls)
+	}
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Default number of instances worked on at once over SSH.
+const DefaultParallel = 10
+
+/* ---
+ * Get the selected running instances as SSH hosts, with the user and key
+ * file for each worked out as for report export. Instances that can not be
+ * reached over SSH are reported and left out.
+ * --- */
+func (c *Controller) sshHosts(ctx aws.Context, selection Selection, options datamodels.ExportOptions) ([]datamodels.ExportHost, string, error) {
+	t, err := c.resolve(ctx, selection, "running")
+	if err != nil {
+		return nil, "", err
+	}
+	running := datamodels.EC2InstanceReport{SchemaVersion: t.report.SchemaVersion}
+	for _, instance := range t.report.Instances {
+		if instance.InstanceState == "running" {
+			running.Instances = append(running.Instances, instance)
+		} else {
+			c.printf("Skipping %s (%s): %s\n", instance.Name, instance.InstanceID, instance.InstanceState)
+		}
+	}
+
+	imageUsers := make(map[string]string)
+	if options.User == "" {
+		if imageUsers, err = c.imageSSHUsers(ctx, t.region, running); err != nil {
+			c.printf("Warning: unable to describe AMIs, using %s for instances without an %s tag: %s\n", utils.DefaultSSHUser, utils.TagSSHUser, utils.ErrorSummary(err))
+		}
+	}
+	hosts := make([]datamodels.ExportHost, 0)
+	for _, host := range utils.ExportHosts(running, imageUsers, options) {
+		if !utils.Exportable("ssh-config", host) {
+			c.printf("Skipping %s (%s): no address or SSH access\n", host.Instance.Name, host.Instance.InstanceID)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, t.region, nil
+}
+
+/* ---
+ * Call fn for each host with at most parallel calls running at once. Hosts
+ * not yet started when ctx is cancelled are skipped.
+ * --- */
+func forEachHost(ctx aws.Context, hosts []datamodels.ExportHost, parallel int, fn func(idx int, host datamodels.ExportHost)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for idx, host := range hosts {
+		select {
+		case <-ctx.Done():
+			return
+		case slots <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		wg.Add(1)
+		go func(idx int, host datamodels.ExportHost) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fn(idx, host)
+		}(idx, host)
+	}
+}
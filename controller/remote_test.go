@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func testHosts(count int) []datamodels.ExportHost {
+	hosts := make([]datamodels.ExportHost, 0, count)
+	for idx := 0; idx < count; idx++ {
+		hosts = append(hosts, datamodels.ExportHost{Alias: fmt.Sprintf("node-%d", idx)})
+	}
+	return hosts
+}
+
+func TestForEachHostLimitsParallelism(t *testing.T) {
+	var mu sync.Mutex
+	running, most := 0, 0
+	seen := make(map[int]bool)
+	forEachHost(aws.BackgroundContext(), testHosts(12), 3, func(idx int, host datamodels.ExportHost) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		seen[idx] = true
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	if most != 3 {
+		t.Errorf("got at most %d hosts at once, want 3", most)
+	}
+	if len(seen) != 12 {
+		t.Errorf("ran on %d hosts, want 12", len(seen))
+	}
+}
+
+func TestForEachHostStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	ran := 0
+	forEachHost(ctx, testHosts(10), 2, func(idx int, host datamodels.ExportHost) {
+		mu.Lock()
+		ran++
+		if ran == 2 {
+			cancel()
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	})
+	if ran > 2 {
+		t.Errorf("ran on %d hosts after the context was cancelled, want at most 2", ran)
+	}
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+/* ---
+ * Compare a baseline report against the instances currently in the
+ * baseline's region and write a drift report. Only live instances matching
+ * the scope filter expressions count as extra; with no scope, the Project
+ * and Owner tags shared by all the baseline's instances are used, and the
+ * whole region only if they share neither.
+ * --- */
+func (c *Controller) Diff(ctx aws.Context, baselinePath string, scope []string) (datamodels.DriftReport, string, error) {
+	drift := datamodels.DriftReport{}
+	baseline, err := utils.LoadInstanceReport(baselinePath)
+	if err != nil {
+		return drift, "", err
+	}
+	if len(scope) == 0 {
+		if scope = utils.DefaultDiffScope(baseline); len(scope) == 0 {
+			c.printf("Warning: baseline instances share no Project or Owner tag, every instance in the region not in the baseline is extra\n")
+		}
+	}
+	filters, err := utils.ParseInstanceFilters(scope)
+	if err != nil {
+		return drift, "", err
+	}
+
+	// Compare in the region the baseline was created in.
+	region, err := utils.ReportRegion(baseline, c.Region, c.AccountID)
+	if err != nil {
+		return drift, "", err
+	}
+
+	// Terminated instances count as missing.
+	params := utils.CreateEC2InstanceFilterParams("instance-state-name", []string{"pending", "running", "shutting-down", "stopping", "stopped"})
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	live, err := utils.DescribeEC2Instances(callCtx, c.clientFor(region), params)
+	if err != nil {
+		return drift, "", err
+	}
+
+	drift = utils.DiffInstanceReports(baseline, live, filters)
+	drift.Metadata = c.metadata(region)
+	drift.Baseline = baselinePath
+	drift.Scope = scope
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, region, "drift_report", drift)
+	return drift, outputFileName, err
+}
+
+/* ---
+ * List the instances in a report and let the user pick some by index.
+ * --- */
+func (c *Controller) SelectInstances(ctx aws.Context, report datamodels.EC2InstanceReport) (datamodels.EC2InstanceReport, error) {
+	c.printf("\nInstances in report:\n")
+	c.printf("--------------------\n\n")
+	for idx, instance := range report.Instances {
+		c.printf("%3d) Name: %s, ID: %s, Instance type: %s, State: %s\n", idx+1, instance.Name, instance.InstanceID, instance.InstanceType, instance.InstanceState)
+	}
+	c.printf("\nSelect instances (e.g., 1 3 5-7 or all): ")
+	response, err := c.readLine(ctx)
+	if err != nil {
+		return report, err
+	}
+	indexes, err := utils.ParseIndexSelection(response, len(report.Instances))
+	if err != nil {
+		return report, err
+	}
+	return utils.SelectInstanceReport(report, indexes), nil
+}
+
+/* ---
+ * Write a report derived from another report. It goes in the directory of
+ * the region the source report describes, or the controller's region if the
+ * source has no metadata.
+ * --- */
+func (c *Controller) WriteDerivedReport(report datamodels.EC2InstanceReport, reportType string) (string, error) {
+	region := c.Region
+	if report.Metadata != nil && report.Metadata.Region != "" {
+		region = report.Metadata.Region
+	}
+
+	outputFileName, err := utils.WriteInstanceDetailsReport(c.ReportDir, region, report, reportType)
+	if err != nil {
+		return outputFileName, err
+	}
+	c.printf("%d instances written to %s\n", len(report.Instances), outputFileName)
+	return outputFileName, nil
+}
+
+/* ---
+ * Upgrade instance report files to the current report format.
+ * --- */
+func (c *Controller) MigrateReports(paths []string) error {
+	for _, path := range paths {
+		version, err := utils.MigrateInstanceReportFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if version == datamodels.EC2InstanceReportSchemaVersion {
+			c.printf("%s: already at version %d\n", path, version)
+			continue
+		}
+		c.printf("%s: upgraded from version %d to %d (original saved as %s.v%d.bak)\n", path, version, datamodels.EC2InstanceReportSchemaVersion, path, version)
+	}
+	return nil
+}
+
+/* ---
+ * Export the instances in a report as an ssh_config block, Ansible
+ * inventory, /etc/hosts entries or CSV roster. Unless options.User is set,
+ * each instance's SSH user is inferred from its AMI, which needs AWS
+ * clients; without them every instance gets its SSHUser tag or the default.
+ * --- */
+func (c *Controller) ExportReport(ctx aws.Context, path, format string, options datamodels.ExportOptions) ([]byte, error) {
+	if err := utils.ValidateExportFormat(format); err != nil {
+		return nil, err
+	}
+	report, err := utils.LoadInstanceReport(path)
+	if err != nil {
+		return nil, err
+	}
+	imageUsers := make(map[string]string)
+	if options.User == "" && c.EC2 != nil && format != "hosts" {
+		region := c.Region
+		if report.Metadata != nil && report.Metadata.Region != "" {
+			region = report.Metadata.Region
+		}
+		if imageUsers, err = c.imageSSHUsers(ctx, region, report); err != nil {
+			c.printf("Warning: unable to describe AMIs, using %s for instances without an %s tag: %s\n", utils.DefaultSSHUser, utils.TagSSHUser, utils.ErrorSummary(err))
+		}
+	}
+
+	hosts := utils.ExportHosts(report, imageUsers, options)
+	skipped := 0
+	for _, host := range hosts {
+		if !utils.Exportable(format, host) {
+			skipped++
+		}
+	}
+	output, err := utils.FormatExport(format, path, hosts, options)
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		c.printf("Left out %d instances without an address or SSH access\n", skipped)
+	}
+	return output, nil
+}
+
+/* ---
+ * Infer the SSH user of each AMI in a report. AMIs that have been
+ * deregistered or whose family is not recognised are left out.
+ * --- */
+func (c *Controller) imageSSHUsers(ctx aws.Context, region string, report datamodels.EC2InstanceReport) (map[string]string, error) {
+	imageIDs := make([]string, 0)
+	for _, instance := range report.Instances {
+		if instance.ImageID != "" {
+			imageIDs = append(imageIDs, instance.ImageID)
+		}
+	}
+	users := make(map[string]string)
+	client := c.clientFor(region)
+	for _, batch := range utils.BatchInstanceIDs(uniqueStrings(imageIDs), utils.DescribeImagesBatchSize) {
+		callCtx, cancel := c.callContext(ctx)
+		output, err := client.DescribeImagesWithContext(callCtx, utils.CreateEC2DescribeImagesParams(batch))
+		cancel()
+		if err != nil {
+			return users, err
+		}
+		for _, image := range output.Images {
+			if user := utils.SSHUserForImage(aws.StringValue(image.Name), aws.StringValue(image.Description)); user != "" {
+				users[aws.StringValue(image.ImageId)] = user
+			}
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDiff(t *testing.T) {
+	project := map[string]string{"Project": "rnaseq"}
+	resized := newInstance("i-02", "db", "running", project)
+	resized.InstanceType = aws.String("r5.large")
+	client := &fakeEC2{instances: []*ec2.Instance{
+		newInstance("i-01", "web", "stopped", project),
+		resized,
+		newInstance("i-04", "web-2", "running", project),
+		newInstance("i-05", "unrelated", "running", map[string]string{"Project": "other"}),
+		newInstance("i-06", "gone", "terminated", project),
+	}}
+	c, _ := newTestController(t, client, "")
+
+	baseline := writeTestReport(t, datamodels.EC2InstanceReport{
+		SchemaVersion: datamodels.EC2InstanceReportSchemaVersion,
+		Metadata:      &datamodels.ReportMetadata{Region: "us-east-1", AccountID: "123456789012"},
+		Instances: []datamodels.EC2InstanceDetails{
+			{InstanceID: "i-01", Name: "web", InstanceType: "t3.micro", InstanceState: "running", Tags: project},
+			{InstanceID: "i-02", Name: "db", InstanceType: "t3.micro", InstanceState: "running", Tags: project},
+			{InstanceID: "i-03", Name: "worker", InstanceType: "t3.micro", InstanceState: "running", Tags: project},
+			{InstanceID: "i-06", Name: "gone", InstanceType: "t3.micro", InstanceState: "running", Tags: project},
+		},
+	})
+
+	drift, outputFileName, err := c.Diff(aws.BackgroundContext(), baseline, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputFileName == "" {
+		t.Error("no drift report written")
+	}
+	if len(drift.Scope) != 1 || drift.Scope[0] != "tag:Project=rnaseq" {
+		t.Errorf("got scope %v, want the baseline's Project tag", drift.Scope)
+	}
+
+	ids := func(instances []datamodels.EC2InstanceDetails) string {
+		found := make([]string, 0)
+		for _, instance := range instances {
+			found = append(found, instance.InstanceID)
+		}
+		return strings.Join(found, ",")
+	}
+	if got := ids(drift.Missing); got != "i-03,i-06" {
+		t.Errorf("got missing %s, want i-03,i-06", got)
+	}
+	if got := ids(drift.Extra); got != "i-04" {
+		t.Errorf("got extra %s, want i-04 (i-05 is out of scope)", got)
+	}
+	if len(drift.StateChanged) != 1 || drift.StateChanged[0].InstanceID != "i-01" || drift.StateChanged[0].Current != "stopped" {
+		t.Errorf("got state changes %+v, want i-01 stopped", drift.StateChanged)
+	}
+	if len(drift.Retyped) != 1 || drift.Retyped[0].InstanceID != "i-02" || drift.Retyped[0].Current != "r5.large" {
+		t.Errorf("got type changes %+v, want i-02 r5.large", drift.Retyped)
+	}
+
+	// An explicit scope replaces the default.
+	drift, _, err = c.Diff(aws.BackgroundContext(), baseline, []string{"name=*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(drift.Extra); got != "i-04,i-05" {
+		t.Errorf("got extra %s with scope name=*, want i-04,i-05", got)
+	}
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Limit on waiting for an instance to stop before changing its type. Stopping
+// can take longer than a single AWS call is allowed.
+const resizeStopTimeout = 15 * time.Minute
+
+/* ---
+ * Options for changing instance types. SkipChecks skips the architecture,
+ * virtualization, boot mode, ENA and NVMe compatibility checks (the target
+ * type must still be offered in the region).
+ * --- */
+type ResizeOptions struct {
+	InstanceType string
+	DryRun       bool
+	SkipChecks   bool
+}
+
+/* ---
+ * Change the instance type of the selected instances. Running instances are
+ * stopped, resized and started again; stopped instances stay stopped. The
+ * results are printed and written to a report.
+ * --- */
+func (c *Controller) Resize(ctx aws.Context, selection Selection, options ResizeOptions) (datamodels.ResizeReport, string, error) {
+	report := datamodels.ResizeReport{TargetType: options.InstanceType}
+	if options.InstanceType == "" {
+		return report, "", fmt.Errorf("Target instance type required but not supplied")
+	}
+
+	check := func(ctx aws.Context, t target) error {
+		return c.checkResize(ctx, t, options)
+	}
+	t, err := c.prepare(ctx, selection, "", fmt.Sprintf("resized to %s", options.InstanceType), check)
+	if err != nil || len(t.report.Instances) == 0 {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(t.region)
+
+	// A report given on the command line may be out of date, and the
+	// instances may have changed while the user confirmed; take the types
+	// and states to resize from AWS.
+	live, err := c.describeLive(ctx, t)
+	if err != nil {
+		return report, "", err
+	}
+
+	for _, instance := range t.report.Instances {
+		result := datamodels.InstanceResizeResult{
+			InstanceID: instance.InstanceID,
+			Name:       instance.Name,
+		}
+		current, ok := live[instance.InstanceID]
+		if !ok {
+			result.Error = "instance not found"
+			report.Results = append(report.Results, result)
+			continue
+		}
+		result.PreviousType = current.InstanceType
+		result.PreviousState = current.InstanceState
+		if options.DryRun {
+			callCtx, cancel := c.callContext(ctx)
+			_, err := t.client.ModifyInstanceAttributeWithContext(callCtx, utils.CreateEC2ModifyInstanceTypeParams(instance.InstanceID, options.InstanceType, true))
+			cancel()
+			if err != nil && !strings.Contains(err.Error(), "DryRunOperation") {
+				result.Error = utils.ErrorSummary(err)
+			}
+		} else {
+			c.resizeInstance(ctx, t.client, options.InstanceType, &result)
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	utils.FprintResizeReport(c.Out, report)
+	if options.DryRun {
+		if failed := report.Failed(); failed > 0 {
+			return report, "", fmt.Errorf("%d of %d instances could not be resized", failed, len(report.Results))
+		}
+		c.printf("Done!\n")
+		return report, "", nil
+	}
+
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, t.region, "resize_results", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("%d of %d instances could not be resized", failed, len(report.Results))
+	}
+	c.printf("Done!\n")
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Describe the target instances as they are now, keyed by instance ID.
+ * --- */
+func (c *Controller) describeLive(ctx aws.Context, t target) (map[string]datamodels.EC2InstanceDetails, error) {
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	report, err := utils.DescribeEC2Instances(callCtx, t.client, utils.CreateEC2InstanceIDFilterParams(instanceIDs(t.report)))
+	if err != nil {
+		return nil, err
+	}
+	instances := make(map[string]datamodels.EC2InstanceDetails)
+	for _, instance := range report.Instances {
+		instances[instance.InstanceID] = instance
+	}
+	return instances, nil
+}
+
+/* ---
+ * Stop an instance if needed, change its type and start it again if it was
+ * running. The outcome is recorded in result.
+ * --- */
+func (c *Controller) resizeInstance(ctx aws.Context, client ec2iface.EC2API, instanceType string, result *datamodels.InstanceResizeResult) {
+	id := result.InstanceID
+	fail := func(step string, err error) {
+		result.Error = fmt.Sprintf("%s: %s", step, utils.ErrorSummary(err))
+	}
+	if result.PreviousType == instanceType {
+		result.NewType = instanceType
+		return
+	}
+
+	// Get the instance to stopped, remembering whether to start it again.
+	restart := false
+	switch result.PreviousState {
+	case "stopped":
+	case "running":
+		restart = true
+		c.printf("Stopping %s...\n", id)
+		callCtx, cancel := c.callContext(ctx)
+		_, err := client.StopInstancesWithContext(callCtx, utils.CreateEC2StopInstanceParams([]string{id}, false, false, false))
+		cancel()
+		if err != nil {
+			fail("stop", err)
+			// The stop may have gone through before the call failed.
+			c.startAgain(ctx, client, result)
+			return
+		}
+		fallthrough
+	case "stopping":
+		waitCtx, cancel := context.WithTimeout(ctx, resizeStopTimeout)
+		err := client.WaitUntilInstanceStoppedWithContext(waitCtx, utils.CreateEC2InstanceIDFilterParams([]string{id}))
+		cancel()
+		if err != nil {
+			fail("wait for stop", err)
+			if restart {
+				c.startAgain(ctx, client, result)
+			}
+			return
+		}
+	default:
+		result.Error = fmt.Sprintf("instance is %s; it must be running or stopped", result.PreviousState)
+		return
+	}
+
+	c.printf("Changing %s from %s to %s...\n", id, result.PreviousType, instanceType)
+	callCtx, cancel := c.callContext(ctx)
+	_, err := client.ModifyInstanceAttributeWithContext(callCtx, utils.CreateEC2ModifyInstanceTypeParams(id, instanceType, false))
+	cancel()
+	if err != nil {
+		fail("modify", err)
+		// Leave the instance as we found it.
+		if restart {
+			c.startAgain(ctx, client, result)
+		}
+		return
+	}
+	result.NewType = instanceType
+
+	if restart {
+		c.startAgain(ctx, client, result)
+	}
+}
+
+/* ---
+ * Start an instance stopped for a resize. Errors are added to result.
+ * --- */
+func (c *Controller) startAgain(ctx aws.Context, client ec2iface.EC2API, result *datamodels.InstanceResizeResult) {
+	c.printf("Starting %s...\n", result.InstanceID)
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+	_, err := client.StartInstancesWithContext(callCtx, utils.CreateEC2StartInstanceParams([]string{result.InstanceID}, false))
+	if err != nil {
+		startErr := fmt.Sprintf("start: %s", utils.ErrorSummary(err))
+		if result.Error != "" {
+			startErr = result.Error + "; " + startErr
+		}
+		result.Error = startErr
+		return
+	}
+	result.Restarted = true
+}
+
+/* ---
+ * Make sure the target type is offered in the region and, unless skipped,
+ * that every instance can run on it.
+ * --- */
+func (c *Controller) checkResize(ctx aws.Context, t target, options ResizeOptions) error {
+	callCtx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	offerings, err := t.client.DescribeInstanceTypeOfferingsWithContext(callCtx, utils.CreateInstanceTypeOfferedParams(options.InstanceType))
+	if err != nil {
+		return err
+	}
+	if len(offerings.InstanceTypeOfferings) == 0 {
+		return fmt.Errorf("Instance type %s is not offered in %s", options.InstanceType, t.region)
+	}
+	if options.SkipChecks {
+		return nil
+	}
+
+	// Gather the instances, their AMIs and their current types.
+	instances := make([]*ec2.Instance, 0)
+	err = t.client.DescribeInstancesPagesWithContext(callCtx, utils.CreateEC2InstanceIDFilterParams(instanceIDs(t.report)), func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	typeNames := []string{options.InstanceType}
+	imageIDs := make([]string, 0)
+	for _, instance := range instances {
+		typeNames = append(typeNames, aws.StringValue(instance.InstanceType))
+		imageIDs = append(imageIDs, aws.StringValue(instance.ImageId))
+	}
+
+	types := make(map[string]*ec2.InstanceTypeInfo)
+	err = t.client.DescribeInstanceTypesPagesWithContext(callCtx, utils.CreateDescribeInstanceTypesParams(uniqueStrings(typeNames)), func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
+		for _, info := range page.InstanceTypes {
+			types[aws.StringValue(info.InstanceType)] = info
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	targetInfo, ok := types[options.InstanceType]
+	if !ok {
+		return fmt.Errorf("Unable to describe instance type %s", options.InstanceType)
+	}
+
+	// An AMI may have been deregistered since launch; check without it.
+	images := make(map[string]*ec2.Image)
+	imageOutput, err := t.client.DescribeImagesWithContext(callCtx, &ec2.DescribeImagesInput{ImageIds: aws.StringSlice(uniqueStrings(imageIDs))})
+	if err != nil {
+		c.printf("Warning: unable to describe AMIs, checking against the instances only: %s\n", utils.ErrorSummary(err))
+	} else {
+		for _, image := range imageOutput.Images {
+			images[aws.StringValue(image.ImageId)] = image
+		}
+	}
+
+	problems := make([]string, 0)
+	for _, instance := range instances {
+		current := types[aws.StringValue(instance.InstanceType)]
+		image := images[aws.StringValue(instance.ImageId)]
+		for _, problem := range utils.InstanceTypeIncompatibilities(instance, image, current, targetInfo) {
+			problems = append(problems, fmt.Sprintf("  %s: %s", aws.StringValue(instance.InstanceId), problem))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Instances can not be resized to %s:\n%s\nUse --skip-checks to resize anyway", options.InstanceType, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0)
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The fake EC2 with the stop, wait and modify calls a resize makes.
+type resizeEC2 struct {
+	*fakeEC2
+	stopErr     error
+	waitErr     error
+	waitLimit   time.Duration
+	modifyCalls int
+}
+
+func (f *resizeEC2) StopInstancesWithContext(ctx aws.Context, input *ec2.StopInstancesInput, opts ...request.Option) (*ec2.StopInstancesOutput, error) {
+	return &ec2.StopInstancesOutput{}, f.stopErr
+}
+
+func (f *resizeEC2) WaitUntilInstanceStoppedWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		f.waitLimit = time.Until(deadline)
+	}
+	return f.waitErr
+}
+
+func (f *resizeEC2) ModifyInstanceAttributeWithContext(ctx aws.Context, input *ec2.ModifyInstanceAttributeInput, opts ...request.Option) (*ec2.ModifyInstanceAttributeOutput, error) {
+	f.modifyCalls++
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func TestResizeInstance(t *testing.T) {
+	client := &resizeEC2{fakeEC2: &fakeEC2{}}
+	c, _ := newTestController(t, client, "")
+	c.Timeout = time.Second
+
+	result := datamodels.InstanceResizeResult{InstanceID: "i-01", PreviousType: "t3.micro", PreviousState: "running"}
+	c.resizeInstance(aws.BackgroundContext(), client, "t3.large", &result)
+	if result.Error != "" || result.NewType != "t3.large" || !result.Restarted {
+		t.Errorf("got %+v, want resized and restarted", result)
+	}
+	if client.waitLimit < resizeStopTimeout-time.Minute {
+		t.Errorf("waited for the stop with a limit of %s, want %s rather than the call timeout", client.waitLimit, resizeStopTimeout)
+	}
+}
+
+func TestResizeInstanceRestartsAfterFailedStop(t *testing.T) {
+	tests := []struct {
+		name          string
+		stopErr       error
+		waitErr       error
+		previousState string
+		wantError     string
+		wantStart     bool
+	}{
+		{"wait timed out", nil, awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil), "running", "wait for stop", true},
+		{"stop failed", awserr.New("RequestExpired", "Request has expired.", nil), nil, "running", "stop", true},
+		{"stopping when found", nil, awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil), "stopping", "wait for stop", false},
+	}
+	for _, test := range tests {
+		client := &resizeEC2{fakeEC2: &fakeEC2{}, stopErr: test.stopErr, waitErr: test.waitErr}
+		c, _ := newTestController(t, client, "")
+
+		result := datamodels.InstanceResizeResult{InstanceID: "i-01", PreviousType: "t3.micro", PreviousState: test.previousState}
+		c.resizeInstance(aws.BackgroundContext(), client, "t3.large", &result)
+		if !strings.HasPrefix(result.Error, test.wantError+":") || result.NewType != "" {
+			t.Errorf("%s: got %+v, want a %s error and no new type", test.name, result, test.wantError)
+		}
+		if client.modifyCalls != 0 {
+			t.Errorf("%s: type changed without the instance stopped", test.name)
+		}
+		if started := len(client.startCalls) == 1; started != test.wantStart || result.Restarted != test.wantStart {
+			t.Errorf("%s: got start calls %v and restarted %t, want %t", test.name, client.startCalls, result.Restarted, test.wantStart)
+		}
+	}
+}
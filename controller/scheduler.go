@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/schedule"
+	"mdibl_cloud_control/utils"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Name given to schedules written inline in an instance's Schedule tag.
+const inlineScheduleName = "tag"
+
+/* ---
+ * How to run the schedule daemon. With Once, instances are checked a single
+ * time rather than every Config.Interval. With DryRun, actions are logged
+ * but not taken and the state file is not updated.
+ * --- */
+type SchedulerOptions struct {
+	Config datamodels.SchedulerConfig
+	DryRun bool
+	Once   bool
+}
+
+/* ---
+ * Instance schedules from a schedule config, and the state of a running
+ * daemon.
+ * --- */
+type scheduler struct {
+	c       *Controller
+	config  datamodels.SchedulerConfig
+	named   map[string]*schedule.Schedule
+	filters map[string][]utils.InstanceFilter
+	state   datamodels.SchedulerState
+	log     io.Writer
+	dryRun  bool
+
+	// Schedule tags already warned about, so a bad tag is reported once
+	// rather than every interval.
+	warned map[string]string
+}
+
+/* ---
+ * Run the schedule daemon: start and stop instances according to their
+ * schedules until ctx is cancelled. Each schedule event is acted on once;
+ * an instance started or stopped by hand after an event is left alone until
+ * the next event. Every action is written to Out and the config's log file.
+ * --- */
+func (c *Controller) RunScheduler(ctx aws.Context, options SchedulerOptions) error {
+	s, err := c.newScheduler(options.Config, options.DryRun)
+	if err != nil {
+		return err
+	}
+	if s.state, err = utils.LoadSchedulerState(options.Config.StateFile); err != nil {
+		return err
+	}
+	if options.Config.LogFile != "" {
+		logFile, err := os.OpenFile(options.Config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, utils.ReportFilePerm)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		s.log = io.MultiWriter(c.Out, logFile)
+	}
+
+	if !options.Once {
+		c.printf("Scheduler running in %s with %d configured schedules, checking every %s\n", c.Region, len(s.named), options.Config.Interval)
+	}
+	for {
+		err := s.check(ctx, time.Now())
+		if options.Once {
+			return err
+		}
+		if err != nil {
+			c.printf("Warning: %s\n", err)
+		}
+
+		// Wake at the start of the next interval so events are seen promptly.
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(options.Config.Interval).Add(options.Config.Interval).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.printf("Scheduler stopped\n")
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+/* ---
+ * Show each scheduled instance's schedule and when it last and next fires.
+ * --- */
+func (c *Controller) ScheduleStatus(ctx aws.Context, config datamodels.SchedulerConfig) ([]datamodels.InstanceSchedule, error) {
+	s, err := c.newScheduler(config, true)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := s.describe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]datamodels.InstanceSchedule, 0)
+	for _, instance := range instances.Instances {
+		sched := s.scheduleFor(instance)
+		if sched == nil {
+			continue
+		}
+		status := datamodels.InstanceSchedule{InstanceID: instance.InstanceID, Name: instance.Name, State: instance.InstanceState, Schedule: sched.Name}
+		if event, ok := sched.LastEvent(now); ok {
+			status.LastEvent = fmt.Sprintf("%s %s", event.Action, event.At.Format("Mon 2006-01-02 15:04 MST"))
+		}
+		if event, ok := sched.NextEvent(now); ok {
+			status.NextEvent = fmt.Sprintf("%s %s", event.Action, event.At.Format("Mon 2006-01-02 15:04 MST"))
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Schedule != statuses[j].Schedule {
+			return statuses[i].Schedule < statuses[j].Schedule
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, nil
+}
+
+func (c *Controller) newScheduler(config datamodels.SchedulerConfig, dryRun bool) (*scheduler, error) {
+	s := &scheduler{
+		c:       c,
+		config:  config,
+		named:   make(map[string]*schedule.Schedule),
+		filters: make(map[string][]utils.InstanceFilter),
+		state:   datamodels.SchedulerState{Instances: make(map[string]datamodels.ScheduledInstanceState)},
+		log:     c.Out,
+		dryRun:  dryRun,
+		warned:  make(map[string]string),
+	}
+	for _, sc := range config.Schedules {
+		sched, err := schedule.New(sc.Name, sc.Start, sc.Stop, sc.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		s.named[sc.Name] = sched
+		if s.filters[sc.Name], err = utils.ParseInstanceFilters(sc.Filters); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+/* ---
+ * Get every instance that has not been terminated.
+ * --- */
+func (s *scheduler) describe(ctx aws.Context) (datamodels.EC2InstanceReport, error) {
+	callCtx, cancel := s.c.callContext(ctx)
+	defer cancel()
+	states := []string{"pending", "running", "shutting-down", "stopping", "stopped"}
+	return utils.DescribeEC2Instances(callCtx, s.c.EC2, utils.CreateEC2InstanceFilterParams("instance-state-name", states))
+}
+
+/* ---
+ * Get the schedule an instance follows: the one its Schedule tag names or
+ * defines, else the first configured schedule (by name) whose filters it
+ * matches. Returns nil for unscheduled instances.
+ * --- */
+func (s *scheduler) scheduleFor(instance datamodels.EC2InstanceDetails) *schedule.Schedule {
+	if value, ok := instance.Tags[utils.TagSchedule]; ok && strings.TrimSpace(value) != "" {
+		var sched *schedule.Schedule
+		var err error
+		if strings.Contains(value, "=") {
+			sched, err = schedule.ParseInline(inlineScheduleName, value)
+		} else if sched = s.named[strings.TrimSpace(value)]; sched == nil {
+			err = fmt.Errorf("no schedule named %q in the schedule config", strings.TrimSpace(value))
+		}
+		if err != nil {
+			if s.warned[instance.InstanceID] != value {
+				s.c.printf("Warning: ignoring %s tag on %s: %s\n", utils.TagSchedule, instance.InstanceID, err)
+				s.warned[instance.InstanceID] = value
+			}
+			return nil
+		}
+		return sched
+	}
+
+	for _, sc := range s.config.Schedules {
+		filters := s.filters[sc.Name]
+		if len(filters) == 0 {
+			continue
+		}
+		matches := true
+		for _, filter := range filters {
+			if !filter.Matches(instance) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return s.named[sc.Name]
+		}
+	}
+	return nil
+}
+
+/* ---
+ * Check every instance once and start or stop those with a schedule event
+ * not yet handled.
+ * --- */
+func (s *scheduler) check(ctx aws.Context, now time.Time) error {
+	instances, err := s.describe(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to describe instances: %s", utils.ErrorSummary(err))
+	}
+
+	seen := make(map[string]bool)
+	pending := make(map[string][]datamodels.ScheduledAction)
+	byID := make(map[string]datamodels.EC2InstanceDetails)
+	for _, instance := range instances.Instances {
+		seen[instance.InstanceID] = true
+		byID[instance.InstanceID] = instance
+		sched := s.scheduleFor(instance)
+		if sched == nil {
+			continue
+		}
+		event, ok := sched.LastEvent(now)
+		if !ok {
+			continue
+		}
+		previous, handled := s.state.Instances[instance.InstanceID]
+		if handled && previous.Schedule == sched.Name && !event.At.After(previous.EventTime) {
+			continue
+		}
+
+		action := datamodels.ScheduledAction{
+			Time:       now,
+			InstanceID: instance.InstanceID,
+			Name:       instance.Name,
+			Schedule:   sched.Name,
+			Event:      event.Action,
+			EventTime:  event.At,
+			State:      instance.InstanceState,
+		}
+		switch {
+		case now.Sub(event.At) > s.config.CatchUp:
+			action.Action = "skipped"
+			action.Reason = fmt.Sprintf("event missed by %s", now.Sub(event.At).Truncate(time.Second))
+		case scheduledStateReached(event.Action, instance.InstanceState):
+			action.Action = "none"
+		case instance.InstanceState != "running" && instance.InstanceState != "stopped":
+			// Try again once the instance settles.
+			continue
+		case !previous.ActedAt.IsZero() && now.Sub(previous.ActedAt) < s.config.MinInterval:
+			action.Action = "skipped"
+			action.Reason = fmt.Sprintf("last %s was %s ago", previous.Action, now.Sub(previous.ActedAt).Truncate(time.Second))
+		default:
+			action.Action = event.Action
+			pending[event.Action] = append(pending[event.Action], action)
+			continue
+		}
+		s.record(action, previous)
+	}
+
+	for _, event := range []string{"start", "stop"} {
+		actions := pending[event]
+		if len(actions) == 0 {
+			continue
+		}
+		if s.dryRun {
+			for _, action := range actions {
+				action.Reason = "dry run"
+				s.record(action, s.state.Instances[action.InstanceID])
+			}
+			continue
+		}
+
+		t := target{client: s.c.EC2, region: s.c.Region, report: datamodels.EC2InstanceReport{SchemaVersion: datamodels.EC2InstanceReportSchemaVersion}}
+		for _, action := range actions {
+			t.report.Instances = append(t.report.Instances, byID[action.InstanceID])
+		}
+		errs := s.c.applyAction(ctx, t, event)
+		for _, action := range actions {
+			action.Error = errs[action.InstanceID]
+			s.record(action, s.state.Instances[action.InstanceID])
+		}
+	}
+
+	// Forget instances that have been terminated.
+	for id := range s.state.Instances {
+		if !seen[id] {
+			delete(s.state.Instances, id)
+		}
+	}
+	if s.dryRun {
+		return nil
+	}
+	return utils.WriteSchedulerState(s.config.StateFile, s.state)
+}
+
+/* ---
+ * Log an action and remember its event as handled. Failed actions are
+ * logged but not remembered, so they are tried again next interval (until
+ * the event is older than the catch up window).
+ * --- */
+func (s *scheduler) record(action datamodels.ScheduledAction, previous datamodels.ScheduledInstanceState) {
+	utils.FprintScheduledAction(s.log, action)
+	if action.Error != "" {
+		return
+	}
+	state := datamodels.ScheduledInstanceState{
+		Schedule:  action.Schedule,
+		Event:     action.Event,
+		EventTime: action.EventTime,
+		Action:    previous.Action,
+		ActedAt:   previous.ActedAt,
+	}
+	if (action.Action == "start" || action.Action == "stop") && action.Reason == "" {
+		state.Action = action.Action
+		state.ActedAt = action.Time
+	}
+	s.state.Instances[action.InstanceID] = state
+}
+
+/* ---
+ * Check if an instance is already where a schedule event would put it.
+ * --- */
+func scheduledStateReached(event, state string) bool {
+	if event == "start" {
+		return state == "running" || state == "pending"
+	}
+	return state == "stopped" || state == "stopping"
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/utils"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+/* ---
+ * Set tags on the selected instances. With dryRun the changes are only
+ * previewed.
+ * --- */
+func (c *Controller) AddTags(ctx aws.Context, selection Selection, tags map[string]string, dryRun bool) (datamodels.TagChangeReport, string, error) {
+	if len(tags) == 0 {
+		return datamodels.TagChangeReport{}, "", fmt.Errorf("No tags given")
+	}
+	return c.changeTags(ctx, selection, dryRun, func(instance datamodels.EC2InstanceDetails) []datamodels.TagChange {
+		return utils.PlanTagChanges(instance, tags, nil)
+	})
+}
+
+/* ---
+ * Remove tags from the selected instances. With dryRun the changes are only
+ * previewed.
+ * --- */
+func (c *Controller) RemoveTags(ctx aws.Context, selection Selection, keys []string, dryRun bool) (datamodels.TagChangeReport, string, error) {
+	if len(keys) == 0 {
+		return datamodels.TagChangeReport{}, "", fmt.Errorf("No tag keys given")
+	}
+	return c.changeTags(ctx, selection, dryRun, func(instance datamodels.EC2InstanceDetails) []datamodels.TagChange {
+		return utils.PlanTagChanges(instance, nil, keys)
+	})
+}
+
+/* ---
+ * Rename a tag key on the selected instances, keeping its value. Instances
+ * without the tag are left alone. With dryRun the changes are only
+ * previewed.
+ * --- */
+func (c *Controller) RenameTag(ctx aws.Context, selection Selection, from, to string, dryRun bool) (datamodels.TagChangeReport, string, error) {
+	if err := utils.ValidateTag(to, ""); err != nil {
+		return datamodels.TagChangeReport{}, "", err
+	}
+	if from == to {
+		return datamodels.TagChangeReport{}, "", fmt.Errorf("Tag %s can not be renamed to itself", from)
+	}
+	return c.changeTags(ctx, selection, dryRun, func(instance datamodels.EC2InstanceDetails) []datamodels.TagChange {
+		value, ok := instance.Tags[from]
+		if !ok {
+			return nil
+		}
+		return utils.PlanTagChanges(instance, map[string]string{to: value}, []string{from})
+	})
+}
+
+/* ---
+ * Set tags from a CSV file mapping instance IDs to tag values (see
+ * utils.LoadTagCSV). With dryRun the changes are only previewed.
+ * --- */
+func (c *Controller) ImportTags(ctx aws.Context, csvPath string, dryRun bool) (datamodels.TagChangeReport, string, error) {
+	tags, err := utils.LoadTagCSV(csvPath)
+	if err != nil {
+		return datamodels.TagChangeReport{}, "", err
+	}
+	ids := make([]string, 0, len(tags))
+	for id := range tags {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return c.changeTags(ctx, Selection{Instances: ids}, dryRun, func(instance datamodels.EC2InstanceDetails) []datamodels.TagChange {
+		return utils.PlanTagChanges(instance, tags[instance.InstanceID], nil)
+	})
+}
+
+/* ---
+ * Plan tag changes on the selected instances with plan, show them, and
+ * unless this is a dry run, confirm and apply them and write a report.
+ * Changes are planned against the instances' current tags rather than those
+ * in a report, which may be out of date.
+ * --- */
+func (c *Controller) changeTags(ctx aws.Context, selection Selection, dryRun bool, plan func(instance datamodels.EC2InstanceDetails) []datamodels.TagChange) (datamodels.TagChangeReport, string, error) {
+	report := datamodels.TagChangeReport{DryRun: dryRun, Changes: make([]datamodels.TagChange, 0)}
+	t, err := c.resolve(ctx, selection, "")
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(t.region)
+	if len(t.report.Instances) == 0 {
+		c.printf("No matching instances\n")
+		return report, "", nil
+	}
+	if selection.Report != "" {
+		callCtx, cancel := c.callContext(ctx)
+		defer cancel()
+		t.report, err = utils.DescribeEC2Instances(callCtx, t.client, utils.CreateEC2InstanceIDFilterParams(instanceIDs(t.report)))
+		if err != nil {
+			return report, "", err
+		}
+	}
+
+	planned := make([]datamodels.TagChange, 0)
+	for _, instance := range t.report.Instances {
+		planned = append(planned, plan(instance)...)
+	}
+	if len(planned) == 0 {
+		c.printf("No tags need changing\n")
+		return report, "", nil
+	}
+
+	title := "Tag changes:"
+	if dryRun {
+		title = "Tag changes (dry run, nothing will be changed):"
+	}
+	c.printf("\n%s\n%s\n\n", title, strings.Repeat("-", len(title)))
+	utils.FprintTagChanges(c.Out, planned)
+	if dryRun {
+		report.Changes = planned
+		return report, "", nil
+	}
+	if !c.confirm(ctx) {
+		return report, "", ErrAborted
+	}
+
+	applyErr := c.applyTagChanges(ctx, t, planned, &report)
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, t.region, "tag_changes", report)
+	if applyErr != nil {
+		return report, outputFileName, applyErr
+	}
+	if err != nil {
+		return report, "", err
+	}
+	c.printf("Done!\n")
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Apply planned tag changes, grouping instances that get the same tag into
+ * one call. Applied changes are added to the report as they succeed.
+ * --- */
+func (c *Controller) applyTagChanges(ctx aws.Context, t target, planned []datamodels.TagChange, report *datamodels.TagChangeReport) error {
+	type group struct {
+		remove     bool
+		key, value string
+	}
+	groups := make(map[group][]datamodels.TagChange)
+	order := make([]group, 0)
+	for _, change := range planned {
+		g := group{remove: change.Action == "remove", key: change.Key, value: change.NewValue}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], change)
+	}
+
+	// Tags are set before old ones are removed so a rename never loses a value.
+	sort.SliceStable(order, func(i, j int) bool {
+		return !order[i].remove && order[j].remove
+	})
+
+	for _, g := range order {
+		changes := groups[g]
+		ids := make([]string, 0, len(changes))
+		for _, change := range changes {
+			ids = append(ids, change.InstanceID)
+		}
+		for _, batch := range utils.BatchInstanceIDs(ids, utils.InstanceBatchSize) {
+			callCtx, cancel := c.callContext(ctx)
+			var err error
+			if g.remove {
+				_, err = t.client.DeleteTagsWithContext(callCtx, utils.CreateEC2DeleteTagsParams(batch, g.key))
+			} else {
+				_, err = t.client.CreateTagsWithContext(callCtx, utils.CreateEC2CreateTagsParams(batch, g.key, g.value))
+			}
+			cancel()
+			if err != nil {
+				return fmt.Errorf("Unable to change tag %s: %s", g.key, utils.ErrorSummary(err))
+			}
+			report.Changes = append(report.Changes, changes[:len(batch)]...)
+			changes = changes[len(batch):]
+		}
+	}
+	return nil
+}
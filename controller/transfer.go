@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"mdibl_cloud_control/remote"
+	"mdibl_cloud_control/utils"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+/* ---
+ * What to copy to (push) or from (pull) instances. Source and Destination
+ * are local and remote paths for a push and the other way round for a pull.
+ * Pulls copy the source from each instance into a directory named after the
+ * instance under the destination.
+ * --- */
+type TransferOptions struct {
+	Direction   string
+	Source      string
+	Destination string
+	Parallel    int
+	Hosts       datamodels.ExportOptions
+	SSH         remote.Config
+}
+
+/* ---
+ * Copy files or directories to or from the selected running instances over
+ * SFTP, at most options.Parallel instances at a time. Partial copies left by
+ * an interrupted transfer are resumed, files already up to date are skipped
+ * and every copy is checked against the source's sha256. Writes a
+ * push_results or pull_results report.
+ * --- */
+func (c *Controller) Transfer(ctx aws.Context, selection Selection, options TransferOptions) (datamodels.TransferReport, string, error) {
+	report := datamodels.TransferReport{Direction: options.Direction, Source: options.Source, Destination: options.Destination, Results: make([]datamodels.TransferResult, 0)}
+	if options.Direction != "push" && options.Direction != "pull" {
+		return report, "", fmt.Errorf("Unknown transfer direction %q", options.Direction)
+	}
+	hosts, region, err := c.sshHosts(ctx, selection, options.Hosts)
+	if err != nil {
+		return report, "", err
+	}
+	report.Metadata = c.metadata(region)
+	if len(hosts) == 0 {
+		c.printf("No instances to copy files %s\n", map[string]string{"push": "to", "pull": "from"}[options.Direction])
+		return report, "", nil
+	}
+
+	width := 0
+	for _, host := range hosts {
+		if len(host.Alias) > width {
+			width = len(host.Alias)
+		}
+	}
+
+	// A push sends the same files everywhere, so they are hashed once here.
+	var hashes map[string]string
+	if options.Direction == "push" {
+		c.printf("Checksumming %s...\n", options.Source)
+		if hashes, err = remote.HashSources(ctx, options.Source); err != nil {
+			return report, "", err
+		}
+	}
+
+	var outputLock sync.Mutex
+	report.Results = make([]datamodels.TransferResult, len(hosts))
+	forEachHost(ctx, hosts, options.Parallel, func(idx int, host datamodels.ExportHost) {
+		out := remote.NewPrefixWriter(c.Out, fmt.Sprintf("%-*s | ", width, host.Alias), &outputLock)
+		report.Results[idx] = c.transferOne(ctx, host, out, options, hashes)
+		out.Flush()
+	})
+
+	// Hosts skipped after an interrupt have no result.
+	results := make([]datamodels.TransferResult, 0, len(hosts))
+	for _, result := range report.Results {
+		if result.InstanceID != "" {
+			results = append(results, result)
+		}
+	}
+	report.Results = results
+
+	c.printf("\n")
+	utils.FprintTransferResults(c.Out, report)
+	outputFileName, err := utils.WriteJSONReport(c.ReportDir, region, options.Direction+"_results", report)
+	if err != nil {
+		return report, "", err
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, outputFileName, fmt.Errorf("Transfer failed on %d of %d instances", failed, len(report.Results))
+	}
+	return report, outputFileName, nil
+}
+
+/* ---
+ * Copy files to or from one host. hashes holds the checksums of the local
+ * files for a push.
+ * --- */
+func (c *Controller) transferOne(ctx aws.Context, host datamodels.ExportHost, out *remote.PrefixWriter, options TransferOptions, hashes map[string]string) (result datamodels.TransferResult) {
+	result = datamodels.TransferResult{
+		InstanceID:  host.Instance.InstanceID,
+		Name:        host.Instance.Name,
+		Address:     host.Address,
+		Destination: options.Destination,
+		StartedAt:   time.Now(),
+		Files:       make([]datamodels.TransferFile, 0),
+	}
+	defer func() {
+		result.Duration = time.Since(result.StartedAt).Truncate(time.Millisecond).String()
+	}()
+
+	client, err := remote.Connect(ctx, options.SSH, remote.Host{Name: host.Alias, Address: host.Address, User: host.User, IdentityFile: host.IdentityFile})
+	if err != nil {
+		result.Error = err.Error()
+		fmt.Fprintf(out, "unable to connect: %s\n", err)
+		return result
+	}
+	defer client.Close()
+
+	if options.Direction == "push" {
+		result.Files, err = remote.Push(ctx, client, options.Source, options.Destination, hashes)
+	} else {
+		result.Destination = filepath.Join(options.Destination, host.Alias, path.Base(options.Source))
+		result.Files, err = remote.Pull(ctx, client, options.Source, result.Destination)
+	}
+	for _, file := range result.Files {
+		fmt.Fprintf(out, "%s\n", utils.TransferFileSummary(file))
+	}
+	if err != nil {
+		result.Error = err.Error()
+		fmt.Fprintf(out, "%s\n", err)
+	}
+	return result
+}
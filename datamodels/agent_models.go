@@ -0,0 +1,31 @@
+package datamodels
+
+import "time"
+
+// Settings for the on-instance agent. The instance is busy while any of
+// Processes is running, while JobDir has been written to within
+// QuietPeriod, or (with CheckUsers) while anyone is logged in. The agent
+// stops the instance once it has not been busy for IdleAfter; with
+// RequireJob, only after a watched process or job directory has been seen
+// active at least once.
+type AgentConfig struct {
+	Processes   []string
+	JobDir      string
+	QuietPeriod time.Duration
+	IdleAfter   time.Duration
+	Interval    time.Duration
+	CheckUsers  bool
+	RequireJob  bool
+}
+
+// An instance's agent as last reported in its heartbeat tags. Status is
+// "busy", "idle", "stopping", "stale" (no recent heartbeat) or "none" (no
+// agent has reported).
+type AgentStatus struct {
+	InstanceID    string
+	Name          string
+	State         string
+	Status        string
+	LastHeartbeat time.Time
+	Detail        string
+}
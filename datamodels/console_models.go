@@ -0,0 +1,40 @@
+package datamodels
+
+import "time"
+
+// A console output line matching a known failure pattern. Category is
+// "kernel", "cloud-init", "user-data" or "boot".
+type ConsoleFinding struct {
+	Line     int    `json:"line"`
+	Category string `json:"category"`
+	Text     string `json:"text"`
+}
+
+// Console diagnostics for one instance. The decoded output and any
+// screenshot are saved beside the report in OutputFile and ScreenshotFile.
+type InstanceConsole struct {
+	InstanceID      string           `json:"instance_id"`
+	Name            string           `json:"name"`
+	Timestamp       time.Time        `json:"timestamp,omitempty"`
+	OutputFile      string           `json:"output_file,omitempty"`
+	ScreenshotFile  string           `json:"screenshot_file,omitempty"`
+	Findings        []ConsoleFinding `json:"findings"`
+	Error           string           `json:"error,omitempty"`
+	ScreenshotError string           `json:"screenshot_error,omitempty"`
+}
+
+// Console diagnostics for a set of instances.
+type ConsoleReport struct {
+	Metadata  *ReportMetadata   `json:"metadata,omitempty"`
+	Instances []InstanceConsole `json:"instances"`
+}
+
+// Check if any instance's console output matched a failure pattern.
+func (r ConsoleReport) HasProblems() bool {
+	for _, instance := range r.Instances {
+		if len(instance.Findings) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package datamodels
+
+// A single field of an instance that differs between a baseline report and
+// the live infrastructure.
+type InstanceChange struct {
+	InstanceID string `json:"instance_id"`
+	Name       string `json:"name"`
+	Field      string `json:"field"`
+	Baseline   string `json:"baseline"`
+	Current    string `json:"current"`
+}
+
+// Differences between a saved baseline report and live infrastructure.
+type DriftReport struct {
+	Metadata     *ReportMetadata      `json:"metadata,omitempty"`
+	Baseline     string               `json:"baseline"`
+	Scope        []string             `json:"scope"`
+	Missing      []EC2InstanceDetails `json:"missing"`
+	Extra        []EC2InstanceDetails `json:"extra"`
+	StateChanged []InstanceChange     `json:"state_changed"`
+	Retyped      []InstanceChange     `json:"retyped"`
+	IPChanged    []InstanceChange     `json:"ip_changed"`
+}
+
+func (r DriftReport) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Extra) > 0 || len(r.StateChanged) > 0 ||
+		len(r.Retyped) > 0 || len(r.IPChanged) > 0
+}
@@ -1,14 +1,58 @@
 package datamodels
 
+import "time"
+
+// Version of the EC2InstanceReport format written by this tool. Reports
+// written before the field existed have no schema_version and are version 1.
+const EC2InstanceReportSchemaVersion = 3
+
+type EC2SecurityGroup struct {
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+}
+
+type EC2Volume struct {
+	DeviceName          string    `json:"device_name"`
+	VolumeID            string    `json:"volume_id"`
+	Status              string    `json:"status"`
+	AttachTime          time.Time `json:"attach_time"`
+	DeleteOnTermination bool      `json:"delete_on_termination"`
+}
+
 type EC2InstanceDetails struct {
-	Name          string `json:"name"`
-	InstanceID    string `json:"instance_id"`
-	InstanceType  string `json:"instance_type"`
-	InstanceState string `json:"instance_state"`
-	PrivateIP     string `json:"private_ip"`
-	PublicIP      string `json:"public_ip"`
+	Name             string             `json:"name"`
+	InstanceID       string             `json:"instance_id"`
+	InstanceType     string             `json:"instance_type"`
+	InstanceState    string             `json:"instance_state"`
+	PrivateIP        string             `json:"private_ip"`
+	PublicIP         string             `json:"public_ip"`
+	Tags             map[string]string  `json:"tags"`
+	AvailabilityZone string             `json:"availability_zone"`
+	VpcID            string             `json:"vpc_id"`
+	SubnetID         string             `json:"subnet_id"`
+	ImageID          string             `json:"image_id"`
+	KeyName          string             `json:"key_name"`
+	LaunchTime       time.Time          `json:"launch_time"`
+	Platform         string             `json:"platform"`
+	Architecture     string             `json:"architecture"`
+	Lifecycle        string             `json:"lifecycle"`
+	SecurityGroups   []EC2SecurityGroup `json:"security_groups"`
+	Volumes          []EC2Volume        `json:"volumes"`
+}
+
+// Where and how a report was produced. Used to make sure a report is only
+// acted on in the region and account it describes.
+type ReportMetadata struct {
+	Region      string    `json:"region"`
+	AccountID   string    `json:"account_id"`
+	Profile     string    `json:"profile"`
+	ToolVersion string    `json:"tool_version"`
+	CreatedAt   time.Time `json:"created_at"`
+	Command     string    `json:"command"`
 }
 
 type EC2InstanceReport struct {
-	Instances []EC2InstanceDetails `json:"instances"`
+	SchemaVersion int                  `json:"schema_version"`
+	Metadata      *ReportMetadata      `json:"metadata,omitempty"`
+	Instances     []EC2InstanceDetails `json:"instances"`
 }
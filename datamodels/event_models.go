@@ -0,0 +1,28 @@
+package datamodels
+
+import "time"
+
+// A scheduled maintenance event on an instance in some region. Notified is
+// set when the owner was sent a notice about it in this run.
+type ScheduledEvent struct {
+	Region      string    `json:"region"`
+	InstanceID  string    `json:"instance_id"`
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner"`
+	State       string    `json:"state"`
+	Code        string    `json:"code"`
+	Description string    `json:"description"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+	Notified    bool      `json:"notified"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Scheduled events found across regions. RegionErrors holds, by region,
+// why regions could not be checked.
+type ScheduledEventsReport struct {
+	Metadata     *ReportMetadata   `json:"metadata,omitempty"`
+	Regions      []string          `json:"regions"`
+	Events       []ScheduledEvent  `json:"events"`
+	RegionErrors map[string]string `json:"region_errors,omitempty"`
+}
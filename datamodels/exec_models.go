@@ -0,0 +1,36 @@
+package datamodels
+
+import "time"
+
+// The result of running a command on one instance. ExitCode is -1 if the
+// command did not run or its exit status is unknown; Output holds the end of
+// its combined output.
+type ExecResult struct {
+	InstanceID string    `json:"instance_id"`
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	User       string    `json:"user"`
+	StartedAt  time.Time `json:"started_at"`
+	Duration   string    `json:"duration"`
+	ExitCode   int       `json:"exit_code"`
+	Output     string    `json:"output"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// The results of running a command across instances.
+type ExecReport struct {
+	Metadata *ReportMetadata `json:"metadata,omitempty"`
+	Command  string          `json:"command"`
+	Results  []ExecResult    `json:"results"`
+}
+
+// Count the instances the command failed on or could not be run on.
+func (r ExecReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Error != "" || result.ExitCode != 0 {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,22 @@
+package datamodels
+
+// How to export a report. Address is "auto" (public IP if there is one),
+// "public" or "private". User, if set, is used for every host instead of the
+// user inferred from its AMI. Tags are the tag keys to group Ansible hosts
+// by (all tags if empty) and to add as CSV columns.
+type ExportOptions struct {
+	Address string
+	User    string
+	KeyDir  string
+	Tags    []string
+}
+
+// An instance as written to an export: its host alias, the address to
+// connect to and the SSH user and key file to connect with.
+type ExportHost struct {
+	Alias        string
+	Address      string
+	User         string
+	IdentityFile string
+	Instance     EC2InstanceDetails
+}
@@ -0,0 +1,45 @@
+package datamodels
+
+import "time"
+
+// A scheduled maintenance event (reboot, retirement, etc.) for an instance.
+type MaintenanceEvent struct {
+	Code        string    `json:"code"`
+	Description string    `json:"description"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after,omitempty"`
+}
+
+// Status check results for one instance. SystemStatus and InstanceStatus
+// are "ok", "impaired", "initializing", "insufficient-data" or
+// "not-applicable". ImpairedSince is when the earliest failing check began
+// failing. Unreachable is set for running instances that have failed their
+// reachability checks for longer than the health check allows.
+type InstanceHealth struct {
+	InstanceID     string             `json:"instance_id"`
+	Name           string             `json:"name"`
+	State          string             `json:"state"`
+	SystemStatus   string             `json:"system_status"`
+	InstanceStatus string             `json:"instance_status"`
+	ImpairedSince  time.Time          `json:"impaired_since,omitempty"`
+	Unreachable    bool               `json:"unreachable"`
+	Events         []MaintenanceEvent `json:"events"`
+}
+
+// Health of a set of instances.
+type HealthReport struct {
+	Metadata         *ReportMetadata  `json:"metadata,omitempty"`
+	UnreachableAfter string           `json:"unreachable_after"`
+	Instances        []InstanceHealth `json:"instances"`
+}
+
+// Check if any instance is impaired, unreachable or has a maintenance
+// event scheduled.
+func (r HealthReport) HasProblems() bool {
+	for _, instance := range r.Instances {
+		if instance.SystemStatus == "impaired" || instance.InstanceStatus == "impaired" || instance.Unreachable || len(instance.Events) > 0 {
+			return true
+		}
+	}
+	return false
+}
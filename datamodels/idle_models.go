@@ -0,0 +1,49 @@
+package datamodels
+
+import "time"
+
+// Thresholds for deciding an instance is idle. An instance is idle when, in
+// every Period over the last Window, its average CPU is below CPUPercent and
+// its network traffic (in plus out) is below NetworkBytesPerSecond.
+type IdleThresholds struct {
+	CPUPercent            float64
+	NetworkBytesPerSecond float64
+	Window                time.Duration
+	Period                time.Duration
+}
+
+// The idle check result for one instance. Peak values are the highest
+// period averages seen in the window. Reason says why an instance was not
+// judged idle, or why it could not be judged.
+type InstanceIdleResult struct {
+	InstanceID  string  `json:"instance_id"`
+	Name        string  `json:"name"`
+	Datapoints  int     `json:"datapoints"`
+	PeakCPU     float64 `json:"peak_cpu_percent"`
+	PeakNetwork float64 `json:"peak_network_bytes_per_second"`
+	Idle        bool    `json:"idle"`
+	Reason      string  `json:"reason,omitempty"`
+	Action      string  `json:"action,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Results of an idle check and the thresholds used.
+type IdleReport struct {
+	Metadata              *ReportMetadata      `json:"metadata,omitempty"`
+	CPUPercent            float64              `json:"cpu_percent"`
+	NetworkBytesPerSecond float64              `json:"network_bytes_per_second"`
+	Window                string               `json:"window"`
+	Period                string               `json:"period"`
+	Stop                  bool                 `json:"stop"`
+	Results               []InstanceIdleResult `json:"results"`
+}
+
+func (r IdleReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
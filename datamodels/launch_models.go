@@ -0,0 +1,29 @@
+package datamodels
+
+import "time"
+
+// Launch request read from an instance config file. Name, Owner, Project
+// and Expiry are applied as tags; Expiry is a date or a duration from launch.
+// If IdleStopAfter is set, each instance gets a CloudWatch alarm that stops
+// it once its CPU has been below IdleStopCPU percent for that long. If
+// AgentURL is set, user data installs the agent from that URL with Agent as
+// its config; InstanceProfile gives it permission to tag and stop the
+// instance.
+type LaunchConfig struct {
+	AMIID        string
+	AMIName      string
+	InstanceType string
+	Region       string
+	Count        int64
+	Name         string
+	Owner        string
+	Project      string
+	Expiry       string
+
+	IdleStopCPU   float64
+	IdleStopAfter time.Duration
+
+	InstanceProfile string
+	AgentURL        string
+	Agent           AgentConfig
+}
@@ -0,0 +1,58 @@
+package datamodels
+
+import "time"
+
+// Where to send notices to instance owners. Every channel that is configured
+// is used.
+type NotifyConfig struct {
+	LogFile      string
+	SMTPServer   string
+	SMTPFrom     string
+	SMTPDomain   string
+	SMTPUsername string
+	SMTPPassword string
+	WebhookURL   string
+}
+
+// Whether any channel is configured. With none, notices are only printed.
+func (c NotifyConfig) HasChannel() bool {
+	return c.LogFile != "" || c.SMTPServer != "" || c.WebhookURL != ""
+}
+
+// Reaper policy read from a reaper config file. Action is what happens to
+// expired instances ("stop" or "terminate"); owners are warned WarnBefore
+// their instances expire.
+type ReaperConfig struct {
+	Action     string
+	WarnBefore time.Duration
+	Notify     NotifyConfig
+}
+
+// One thing the reaper did (or, for a dry run, would do) to an instance.
+// Action is "warn", "stop" or "terminate".
+type ReaperEntry struct {
+	InstanceID string `json:"instance_id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	Expiry     string `json:"expiry"`
+	State      string `json:"state"`
+	Action     string `json:"action"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Actions taken by a reaper run.
+type ReaperReport struct {
+	Metadata *ReportMetadata `json:"metadata,omitempty"`
+	DryRun   bool            `json:"dry_run"`
+	Entries  []ReaperEntry   `json:"entries"`
+}
+
+func (r ReaperReport) Failed() int {
+	failed := 0
+	for _, entry := range r.Entries {
+		if entry.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,30 @@
+package datamodels
+
+// The outcome of changing one instance's type. Restarted is set when the
+// instance was running and has been started again on the new type.
+type InstanceResizeResult struct {
+	InstanceID    string `json:"instance_id"`
+	Name          string `json:"name"`
+	PreviousType  string `json:"previous_type"`
+	NewType       string `json:"new_type"`
+	PreviousState string `json:"previous_state"`
+	Restarted     bool   `json:"restarted"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Per-instance results of a resize operation.
+type ResizeReport struct {
+	Metadata   *ReportMetadata        `json:"metadata,omitempty"`
+	TargetType string                 `json:"target_type"`
+	Results    []InstanceResizeResult `json:"results"`
+}
+
+func (r ResizeReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,68 @@
+package datamodels
+
+import "time"
+
+// One named schedule from a schedule config file. Instances matching
+// Filters (filter expressions as for --filter) or with a Schedule tag naming
+// it follow the schedule.
+type ScheduleConfig struct {
+	Name     string
+	Start    string
+	Stop     string
+	TimeZone string
+	Filters  []string
+}
+
+// Settings for the schedule daemon. Interval is how often instances are
+// checked; events missed by more than CatchUp (e.g., while the daemon was
+// down) are not acted on. MinInterval is the least time between two actions
+// on the same instance.
+type SchedulerConfig struct {
+	Interval    time.Duration
+	CatchUp     time.Duration
+	MinInterval time.Duration
+	StateFile   string
+	LogFile     string
+	Schedules   []ScheduleConfig
+}
+
+// The last schedule event handled for an instance.
+type ScheduledInstanceState struct {
+	Schedule  string    `json:"schedule"`
+	Event     string    `json:"event"`
+	EventTime time.Time `json:"event_time"`
+	Action    string    `json:"action"`
+	ActedAt   time.Time `json:"acted_at,omitempty"`
+}
+
+// What the schedule daemon has done, kept between runs so an event is only
+// ever acted on once and manual starts and stops are not undone.
+type SchedulerState struct {
+	Instances map[string]ScheduledInstanceState `json:"instances"`
+}
+
+// One scheduled action on an instance. Action is "start", "stop", "none"
+// (the instance was already in the scheduled state) or "skipped" (the event
+// was missed or came too soon after the last action).
+type ScheduledAction struct {
+	Time       time.Time `json:"time"`
+	InstanceID string    `json:"instance_id"`
+	Name       string    `json:"name"`
+	Schedule   string    `json:"schedule"`
+	Event      string    `json:"event"`
+	EventTime  time.Time `json:"event_time"`
+	State      string    `json:"state"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// An instance's schedule and when it last and next fires, for display.
+type InstanceSchedule struct {
+	InstanceID string
+	Name       string
+	State      string
+	Schedule   string
+	LastEvent  string
+	NextEvent  string
+}
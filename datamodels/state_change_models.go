@@ -0,0 +1,28 @@
+package datamodels
+
+// The outcome of a start, stop or terminate request for one instance. Error
+// is empty when the request was accepted.
+type InstanceStateResult struct {
+	InstanceID    string `json:"instance_id"`
+	Name          string `json:"name"`
+	PreviousState string `json:"previous_state"`
+	CurrentState  string `json:"current_state"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Per-instance results of a start, stop or terminate operation.
+type StateChangeReport struct {
+	Metadata *ReportMetadata       `json:"metadata,omitempty"`
+	Action   string                `json:"action"`
+	Results  []InstanceStateResult `json:"results"`
+}
+
+func (r StateChangeReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,19 @@
+package datamodels
+
+// A change to one tag on one instance. Action is "add", "update" or
+// "remove"; OldValue is empty for added tags and NewValue for removed ones.
+type TagChange struct {
+	InstanceID string `json:"instance_id"`
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Key        string `json:"key"`
+	OldValue   string `json:"old_value"`
+	NewValue   string `json:"new_value"`
+}
+
+// Tag changes made (or, for a dry run, planned) on a set of instances.
+type TagChangeReport struct {
+	Metadata *ReportMetadata `json:"metadata,omitempty"`
+	DryRun   bool            `json:"dry_run"`
+	Changes  []TagChange     `json:"changes"`
+}
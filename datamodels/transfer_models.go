@@ -0,0 +1,66 @@
+package datamodels
+
+import "time"
+
+// Why a file was not copied.
+const (
+	SkipUpToDate = "up to date"
+	SkipSymlink  = "symbolic link"
+	SkipPartial  = "partial transfer file"
+	SkipSpecial  = "not a regular file"
+)
+
+// A file copied to or from an instance. Resumed is how many bytes of a
+// partial earlier transfer were kept; Skipped is set for files that were not
+// copied, with the reason in SkipReason.
+type TransferFile struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Sent       int64  `json:"sent"`
+	Resumed    int64  `json:"resumed,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	SkipReason string `json:"skip_reason,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Verified   bool   `json:"verified"`
+}
+
+// The files copied to or from one instance.
+type TransferResult struct {
+	InstanceID  string         `json:"instance_id"`
+	Name        string         `json:"name"`
+	Address     string         `json:"address"`
+	Destination string         `json:"destination"`
+	StartedAt   time.Time      `json:"started_at"`
+	Duration    string         `json:"duration"`
+	Files       []TransferFile `json:"files"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// The results of copying files to (push) or from (pull) instances.
+type TransferReport struct {
+	Metadata    *ReportMetadata  `json:"metadata,omitempty"`
+	Direction   string           `json:"direction"`
+	Source      string           `json:"source"`
+	Destination string           `json:"destination"`
+	Results     []TransferResult `json:"results"`
+}
+
+// Count the instances where the transfer failed or a file could not be
+// copied or verified.
+func (r TransferReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Error != "" {
+			failed++
+			continue
+		}
+		for _, file := range result.Files {
+			if file.Error != "" {
+				failed++
+				break
+			}
+		}
+	}
+	return failed
+}
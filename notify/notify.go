@@ -0,0 +1,184 @@
+// Package notify sends notices about instances to their owners by log file,
+// email and webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ---
+ * A notice for one instance owner. Owner is a user name or email address.
+ * --- */
+type Message struct {
+	Owner   string
+	Subject string
+	Body    string
+}
+
+/* ---
+ * Something that can deliver messages.
+ * --- */
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+/* ---
+ * Create a notifier for every channel set in config. With nothing
+ * configured, messages are written to fallback.
+ * --- */
+func New(config datamodels.NotifyConfig, fallback io.Writer) (Notifier, error) {
+	notifiers := Multi{}
+	if config.LogFile != "" {
+		logFile, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, &Log{W: logFile})
+	}
+	if config.SMTPServer != "" {
+		if config.SMTPFrom == "" {
+			return nil, fmt.Errorf("smtp_from is required to send email")
+		}
+		notifiers = append(notifiers, &SMTP{
+			Server:   config.SMTPServer,
+			From:     config.SMTPFrom,
+			Domain:   config.SMTPDomain,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+		})
+	}
+	if config.WebhookURL != "" {
+		notifiers = append(notifiers, &Webhook{URL: config.WebhookURL})
+	}
+	if len(notifiers) == 0 {
+		notifiers = append(notifiers, &Log{W: fallback})
+	}
+	return notifiers, nil
+}
+
+/* ---
+ * Sends each message through every notifier. All are tried even if some
+ * fail; the errors are combined.
+ * --- */
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, message Message) error {
+	errs := make([]string, 0)
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, message); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/* ---
+ * Writes messages, with a timestamp, to a writer such as a log file.
+ * --- */
+type Log struct {
+	W io.Writer
+
+	mutex sync.Mutex
+}
+
+func (l *Log) Notify(ctx context.Context, message Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := fmt.Fprintf(l.W, "%s To: %s Subject: %s\n%s\n\n", time.Now().UTC().Format(time.RFC3339), message.Owner, message.Subject, strings.TrimRight(message.Body, "\n"))
+	return err
+}
+
+/* ---
+ * Emails messages. Owners that are not email addresses are sent mail at
+ * <owner>@Domain. Username and Password are used for SMTP authentication
+ * if set.
+ * --- */
+type SMTP struct {
+	Server   string
+	From     string
+	Domain   string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Notify(ctx context.Context, message Message) error {
+	to := message.Owner
+	if !strings.Contains(to, "@") {
+		if s.Domain == "" {
+			return fmt.Errorf("unable to email owner %q: no smtp_domain configured", to)
+		}
+		to = fmt.Sprintf("%s@%s", to, s.Domain)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Server
+		if idx := strings.LastIndex(host, ":"); idx >= 0 {
+			host = host[:idx]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var mail bytes.Buffer
+	fmt.Fprintf(&mail, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n", s.From, to, message.Subject, time.Now().Format(time.RFC1123Z))
+	mail.WriteString(strings.Replace(message.Body, "\n", "\r\n", -1))
+	if err := smtp.SendMail(s.Server, auth, s.From, []string{to}, mail.Bytes()); err != nil {
+		return fmt.Errorf("unable to email %s: %s", to, err)
+	}
+	return nil
+}
+
+/* ---
+ * Posts messages as JSON to a webhook. The text field makes the payload
+ * usable with Slack and Teams style incoming webhooks.
+ * --- */
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *Webhook) Notify(ctx context.Context, message Message) error {
+	payload, err := json.Marshal(map[string]string{
+		"owner":   message.Owner,
+		"subject": message.Subject,
+		"body":    message.Body,
+		"text":    fmt.Sprintf("*%s* (owner: %s)\n%s", message.Subject, message.Owner, message.Body),
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to post to webhook: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
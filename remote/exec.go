@@ -0,0 +1,136 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/* ---
+ * Run a command in a new session on client, streaming its output to stdout
+ * and stderr. Returns the command's exit status; err is only set if the
+ * command could not be run or its status is unknown (e.g., the connection
+ * dropped). Cancelling ctx closes the session.
+ * --- */
+func Run(ctx context.Context, client *ssh.Client, command string, stdout, stderr io.Writer) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+	select {
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+		<-done
+		return -1, ctx.Err()
+	case err = <-done:
+	}
+
+	switch e := err.(type) {
+	case nil:
+		return 0, nil
+	case *ssh.ExitError:
+		return e.ExitStatus(), nil
+	case *ssh.ExitMissingError:
+		return -1, fmt.Errorf("connection closed before the command exited")
+	}
+	return -1, err
+}
+
+/* ---
+ * A writer that prefixes each line with a host's name before writing it to
+ * a shared output. Writers sharing an output must share a lock so lines from
+ * different hosts are not interleaved. Partial lines are held until they are
+ * completed or Flush is called. Safe for concurrent use, but a stream's
+ * partial lines are only kept apart from another's if each has its own
+ * writer.
+ * --- */
+type PrefixWriter struct {
+	out     io.Writer
+	prefix  []byte
+	lock    sync.Locker
+	mutex   sync.Mutex
+	pending []byte
+}
+
+func NewPrefixWriter(out io.Writer, prefix string, lock sync.Locker) *PrefixWriter {
+	return &PrefixWriter{out: out, prefix: []byte(prefix), lock: lock}
+}
+
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = append(w.pending, p...)
+	idx := bytes.LastIndexByte(w.pending, '\n')
+	if idx < 0 {
+		return len(p), nil
+	}
+	if err := w.write(w.pending[:idx+1]); err != nil {
+		return 0, err
+	}
+	w.pending = append(w.pending[:0], w.pending[idx+1:]...)
+	return len(p), nil
+}
+
+/* ---
+ * Write any partial last line, ending it with a newline.
+ * --- */
+func (w *PrefixWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.write(append(w.pending, '\n'))
+	w.pending = w.pending[:0]
+	return err
+}
+
+func (w *PrefixWriter) write(lines []byte) error {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			buf.Write(w.prefix)
+			buf.Write(line)
+		}
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := w.out.Write(buf.Bytes())
+	return err
+}
+
+/* ---
+ * A writer keeping only the last Limit bytes written to it.
+ * --- */
+type TailBuffer struct {
+	Limit int
+	data  []byte
+	lock  sync.Mutex
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.data = append(b.data, p...)
+	if over := len(b.data) - b.Limit; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+	return len(p), nil
+}
+
+func (b *TailBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return string(b.data)
+}
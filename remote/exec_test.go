@@ -0,0 +1,293 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+/* ---
+ * An SSH server on a local port that serves SFTP from the local
+ * filesystem and runs commands with handler. The
+ * handler's exit status is sent unless it returns false, in which case the
+ * channel is closed without one. done is closed if the client gives up on
+ * the command.
+ * --- */
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	handler  func(command string, stdout, stderr io.Writer, done <-chan struct{}) (int, bool)
+}
+
+func newTestServer(t *testing.T, clientKey ssh.Signer, handler func(command string, stdout, stderr io.Writer, done <-chan struct{}) (int, bool)) *testServer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !bytes.Equal(key.Marshal(), clientKey.PublicKey().Marshal()) {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return nil, nil
+	}}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &testServer{listener: listener, config: config, handler: handler}
+	go server.serve()
+	return server
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(channel, requests)
+			}
+		}()
+	}
+}
+
+func (s *testServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	done := make(chan struct{})
+	for request := range requests {
+		if request.Type == "subsystem" && string(request.Payload[4:]) == "sftp" {
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			server, err := sftp.NewServer(channel)
+			if err == nil {
+				server.Serve()
+			}
+			channel.Close()
+			return
+		}
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		command := string(request.Payload[4:])
+		request.Reply(true, nil)
+		go func() {
+			// The rest of the requests (signals, then the close) end the
+			// command early.
+			for range requests {
+			}
+			close(done)
+		}()
+		status, exited := s.handler(command, channel, channel.Stderr(), done)
+		if exited {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, uint32(status))
+			channel.SendRequest("exit-status", false, payload)
+		}
+		channel.Close()
+		return
+	}
+}
+
+/* ---
+ * Connect to the server as a client with key.
+ * --- */
+func (s *testServer) connect(t *testing.T, key ssh.Signer) *ssh.Client {
+	config := Config{
+		Port:            s.listener.Addr().(*net.TCPAddr).Port,
+		ConnectTimeout:  5 * time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+	}
+	client, err := Connect(context.Background(), config, Host{Name: "test", Address: "127.0.0.1", User: "ec2-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newClientKey(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func runCommands(command string, stdout, stderr io.Writer, done <-chan struct{}) (int, bool) {
+	switch {
+	case command == "greet":
+		fmt.Fprint(stdout, "hello\nwor")
+		fmt.Fprint(stdout, "ld")
+		fmt.Fprint(stderr, "warning\n")
+		return 0, true
+	case strings.HasPrefix(command, "exit "):
+		status, _ := strconv.Atoi(strings.TrimPrefix(command, "exit "))
+		return status, true
+	case command == "drop":
+		return 0, false
+	case command == "sleep":
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+		return 0, true
+	}
+	fmt.Fprintf(stderr, "%s: command not found\n", command)
+	return 127, true
+}
+
+func TestRunExitCodes(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+
+	for command, want := range map[string]int{"exit 0": 0, "exit 3": 3, "exit 255": 255, "missing": 127} {
+		status, err := Run(context.Background(), client, command, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			t.Errorf("%s: %s", command, err)
+		}
+		if status != want {
+			t.Errorf("%s: got exit code %d, want %d", command, status, want)
+		}
+	}
+}
+
+func TestRunExitMissing(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+
+	status, err := Run(context.Background(), client, "drop", ioutil.Discard, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "connection closed before the command exited") {
+		t.Errorf("got error %v, want the missing exit status reported", err)
+	}
+	if status != -1 {
+		t.Errorf("got exit code %d, want -1", status)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	status, err := Run(ctx, client, "sleep", ioutil.Discard, ioutil.Discard)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want the deadline", err)
+	}
+	if status != -1 {
+		t.Errorf("got exit code %d, want -1", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run returned after %s, long after the timeout", elapsed)
+	}
+
+	// The connection is still usable for the next command.
+	if status, err := Run(context.Background(), client, "exit 4", ioutil.Discard, ioutil.Discard); err != nil || status != 4 {
+		t.Errorf("after a timeout: got exit code %d (%v), want 4", status, err)
+	}
+}
+
+func TestRunPrefixedOutput(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+
+	var output bytes.Buffer
+	var lock sync.Mutex
+	stdout := NewPrefixWriter(&output, "web-1 | ", &lock)
+	stderr := NewPrefixWriter(&output, "web-1 | ", &lock)
+	if status, err := Run(context.Background(), client, "greet", stdout, stderr); err != nil || status != 0 {
+		t.Fatalf("got exit code %d (%v), want 0", status, err)
+	}
+	stdout.Flush()
+	stderr.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	got := make(map[string]bool)
+	for _, line := range lines {
+		got[line] = true
+	}
+	for _, want := range []string{"web-1 | hello", "web-1 | world", "web-1 | warning"} {
+		if !got[want] {
+			t.Errorf("output %q is missing line %q", output.String(), want)
+		}
+	}
+	if len(lines) != 3 {
+		t.Errorf("got %d lines, want 3: %q", len(lines), output.String())
+	}
+}
+
+func TestPrefixWriterConcurrentWrites(t *testing.T) {
+	var output bytes.Buffer
+	var lock sync.Mutex
+	writer := NewPrefixWriter(&output, "> ", &lock)
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 4; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			for line := 0; line < 100; line++ {
+				fmt.Fprintf(writer, "writer %d line %d\n", idx, line)
+			}
+		}(idx)
+	}
+	wg.Wait()
+	writer.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 400 {
+		t.Fatalf("got %d lines, want 400", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "> writer ") || strings.Count(line, "writer") != 1 {
+			t.Fatalf("line mangled: %q", line)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := &TailBuffer{Limit: 8}
+	fmt.Fprint(tail, "0123")
+	fmt.Fprint(tail, "456789ab")
+	if got := tail.String(); got != "456789ab" {
+		t.Errorf("got %q, want the last 8 bytes", got)
+	}
+}
@@ -0,0 +1,240 @@
+// Package remote runs commands on and copies files to instances over SSH.
+// Connections go through a Config whose Dial function can be replaced, so
+// the package can be exercised against a local SSH server.
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Default SSH port and connection timeout.
+const (
+	DefaultPort           = 22
+	DefaultConnectTimeout = 15 * time.Second
+)
+
+// Host key checking modes, named after OpenSSH's StrictHostKeyChecking:
+// "yes" only accepts keys in known_hosts, "accept-new" also adds unknown
+// hosts to it (but rejects changed keys) and "no" accepts any key.
+var HostKeyModes = []string{"accept-new", "yes", "no"}
+
+/* ---
+ * Open a network connection. Matches net.Dialer.DialContext.
+ * --- */
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+/* ---
+ * How to connect to hosts. Auth is tried after a host's own key file; it
+ * usually holds the SSH agent. Dial defaults to a TCP dialer.
+ * --- */
+type Config struct {
+	Port            int
+	ConnectTimeout  time.Duration
+	HostKeyCallback ssh.HostKeyCallback
+	Auth            []ssh.AuthMethod
+	Dial            DialFunc
+}
+
+/* ---
+ * A host to connect to.
+ * --- */
+type Host struct {
+	Name         string
+	Address      string
+	User         string
+	IdentityFile string
+}
+
+/* ---
+ * Connect to a host, authenticating with its identity file (if any) and the
+ * config's other auth methods. The connection is closed if ctx is cancelled
+ * while connecting.
+ * --- */
+func Connect(ctx context.Context, config Config, host Host) (*ssh.Client, error) {
+	auth := make([]ssh.AuthMethod, 0, len(config.Auth)+1)
+	if host.IdentityFile != "" {
+		signer, err := loadKey(host.IdentityFile)
+		switch {
+		case err == nil:
+			auth = append(auth, ssh.PublicKeys(signer))
+		case os.IsNotExist(err) && len(config.Auth) > 0:
+			// The key may be in the agent instead.
+		default:
+			return nil, err
+		}
+	}
+	auth = append(auth, config.Auth...)
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no key file or SSH agent to authenticate with")
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	timeout := config.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	dial := config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	hostKeyCallback := config.HostKeyCallback
+	if hostKeyCallback == nil {
+		return nil, fmt.Errorf("no host key callback configured")
+	}
+
+	address := net.JoinHostPort(host.Address, strconv.Itoa(port))
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dial(dialCtx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake does not take a context, so close the connection to
+	// abandon it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-dialCtx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            host.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		conn.Close()
+		if dialCtx.Err() != nil && ctx.Err() == nil {
+			return nil, fmt.Errorf("timed out connecting to %s", address)
+		}
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+/* ---
+ * Get auth methods from the SSH agent at SSH_AUTH_SOCK, if one is running.
+ * --- */
+func AgentAuth() []ssh.AuthMethod {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil
+	}
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}
+}
+
+/* ---
+ * Get a host key callback for a checking mode (see HostKeyModes) using the
+ * known_hosts file at path. In accept-new mode the file is created if
+ * needed and unknown hosts are appended to it.
+ * --- */
+func HostKeyCallback(mode, path string) (ssh.HostKeyCallback, error) {
+	switch mode {
+	case "no":
+		return ssh.InsecureIgnoreHostKey(), nil
+	case "yes", "accept-new":
+	default:
+		return nil, fmt.Errorf("Unknown host key checking mode %q, expected one of %s", mode, strings.Join(HostKeyModes, ", "))
+	}
+
+	path = ExpandHome(path)
+	if mode == "accept-new" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	}
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "yes" {
+		return known, nil
+	}
+
+	// Hosts are checked in parallel, so appends (and the callback's view of
+	// them) are serialized.
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := known(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) > 0 {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+			return err
+		}
+		// Reload so the new key is known for the rest of the run.
+		known, err = knownhosts.New(path)
+		return err
+	}, nil
+}
+
+/* ---
+ * Expand a leading ~/ to the user's home directory.
+ * --- */
+func ExpandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+/* ---
+ * Load an unencrypted private key. Encrypted keys should be added to the
+ * SSH agent instead.
+ * --- */
+func loadKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(ExpandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("%s is encrypted; add it to the SSH agent with ssh-add", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key %s: %s", path, err)
+	}
+	return signer, nil
+}
@@ -0,0 +1,399 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Suffix of files being transferred. A transfer that is interrupted leaves
+// the .part file behind and the next transfer of the file resumes from it.
+const PartialSuffix = ".part"
+
+/* ---
+ * The operations a transfer needs from the filesystem at each end.
+ * --- */
+type fileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadSeekCloser, error)
+	Append(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Rename(from, to string) error
+	Remove(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Walk(root string, fn func(name string, info os.FileInfo) error) error
+	Join(elem ...string) string
+	Rel(base, target string) (string, error)
+	Hash(ctx context.Context, name string) (string, error)
+}
+
+/* ---
+ * Copy a file or directory from local to remote over client. A file is
+ * copied to dst, or into it if dst is an existing directory; a directory is
+ * copied to dst with its contents. Files already at the destination with the
+ * same checksum are skipped, as are symbolic links, special files and
+ * partial transfer files. hashes holds source checksums already worked out
+ * (see HashSources); other files are hashed as they are copied.
+ * --- */
+func Push(ctx context.Context, client *ssh.Client, src, dst string, hashes map[string]string) ([]datamodels.TransferFile, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer sftpClient.Close()
+	return transfer(ctx, localFS{}, &sftpFS{client: sftpClient, ssh: client}, src, dst, hashes)
+}
+
+/* ---
+ * Copy a file or directory from remote to local over client, as for Push.
+ * --- */
+func Pull(ctx context.Context, client *ssh.Client, src, dst string) ([]datamodels.TransferFile, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer sftpClient.Close()
+	return transfer(ctx, &sftpFS{client: sftpClient, ssh: client}, localFS{}, src, dst, nil)
+}
+
+/* ---
+ * Work out the sha256 of each file a push of src would copy, keyed by path,
+ * so sources are read once rather than once per instance. Files that can
+ * not be read are left out; they fail when they are copied.
+ * --- */
+func HashSources(ctx context.Context, src string) (map[string]string, error) {
+	from := localFS{}
+	hashes := make(map[string]string)
+	info, err := from.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", src, err)
+	}
+	if !info.IsDir() {
+		if hash, err := from.Hash(ctx, src); err == nil {
+			hashes[src] = hash
+		}
+		return hashes, ctx.Err()
+	}
+	err = from.Walk(src, func(name string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || skipReason(name, info) != "" {
+			return nil
+		}
+		if hash, err := from.Hash(ctx, name); err == nil {
+			hashes[name] = hash
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+func transfer(ctx context.Context, from, to fileSystem, src, dst string, hashes map[string]string) ([]datamodels.TransferFile, error) {
+	info, err := from.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", src, err)
+	}
+	if !info.IsDir() {
+		if dstInfo, err := to.Stat(dst); err == nil && dstInfo.IsDir() {
+			dst = to.Join(dst, path.Base(filepath.ToSlash(src)))
+		}
+		return []datamodels.TransferFile{copyFile(ctx, from, to, src, dst, info, hashes)}, nil
+	}
+
+	files := make([]datamodels.TransferFile, 0)
+	err = from.Walk(src, func(name string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := from.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := to.Join(append([]string{dst}, strings.Split(filepath.ToSlash(rel), "/")...)...)
+		if info.IsDir() {
+			return to.MkdirAll(target)
+		}
+		if reason := skipReason(name, info); reason != "" {
+			files = append(files, datamodels.TransferFile{Path: target, Size: info.Size(), Skipped: true, SkipReason: reason})
+			return nil
+		}
+		files = append(files, copyFile(ctx, from, to, name, target, info, hashes))
+		return nil
+	})
+	return files, err
+}
+
+/* ---
+ * Why a file found in a directory being copied is left out, or "" if it is
+ * copied. Links are not followed, and .part files are left by interrupted
+ * transfers rather than being part of the source.
+ * --- */
+func skipReason(name string, info os.FileInfo) string {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return datamodels.SkipSymlink
+	case !info.Mode().IsRegular():
+		return datamodels.SkipSpecial
+	case strings.HasSuffix(name, PartialSuffix):
+		return datamodels.SkipPartial
+	}
+	return ""
+}
+
+/* ---
+ * Copy one file through a .part file, resuming a partial earlier copy, and
+ * check the copy's checksum before moving it into place. The source is
+ * hashed unless its checksum is in hashes.
+ * --- */
+func copyFile(ctx context.Context, from, to fileSystem, src, dst string, info os.FileInfo, hashes map[string]string) datamodels.TransferFile {
+	file := datamodels.TransferFile{Path: dst, Size: info.Size()}
+	fail := func(err error) datamodels.TransferFile {
+		file.Error = err.Error()
+		return file
+	}
+
+	srcHash, ok := hashes[src]
+	if !ok {
+		var err error
+		if srcHash, err = from.Hash(ctx, src); err != nil {
+			return fail(err)
+		}
+	}
+	file.SHA256 = srcHash
+	if existing, err := to.Stat(dst); err == nil && existing.Size() == info.Size() {
+		if dstHash, err := to.Hash(ctx, dst); err == nil && dstHash == srcHash {
+			file.Skipped = true
+			file.SkipReason = datamodels.SkipUpToDate
+			file.Verified = true
+			return file
+		}
+	}
+
+	partial := dst + PartialSuffix
+	if existing, err := to.Stat(partial); err == nil && existing.Size() <= info.Size() {
+		file.Resumed = existing.Size()
+	} else if err == nil {
+		to.Remove(partial)
+	}
+	if err := copyRange(ctx, from, to, src, partial, file.Resumed); err != nil {
+		return fail(err)
+	}
+	file.Sent = info.Size() - file.Resumed
+
+	dstHash, err := to.Hash(ctx, partial)
+	if err != nil {
+		return fail(err)
+	}
+	if dstHash != srcHash {
+		// Start again next time rather than resuming from a bad copy.
+		to.Remove(partial)
+		return fail(fmt.Errorf("checksum mismatch after copy (sha256 %s, expected %s)", dstHash, srcHash))
+	}
+	file.Verified = true
+	to.Chmod(partial, info.Mode().Perm())
+	if err := to.Rename(partial, dst); err != nil {
+		return fail(err)
+	}
+	return file
+}
+
+/* ---
+ * Append src from offset onwards to dst.
+ * --- */
+func copyRange(ctx context.Context, from, to fileSystem, src, dst string, offset int64) error {
+	in, err := from.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := to.Append(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, contextReader{ctx: ctx, r: in}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+/* ---
+ * A reader that stops once its context is cancelled.
+ * --- */
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func hashReader(ctx context.Context, r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: r}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* ---
+ * The local filesystem.
+ * --- */
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error)       { return os.Stat(name) }
+func (localFS) Open(name string) (io.ReadSeekCloser, error) { return os.Open(name) }
+func (localFS) Append(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+func (localFS) MkdirAll(name string) error                { return os.MkdirAll(name, 0755) }
+func (localFS) Rename(from, to string) error              { return os.Rename(from, to) }
+func (localFS) Remove(name string) error                  { return os.Remove(name) }
+func (localFS) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (localFS) Join(elem ...string) string                { return filepath.Join(elem...) }
+func (localFS) Rel(base, target string) (string, error)   { return filepath.Rel(base, target) }
+func (localFS) Walk(root string, fn func(string, os.FileInfo) error) error {
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(name, info)
+	})
+}
+func (localFS) Hash(ctx context.Context, name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(ctx, f)
+}
+
+/* ---
+ * An instance's filesystem over SFTP. Checksums are worked out on the
+ * instance with sha256sum where it is installed rather than by reading the
+ * file back.
+ * --- */
+type sftpFS struct {
+	client   *sftp.Client
+	ssh      *ssh.Client
+	noSha256 bool
+}
+
+func (s *sftpFS) Stat(name string) (os.FileInfo, error)       { return s.client.Stat(name) }
+func (s *sftpFS) Open(name string) (io.ReadSeekCloser, error) { return s.client.Open(name) }
+func (s *sftpFS) Append(name string) (io.WriteCloser, error) {
+	if err := s.client.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	// SFTP writes go to explicit offsets, so O_APPEND alone would write
+	// from the start of the file.
+	f, err := s.client.OpenFile(name, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+func (s *sftpFS) MkdirAll(name string) error                { return s.client.MkdirAll(name) }
+func (s *sftpFS) Remove(name string) error                  { return s.client.Remove(name) }
+func (s *sftpFS) Chmod(name string, mode os.FileMode) error { return s.client.Chmod(name, mode) }
+func (s *sftpFS) Join(elem ...string) string                { return path.Join(elem...) }
+func (s *sftpFS) Rel(base, target string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(target, base), "/")
+	if rel == "" {
+		rel = "."
+	}
+	return rel, nil
+}
+
+func (s *sftpFS) Rename(from, to string) error {
+	err := s.client.PosixRename(from, to)
+	if err == nil {
+		return nil
+	}
+	// Servers without the posix-rename extension only have plain SFTP
+	// rename, which fails if the target exists. Only then is the target
+	// removed first.
+	if err = s.client.Rename(from, to); err == nil {
+		return nil
+	}
+	if _, statErr := s.client.Stat(from); statErr != nil {
+		return err
+	}
+	if target, statErr := s.client.Stat(to); statErr != nil || target.IsDir() {
+		return err
+	}
+	if err := s.client.Remove(to); err != nil {
+		return err
+	}
+	return s.client.Rename(from, to)
+}
+
+func (s *sftpFS) Walk(root string, fn func(string, os.FileInfo) error) error {
+	walker := s.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpFS) Hash(ctx context.Context, name string) (string, error) {
+	if !s.noSha256 {
+		var out bytes.Buffer
+		code, err := Run(ctx, s.ssh, "sha256sum -- "+shellQuote(name), &out, ioutil.Discard)
+		if err != nil {
+			return "", err
+		}
+		if fields := strings.Fields(out.String()); code == 0 && len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+			return fields[0], nil
+		}
+		if code == 127 {
+			s.noSha256 = true
+		}
+	}
+	f, err := s.client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(ctx, f)
+}
+
+/* ---
+ * Quote a string for a POSIX shell.
+ * --- */
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,274 @@
+package remote
+
+import (
+	"context"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+/* ---
+ * Make a source directory holding three files, a link and a .part file
+ * left by an interrupted transfer.
+ * --- */
+func writeSourceTree(t *testing.T) string {
+	src := t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":       "alpha\n",
+		"sub/b.txt":   "bravo\n",
+		"c.txt.part":  "char",
+		"sub/d.empty": "",
+	} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func transferredFiles(files []datamodels.TransferFile, dst string) map[string]datamodels.TransferFile {
+	byName := make(map[string]datamodels.TransferFile)
+	for _, file := range files {
+		byName[filepath.ToSlash(strings.TrimPrefix(file.Path, dst+"/"))] = file
+	}
+	return byName
+}
+
+func TestHashSources(t *testing.T) {
+	src := writeSourceTree(t)
+	hashes, err := HashSources(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 3 {
+		t.Errorf("got hashes for %v, want a.txt, sub/b.txt and sub/d.empty", hashes)
+	}
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := hashes[filepath.Join(src, "sub", "d.empty")]; got != want {
+		t.Errorf("empty file: got sha256 %s, want %s", got, want)
+	}
+	if _, err := HashSources(context.Background(), filepath.Join(src, "missing")); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
+
+func TestPush(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+	src := writeSourceTree(t)
+	dst := filepath.Join(t.TempDir(), "copy")
+	hashes, err := HashSources(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Push(context.Background(), client, src, dst, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := transferredFiles(files, dst)
+	if len(byName) != 5 {
+		t.Errorf("got files %v, want 5", byName)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/d.empty"} {
+		if file := byName[name]; file.Error != "" || file.Skipped || !file.Verified {
+			t.Errorf("%s: got %+v, want a verified copy", name, file)
+		}
+	}
+	if file := byName["link.txt"]; !file.Skipped || file.SkipReason != datamodels.SkipSymlink {
+		t.Errorf("link.txt: got %+v, want skipped as a link", file)
+	}
+	if file := byName["c.txt.part"]; !file.Skipped || file.SkipReason != datamodels.SkipPartial {
+		t.Errorf("c.txt.part: got %+v, want skipped as a partial file", file)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b.txt"))
+	if err != nil || string(data) != "bravo\n" {
+		t.Errorf("sub/b.txt: got %q (%v)", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("a.txt: mode not kept: %v %v", info, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "link.txt")); !os.IsNotExist(err) {
+		t.Errorf("link.txt was copied")
+	}
+
+	// A second push finds everything up to date.
+	files, err = Push(context.Background(), client, src, dst, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, file := range transferredFiles(files, dst) {
+		if !file.Skipped || file.Error != "" {
+			t.Errorf("second push: %s: got %+v, want skipped", name, file)
+		}
+		if strings.HasSuffix(name, ".txt") && name != "link.txt" && file.SkipReason != datamodels.SkipUpToDate {
+			t.Errorf("second push: %s: got reason %q, want up to date", name, file.SkipReason)
+		}
+	}
+}
+
+func TestPushUsesGivenHashes(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+	src := filepath.Join(t.TempDir(), "a.txt")
+	if err := ioutil.WriteFile(src, []byte("alpha\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "a.txt")
+
+	// A source hash that does not match the file fails the copy's check,
+	// so the given hash must be the one checked against.
+	hashes := map[string]string{src: strings.Repeat("0", 64)}
+	files, err := Push(context.Background(), client, src, dst, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.Contains(files[0].Error, "checksum mismatch") {
+		t.Fatalf("got %+v, want a checksum mismatch", files)
+	}
+	if _, err := os.Stat(dst + PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("bad partial copy left behind")
+	}
+
+	// Without a given hash the file is hashed as it is copied.
+	files, err = Push(context.Background(), client, src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Error != "" || !files[0].Verified {
+		t.Errorf("got %+v, want a verified copy", files)
+	}
+}
+
+func TestPushResumes(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+	src := filepath.Join(t.TempDir(), "data.bin")
+	content := "0123456789abcdef"
+	if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		partial string
+		resumed int64
+		err     string
+	}{
+		{"partial copy", content[:6], 6, ""},
+		{"oversize partial copy", content + "left over", 0, ""},
+		{"complete partial copy", content, 16, ""},
+		{"partial copy of another file", "zzzzzz", 6, "checksum mismatch"},
+	}
+	for _, test := range tests {
+		dst := filepath.Join(t.TempDir(), "data.bin")
+		if err := ioutil.WriteFile(dst+PartialSuffix, []byte(test.partial), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files, err := Push(context.Background(), client, src, dst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := files[0]
+		if file.Resumed != test.resumed || file.Sent != int64(len(content))-test.resumed {
+			t.Errorf("%s: got resumed %d sent %d, want resumed %d sent %d", test.name, file.Resumed, file.Sent, test.resumed, int64(len(content))-test.resumed)
+		}
+		if _, err := os.Stat(dst + PartialSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: partial copy left behind", test.name)
+		}
+		if test.err != "" {
+			if !strings.Contains(file.Error, test.err) {
+				t.Errorf("%s: got error %q, want %s", test.name, file.Error, test.err)
+			}
+			continue
+		}
+		if file.Error != "" || !file.Verified {
+			t.Errorf("%s: got %+v, want a verified copy", test.name, file)
+		}
+		if data, err := ioutil.ReadFile(dst); err != nil || string(data) != content {
+			t.Errorf("%s: got %q (%v), want %q", test.name, data, err, content)
+		}
+	}
+}
+
+func TestPull(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+	src := writeSourceTree(t)
+	dst := filepath.Join(t.TempDir(), "web-1")
+
+	files, err := Pull(context.Background(), client, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := transferredFiles(files, dst)
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/d.empty"} {
+		if file := byName[name]; file.Error != "" || file.Skipped || !file.Verified {
+			t.Errorf("%s: got %+v, want a verified copy", name, file)
+		}
+	}
+	if file := byName["link.txt"]; !file.Skipped || file.SkipReason != datamodels.SkipSymlink {
+		t.Errorf("link.txt: got %+v, want skipped as a link", file)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b.txt")); err != nil || string(data) != "bravo\n" {
+		t.Errorf("sub/b.txt: got %q (%v)", data, err)
+	}
+
+	// A single file is pulled into an existing directory.
+	files, err = Pull(context.Background(), client, filepath.Join(src, "a.txt"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != filepath.Join(dst, "a.txt") || files[0].SkipReason != datamodels.SkipUpToDate {
+		t.Errorf("got %+v, want a.txt in %s up to date", files, dst)
+	}
+	if _, err := Pull(context.Background(), client, filepath.Join(src, "missing"), dst); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
+
+func TestSFTPRename(t *testing.T) {
+	key := newClientKey(t)
+	client := newTestServer(t, key, runCommands).connect(t, key)
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpClient.Close()
+	fs := &sftpFS{client: sftpClient, ssh: client}
+
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "new"), filepath.Join(dir, "old")
+	for name, data := range map[string]string{from: "new", to: "old"} {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed rename leaves the target alone.
+	if err := fs.Rename(filepath.Join(dir, "missing"), to); err == nil {
+		t.Error("expected an error renaming a missing file")
+	}
+	if data, err := ioutil.ReadFile(to); err != nil || string(data) != "old" {
+		t.Errorf("target changed by a failed rename: %q (%v)", data, err)
+	}
+
+	if err := fs.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(to); err != nil || string(data) != "new" {
+		t.Errorf("got %q (%v), want the target replaced", data, err)
+	}
+}
@@ -0,0 +1,209 @@
+// Package schedule parses cron expressions and works out when instance
+// schedules last asked for instances to be started or stopped.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ---
+ * A parsed five field cron expression: minute, hour, day of month, month and
+ * day of week. Fields accept *, numbers, ranges (1-5), lists (1,3,5), steps
+ * (*\/15, 8-18/2) and month and weekday names (jan, mon-fri).
+ * --- */
+type Cron struct {
+	expression string
+	minutes    [60]bool
+	hours      [24]bool
+	days       [32]bool
+	months     [13]bool
+	weekdays   [7]bool
+
+	// Standard cron matches either day field when both are restricted. A
+	// field is unrestricted if it selects every value.
+	anyDay     bool
+	anyWeekday bool
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var shortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+/* ---
+ * Parse a cron expression.
+ * --- */
+func ParseCron(expression string) (*Cron, error) {
+	expression = strings.TrimSpace(expression)
+	fields := strings.Fields(expression)
+	if shortcut, ok := shortcuts[strings.ToLower(expression)]; ok {
+		fields = strings.Fields(shortcut)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression %q, expected 5 fields", expression)
+	}
+
+	c := &Cron{expression: expression}
+	var weekdays [8]bool
+	steps := []struct {
+		field    string
+		values   []bool
+		min, max int
+		names    map[string]int
+	}{
+		{fields[0], c.minutes[:], 0, 59, nil},
+		{fields[1], c.hours[:], 0, 23, nil},
+		{fields[2], c.days[:], 1, 31, nil},
+		{fields[3], c.months[:], 1, 12, monthNames},
+		{fields[4], weekdays[:], 0, 7, weekdayNames},
+	}
+	for _, step := range steps {
+		if err := parseField(step.field, step.values, step.min, step.max, step.names); err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %q: %s", expression, err)
+		}
+	}
+
+	// 7 is another name for Sunday.
+	for day := 0; day < 7; day++ {
+		c.weekdays[day] = weekdays[day]
+	}
+	c.weekdays[0] = c.weekdays[0] || weekdays[7]
+	c.anyDay = allSet(c.days[1:])
+	c.anyWeekday = allSet(c.weekdays[:])
+	return c, nil
+}
+
+/* ---
+ * Check if a field selects every value, however it was written (e.g., *,
+ * *\/1 or 0-6 for weekdays).
+ * --- */
+func allSet(values []bool) bool {
+	for _, set := range values {
+		if !set {
+			return false
+		}
+	}
+	return true
+}
+
+/* ---
+ * Set values[n] for every n the field selects.
+ * --- */
+func parseField(field string, values []bool, min, max int, names map[string]int) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0], min, max, names); err != nil {
+				return err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = parseValue(bounds[1], min, max, names); err != nil {
+					return err
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5.
+				high = max
+			}
+			if high < low {
+				return fmt.Errorf("invalid range %q", part)
+			}
+		}
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return nil
+}
+
+func parseValue(value string, min, max int, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q is not between %d and %d", value, min, max)
+	}
+	return n, nil
+}
+
+func (c *Cron) String() string {
+	return c.expression
+}
+
+/* ---
+ * Check if the expression fires at the minute containing t (in t's
+ * location).
+ * --- */
+func (c *Cron) Matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[t.Month()] {
+		return false
+	}
+	dayMatch := c.days[t.Day()]
+	weekdayMatch := c.weekdays[t.Weekday()]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekdayMatch
+	case c.anyWeekday:
+		return dayMatch
+	default:
+		return dayMatch || weekdayMatch
+	}
+}
+
+/* ---
+ * Get the latest time at or before t the expression fires, looking back at
+ * most limit. Returns false if it does not fire in that time.
+ * --- */
+func (c *Cron) Prev(t time.Time, limit time.Duration) (time.Time, bool) {
+	earliest := t.Add(-limit)
+	for candidate := t.Truncate(time.Minute); !candidate.Before(earliest); candidate = candidate.Add(-time.Minute) {
+		if c.Matches(candidate) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/* ---
+ * Get the first time after t the expression fires, looking ahead at most
+ * limit. Returns false if it does not fire in that time.
+ * --- */
+func (c *Cron) Next(t time.Time, limit time.Duration) (time.Time, bool) {
+	latest := t.Add(limit)
+	for candidate := t.Truncate(time.Minute).Add(time.Minute); !candidate.After(latest); candidate = candidate.Add(time.Minute) {
+		if c.Matches(candidate) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
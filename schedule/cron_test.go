@@ -0,0 +1,150 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+/* ---
+ * Get a time in New York, where the clocks change on 10 March and 3
+ * November 2024.
+ * --- */
+func newYork(t *testing.T, value string) time.Time {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available:", err)
+	}
+	at, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		matches    []string
+		misses     []string
+	}{
+		{"0 8 * * mon-fri", []string{"2024-03-04 08:00", "2024-03-08 08:00"}, []string{"2024-03-04 08:01", "2024-03-09 08:00", "2024-03-10 08:00"}},
+		{"*/15 9-17 * * *", []string{"2024-03-04 09:00", "2024-03-04 09:45", "2024-03-04 17:30"}, []string{"2024-03-04 09:10", "2024-03-04 18:00", "2024-03-04 08:45"}},
+		{"5/20 * * * *", []string{"2024-03-04 10:05", "2024-03-04 10:25", "2024-03-04 10:45"}, []string{"2024-03-04 10:00", "2024-03-04 10:20"}},
+		{"0 8-18/2 * * *", []string{"2024-03-04 08:00", "2024-03-04 18:00"}, []string{"2024-03-04 09:00", "2024-03-04 20:00"}},
+		{"0 0 1,15 jan,JUL *", []string{"2024-01-01 00:00", "2024-07-15 00:00"}, []string{"2024-02-01 00:00", "2024-01-02 00:00"}},
+		{"30 12 * * 7", []string{"2024-03-03 12:30"}, []string{"2024-03-02 12:30", "2024-03-04 12:30"}},
+		{"30 12 * * sun", []string{"2024-03-03 12:30"}, []string{"2024-03-04 12:30"}},
+		{"0 9 * * 5-7", []string{"2024-03-01 09:00", "2024-03-02 09:00", "2024-03-03 09:00"}, []string{"2024-03-04 09:00"}},
+		{"@daily", []string{"2024-03-04 00:00"}, []string{"2024-03-04 01:00"}},
+		{"@weekly", []string{"2024-03-03 00:00"}, []string{"2024-03-04 00:00"}},
+		// Both day fields restricted: either matches.
+		{"0 0 13 * fri", []string{"2024-09-13 00:00", "2024-09-06 00:00", "2024-10-13 00:00"}, []string{"2024-09-12 00:00"}},
+		// Only one restricted, however the other is written: that one must match.
+		{"0 0 13 * *", []string{"2024-10-13 00:00"}, []string{"2024-09-06 00:00"}},
+		{"0 0 13 * */1", []string{"2024-10-13 00:00"}, []string{"2024-09-06 00:00"}},
+		{"0 0 13 * 0-6", []string{"2024-10-13 00:00"}, []string{"2024-09-06 00:00"}},
+		{"0 0 */1 * fri", []string{"2024-09-06 00:00"}, []string{"2024-10-13 00:00", "2024-09-12 00:00"}},
+		{"0 0 1-31 * fri", []string{"2024-09-06 00:00"}, []string{"2024-10-13 00:00"}},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+		for _, value := range test.matches {
+			if !cron.Matches(newYork(t, value)) {
+				t.Errorf("%s: does not match %s", test.expression, value)
+			}
+		}
+		for _, value := range test.misses {
+			if cron.Matches(newYork(t, value)) {
+				t.Errorf("%s: matches %s", test.expression, value)
+			}
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"0 8 * *",
+		"0 8 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * * funday",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"0 18-8 * * *",
+		"@yearly",
+	} {
+		if _, err := ParseCron(expression); err == nil {
+			t.Errorf("%q: parsed without an error", expression)
+		}
+	}
+}
+
+func TestCronNextPrev(t *testing.T) {
+	cron, err := ParseCron("0 8 * * mon-fri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from, next, prev string
+	}{
+		{"2024-03-04 07:59", "2024-03-04 08:00", "2024-03-01 08:00"},
+		{"2024-03-04 08:00", "2024-03-05 08:00", "2024-03-04 08:00"},
+		{"2024-03-08 12:00", "2024-03-11 08:00", "2024-03-08 08:00"},
+		// Across the spring and autumn clock changes, on Sunday at 02:00.
+		{"2024-03-09 12:00", "2024-03-11 08:00", "2024-03-08 08:00"},
+		{"2024-11-02 12:00", "2024-11-04 08:00", "2024-11-01 08:00"},
+	}
+	for _, test := range tests {
+		from := newYork(t, test.from)
+		if next, ok := cron.Next(from, 8*24*time.Hour); !ok || !next.Equal(newYork(t, test.next)) {
+			t.Errorf("next after %s: got %s (%t), want %s", test.from, next, ok, test.next)
+		}
+		if prev, ok := cron.Prev(from, 8*24*time.Hour); !ok || !prev.Equal(newYork(t, test.prev)) {
+			t.Errorf("at or before %s: got %s (%t), want %s", test.from, prev, ok, test.prev)
+		}
+	}
+
+	if _, ok := cron.Next(newYork(t, "2024-03-08 12:00"), 24*time.Hour); ok {
+		t.Error("found an event past the limit")
+	}
+	if _, ok := cron.Prev(newYork(t, "2024-03-11 07:00"), 24*time.Hour); ok {
+		t.Error("found an event before the limit")
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	// 02:30 does not exist on 10 March 2024 in New York.
+	cron, err := ParseCron("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, ok := cron.Next(newYork(t, "2024-03-10 01:00"), 48*time.Hour)
+	if !ok || !next.Equal(newYork(t, "2024-03-11 02:30")) {
+		t.Errorf("got %s, want the skipped time passed over", next)
+	}
+
+	// The day of the autumn change is 25 hours long and the day of the
+	// spring change 23, but events stay at the same local time.
+	cron, err = ParseCron("0 19 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range []string{"2024-03-09", "2024-11-02"} {
+		from := newYork(t, day+" 19:00")
+		next, ok := cron.Next(from, 48*time.Hour)
+		if !ok || next.Hour() != 19 || next.Day() != from.Day()+1 {
+			t.Errorf("after %s: got %s, want 19:00 the next day", from, next)
+		}
+		if gap := next.Sub(from); gap == 24*time.Hour {
+			t.Errorf("after %s: got a 24 hour gap over a clock change", from)
+		}
+	}
+}
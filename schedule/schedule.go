@@ -0,0 +1,149 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How far back and ahead to look for schedule events. Every sensible
+// office-hours schedule fires at least once a week.
+const EventHorizon = 8 * 24 * time.Hour
+
+/* ---
+ * When a group of instances should be started and stopped. Either cron
+ * expression may be nil, e.g., for a schedule that only stops instances.
+ * The expressions are evaluated in Location.
+ * --- */
+type Schedule struct {
+	Name     string
+	Start    *Cron
+	Stop     *Cron
+	Location *time.Location
+}
+
+/* ---
+ * A point at which a schedule starts or stops instances.
+ * --- */
+type Event struct {
+	Action string // "start" or "stop"
+	At     time.Time
+}
+
+/* ---
+ * Create a schedule from start and stop cron expressions and a time zone
+ * name. An empty time zone means UTC.
+ * --- */
+func New(name, start, stop, timeZone string) (*Schedule, error) {
+	s := &Schedule{Name: name, Location: time.UTC}
+	var err error
+	if start == "" && stop == "" {
+		return nil, fmt.Errorf("Schedule %s must set start, stop or both", name)
+	}
+	if start != "" {
+		if s.Start, err = ParseCron(start); err != nil {
+			return nil, fmt.Errorf("Schedule %s: %s", name, err)
+		}
+	}
+	if stop != "" {
+		if s.Stop, err = ParseCron(stop); err != nil {
+			return nil, fmt.Errorf("Schedule %s: %s", name, err)
+		}
+	}
+	if timeZone != "" {
+		if s.Location, err = time.LoadLocation(timeZone); err != nil {
+			return nil, fmt.Errorf("Schedule %s: unknown time zone %q", name, timeZone)
+		}
+	}
+	return s, nil
+}
+
+/* ---
+ * Parse a schedule written inline in a Schedule tag, e.g.,
+ * "start=0 8 * * mon-fri; stop=0 19 * * mon-fri; tz=America/New_York".
+ * --- */
+func ParseInline(name, value string) (*Schedule, error) {
+	var start, stop, timeZone string
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Schedule %s: expected key=value, got %q", name, part)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "start":
+			start = strings.TrimSpace(kv[1])
+		case "stop":
+			stop = strings.TrimSpace(kv[1])
+		case "tz", "timezone":
+			timeZone = strings.TrimSpace(kv[1])
+		default:
+			return nil, fmt.Errorf("Schedule %s: unknown key %q", name, kv[0])
+		}
+	}
+	return New(name, start, stop, timeZone)
+}
+
+/* ---
+ * Get the most recent start or stop at or before now. If both fire in the
+ * same minute, stop wins. Returns false if neither fired within
+ * EventHorizon.
+ * --- */
+func (s *Schedule) LastEvent(now time.Time) (Event, bool) {
+	now = now.In(s.Location)
+	last := Event{}
+	found := false
+	for _, candidate := range []struct {
+		action string
+		cron   *Cron
+	}{{"start", s.Start}, {"stop", s.Stop}} {
+		if candidate.cron == nil {
+			continue
+		}
+		at, ok := candidate.cron.Prev(now, EventHorizon)
+		if ok && (!found || !at.Before(last.At)) {
+			last = Event{Action: candidate.action, At: at}
+			found = true
+		}
+	}
+	return last, found
+}
+
+/* ---
+ * Get the next start or stop after now. Returns false if neither fires
+ * within EventHorizon.
+ * --- */
+func (s *Schedule) NextEvent(now time.Time) (Event, bool) {
+	now = now.In(s.Location)
+	next := Event{}
+	found := false
+	for _, candidate := range []struct {
+		action string
+		cron   *Cron
+	}{{"start", s.Start}, {"stop", s.Stop}} {
+		if candidate.cron == nil {
+			continue
+		}
+		at, ok := candidate.cron.Next(now, EventHorizon)
+		if ok && (!found || at.Before(next.At)) {
+			next = Event{Action: candidate.action, At: at}
+			found = true
+		}
+	}
+	return next, found
+}
+
+func (s *Schedule) String() string {
+	parts := make([]string, 0, 3)
+	if s.Start != nil {
+		parts = append(parts, "start="+s.Start.String())
+	}
+	if s.Stop != nil {
+		parts = append(parts, "stop="+s.Stop.String())
+	}
+	parts = append(parts, "tz="+s.Location.String())
+	return strings.Join(parts, "; ")
+}
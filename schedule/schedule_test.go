@@ -0,0 +1,78 @@
+package schedule
+
+import "testing"
+
+func TestLastEvent(t *testing.T) {
+	office, err := ParseInline("office", "start=0 8 * * mon-fri; stop=0 19 * * mon-fri; tz=America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available:", err)
+	}
+	tests := []struct {
+		now    string
+		action string
+		at     string
+	}{
+		{"2024-03-04 07:59", "stop", "2024-03-01 19:00"},
+		{"2024-03-04 08:00", "start", "2024-03-04 08:00"},
+		{"2024-03-04 18:59", "start", "2024-03-04 08:00"},
+		{"2024-03-09 12:00", "stop", "2024-03-08 19:00"},
+		// Monday morning after the clocks go forward or back.
+		{"2024-03-11 08:30", "start", "2024-03-11 08:00"},
+		{"2024-11-04 07:30", "stop", "2024-11-01 19:00"},
+	}
+	for _, test := range tests {
+		event, ok := office.LastEvent(newYork(t, test.now).UTC())
+		if !ok || event.Action != test.action || !event.At.Equal(newYork(t, test.at)) {
+			t.Errorf("at %s: got %s at %s (%t), want %s at %s", test.now, event.Action, event.At, ok, test.action, test.at)
+		}
+		if event.At.Location() != office.Location {
+			t.Errorf("at %s: event in %s, want the schedule's time zone", test.now, event.At.Location())
+		}
+	}
+
+	next, ok := office.NextEvent(newYork(t, "2024-03-08 19:00"))
+	if !ok || next.Action != "start" || !next.At.Equal(newYork(t, "2024-03-11 08:00")) {
+		t.Errorf("got next %s at %s (%t), want start on Monday", next.Action, next.At, ok)
+	}
+}
+
+func TestLastEventStopWins(t *testing.T) {
+	both, err := New("both", "0 12 * * *", "0 12 * * *", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := both.LastEvent(newYork(t, "2024-03-04 12:00"))
+	if !ok || event.Action != "stop" {
+		t.Errorf("got %s (%t), want stop when both fire in the same minute", event.Action, ok)
+	}
+
+	stopOnly, err := New("stop-only", "", "0 19 * * *", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, ok := stopOnly.LastEvent(newYork(t, "2024-03-04 12:00")); !ok || event.Action != "stop" {
+		t.Errorf("got %s (%t), want the last stop", event.Action, ok)
+	}
+	never, err := New("never", "0 0 31 feb *", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := never.LastEvent(newYork(t, "2024-03-04 12:00")); ok {
+		t.Error("found an event for a schedule that never fires")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, test := range [][3]string{
+		{"", "", ""},
+		{"0 8 * * *", "0 25 * * *", ""},
+		{"0 8 * * *", "", "Mars/Olympus_Mons"},
+	} {
+		if _, err := New("test", test[0], test[1], test[2]); err == nil {
+			t.Errorf("%q: created without an error", test)
+		}
+	}
+	if _, err := ParseInline("test", "start=0 8 * * *; when=never"); err == nil {
+		t.Error("unknown key accepted")
+	}
+}
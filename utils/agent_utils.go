@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+// Where user data installs the agent and its config on launched instances.
+const (
+	AgentInstallPath = "/usr/local/bin/cloud_control_agent"
+	AgentConfigPath  = "/etc/cloud_control_agent.conf"
+)
+
+/* ---
+ * Agent settings used when not configured: check every five minutes, treat
+ * a job directory untouched for ten minutes as finished, and stop after
+ * half an hour without work or logged in users.
+ * --- */
+func DefaultAgentConfig() datamodels.AgentConfig {
+	return datamodels.AgentConfig{
+		Processes:   make([]string, 0),
+		QuietPeriod: 10 * time.Minute,
+		IdleAfter:   30 * time.Minute,
+		Interval:    5 * time.Minute,
+		CheckUsers:  true,
+		RequireJob:  true,
+	}
+}
+
+/* ---
+ * Load an agent config file. See AgentConfigText for the format.
+ * --- */
+func LoadAgentConfig(path string) (datamodels.AgentConfig, error) {
+	// Make sure the config file exists. If configuration is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return DefaultAgentConfig(), fmt.Errorf("No agent config file found at: %s", path)
+	}
+	configFile, err := ini.LoadFile(path)
+	if err != nil {
+		return DefaultAgentConfig(), err
+	}
+	config, err := loadAgentSettings(configFile, "agent", "")
+	if err != nil {
+		return config, fmt.Errorf("Agent config %s: %s", path, err)
+	}
+	return config, nil
+}
+
+/* ---
+ * Read agent settings from section, with each key prefixed by prefix (so
+ * a launch config can carry them as agent_<key>).
+ * --- */
+func loadAgentSettings(configFile ini.File, section, prefix string) (datamodels.AgentConfig, error) {
+	config := DefaultAgentConfig()
+	get := func(key string) string {
+		value, _ := configFile.Get(section, prefix+key)
+		return strings.TrimSpace(value)
+	}
+
+	for _, process := range strings.Split(get("processes"), ",") {
+		if process = strings.TrimSpace(process); process != "" {
+			config.Processes = append(config.Processes, process)
+		}
+	}
+	config.JobDir = get("job_dir")
+	for key, setting := range map[string]*time.Duration{"quiet_period": &config.QuietPeriod, "idle_after": &config.IdleAfter, "interval": &config.Interval} {
+		value := get(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return config, fmt.Errorf("invalid %s%s %q", prefix, key, value)
+		}
+		*setting = duration
+	}
+	if config.Interval < 30*time.Second {
+		return config, fmt.Errorf("%sinterval must be at least 30s", prefix)
+	}
+	for key, setting := range map[string]*bool{"check_users": &config.CheckUsers, "require_job": &config.RequireJob} {
+		value := get(key)
+		if value == "" {
+			continue
+		}
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s%s %q", prefix, key, value)
+		}
+		*setting = flag
+	}
+
+	// With nothing to watch there is no job to wait for.
+	if len(config.Processes) == 0 && config.JobDir == "" {
+		config.RequireJob = false
+	}
+	return config, nil
+}
+
+/* ---
+ * Write an agent config file's contents.
+ * --- */
+func AgentConfigText(config datamodels.AgentConfig) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "[agent]\n")
+	fmt.Fprintf(&text, "; process names that mean a job is running, comma separated\n")
+	fmt.Fprintf(&text, "processes=%s\n", strings.Join(config.Processes, ","))
+	fmt.Fprintf(&text, "; a job is running while this directory has been written to within quiet_period\n")
+	fmt.Fprintf(&text, "job_dir=%s\n", config.JobDir)
+	fmt.Fprintf(&text, "quiet_period=%s\n", config.QuietPeriod)
+	fmt.Fprintf(&text, "; stop the instance after this long with no job and (with check_users) nobody logged in\n")
+	fmt.Fprintf(&text, "idle_after=%s\n", config.IdleAfter)
+	fmt.Fprintf(&text, "interval=%s\n", config.Interval)
+	fmt.Fprintf(&text, "check_users=%t\n", config.CheckUsers)
+	fmt.Fprintf(&text, "; only stop once a job has been seen\n")
+	fmt.Fprintf(&text, "require_job=%t\n", config.RequireJob)
+	return text.String()
+}
+
+/* ---
+ * Create a user data script that downloads the agent from url, writes its
+ * config and runs it as a systemd service.
+ * --- */
+func AgentUserData(url string, config datamodels.AgentConfig) string {
+	var script strings.Builder
+	fmt.Fprintf(&script, "#!/bin/bash\nset -eu\n\n")
+	fmt.Fprintf(&script, "curl -fsSL --retry 5 -o %s %s\n", AgentInstallPath, shellQuote(url))
+	fmt.Fprintf(&script, "chmod 755 %s\n\n", AgentInstallPath)
+	fmt.Fprintf(&script, "cat > %s <<'CONF'\n%sCONF\n\n", AgentConfigPath, AgentConfigText(config))
+	fmt.Fprintf(&script, "cat > /etc/systemd/system/cloud_control_agent.service <<'UNIT'\n")
+	fmt.Fprintf(&script, "[Unit]\nDescription=mdibl_cloud_control job-aware auto-shutdown agent\nAfter=network-online.target\nWants=network-online.target\n\n")
+	fmt.Fprintf(&script, "[Service]\nExecStart=%s --config %s\nRestart=on-failure\nRestartSec=30\n\n", AgentInstallPath, AgentConfigPath)
+	fmt.Fprintf(&script, "[Install]\nWantedBy=multi-user.target\nUNIT\n\n")
+	fmt.Fprintf(&script, "systemctl daemon-reload\nsystemctl enable --now cloud_control_agent\n")
+	return script.String()
+}
+
+/* ---
+ * Quote a string for a POSIX shell.
+ * --- */
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+/* ---
+ * Print agent statuses as a table.
+ * --- */
+func FprintAgentStatuses(w io.Writer, statuses []datamodels.AgentStatus, now time.Time) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tSTATE\tAGENT\tLAST HEARTBEAT\tDETAIL")
+	for _, status := range statuses {
+		heartbeat := "-"
+		if !status.LastHeartbeat.IsZero() {
+			heartbeat = fmt.Sprintf("%s ago", now.Sub(status.LastHeartbeat).Truncate(time.Second))
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", dash(status.Name), status.InstanceID, status.State, status.Status, heartbeat, dash(status.Detail))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Largest number of instances whose metrics are fetched in one
+// GetMetricData call. Each instance needs three of the 500 queries allowed.
+const IdleMetricBatchSize = 150
+
+// Default idle thresholds: an instance is idle below 5% CPU and 10 KiB/s of
+// network traffic, measured in five minute periods over two hours.
+const (
+	DefaultIdleCPUPercent    = 5.0
+	DefaultIdleNetworkPerSec = 10 * 1024.0
+	DefaultIdleWindow        = 2 * time.Hour
+	DefaultIdlePeriod        = 5 * time.Minute
+)
+
+// Share of the expected datapoints an instance must have in the window to
+// be judged idle, allowing for the odd missing period.
+const idleMinCoverage = 0.8
+
+// Period of the idle stop alarms installed at launch. Basic monitoring
+// publishes CPU every five minutes.
+const idleAlarmPeriod = 5 * time.Minute
+
+// Metrics for one instance over an idle check window, keyed by timestamp.
+type InstanceMetrics struct {
+	CPU        map[time.Time]float64
+	NetworkIn  map[time.Time]float64
+	NetworkOut map[time.Time]float64
+}
+
+/* ---
+ * Create a new AWS CloudWatch client. Failed calls are retried by retryer,
+ * or by the SDK's default policy if it is nil.
+ * --- */
+func CreateNewCloudWatchClient(creds *credentials.Credentials, region string, retryer request.Retryer) *cloudwatch.CloudWatch {
+	mySession := session.Must(session.NewSession())
+	config := aws.NewConfig().WithCredentials(creds).WithRegion(region)
+	if retryer != nil {
+		config = request.WithRetryer(config, retryer)
+	}
+	return cloudwatch.New(mySession, config)
+}
+
+/* ---
+ * Create the params to fetch average CPU and total network in and out, per
+ * period, for a batch of instances. Query IDs are cpu_<n>, in_<n> and
+ * out_<n> where n is the instance's index in ids.
+ * --- */
+func CreateGetMetricDataParams(ids []string, start, end time.Time, period time.Duration) *cloudwatch.GetMetricDataInput {
+	queries := make([]*cloudwatch.MetricDataQuery, 0, 3*len(ids))
+	for idx, id := range ids {
+		for _, metric := range []struct{ queryID, name, stat string }{
+			{"cpu", "CPUUtilization", "Average"},
+			{"in", "NetworkIn", "Sum"},
+			{"out", "NetworkOut", "Sum"},
+		} {
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(fmt.Sprintf("%s_%d", metric.queryID, idx)),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String("AWS/EC2"),
+						MetricName: aws.String(metric.name),
+						Dimensions: []*cloudwatch.Dimension{{Name: aws.String("InstanceId"), Value: aws.String(id)}},
+					},
+					Period: aws.Int64(int64(period.Seconds())),
+					Stat:   aws.String(metric.stat),
+				},
+				ReturnData: aws.Bool(true),
+			})
+		}
+	}
+	return &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(start),
+		EndTime:           aws.Time(end),
+		MetricDataQueries: queries,
+	}
+}
+
+/* ---
+ * Add the values from a GetMetricData result to metrics, keyed by instance
+ * ID. ids is the batch the params were created for.
+ * --- */
+func AddMetricDataResults(metrics map[string]*InstanceMetrics, ids []string, results []*cloudwatch.MetricDataResult) {
+	for _, result := range results {
+		id := aws.StringValue(result.Id)
+		sep := strings.LastIndex(id, "_")
+		if sep < 0 {
+			continue
+		}
+		metric := id[:sep]
+		idx, err := strconv.Atoi(id[sep+1:])
+		if err != nil {
+			continue
+		}
+		if idx < 0 || idx >= len(ids) {
+			continue
+		}
+		m := metrics[ids[idx]]
+		if m == nil {
+			m = &InstanceMetrics{CPU: map[time.Time]float64{}, NetworkIn: map[time.Time]float64{}, NetworkOut: map[time.Time]float64{}}
+			metrics[ids[idx]] = m
+		}
+		values := map[string]map[time.Time]float64{"cpu": m.CPU, "in": m.NetworkIn, "out": m.NetworkOut}[metric]
+		if values == nil {
+			continue
+		}
+		for i := range result.Timestamps {
+			if i < len(result.Values) {
+				values[aws.TimeValue(result.Timestamps[i])] = aws.Float64Value(result.Values[i])
+			}
+		}
+	}
+}
+
+/* ---
+ * Decide whether an instance is idle from its metrics. Instances that have
+ * been running for less than the window, or are missing too many
+ * datapoints, are never judged idle.
+ * --- */
+func ClassifyIdle(instance datamodels.EC2InstanceDetails, metrics *InstanceMetrics, thresholds datamodels.IdleThresholds, now time.Time) datamodels.InstanceIdleResult {
+	result := datamodels.InstanceIdleResult{InstanceID: instance.InstanceID, Name: instance.Name}
+	if metrics == nil {
+		metrics = &InstanceMetrics{}
+	}
+	result.Datapoints = len(metrics.CPU)
+
+	seconds := thresholds.Period.Seconds()
+	for at, cpu := range metrics.CPU {
+		if cpu > result.PeakCPU {
+			result.PeakCPU = cpu
+		}
+		if network := (metrics.NetworkIn[at] + metrics.NetworkOut[at]) / seconds; network > result.PeakNetwork {
+			result.PeakNetwork = network
+		}
+	}
+
+	expected := int(thresholds.Window / thresholds.Period)
+	switch {
+	case !instance.LaunchTime.IsZero() && now.Sub(instance.LaunchTime) < thresholds.Window:
+		result.Reason = fmt.Sprintf("running for less than %s", thresholds.Window)
+	case float64(result.Datapoints) < idleMinCoverage*float64(expected):
+		result.Reason = fmt.Sprintf("only %d of %d datapoints", result.Datapoints, expected)
+	case result.PeakCPU >= thresholds.CPUPercent:
+		result.Reason = fmt.Sprintf("CPU reached %.1f%%", result.PeakCPU)
+	case result.PeakNetwork >= thresholds.NetworkBytesPerSecond:
+		result.Reason = fmt.Sprintf("network reached %s/s", FormatBytes(result.PeakNetwork))
+	default:
+		result.Idle = true
+	}
+	return result
+}
+
+/* ---
+ * Create the params for an alarm that stops an instance once its average
+ * CPU has stayed below cpuPercent for after. Missing data (e.g., while the
+ * instance is stopped) does not count towards the alarm.
+ * --- */
+func CreateIdleStopAlarmParams(region, instanceID string, cpuPercent float64, after time.Duration) *cloudwatch.PutMetricAlarmInput {
+	return &cloudwatch.PutMetricAlarmInput{
+		AlarmName:          aws.String(IdleStopAlarmName(instanceID)),
+		AlarmDescription:   aws.String(fmt.Sprintf("Stop %s when CPU is below %g%% for %s", instanceID, cpuPercent, after)),
+		Namespace:          aws.String("AWS/EC2"),
+		MetricName:         aws.String("CPUUtilization"),
+		Dimensions:         []*cloudwatch.Dimension{{Name: aws.String("InstanceId"), Value: aws.String(instanceID)}},
+		Statistic:          aws.String("Average"),
+		Period:             aws.Int64(int64(idleAlarmPeriod.Seconds())),
+		EvaluationPeriods:  aws.Int64(int64(after / idleAlarmPeriod)),
+		Threshold:          aws.Float64(cpuPercent),
+		ComparisonOperator: aws.String(cloudwatch.ComparisonOperatorLessThanThreshold),
+		TreatMissingData:   aws.String("notBreaching"),
+		AlarmActions:       []*string{aws.String(fmt.Sprintf("arn:aws:automate:%s:ec2:stop", region))},
+	}
+}
+
+/* ---
+ * Name of the idle stop alarm for an instance.
+ * --- */
+func IdleStopAlarmName(instanceID string) string {
+	return fmt.Sprintf("idle-stop-%s", instanceID)
+}
+
+/* ---
+ * Check an idle stop period for a launch alarm. CloudWatch evaluates at
+ * most a day of five minute periods.
+ * --- */
+func ValidateIdleStopAfter(after time.Duration) error {
+	if after < idleAlarmPeriod || after > 24*time.Hour || after%idleAlarmPeriod != 0 {
+		return fmt.Errorf("idle stop time %s must be a multiple of 5m between 5m and 24h", after)
+	}
+	return nil
+}
+
+/* ---
+ * Format a byte count with a binary unit, e.g., 1.5 KiB.
+ * --- */
+func FormatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+/* ---
+ * Print idle check results as a table.
+ * --- */
+func FprintIdleReport(w io.Writer, report datamodels.IdleReport) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tPEAK CPU\tPEAK NETWORK\tIDLE\tREASON\tACTION\tERROR")
+	for _, result := range report.Results {
+		idle := "no"
+		if result.Idle {
+			idle = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%.1f%%\t%s/s\t%s\t%s\t%s\t%s\n", dash(result.Name), result.InstanceID, result.PeakCPU,
+			FormatBytes(result.PeakNetwork), idle, dash(result.Reason), dash(result.Action), dash(result.Error))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+var idleTestThresholds = datamodels.IdleThresholds{
+	CPUPercent:            DefaultIdleCPUPercent,
+	NetworkBytesPerSecond: DefaultIdleNetworkPerSec,
+	Window:                DefaultIdleWindow,
+	Period:                DefaultIdlePeriod,
+}
+
+/* ---
+ * Metrics with count five minute datapoints ending at end, each with the
+ * given CPU and network bytes in and out per period.
+ * --- */
+func idleTestMetrics(end time.Time, count int, cpu, network float64) *InstanceMetrics {
+	metrics := &InstanceMetrics{CPU: map[time.Time]float64{}, NetworkIn: map[time.Time]float64{}, NetworkOut: map[time.Time]float64{}}
+	for idx := 0; idx < count; idx++ {
+		at := end.Add(-time.Duration(idx+1) * DefaultIdlePeriod)
+		metrics.CPU[at] = cpu
+		metrics.NetworkIn[at] = network / 2
+		metrics.NetworkOut[at] = network / 2
+	}
+	return metrics
+}
+
+func TestClassifyIdle(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	old := datamodels.EC2InstanceDetails{InstanceID: "i-01", Name: "analysis", LaunchTime: now.Add(-24 * time.Hour)}
+	young := datamodels.EC2InstanceDetails{InstanceID: "i-02", LaunchTime: now.Add(-90 * time.Minute)}
+	periodBytes := DefaultIdleNetworkPerSec * DefaultIdlePeriod.Seconds()
+
+	// A spike in one period is enough to keep an instance from being idle.
+	cpuPeak := idleTestMetrics(now, 24, 1, 0)
+	cpuPeak.CPU[now.Add(-time.Hour)] = 40
+	networkPeak := idleTestMetrics(now, 24, 1, 0)
+	networkPeak.NetworkIn[now.Add(-time.Hour)] = periodBytes
+
+	tests := []struct {
+		name     string
+		instance datamodels.EC2InstanceDetails
+		metrics  *InstanceMetrics
+		idle     bool
+		reason   string
+	}{
+		{"idle", old, idleTestMetrics(now, 24, 1, periodBytes/2), true, ""},
+		{"young", young, idleTestMetrics(now, 18, 0, 0), false, "running for less than 2h0m0s"},
+		{"unknown launch time", datamodels.EC2InstanceDetails{InstanceID: "i-03"}, idleTestMetrics(now, 24, 0, 0), true, ""},
+		{"full coverage needed", old, idleTestMetrics(now, 19, 0, 0), false, "only 19 of 24 datapoints"},
+		{"coverage threshold", old, idleTestMetrics(now, 20, 0, 0), true, ""},
+		{"no metrics", old, nil, false, "only 0 of 24 datapoints"},
+		{"CPU peak", old, cpuPeak, false, "CPU reached 40.0%"},
+		{"CPU at threshold", old, idleTestMetrics(now, 24, DefaultIdleCPUPercent, 0), false, "CPU reached 5.0%"},
+		{"network peak", old, networkPeak, false, "network reached 10.0 KiB/s"},
+	}
+	for _, test := range tests {
+		result := ClassifyIdle(test.instance, test.metrics, idleTestThresholds, now)
+		if result.Idle != test.idle || result.Reason != test.reason {
+			t.Errorf("%s: got idle %t (%q), want %t (%q)", test.name, result.Idle, result.Reason, test.idle, test.reason)
+		}
+		if result.InstanceID != test.instance.InstanceID {
+			t.Errorf("%s: got result for %s", test.name, result.InstanceID)
+		}
+	}
+
+	result := ClassifyIdle(old, networkPeak, idleTestThresholds, now)
+	if result.PeakCPU != 1 || result.PeakNetwork != DefaultIdleNetworkPerSec || result.Datapoints != 24 {
+		t.Errorf("got peaks %.1f%% %.0f B/s from %d datapoints, want 1%% 10240 B/s from 24", result.PeakCPU, result.PeakNetwork, result.Datapoints)
+	}
+}
+
+func TestAddMetricDataResults(t *testing.T) {
+	start := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	times := []*time.Time{aws.Time(start), aws.Time(start.Add(5 * time.Minute))}
+	ids := []string{"i-01", "i-02"}
+	metrics := map[string]*InstanceMetrics{}
+
+	AddMetricDataResults(metrics, ids, []*cloudwatch.MetricDataResult{
+		{Id: aws.String("cpu_0"), Timestamps: times, Values: aws.Float64Slice([]float64{1.5, 2.5})},
+		{Id: aws.String("in_0"), Timestamps: times, Values: aws.Float64Slice([]float64{100, 200})},
+		{Id: aws.String("out_0"), Timestamps: times[:1], Values: aws.Float64Slice([]float64{300})},
+		{Id: aws.String("cpu_1"), Timestamps: times, Values: aws.Float64Slice([]float64{7})},
+		// Unknown metrics, indexes and malformed IDs are ignored.
+		{Id: aws.String("disk_0"), Timestamps: times, Values: aws.Float64Slice([]float64{1, 1})},
+		{Id: aws.String("cpu_2"), Timestamps: times, Values: aws.Float64Slice([]float64{1, 1})},
+		{Id: aws.String("cpu_x"), Timestamps: times, Values: aws.Float64Slice([]float64{1, 1})},
+		{Id: aws.String("cpu"), Timestamps: times, Values: aws.Float64Slice([]float64{1, 1})},
+	})
+
+	if len(metrics) != 2 {
+		t.Fatalf("got metrics for %d instances, want 2", len(metrics))
+	}
+	first := metrics["i-01"]
+	if first.CPU[start] != 1.5 || first.CPU[start.Add(5*time.Minute)] != 2.5 || first.NetworkIn[start] != 100 || first.NetworkOut[start] != 300 {
+		t.Errorf("i-01: got %+v", first)
+	}
+	if len(first.NetworkOut) != 1 {
+		t.Errorf("i-01: got %d network out datapoints, want 1", len(first.NetworkOut))
+	}
+	// A result with fewer values than timestamps keeps the values it has.
+	if second := metrics["i-02"]; len(second.CPU) != 1 || second.CPU[start] != 7 {
+		t.Errorf("i-02: got CPU %v, want one datapoint of 7", second.CPU)
+	}
+
+	// Later batches add to the metrics already fetched.
+	AddMetricDataResults(metrics, []string{"i-01"}, []*cloudwatch.MetricDataResult{
+		{Id: aws.String("cpu_0"), Timestamps: []*time.Time{aws.Time(start.Add(10 * time.Minute))}, Values: aws.Float64Slice([]float64{3.5})},
+	})
+	if len(metrics["i-01"].CPU) != 3 {
+		t.Errorf("i-01: got %d CPU datapoints after a second batch, want 3", len(metrics["i-01"].CPU))
+	}
+}
+
+func TestCreateGetMetricDataParams(t *testing.T) {
+	start := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	input := CreateGetMetricDataParams([]string{"i-01", "i-02"}, start, start.Add(2*time.Hour), 5*time.Minute)
+	if len(input.MetricDataQueries) != 6 {
+		t.Fatalf("got %d queries, want 3 per instance", len(input.MetricDataQueries))
+	}
+	ids := make([]string, 0)
+	for _, query := range input.MetricDataQueries {
+		ids = append(ids, aws.StringValue(query.Id))
+		if aws.Int64Value(query.MetricStat.Period) != 300 {
+			t.Errorf("%s: got period %d, want 300", aws.StringValue(query.Id), aws.Int64Value(query.MetricStat.Period))
+		}
+	}
+	if got := strings.Join(ids, ","); got != "cpu_0,in_0,out_0,cpu_1,in_1,out_1" {
+		t.Errorf("got query IDs %s", got)
+	}
+}
+
+func TestValidateIdleStopAfter(t *testing.T) {
+	for after, valid := range map[time.Duration]bool{
+		5 * time.Minute:  true,
+		2 * time.Hour:    true,
+		24 * time.Hour:   true,
+		time.Minute:      false,
+		7 * time.Minute:  false,
+		25 * time.Hour:   false,
+		-5 * time.Minute: false,
+	} {
+		if err := ValidateIdleStopAfter(after); (err == nil) != valid {
+			t.Errorf("%s: got error %v, want valid %t", after, err, valid)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+/* ---
+ * Load a launch config file. See instance.config for the format.
+ * --- */
+func LoadLaunchConfig(path string) (datamodels.LaunchConfig, error) {
+	config := datamodels.LaunchConfig{}
+
+	// Make sure the config file exists. If configuration is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return config, fmt.Errorf("No instance config file found at: %s", path)
+	}
+
+	// Load the config file and extract the parameters.
+	configFile, err := ini.LoadFile(path)
+	if err != nil {
+		return config, err
+	}
+	config.AMIID, _ = configFile.Get("instance", "ami_id")
+	config.AMIName, _ = configFile.Get("instance", "ami_name")
+	config.InstanceType, _ = configFile.Get("instance", "instance_type")
+	config.Region, _ = configFile.Get("instance", "region")
+	countString, _ := configFile.Get("instance", "count")
+	config.Name, _ = configFile.Get("instance", "name")
+	config.Owner, _ = configFile.Get("instance", "owner")
+	config.Project, _ = configFile.Get("instance", "project")
+	config.Expiry, _ = configFile.Get("instance", "expiry")
+	idleCPU, _ := configFile.Get("instance", "idle_stop_cpu")
+	idleAfter, _ := configFile.Get("instance", "idle_stop_after")
+	config.InstanceProfile, _ = configFile.Get("instance", "iam_instance_profile")
+	config.AgentURL, _ = configFile.Get("instance", "agent_url")
+
+	if config.AMIID == "" || config.InstanceType == "" {
+		return config, fmt.Errorf("Instance config %s must set ami_id and instance_type", path)
+	}
+	config.Count, err = strconv.ParseInt(countString, 10, 64)
+	if err != nil || config.Count < 1 {
+		return config, fmt.Errorf("Instance config %s has an invalid count: %q", path, countString)
+	}
+	for key, value := range map[string]string{TagName: config.Name, TagOwner: config.Owner, TagProject: config.Project} {
+		if err := ValidateTag(key, value); err != nil {
+			return config, fmt.Errorf("Instance config %s: %s", path, err)
+		}
+	}
+	if config.Expiry != "" {
+		if _, err := ParseExpiry(config.Expiry, time.Now()); err != nil {
+			return config, fmt.Errorf("Instance config %s: %s", path, err)
+		}
+	}
+	if idleAfter != "" {
+		if config.IdleStopAfter, err = time.ParseDuration(idleAfter); err != nil {
+			return config, fmt.Errorf("Instance config %s: invalid idle_stop_after %q", path, idleAfter)
+		}
+		if err := ValidateIdleStopAfter(config.IdleStopAfter); err != nil {
+			return config, fmt.Errorf("Instance config %s: %s", path, err)
+		}
+		config.IdleStopCPU = DefaultIdleCPUPercent
+		if idleCPU != "" {
+			config.IdleStopCPU, err = strconv.ParseFloat(idleCPU, 64)
+			if err != nil || config.IdleStopCPU <= 0 || config.IdleStopCPU > 100 {
+				return config, fmt.Errorf("Instance config %s: invalid idle_stop_cpu %q", path, idleCPU)
+			}
+		}
+	} else if idleCPU != "" {
+		return config, fmt.Errorf("Instance config %s: idle_stop_cpu needs idle_stop_after", path)
+	}
+	if config.Agent, err = loadAgentSettings(configFile, "instance", "agent_"); err != nil {
+		return config, fmt.Errorf("Instance config %s: %s", path, err)
+	}
+	if config.AgentURL != "" && config.InstanceProfile == "" {
+		return config, fmt.Errorf("Instance config %s: agent_url needs an iam_instance_profile that lets the agent tag and stop the instance", path)
+	}
+	return config, nil
+}
+
+/* ---
+ * Load a reaper config file. See reaper.config for the format. Missing
+ * settings keep the defaults: stop expired instances and warn a day ahead.
+ * --- */
+func LoadReaperConfig(path string) (datamodels.ReaperConfig, error) {
+	config := datamodels.ReaperConfig{Action: "stop", WarnBefore: 24 * time.Hour}
+
+	// Make sure the config file exists. If configuration is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return config, fmt.Errorf("No reaper config file found at: %s", path)
+	}
+
+	configFile, err := ini.LoadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if action, ok := configFile.Get("reaper", "action"); ok && action != "" {
+		config.Action = action
+	}
+	if err := ValidateReaperAction(config.Action); err != nil {
+		return config, fmt.Errorf("Reaper config %s: %s", path, err)
+	}
+	if warnBefore, ok := configFile.Get("reaper", "warn_before"); ok && warnBefore != "" {
+		config.WarnBefore, err = ParseDays(warnBefore)
+		if err != nil {
+			return config, fmt.Errorf("Reaper config %s: invalid warn_before: %s", path, err)
+		}
+	}
+	config.Notify = loadNotifyConfig(configFile)
+	return config, nil
+}
+
+/* ---
+ * Load a schedule config file. See schedule.config for the format. Missing
+ * settings are given defaults: check every minute, act on events up to ten
+ * minutes late, and leave at least 15 minutes between actions on an
+ * instance. Schedules are returned sorted by name.
+ * --- */
+func LoadSchedulerConfig(path string) (datamodels.SchedulerConfig, error) {
+	config := datamodels.SchedulerConfig{
+		Interval:    time.Minute,
+		CatchUp:     10 * time.Minute,
+		MinInterval: 15 * time.Minute,
+		StateFile:   "scheduler_state.json",
+		Schedules:   make([]datamodels.ScheduleConfig, 0),
+	}
+
+	// Make sure the config file exists. If configuration is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return config, fmt.Errorf("No schedule config file found at: %s", path)
+	}
+
+	configFile, err := ini.LoadFile(path)
+	if err != nil {
+		return config, err
+	}
+	for key, setting := range map[string]*time.Duration{"interval": &config.Interval, "catch_up": &config.CatchUp, "min_interval": &config.MinInterval} {
+		value, ok := configFile.Get("scheduler", key)
+		if !ok || value == "" {
+			continue
+		}
+		if *setting, err = time.ParseDuration(value); err != nil || *setting < 0 {
+			return config, fmt.Errorf("Schedule config %s: invalid %s %q", path, key, value)
+		}
+	}
+	if config.Interval < time.Minute {
+		return config, fmt.Errorf("Schedule config %s: interval must be at least 1m", path)
+	}
+	if stateFile, ok := configFile.Get("scheduler", "state_file"); ok && stateFile != "" {
+		config.StateFile = stateFile
+	}
+	config.LogFile, _ = configFile.Get("scheduler", "log_file")
+
+	for section, values := range configFile {
+		if !strings.HasPrefix(section, "schedule ") {
+			continue
+		}
+		schedule := datamodels.ScheduleConfig{
+			Name:     strings.TrimSpace(strings.TrimPrefix(section, "schedule ")),
+			Start:    values["start"],
+			Stop:     values["stop"],
+			TimeZone: values["timezone"],
+			Filters:  strings.Fields(values["filter"]),
+		}
+		if schedule.Name == "" || strings.Contains(schedule.Name, "=") {
+			return config, fmt.Errorf("Schedule config %s: invalid schedule name %q", path, schedule.Name)
+		}
+		if _, err := ParseInstanceFilters(schedule.Filters); err != nil {
+			return config, fmt.Errorf("Schedule config %s: schedule %s: %s", path, schedule.Name, err)
+		}
+		config.Schedules = append(config.Schedules, schedule)
+	}
+	sort.Slice(config.Schedules, func(i, j int) bool { return config.Schedules[i].Name < config.Schedules[j].Name })
+	return config, nil
+}
+
+/* ---
+ * Check an action for expired instances.
+ * --- */
+func ValidateReaperAction(action string) error {
+	if action != "stop" && action != "terminate" {
+		return fmt.Errorf("Invalid action %q, expected stop or terminate", action)
+	}
+	return nil
+}
+
+/* ---
+ * Parse a duration that may also be given in days, e.g., 2d, 36h or 90m.
+ * --- */
+func ParseDays(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+/* ---
+ * Load the [notify] section of a config file, such as reaper.config.
+ * --- */
+func LoadNotifyConfig(path string) (datamodels.NotifyConfig, error) {
+	// Make sure the config file exists. If configuration is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return datamodels.NotifyConfig{}, fmt.Errorf("No notify config file found at: %s", path)
+	}
+	configFile, err := ini.LoadFile(path)
+	if err != nil {
+		return datamodels.NotifyConfig{}, err
+	}
+	return loadNotifyConfig(configFile), nil
+}
+
+/* ---
+ * Read the [notify] section shared by config files that notify owners.
+ * --- */
+func loadNotifyConfig(configFile ini.File) datamodels.NotifyConfig {
+	config := datamodels.NotifyConfig{}
+	config.LogFile, _ = configFile.Get("notify", "log_file")
+	config.SMTPServer, _ = configFile.Get("notify", "smtp_server")
+	config.SMTPFrom, _ = configFile.Get("notify", "smtp_from")
+	config.SMTPDomain, _ = configFile.Get("notify", "smtp_domain")
+	config.SMTPUsername, _ = configFile.Get("notify", "smtp_username")
+	config.SMTPPassword, _ = configFile.Get("notify", "smtp_password")
+	config.WebhookURL, _ = configFile.Get("notify", "webhook_url")
+	return config
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Console output patterns that point at why an instance did not come up.
+// The first matching pattern gives a line's category, so the more specific
+// user-data patterns come before the general cloud-init ones.
+var consolePatterns = []struct {
+	category string
+	pattern  *regexp.Regexp
+}{
+	{"kernel", regexp.MustCompile(`Kernel panic|\bBUG: |\bOops: |Out of memory: Kill|soft lockup|blocked for more than \d+ seconds`)},
+	{"user-data", regexp.MustCompile(`Failed to run module scripts-user|Failed running /var/lib/cloud/instance/scripts|/var/lib/cloud/instance/scripts/\S+: .*(command not found|No such file|Permission denied|syntax error)|runcmd.*(failed|error)`)},
+	{"cloud-init", regexp.MustCompile(`cloud-init\[\d+\]: .*\b(ERROR|CRITICAL)\b|\[(ERROR|CRITICAL)\]|Failed to run module|cloud-init.*finished.*with errors|Datasource DataSourceNone`)},
+	{"boot", regexp.MustCompile(`[Ee]mergency mode|Failed to mount|EXT4-fs error|XFS \(\S+\): Corruption|Dependency failed for|Timed out waiting for device|Give root password for maintenance`)},
+}
+
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+/* ---
+ * Create EC2 get console output params. Latest asks for the most recent
+ * output rather than the buffer captured at boot (Nitro instances only).
+ * --- */
+func CreateEC2GetConsoleOutputParams(instanceID string, latest bool) *ec2.GetConsoleOutputInput {
+	input := &ec2.GetConsoleOutputInput{InstanceId: aws.String(instanceID)}
+	if latest {
+		input.Latest = aws.Bool(true)
+	}
+	return input
+}
+
+/* ---
+ * Create EC2 get console screenshot params.
+ * --- */
+func CreateEC2GetConsoleScreenshotParams(instanceID string) *ec2.GetConsoleScreenshotInput {
+	return &ec2.GetConsoleScreenshotInput{InstanceId: aws.String(instanceID), WakeUp: aws.Bool(true)}
+}
+
+/* ---
+ * Decode base64 console output, dropping carriage returns and terminal
+ * escape sequences.
+ * --- */
+func DecodeConsoleOutput(encoded string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode console output: %s", err)
+	}
+	output := strings.Replace(string(data), "\r", "", -1)
+	return ansiEscapePattern.ReplaceAllString(output, ""), nil
+}
+
+/* ---
+ * Decode a base64 console screenshot to JPEG data.
+ * --- */
+func DecodeConsoleScreenshot(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("empty screenshot")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode screenshot: %s", err)
+	}
+	return data, nil
+}
+
+/* ---
+ * Find the lines of console output that match a failure pattern.
+ * --- */
+func FindConsoleProblems(output string) []datamodels.ConsoleFinding {
+	findings := make([]datamodels.ConsoleFinding, 0)
+	for idx, line := range strings.Split(output, "\n") {
+		for _, p := range consolePatterns {
+			if p.pattern.MatchString(line) {
+				findings = append(findings, datamodels.ConsoleFinding{Line: idx + 1, Category: p.category, Text: strings.TrimSpace(line)})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+/* ---
+ * Print the last lines of console output, marking lines with findings with
+ * "!!". All lines are printed if lines is zero or less.
+ * --- */
+func FprintConsoleOutput(w io.Writer, output string, findings []datamodels.ConsoleFinding, lines int) {
+	flagged := make(map[int]bool)
+	for _, finding := range findings {
+		flagged[finding.Line] = true
+	}
+	all := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	start := 0
+	if lines > 0 && len(all) > lines {
+		start = len(all) - lines
+		fmt.Fprintf(w, "... %d earlier lines not shown\n", start)
+	}
+	for idx := start; idx < len(all); idx++ {
+		marker := "  "
+		if flagged[idx+1] {
+			marker = "!!"
+		}
+		fmt.Fprintf(w, "%s %s\n", marker, all[idx])
+	}
+}
+
+/* ---
+ * Print console findings grouped under their instance.
+ * --- */
+func FprintConsoleFindings(w io.Writer, console datamodels.InstanceConsole) {
+	if len(console.Findings) == 0 {
+		fmt.Fprintf(w, "No known problems found\n")
+		return
+	}
+	fmt.Fprintf(w, "%d possible problems:\n", len(console.Findings))
+	for _, finding := range console.Findings {
+		fmt.Fprintf(w, "  [%s] line %d: %s\n", finding.Category, finding.Line, finding.Text)
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// Console output of an Amazon Linux instance that booted cleanly.
+const cleanBootOutput = `[    0.000000] Linux version 6.1.79-99.164.amzn2023.x86_64 (mockbuild@ip-10-0-47-200) (gcc (GCC) 11.4.1 20230605 (Red Hat 11.4.1-2)) #1 SMP PREEMPT_DYNAMIC Tue Feb 27 18:02:52 UTC 2024
+[    0.000000] Command line: BOOT_IMAGE=(hd0,gpt1)/boot/vmlinuz-6.1.79-99.164.amzn2023.x86_64 root=UUID=a3f1 ro console=tty0 console=ttyS0,115200n8 nvme_core.io_timeout=4294967295 panic=-1
+[    0.412305] ACPI: PM-Timer IO Port: 0xb008
+[    1.025183] EXT4-fs (nvme0n1p1): mounted filesystem with ordered data mode. Quota mode: none.
+[    1.712934] XFS (nvme1n1): Mounting V5 Filesystem
+[  OK  ] Started systemd-journald.service - Journal Service.
+[  OK  ] Reached target local-fs.target - Local File Systems.
+         Starting cloud-init-local.service - Initial cloud-init job (pre-networking)...
+cloud-init[1534]: Cloud-init v. 22.2.2 running 'init' at Fri, 01 Mar 2024 14:30:05 +0000. Up 6.71 seconds.
+cloud-init[1534]: ci-info: +++++++++++++++++++++++++++Net device info++++++++++++++++++++++++++++
+cloud-init[1534]: ci-info: | Device |  Up  |          Address           |      Mask     | Scope  |
+cloud-init[1534]: ci-info: |  ens5  | True |         10.0.0.12          | 255.255.255.0 | global |
+cloud-init[1534]: Generating public/private ed25519 key pair.
+cloud-init[1534]: 2024-03-01 14:30:06,120 - util.py[WARNING]: Failed to get raw userdata in module rightscale_userdata
+[  OK  ] Finished cloud-final.service - Execute cloud user/final scripts.
+cloud-init[2087]: Cloud-init v. 22.2.2 finished at Fri, 01 Mar 2024 14:30:12 +0000. Datasource DataSourceEc2.  Up 13.32 seconds
+[  OK  ] Reached target cloud-init.target - Cloud-init target.
+
+Amazon Linux 2023
+Kernel 6.1.79-99.164.amzn2023.x86_64 on an x86_64 (-)
+
+ip-10-0-0-12 login: `
+
+func TestFindConsoleProblemsCleanBoot(t *testing.T) {
+	if findings := FindConsoleProblems(cleanBootOutput); len(findings) != 0 {
+		t.Errorf("got findings in a clean boot: %+v", findings)
+	}
+}
+
+func TestFindConsoleProblems(t *testing.T) {
+	tests := []struct {
+		line     string
+		category string
+	}{
+		// Kernel
+		{"[    2.201934] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)", "kernel"},
+		{"[  120.512301] BUG: unable to handle page fault for address: ffffa0b3c0000000", "kernel"},
+		{"[  120.512310] Oops: 0000 [#1] PREEMPT SMP NOPTI", "kernel"},
+		{"[ 3601.330112] Out of memory: Killed process 2211 (java) total-vm:16212440kB", "kernel"},
+		{"[  244.100231] watchdog: BUG: soft lockup - CPU#1 stuck for 22s! [kworker/1:2:118]", "kernel"},
+		{"[  245.910012] INFO: task jbd2/nvme0n1p1-8:301 blocked for more than 120 seconds.", "kernel"},
+		// User data
+		{"cloud-init[2087]: 2024-03-01 14:30:12,301 - cc_scripts_user.py[WARNING]: Failed to run module scripts-user (scripts in /var/lib/cloud/instance/scripts)", "user-data"},
+		{"cloud-init[2087]: 2024-03-01 14:30:12,300 - subp.py[WARNING]: Failed running /var/lib/cloud/instance/scripts/part-001 [127]", "user-data"},
+		{"cloud-init[2087]: /var/lib/cloud/instance/scripts/part-001: line 4: aws: command not found", "user-data"},
+		{"cloud-init[2087]: /var/lib/cloud/instance/scripts/part-001: line 9: /opt/setup.sh: Permission denied", "user-data"},
+		{"cloud-init[2087]: /var/lib/cloud/instance/scripts/part-001: line 12: syntax error near unexpected token `fi'", "user-data"},
+		// Cloud-init
+		{"cloud-init[1534]: 2024-03-01 14:30:06,512 - util.py[ERROR]: Failed to fetch metadata", "cloud-init"},
+		{"cloud-init[1534]: 2024-03-01 14:30:06,512 - handlers.py CRITICAL: Unable to load datasource", "cloud-init"},
+		{"[   12.101201] cloud-init[2087]: 2024-03-01 14:30:12,302 - util.py[WARNING]: Failed to run module write-files (write-files in /etc/cloud/cloud.cfg)", "cloud-init"},
+		{"cloud-init[2087]: Cloud-init v. 22.2.2 finished at Fri, 01 Mar 2024 14:30:12 +0000. Datasource DataSourceNone.  Up 130.11 seconds", "cloud-init"},
+		// Boot
+		{"You are in emergency mode. After logging in, type \"journalctl -xb\" to view", "boot"},
+		{"[FAILED] Failed to mount data.mount - /data.", "boot"},
+		{"[DEPEND] Dependency failed for local-fs.target - Local File Systems.", "boot"},
+		{"[ TIME ] Timed out waiting for device dev-nvme1n1.device - /dev/nvme1n1.", "boot"},
+		{"[   14.501122] EXT4-fs error (device nvme1n1): ext4_find_entry:1682: inode #2: comm mount: reading directory lblock 0", "boot"},
+		{"[   15.001012] XFS (nvme1n1): Corruption detected. Unmount and run xfs_repair", "boot"},
+	}
+	for _, test := range tests {
+		findings := FindConsoleProblems(test.line)
+		if len(findings) != 1 || findings[0].Category != test.category {
+			t.Errorf("%q: got %+v, want one %s finding", test.line, findings, test.category)
+		}
+	}
+}
+
+func TestFindConsoleProblemsLines(t *testing.T) {
+	lines := strings.Split(cleanBootOutput, "\n")
+	output := strings.Join(append(lines[:10:10], "[  122.000001] Kernel panic - not syncing: Fatal exception", "  trailing  "), "\n")
+	findings := FindConsoleProblems(output)
+	if len(findings) != 1 {
+		t.Fatalf("got %d findings, want 1: %+v", len(findings), findings)
+	}
+	if findings[0].Line != 11 || findings[0].Text != "[  122.000001] Kernel panic - not syncing: Fatal exception" {
+		t.Errorf("got line %d %q, want line 11 trimmed", findings[0].Line, findings[0].Text)
+	}
+}
+
+func TestDecodeConsoleOutput(t *testing.T) {
+	// base64 of "\x1b[0;32m  OK  \x1b[0m] Started\r\nlogin: "
+	output, err := DecodeConsoleOutput("G1swOzMybSAgT0sgIBtbMG1dIFN0YXJ0ZWQNCmxvZ2luOiA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "  OK  ] Started\nlogin: "; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	if _, err := DecodeConsoleOutput("not base64!"); err == nil {
+		t.Error("invalid output decoded without an error")
+	}
+}
+
+func TestFprintConsoleOutput(t *testing.T) {
+	output := "one\ntwo\nthree\nfour\n"
+	findings := FindConsoleProblems("one\ntwo\nKernel panic\nfour")
+	var buf strings.Builder
+	FprintConsoleOutput(&buf, output, findings, 2)
+	if want := "... 2 earlier lines not shown\n!! three\n   four\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	FprintConsoleOutput(&buf, output, nil, 0)
+	if got := strings.Count(buf.String(), "\n"); got != 4 {
+		t.Errorf("got %d lines with --lines 0, want all 4: %q", got, buf.String())
+	}
+}
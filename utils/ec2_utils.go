@@ -1,23 +1,28 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"mdibl_cloud_control/datamodels"
-	"net/url"
 	"os"
 	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/vaughan0/go-ini"
 )
 
 /* ---
- * Get default AWS region from config file
+ * Get default AWS region for a profile from config file
  * --- */
-func DefaultAWSRegion(awsConfigFile string) (string, error) {
+func DefaultAWSRegion(awsConfigFile, profile string) (string, error) {
 	var err error
 	var region string
 
@@ -32,14 +37,14 @@ func DefaultAWSRegion(awsConfigFile string) (string, error) {
 	if err != nil {
 		return region, err
 	}
-	region, _ = paramFile.Get("default", "region")
+	region, _ = paramFile.Get(profile, "region")
 	return region, nil
 }
 
 /* ---
- * Create a new AWS EC2 client credentials
+ * Create a new AWS EC2 client credentials for a profile
  * --- */
-func CreateNewEC2ClientCredentials(awsConfigFile string) (*credentials.Credentials, error) {
+func CreateNewEC2ClientCredentials(awsConfigFile, profile string) (*credentials.Credentials, error) {
 	var err error
 	var creds *credentials.Credentials
 
@@ -55,19 +60,42 @@ func CreateNewEC2ClientCredentials(awsConfigFile string) (*credentials.Credentia
 		return creds, err
 	}
 
-	keyID, _ := paramFile.Get("default", "aws_access_key_id")
-	secretKey, _ := paramFile.Get("default", "aws_secret_access_key")
+	if _, ok := paramFile[profile]; !ok {
+		return creds, fmt.Errorf("No profile %s found in: %s\n", profile, awsConfigFile)
+	}
+
+	keyID, _ := paramFile.Get(profile, "aws_access_key_id")
+	secretKey, _ := paramFile.Get(profile, "aws_secret_access_key")
 	return credentials.NewStaticCredentials(keyID, secretKey, ""), nil
 }
 
 /* ---
- * Create a new AWS EC2 client
+ * Create a new AWS EC2 client. Failed calls are retried by retryer, or by the
+ * SDK's default policy if it is nil.
  * --- */
-func CreateNewEC2Client(creds *credentials.Credentials, region string) *ec2.EC2 {
+func CreateNewEC2Client(creds *credentials.Credentials, region string, retryer request.Retryer) *ec2.EC2 {
 	// Create a vanilla session
 	mySession := session.Must(session.NewSession())
 	// Create a EC2 client with additional configuration supplied by user.
-	return ec2.New(mySession, aws.NewConfig().WithCredentials(creds).WithRegion(region))
+	config := aws.NewConfig().WithCredentials(creds).WithRegion(region)
+	if retryer != nil {
+		config = request.WithRetryer(config, retryer)
+	}
+	return ec2.New(mySession, config)
+}
+
+/* ---
+ * Get the ID of the AWS account the credentials belong to and the ARN of
+ * the caller
+ * --- */
+func GetAWSCallerIdentity(ctx aws.Context, creds *credentials.Credentials, region string) (string, string, error) {
+	mySession := session.Must(session.NewSession())
+	stsClient := sts.New(mySession, aws.NewConfig().WithCredentials(creds).WithRegion(region))
+	identity, err := stsClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(identity.Account), aws.StringValue(identity.Arn), nil
 }
 
 /* -----------------------------------------------------------------------------
@@ -142,6 +170,16 @@ func CreateEC2InstanceIDsParams(report datamodels.EC2InstanceReport) *ec2.Descri
 	}
 }
 
+/* ---
+ * Create EC2 instance ID filter params
+ * --- */
+func CreateEC2InstanceIDFilterParams(ids []string) *ec2.DescribeInstancesInput {
+	// Return aws filter parameter object
+	return &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	}
+}
+
 /* ---
  * Create EC2 start instance params
  * --- */
@@ -182,19 +220,54 @@ func CreateEC2StopInstanceParams(ids []string, dryrun, force, hibernate bool) *e
 	}
 }
 
+/* ---
+ * Create EC2 terminate instance params
+ * --- */
+func CreateEC2TerminateInstanceParams(ids []string, dryrun bool) *ec2.TerminateInstancesInput {
+	// Return aws filter parameter object
+	return &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+		DryRun:      aws.Bool(dryrun),
+	}
+}
+
+/* ---
+ * Create EC2 reboot instance params
+ * --- */
+func CreateEC2RebootInstanceParams(ids []string, dryrun bool) *ec2.RebootInstancesInput {
+	// Return aws filter parameter object
+	return &ec2.RebootInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+		DryRun:      aws.Bool(dryrun),
+	}
+}
+
 /* ---
  * Create EC2 run instance params
  * --- */
-func CreateEC2RunInstanceParams(amiID, instanceType string, count int64) *ec2.RunInstancesInput {
+func CreateEC2RunInstanceParams(amiID, instanceType string, count int64, clientToken string, tags map[string]string) *ec2.RunInstancesInput {
 	// Create run instance input for the specified AMI ID and instance type
 	return &ec2.RunInstancesInput{
-		ImageId:      aws.String(amiID),
-		InstanceType: aws.String(instanceType),
-		MinCount:     aws.Int64(count),
-		MaxCount:     aws.Int64(count),
+		ImageId:           aws.String(amiID),
+		InstanceType:      aws.String(instanceType),
+		MinCount:          aws.Int64(count),
+		MaxCount:          aws.Int64(count),
+		ClientToken:       aws.String(clientToken),
+		TagSpecifications: CreateLaunchTagSpecifications(tags),
 	}
 }
 
+/* ---
+ * Create a random client token for idempotent run instance requests
+ * --- */
+func NewClientToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
 // -----------------------------------------------------------------------------
 // Functions for working with results of AWS API results
 // -----------------------------------------------------------------------------
@@ -203,7 +276,7 @@ func CreateEC2RunInstanceParams(amiID, instanceType string, count int64) *ec2.Ru
  * Create a list of EC2Instance details.
  * --- */
 func ParseDescribeInstanceOutput(results *ec2.DescribeInstancesOutput) datamodels.EC2InstanceReport {
-	report := datamodels.EC2InstanceReport{}
+	report := datamodels.EC2InstanceReport{SchemaVersion: datamodels.EC2InstanceReportSchemaVersion}
 	instances := make([]datamodels.EC2InstanceDetails, 0)
 
 	// Results is a JSON(ish) object with the following form:
@@ -212,54 +285,64 @@ func ParseDescribeInstanceOutput(results *ec2.DescribeInstancesOutput) datamodel
 	for idx, _ := range results.Reservations {
 		// Loop over all instances for each index
 		for _, instance := range results.Reservations[idx].Instances {
-
-			// We need to see if the Name is one of the tags. It's not always
-			// present and not required in Ec2.
-			name := "None"
-			for _, keys := range instance.Tags {
-				if *keys.Key == "Name" {
-					name = url.QueryEscape(*keys.Value)
-				}
-			}
-
-			// For now, just get the instance name, instance id, the instance type,
-			// the public and private IPs if present
-			details := datamodels.EC2InstanceDetails{}
-			if &name != nil {
-				details.Name = name
-			}
-			if instance.InstanceId != nil {
-				details.InstanceID = *instance.InstanceId
-			}
-			if instance.InstanceType != nil {
-				details.InstanceType = *instance.InstanceType
-			}
-			if instance.State.Name != nil {
-				details.InstanceState = *instance.State.Name
-			}
-			if instance.PrivateIpAddress != nil {
-				details.PrivateIP = *instance.PrivateIpAddress
-			}
-			if instance.PublicIpAddress != nil {
-				details.PublicIP = *instance.PublicIpAddress
-			}
-
-			instances = append(instances, details)
+			instances = append(instances, ParseEC2Instance(instance))
 		}
 	}
 	report.Instances = instances
 	return report
 }
 
+/* ---
+ * Query AWS for all instances matching the filter params, following
+ * pagination, and parse them into a report.
+ * --- */
+func DescribeEC2Instances(ctx aws.Context, client ec2iface.EC2API, params *ec2.DescribeInstancesInput) (datamodels.EC2InstanceReport, error) {
+	report := datamodels.EC2InstanceReport{
+		SchemaVersion: datamodels.EC2InstanceReportSchemaVersion,
+		Instances:     make([]datamodels.EC2InstanceDetails, 0),
+	}
+	err := client.DescribeInstancesPagesWithContext(ctx, params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		report.Instances = append(report.Instances, ParseDescribeInstanceOutput(page).Instances...)
+		return true
+	})
+	return report, err
+}
+
+/* ---
+ * Get the IDs of the instances that were not launched with hibernation
+ * enabled.
+ * --- */
+func HibernationNotConfigured(ctx aws.Context, client ec2iface.EC2API, ids []string) ([]string, error) {
+	notConfigured := make([]string, 0)
+	err := client.DescribeInstancesPagesWithContext(ctx, CreateEC2InstanceIDFilterParams(ids), func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.HibernationOptions == nil || !aws.BoolValue(instance.HibernationOptions.Configured) {
+					notConfigured = append(notConfigured, aws.StringValue(instance.InstanceId))
+				}
+			}
+		}
+		return true
+	})
+	return notConfigured, err
+}
+
 /* ---
  * Print EC2Instance details to console.
  * --- */
 func PrintEC2InstanceReport(report datamodels.EC2InstanceReport) {
+	FprintEC2InstanceReport(os.Stdout, report)
+}
+
+/* ---
+ * Print EC2Instance details to a writer.
+ * --- */
+func FprintEC2InstanceReport(w io.Writer, report datamodels.EC2InstanceReport) {
 	printString := "Name: %s\nInstanceID: %s\nInstanceType: %s\nInstance State: %s\nPublicIP %s\nPrivateIP: %s\n\n"
-	fmt.Println("\nInstances")
-	fmt.Println("---------")
+	fmt.Fprintln(w, "\nInstances")
+	fmt.Fprintln(w, "---------")
 	for _, elem := range report.Instances {
-		fmt.Printf(printString, elem.Name, elem.InstanceID, elem.InstanceType, elem.InstanceState, elem.PublicIP, elem.PrivateIP)
+		fmt.Fprintf(w, printString, elem.Name, elem.InstanceID, elem.InstanceType, elem.InstanceState, elem.PublicIP, elem.PrivateIP)
 	}
 }
 
@@ -267,47 +350,89 @@ func PrintEC2InstanceReport(report datamodels.EC2InstanceReport) {
  * Get the instance details from a launch.
  * --- */
 func GetInstanceDetails(reservation *ec2.Reservation) datamodels.EC2InstanceReport {
-	report := datamodels.EC2InstanceReport{}
+	report := datamodels.EC2InstanceReport{SchemaVersion: datamodels.EC2InstanceReportSchemaVersion}
 	instances := make([]datamodels.EC2InstanceDetails, 0)
 
-	// Results is a JSON(ish) object with the following form:
-	// {reservations[{instances:[...]}]}
-	// Loop over all reservation indexes
 	for _, instance := range reservation.Instances {
+		instances = append(instances, ParseEC2Instance(instance))
+	}
+	report.Instances = instances
+	return report
+}
 
-		// We need to see if the Name is one of the tags. It's not always
-		// present and not required in Ec2.
-		name := "None"
-		for _, keys := range instance.Tags {
-			if *keys.Key == "Name" {
-				name = url.QueryEscape(*keys.Value)
-			}
-		}
+/* ---
+ * Convert a single EC2 instance into the details we keep in reports.
+ * Every field on the AWS object is optional so check each pointer.
+ * --- */
+func ParseEC2Instance(instance *ec2.Instance) datamodels.EC2InstanceDetails {
+	details := datamodels.EC2InstanceDetails{
+		// The Name tag is not always present and not required in EC2.
+		Name:           "None",
+		Tags:           make(map[string]string),
+		SecurityGroups: make([]datamodels.EC2SecurityGroup, 0),
+		Volumes:        make([]datamodels.EC2Volume, 0),
+	}
 
-		// For now, just get the instance name, instance id, the instance type,
-		// the public and private IPs if present
-		details := datamodels.EC2InstanceDetails{}
-		if &name != nil {
-			details.Name = name
+	for _, tag := range instance.Tags {
+		if tag.Key == nil {
+			continue
 		}
-		if instance.InstanceId != nil {
-			details.InstanceID = *instance.InstanceId
-		}
-		if instance.InstanceType != nil {
-			details.InstanceType = *instance.InstanceType
-		}
-		if instance.State.Name != nil {
-			details.InstanceState = *instance.State.Name
-		}
-		if instance.PrivateIpAddress != nil {
-			details.PrivateIP = *instance.PrivateIpAddress
-		}
-		if instance.PublicIpAddress != nil {
-			details.PublicIP = *instance.PublicIpAddress
+		value := aws.StringValue(tag.Value)
+		details.Tags[*tag.Key] = value
+		if *tag.Key == "Name" {
+			details.Name = value
 		}
+	}
 
-		instances = append(instances, details)
+	details.InstanceID = aws.StringValue(instance.InstanceId)
+	details.InstanceType = aws.StringValue(instance.InstanceType)
+	if instance.State != nil {
+		details.InstanceState = aws.StringValue(instance.State.Name)
 	}
-	report.Instances = instances
-	return report
+	details.PrivateIP = aws.StringValue(instance.PrivateIpAddress)
+	details.PublicIP = aws.StringValue(instance.PublicIpAddress)
+	if instance.Placement != nil {
+		details.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	details.VpcID = aws.StringValue(instance.VpcId)
+	details.SubnetID = aws.StringValue(instance.SubnetId)
+	details.ImageID = aws.StringValue(instance.ImageId)
+	details.KeyName = aws.StringValue(instance.KeyName)
+	details.LaunchTime = aws.TimeValue(instance.LaunchTime)
+	details.Architecture = aws.StringValue(instance.Architecture)
+
+	// PlatformDetails (e.g., "Linux/UNIX") is more descriptive than Platform,
+	// which is only ever set for Windows instances.
+	details.Platform = aws.StringValue(instance.PlatformDetails)
+	if details.Platform == "" {
+		details.Platform = aws.StringValue(instance.Platform)
+	}
+
+	// InstanceLifecycle is only set for spot and scheduled instances.
+	details.Lifecycle = aws.StringValue(instance.InstanceLifecycle)
+	if details.Lifecycle == "" {
+		details.Lifecycle = "on-demand"
+	}
+
+	for _, group := range instance.SecurityGroups {
+		details.SecurityGroups = append(details.SecurityGroups, datamodels.EC2SecurityGroup{
+			GroupID:   aws.StringValue(group.GroupId),
+			GroupName: aws.StringValue(group.GroupName),
+		})
+	}
+
+	for _, mapping := range instance.BlockDeviceMappings {
+		// Only EBS volumes are reported. Instance store volumes have no ID.
+		if mapping.Ebs == nil {
+			continue
+		}
+		details.Volumes = append(details.Volumes, datamodels.EC2Volume{
+			DeviceName:          aws.StringValue(mapping.DeviceName),
+			VolumeID:            aws.StringValue(mapping.Ebs.VolumeId),
+			Status:              aws.StringValue(mapping.Ebs.Status),
+			AttachTime:          aws.TimeValue(mapping.Ebs.AttachTime),
+			DeleteOnTermination: aws.BoolValue(mapping.Ebs.DeleteOnTermination),
+		})
+	}
+	return details
 }
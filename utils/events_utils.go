@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Codes of the maintenance events AWS schedules on instances.
+var MaintenanceEventCodes = []string{"instance-reboot", "system-reboot", "system-maintenance", "instance-retirement", "instance-stop"}
+
+/* ---
+ * Create EC2 describe instance status params for every instance, running or
+ * not, with a scheduled maintenance event.
+ * --- */
+func CreateEC2DescribeEventStatusParams() *ec2.DescribeInstanceStatusInput {
+	return &ec2.DescribeInstanceStatusInput{
+		IncludeAllInstances: aws.Bool(true),
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("event.code"),
+				Values: aws.StringSlice(MaintenanceEventCodes),
+			},
+		},
+	}
+}
+
+/* ---
+ * Create EC2 describe regions params for the regions enabled in the account.
+ * --- */
+func CreateEC2DescribeRegionsParams() *ec2.DescribeRegionsInput {
+	return &ec2.DescribeRegionsInput{AllRegions: aws.Bool(false)}
+}
+
+/* ---
+ * Key identifying an event, used to remember which events an owner has
+ * been told about.
+ * --- */
+func ScheduledEventKey(event datamodels.ScheduledEvent) string {
+	return fmt.Sprintf("%s@%s", event.Code, event.NotBefore.UTC().Format(time.RFC3339))
+}
+
+/* ---
+ * Print scheduled events as a table.
+ * --- */
+func FprintScheduledEvents(w io.Writer, events []datamodels.ScheduledEvent, now time.Time) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "REGION\tNAME\tID\tOWNER\tEVENT\tNOT BEFORE\tIN\tDESCRIPTION\tNOTIFIED")
+	for _, event := range events {
+		notified := "-"
+		if event.Notified {
+			notified = "yes"
+		} else if event.Error != "" {
+			notified = "failed: " + event.Error
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", event.Region, dash(event.Name), event.InstanceID, dash(event.Owner),
+			event.Code, event.NotBefore.UTC().Format("2006-01-02 15:04 MST"), timeUntil(event.NotBefore, now), event.Description, notified)
+	}
+	writer.Flush()
+}
+
+/* ---
+ * Say how long until t in days and hours, e.g., 3d4h.
+ * --- */
+func timeUntil(t, now time.Time) string {
+	d := t.Sub(now)
+	if d < 0 {
+		return "now"
+	}
+	days := int(d / (24 * time.Hour))
+	hours := int(d%(24*time.Hour)) / int(time.Hour)
+	if days == 0 {
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dd%dh", days, hours)
+}
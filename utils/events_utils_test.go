@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFprintScheduledEvents(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	events := []datamodels.ScheduledEvent{
+		{Region: "us-east-1", InstanceID: "i-01", Name: "analysis", Owner: "jsmith", Code: "system-reboot", Description: "scheduled reboot", NotBefore: now.Add(76 * time.Hour), Notified: true},
+		{Region: "eu-west-1", InstanceID: "i-02", Code: "instance-retirement", Description: "retiring", NotBefore: now.Add(-time.Hour), Error: "no address"},
+	}
+	var buf strings.Builder
+	FprintScheduledEvents(&buf, events, now)
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 events: %q", len(lines), buf.String())
+	}
+	if got := strings.Fields(lines[0]); strings.Join(got, " ") != "REGION NAME ID OWNER EVENT NOT BEFORE IN DESCRIPTION NOTIFIED" {
+		t.Errorf("got header %q", lines[0])
+	}
+	// The columns line up under the header.
+	for _, line := range lines[1:] {
+		if idx := strings.Index(lines[0], "ID"); !strings.HasPrefix(line[idx:], "i-0") {
+			t.Errorf("ID column misaligned in %q", line)
+		}
+	}
+	for _, want := range []string{"2024-03-07 16:00 UTC  3d4h  scheduled reboot  yes", "eu-west-1  -         i-02  -", "now   retiring          failed: no address"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got %q, want it to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestTimeUntil(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	for d, want := range map[time.Duration]string{
+		-time.Minute:           "now",
+		0:                      "0h",
+		90 * time.Minute:       "1h",
+		24 * time.Hour:         "1d0h",
+		(3*24 + 4) * time.Hour: "3d4h",
+	} {
+		if got := timeUntil(now.Add(d), now); got != want {
+			t.Errorf("%s: got %s, want %s", d, got, want)
+		}
+	}
+}
+
+func TestScheduledEventKey(t *testing.T) {
+	notBefore := time.Date(2024, 3, 7, 11, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	event := datamodels.ScheduledEvent{Code: "system-reboot", NotBefore: notBefore}
+	if got := ScheduledEventKey(event); got != "system-reboot@2024-03-07T16:00:00Z" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,287 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Formats reports can be exported to.
+var ExportFormats = []string{"ssh-config", "ansible", "hosts", "csv"}
+
+// Tag naming the SSH user of an instance, for AMIs the user can not be
+// inferred from.
+const TagSSHUser = "SSHUser"
+
+// Default SSH user, used by Amazon Linux, RHEL, SUSE and most other AMIs.
+const DefaultSSHUser = "ec2-user"
+
+// SSH users of the common AMI families, matched in order against an AMI's
+// lowercased name and description.
+var amiFamilyUsers = []struct {
+	pattern *regexp.Regexp
+	user    string
+}{
+	{regexp.MustCompile(`ubuntu`), "ubuntu"},
+	{regexp.MustCompile(`debian`), "admin"},
+	{regexp.MustCompile(`centos`), "centos"},
+	{regexp.MustCompile(`rocky`), "rocky"},
+	{regexp.MustCompile(`almalinux`), "ec2-user"},
+	{regexp.MustCompile(`fedora`), "fedora"},
+	{regexp.MustCompile(`bitnami`), "bitnami"},
+	{regexp.MustCompile(`amzn|amazon linux|al2023|rhel|red hat|suse|sles`), "ec2-user"},
+}
+
+// Markers around exported /etc/hosts entries.
+const (
+	hostsFileBegin = "# BEGIN cloud_control hosts"
+	hostsFileEnd   = "# END cloud_control hosts"
+)
+
+// Most AMI IDs to describe in one call.
+const DescribeImagesBatchSize = 100
+
+var hostAliasPattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+var ansibleGroupPattern = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+/* ---
+ * Infer the SSH user of an AMI from its name and description. Returns an
+ * empty string if the family is not recognised.
+ * --- */
+func SSHUserForImage(name, description string) string {
+	text := strings.ToLower(name + " " + description)
+	for _, family := range amiFamilyUsers {
+		if family.pattern.MatchString(text) {
+			return family.user
+		}
+	}
+	return ""
+}
+
+/* ---
+ * Create EC2 describe images params. A filter is used rather than image IDs
+ * so one deregistered AMI does not fail the whole call.
+ * --- */
+func CreateEC2DescribeImagesParams(imageIDs []string) *ec2.DescribeImagesInput {
+	return &ec2.DescribeImagesInput{Filters: []*ec2.Filter{{Name: aws.String("image-id"), Values: aws.StringSlice(imageIDs)}}}
+}
+
+/* ---
+ * Get the hosts to export from a report. imageUsers maps AMI IDs to their
+ * SSH user. Hosts have no address if the instance has none of the requested
+ * kind, and no user if it runs Windows. Aliases are the instances' names,
+ * or their IDs for unnamed or duplicate names.
+ * --- */
+func ExportHosts(report datamodels.EC2InstanceReport, imageUsers map[string]string, options datamodels.ExportOptions) []datamodels.ExportHost {
+	hosts := make([]datamodels.ExportHost, 0)
+	names := make(map[string]int)
+	for _, instance := range report.Instances {
+		names[hostAlias(instance)]++
+	}
+
+	for _, instance := range report.Instances {
+		host := datamodels.ExportHost{Alias: hostAlias(instance), Address: instance.PrivateIP, Instance: instance}
+		if options.Address == "public" || (options.Address != "private" && instance.PublicIP != "") {
+			host.Address = instance.PublicIP
+		}
+		if names[host.Alias] > 1 {
+			host.Alias = instance.InstanceID
+		}
+		switch {
+		case strings.EqualFold(instance.Platform, "windows"):
+		case options.User != "":
+			host.User = options.User
+		case instance.Tags[TagSSHUser] != "":
+			host.User = instance.Tags[TagSSHUser]
+		case imageUsers[instance.ImageID] != "":
+			host.User = imageUsers[instance.ImageID]
+		default:
+			host.User = DefaultSSHUser
+		}
+		if instance.KeyName != "" && options.KeyDir != "" {
+			host.IdentityFile = path.Join(options.KeyDir, instance.KeyName+".pem")
+		}
+		hosts = append(hosts, host)
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Alias < hosts[j].Alias })
+	return hosts
+}
+
+/* ---
+ * Check if a host can be written to the given export format: ssh_config
+ * and Ansible hosts need an address and SSH user, hosts file entries an
+ * address. Every instance goes in a CSV roster.
+ * --- */
+func Exportable(format string, host datamodels.ExportHost) bool {
+	switch format {
+	case "ssh-config", "ansible":
+		return host.Address != "" && host.User != ""
+	case "hosts":
+		return host.Address != ""
+	}
+	return true
+}
+
+/* ---
+ * Get an instance's host alias: its name made safe for ssh_config and
+ * inventories, or its ID if it has no name.
+ * --- */
+func hostAlias(instance datamodels.EC2InstanceDetails) string {
+	alias := strings.Trim(hostAliasPattern.ReplaceAllString(instance.Name, "-"), "-")
+	if alias == "" || alias == "None" {
+		return instance.InstanceID
+	}
+	return alias
+}
+
+/* ---
+ * Write hosts in an export format, leaving out those the format can not
+ * use. source names the report the hosts came from, for the header comment.
+ * --- */
+func FormatExport(format, source string, hosts []datamodels.ExportHost, options datamodels.ExportOptions) ([]byte, error) {
+	if err := ValidateExportFormat(format); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("Generated from %s on %s", source, time.Now().UTC().Format(time.RFC3339))
+	exportable := make([]datamodels.ExportHost, 0, len(hosts))
+	for _, host := range hosts {
+		if Exportable(format, host) {
+			exportable = append(exportable, host)
+		}
+	}
+	hosts = exportable
+	switch format {
+	case "ssh-config":
+		return formatSSHConfig(header, hosts), nil
+	case "ansible":
+		return formatAnsibleInventory(header, hosts, options.Tags), nil
+	case "hosts":
+		return formatHostsFile(header, hosts), nil
+	}
+	return formatCSV(hosts, options.Tags)
+}
+
+/* ---
+ * Check a format is one reports can be exported to.
+ * --- */
+func ValidateExportFormat(format string) error {
+	for _, known := range ExportFormats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown export format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+}
+
+/* ---
+ * Write hosts as ssh_config Host blocks, for including from ~/.ssh/config.
+ * --- */
+func formatSSHConfig(header string, hosts []datamodels.ExportHost) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n", header)
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "\n# %s\n", strings.Join(strings.Fields(host.Instance.InstanceID+" "+host.Instance.InstanceType+" "+host.Instance.AvailabilityZone), " "))
+		fmt.Fprintf(&buf, "Host %s\n", host.Alias)
+		fmt.Fprintf(&buf, "    HostName %s\n", host.Address)
+		fmt.Fprintf(&buf, "    User %s\n", host.User)
+		if host.IdentityFile != "" {
+			fmt.Fprintf(&buf, "    IdentityFile %s\n", host.IdentityFile)
+			fmt.Fprintf(&buf, "    IdentitiesOnly yes\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+/* ---
+ * Write hosts as an INI Ansible inventory with a tag_<key>_<value> group for
+ * each value of the given tag keys (every tag but Name if none are given).
+ * --- */
+func formatAnsibleInventory(header string, hosts []datamodels.ExportHost, tagKeys []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n\n", header)
+	groups := make(map[string][]string)
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "%s ansible_host=%s ansible_user=%s", host.Alias, host.Address, host.User)
+		if host.IdentityFile != "" {
+			fmt.Fprintf(&buf, " ansible_ssh_private_key_file=%s", host.IdentityFile)
+		}
+		fmt.Fprintf(&buf, " instance_id=%s instance_type=%s\n", host.Instance.InstanceID, host.Instance.InstanceType)
+
+		keys := tagKeys
+		if len(keys) == 0 {
+			keys = make([]string, 0, len(host.Instance.Tags))
+			for key := range host.Instance.Tags {
+				if key != TagName && !strings.HasPrefix(key, "aws:") {
+					keys = append(keys, key)
+				}
+			}
+		}
+		for _, key := range keys {
+			if value, ok := host.Instance.Tags[key]; ok && value != "" {
+				group := ansibleGroupPattern.ReplaceAllString(fmt.Sprintf("tag_%s_%s", key, value), "_")
+				groups[group] = append(groups[group], host.Alias)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\n[%s]\n%s\n", name, strings.Join(groups[name], "\n"))
+	}
+	return buf.Bytes()
+}
+
+/* ---
+ * Write hosts as /etc/hosts lines between marker comments, so the block can
+ * be replaced on the next export.
+ * --- */
+func formatHostsFile(header string, hosts []datamodels.ExportHost) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n# %s\n", hostsFileBegin, header)
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "%s\t%s\t# %s\n", host.Address, host.Alias, host.Instance.InstanceID)
+	}
+	fmt.Fprintf(&buf, "%s\n", hostsFileEnd)
+	return buf.Bytes()
+}
+
+/* ---
+ * Write hosts as a CSV roster with a column for each of the given tags.
+ * --- */
+func formatCSV(hosts []datamodels.ExportHost, tagKeys []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	row := []string{"name", "instance_id", "instance_type", "state", "private_ip", "public_ip", "availability_zone", "launch_time", "ssh_user", "key_name"}
+	for _, key := range tagKeys {
+		row = append(row, "tag:"+key)
+	}
+	w.Write(row)
+	for _, host := range hosts {
+		instance := host.Instance
+		launchTime := ""
+		if !instance.LaunchTime.IsZero() {
+			launchTime = instance.LaunchTime.UTC().Format(time.RFC3339)
+		}
+		row = []string{instance.Name, instance.InstanceID, instance.InstanceType, instance.InstanceState, instance.PrivateIP, instance.PublicIP,
+			instance.AvailabilityZone, launchTime, host.User, instance.KeyName}
+		for _, key := range tagKeys {
+			row = append(row, instance.Tags[key])
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHUserForImage(t *testing.T) {
+	tests := []struct {
+		name, description, want string
+	}{
+		{"ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240301", "Canonical, Ubuntu, 22.04 LTS", "ubuntu"},
+		{"debian-12-amd64-20240201-1645", "Debian 12 (20240201-1645)", "admin"},
+		{"al2023-ami-2023.3.20240219.0-kernel-6.1-x86_64", "Amazon Linux 2023 AMI", "ec2-user"},
+		{"amzn2-ami-hvm-2.0.20240223.0-x86_64-gp2", "", "ec2-user"},
+		{"RHEL-9.3.0_HVM-20240117-x86_64-49-Hourly2-GP3", "Provided by Red Hat, Inc.", "ec2-user"},
+		{"Rocky-9-EC2-Base-9.3-20231113.0.x86_64", "", "rocky"},
+		{"CentOS Stream 9 x86_64", "", "centos"},
+		{"bitnami-wordpress-6.4.3-0-linux-debian-12-x86_64-hvm-ebs", "", "admin"},
+		{"Windows_Server-2022-English-Full-Base-2024.02.14", "Microsoft Windows Server 2022", ""},
+		{"custom-pipeline-image", "", ""},
+	}
+	for _, test := range tests {
+		if got := SSHUserForImage(test.name, test.description); got != test.want {
+			t.Errorf("%s: got user %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+/* ---
+ * A report with a public and a private-only host, two instances sharing a
+ * name, an unnamed instance and a Windows instance.
+ * --- */
+func exportTestReport() datamodels.EC2InstanceReport {
+	return datamodels.EC2InstanceReport{Instances: []datamodels.EC2InstanceDetails{
+		{InstanceID: "i-01", Name: "web 1", PrivateIP: "10.0.0.1", PublicIP: "54.0.0.1", ImageID: "ami-ubuntu", KeyName: "lab",
+			InstanceType: "t3.micro", AvailabilityZone: "us-east-1a", Tags: map[string]string{"Name": "web 1", "Project": "rna-seq", "Role": "web"}},
+		{InstanceID: "i-02", Name: "db", PrivateIP: "10.0.0.2", ImageID: "ami-unknown", Tags: map[string]string{"Project": "rna-seq", "SSHUser": "postgres"}},
+		{InstanceID: "i-03", Name: "worker", PrivateIP: "10.0.0.3", Tags: map[string]string{"aws:autoscaling:groupName": "workers"}},
+		{InstanceID: "i-04", Name: "worker", PrivateIP: "10.0.0.4"},
+		{InstanceID: "i-05", Name: "None", PrivateIP: "10.0.0.5"},
+		{InstanceID: "i-06", Name: "build", PrivateIP: "10.0.0.6", PublicIP: "54.0.0.6", Platform: "windows"},
+	}}
+}
+
+func exportHostsByID(hosts []datamodels.ExportHost) map[string]datamodels.ExportHost {
+	byID := make(map[string]datamodels.ExportHost)
+	for _, host := range hosts {
+		byID[host.Instance.InstanceID] = host
+	}
+	return byID
+}
+
+func TestExportHosts(t *testing.T) {
+	imageUsers := map[string]string{"ami-ubuntu": "ubuntu"}
+	hosts := ExportHosts(exportTestReport(), imageUsers, datamodels.ExportOptions{Address: "auto", KeyDir: "/home/jsmith/.ssh"})
+	byID := exportHostsByID(hosts)
+
+	tests := []struct {
+		id, alias, address, user, identityFile string
+	}{
+		{"i-01", "web-1", "54.0.0.1", "ubuntu", "/home/jsmith/.ssh/lab.pem"},
+		{"i-02", "db", "10.0.0.2", "postgres", ""},
+		{"i-03", "i-03", "10.0.0.3", DefaultSSHUser, ""},
+		{"i-04", "i-04", "10.0.0.4", DefaultSSHUser, ""},
+		{"i-05", "i-05", "10.0.0.5", DefaultSSHUser, ""},
+		{"i-06", "build", "54.0.0.6", "", ""},
+	}
+	for _, test := range tests {
+		host := byID[test.id]
+		if host.Alias != test.alias || host.Address != test.address || host.User != test.user || host.IdentityFile != test.identityFile {
+			t.Errorf("%s: got %s %s %s %q, want %s %s %s %q", test.id, host.Alias, host.Address, host.User, host.IdentityFile,
+				test.alias, test.address, test.user, test.identityFile)
+		}
+	}
+	for idx := 1; idx < len(hosts); idx++ {
+		if hosts[idx-1].Alias > hosts[idx].Alias {
+			t.Errorf("hosts not sorted by alias: %s before %s", hosts[idx-1].Alias, hosts[idx].Alias)
+		}
+	}
+}
+
+func TestExportHostsAddress(t *testing.T) {
+	tests := []struct {
+		address, web, db string
+	}{
+		{"auto", "54.0.0.1", "10.0.0.2"},
+		{"public", "54.0.0.1", ""},
+		{"private", "10.0.0.1", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		byID := exportHostsByID(ExportHosts(exportTestReport(), nil, datamodels.ExportOptions{Address: test.address}))
+		if byID["i-01"].Address != test.web || byID["i-02"].Address != test.db {
+			t.Errorf("--address %s: got %q and %q, want %q and %q", test.address, byID["i-01"].Address, byID["i-02"].Address, test.web, test.db)
+		}
+	}
+
+	// --user overrides tags and AMIs, but Windows hosts still have no user.
+	byID := exportHostsByID(ExportHosts(exportTestReport(), nil, datamodels.ExportOptions{User: "admin"}))
+	if byID["i-02"].User != "admin" || byID["i-06"].User != "" {
+		t.Errorf("--user admin: got %q for db and %q for Windows", byID["i-02"].User, byID["i-06"].User)
+	}
+}
+
+func TestExportable(t *testing.T) {
+	windows := datamodels.ExportHost{Alias: "build", Address: "54.0.0.6"}
+	noAddress := datamodels.ExportHost{Alias: "db", User: "ec2-user"}
+	tests := []struct {
+		format string
+		host   datamodels.ExportHost
+		want   bool
+	}{
+		{"ssh-config", windows, false},
+		{"ansible", windows, false},
+		{"hosts", windows, true},
+		{"csv", windows, true},
+		{"ssh-config", noAddress, false},
+		{"hosts", noAddress, false},
+		{"csv", noAddress, true},
+	}
+	for _, test := range tests {
+		if got := Exportable(test.format, test.host); got != test.want {
+			t.Errorf("%s %s: got %t, want %t", test.format, test.host.Alias, got, test.want)
+		}
+	}
+}
+
+func TestFormatSSHConfig(t *testing.T) {
+	hosts := ExportHosts(exportTestReport(), map[string]string{"ami-ubuntu": "ubuntu"}, datamodels.ExportOptions{KeyDir: "~/.ssh"})
+	output, err := FormatExport("ssh-config", "report.json", hosts, datamodels.ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(output)
+	want := "\n# i-01 t3.micro us-east-1a\nHost web-1\n    HostName 54.0.0.1\n    User ubuntu\n    IdentityFile ~/.ssh/lab.pem\n    IdentitiesOnly yes\n"
+	if !strings.Contains(text, want) {
+		t.Errorf("ssh_config missing web-1 block %q:\n%s", want, text)
+	}
+	if !strings.Contains(text, "\n# i-02\nHost db\n    HostName 10.0.0.2\n    User postgres\n\n") {
+		t.Errorf("ssh_config db block wrong:\n%s", text)
+	}
+	if !strings.HasPrefix(text, "# Generated from report.json on ") {
+		t.Errorf("ssh_config header wrong:\n%s", text)
+	}
+	if strings.Contains(text, "build") {
+		t.Errorf("Windows host in ssh_config:\n%s", text)
+	}
+}
+
+func TestFormatAnsibleInventory(t *testing.T) {
+	hosts := []datamodels.ExportHost{
+		{Alias: "web-1", Address: "54.0.0.1", User: "ubuntu", IdentityFile: "~/.ssh/lab.pem",
+			Instance: datamodels.EC2InstanceDetails{InstanceID: "i-01", InstanceType: "t3.micro",
+				Tags: map[string]string{"Name": "web 1", "Project": "rna-seq", "Role": "web/frontend", "aws:cloudformation:stack-name": "lab", "Empty": ""}}},
+		{Alias: "db", Address: "10.0.0.2", User: "ec2-user",
+			Instance: datamodels.EC2InstanceDetails{InstanceID: "i-02", InstanceType: "r5.large", Tags: map[string]string{"Project": "rna-seq"}}},
+	}
+
+	output := string(formatAnsibleInventory("header", hosts, nil))
+	for _, want := range []string{
+		"web-1 ansible_host=54.0.0.1 ansible_user=ubuntu ansible_ssh_private_key_file=~/.ssh/lab.pem instance_id=i-01 instance_type=t3.micro\n",
+		"db ansible_host=10.0.0.2 ansible_user=ec2-user instance_id=i-02 instance_type=r5.large\n",
+		"\n[tag_Project_rna_seq]\nweb-1\ndb\n",
+		"\n[tag_Role_web_frontend]\nweb-1\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("inventory missing %q:\n%s", want, output)
+		}
+	}
+	for _, unwanted := range []string{"tag_Name", "tag_aws", "tag_Empty"} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("inventory has group %s:\n%s", unwanted, output)
+		}
+	}
+	if strings.Index(output, "[tag_Project_rna_seq]") > strings.Index(output, "[tag_Role_web_frontend]") {
+		t.Errorf("groups not sorted:\n%s", output)
+	}
+
+	// Only the given tag keys become groups.
+	output = string(formatAnsibleInventory("header", hosts, []string{"Role"}))
+	if strings.Contains(output, "tag_Project") || !strings.Contains(output, "[tag_Role_web_frontend]") {
+		t.Errorf("inventory grouped by Role only:\n%s", output)
+	}
+}
+
+func TestFormatHostsFile(t *testing.T) {
+	hosts := []datamodels.ExportHost{
+		{Alias: "db", Address: "10.0.0.2", Instance: datamodels.EC2InstanceDetails{InstanceID: "i-02"}},
+		{Alias: "web-1", Address: "54.0.0.1", Instance: datamodels.EC2InstanceDetails{InstanceID: "i-01"}},
+	}
+	want := "# BEGIN cloud_control hosts\n# header\n10.0.0.2\tdb\t# i-02\n54.0.0.1\tweb-1\t# i-01\n# END cloud_control hosts\n"
+	if got := string(formatHostsFile("header", hosts)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFormatCSV(t *testing.T) {
+	launched := time.Date(2024, 3, 1, 9, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+	hosts := []datamodels.ExportHost{
+		{Alias: "web-1", User: "ubuntu", Instance: datamodels.EC2InstanceDetails{Name: "web, public", InstanceID: "i-01", InstanceType: "t3.micro",
+			InstanceState: "running", PrivateIP: "10.0.0.1", PublicIP: "54.0.0.1", AvailabilityZone: "us-east-1a", LaunchTime: launched,
+			KeyName: "lab", Tags: map[string]string{"Owner": "jsmith"}}},
+		{Alias: "build", Instance: datamodels.EC2InstanceDetails{Name: "build", InstanceID: "i-06", InstanceState: "stopped", Platform: "windows"}},
+	}
+	output, err := formatCSV(hosts, []string{"Owner", "Project"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "name,instance_id,instance_type,state,private_ip,public_ip,availability_zone,launch_time,ssh_user,key_name,tag:Owner,tag:Project\n" +
+		"\"web, public\",i-01,t3.micro,running,10.0.0.1,54.0.0.1,us-east-1a,2024-03-01T14:30:00Z,ubuntu,lab,jsmith,\n" +
+		"build,i-06,,stopped,,,,,,,,\n"
+	if string(output) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", output, want)
+	}
+}
@@ -2,39 +2,171 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"mdibl_cloud_control/datamodels"
 	"os"
-	"strings"
+	"path/filepath"
 	"time"
 )
 
-func WriteInstanceTypeOfferings(region string, instanceTypes []string) (string, error) {
-	var err error
+const (
+	// Reports contain instance IDs and IP addresses, so keep them private to
+	// the user running the tool.
+	ReportDirPerm  os.FileMode = 0700
+	ReportFilePerm os.FileMode = 0600
 
-	// Format the output file name.
-	filename := fmt.Sprintf("instance_types_%s.txt", region)
-	outfile, err := os.Create(filename)
-	if err != nil {
-		return filename, err
-	}
-	writer := bufio.NewWriter(outfile)
+	// Timestamp formats used in report paths. Avoid colons and spaces so the
+	// names are safe on every filesystem we share reports on.
+	reportDateFormat = "2006-01-02"
+	reportTimeFormat = "2006-01-02T15-04-05"
+)
+
+/* ---
+ * Get the directory reports for a region are written to on a given day,
+ * e.g., reports/us-east-2/2020-06-01
+ * --- */
+func ReportDirectory(reportDir, region string, t time.Time) string {
+	return filepath.Join(reportDir, region, t.Format(reportDateFormat))
+}
+
+/* ---
+ * Get the path of the "latest" pointer for a report type in a region,
+ * e.g., reports/us-east-2/latest_all_instance_details.json
+ * --- */
+func LatestReportPath(reportDir, region, reportName string) string {
+	return filepath.Join(reportDir, region, fmt.Sprintf("latest_%s", reportName))
+}
+
+/* ---
+ * Write the instance types offered in a region to the report directory.
+ * --- */
+func WriteInstanceTypeOfferings(reportDir, region string, instanceTypes []string) (string, error) {
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
 	for _, elem := range instanceTypes {
 		writer.WriteString(fmt.Sprintf("%s\n", elem))
 	}
 	writer.Flush()
-	return filename, err
+
+	// Format the output file name.
+	now := time.Now()
+	filename := fmt.Sprintf("instance_types_%s.txt", now.Format(reportTimeFormat))
+	return writeReportFile(reportDir, region, now, filename, "instance_types.txt", buffer.Bytes())
+}
+
+/* ---
+ * Write an instance report to the report directory.
+ * --- */
+func WriteInstanceDetailsReport(reportDir, region string, report datamodels.EC2InstanceReport, reportType string) (string, error) {
+	return WriteJSONReport(reportDir, region, fmt.Sprintf("%s_instance_details", reportType), report)
+}
+
+/* ---
+ * Write any JSON report to the report directory as <reportName>_<time>.json.
+ * --- */
+func WriteJSONReport(reportDir, region, reportName string, report interface{}) (string, error) {
+	return WriteJSONReportAt(reportDir, region, reportName, report, time.Now())
 }
 
-func WriteInstanceDetailsReport(report datamodels.EC2InstanceReport, reportType string) (string, error) {
-	timeString := strings.Replace(time.Now().Format("2006-01-02 15:04:05"), " ", "_", -1)
-	// Format the report file name.
-	reportName := fmt.Sprintf("%s_instance_details_%s.json", reportType, timeString)
+/* ---
+ * Write a JSON report with the file name for time t. Used when the name has
+ * to be known before the report is written (e.g., to tag instances with it).
+ * --- */
+func WriteJSONReportAt(reportDir, region, reportName string, report interface{}, t time.Time) (string, error) {
 	outputJSON, err := json.Marshal(report)
 	if err != nil {
-		return reportName, err
+		return "", err
+	}
+	return writeReportFile(reportDir, region, t, ReportFileName(reportName, t), fmt.Sprintf("%s.json", reportName), outputJSON)
+}
+
+/* ---
+ * Write a non-JSON report file, such as a log or image, to the report
+ * directory as <reportName>_<time>.<extension>.
+ * --- */
+func WriteReportData(reportDir, region, reportName, extension string, data []byte) (string, error) {
+	now := time.Now()
+	filename := fmt.Sprintf("%s_%s.%s", reportName, now.Format(reportTimeFormat), extension)
+	return writeReportFile(reportDir, region, now, filename, fmt.Sprintf("%s.%s", reportName, extension), data)
+}
+
+/* ---
+ * Get the file name of a JSON report written at time t,
+ * e.g., launch_instance_details_2020-06-01T09-12-44.json
+ * --- */
+func ReportFileName(reportName string, t time.Time) string {
+	return fmt.Sprintf("%s_%s.json", reportName, t.Format(reportTimeFormat))
+}
+
+/* ---
+ * Write data to <reportDir>/<region>/<date>/<filename> and point the
+ * latest_<latestName> link for the region at it. The report itself is what
+ * matters, so a link that can not be updated is only a warning.
+ * --- */
+func writeReportFile(reportDir, region string, t time.Time, filename, latestName string, data []byte) (string, error) {
+	dir := ReportDirectory(reportDir, region, t)
+	if err := os.MkdirAll(dir, ReportDirPerm); err != nil {
+		return "", err
+	}
+
+	// MkdirAll leaves directories that already exist alone, so tighten the
+	// region and date directories made by older versions. The report
+	// directory itself may be chosen by the user (e.g., ".") and is left be.
+	for _, privateDir := range []string{filepath.Dir(dir), dir} {
+		if err := os.Chmod(privateDir, ReportDirPerm); err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(dir, filename)
+	if err := WriteSecureFile(path, data); err != nil {
+		return path, err
+	}
+	latestPath := LatestReportPath(reportDir, region, latestName)
+	if err := updateLatestReport(latestPath, path); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to update %s: %s\n", latestPath, err)
+	}
+	return path, nil
+}
+
+/* ---
+ * Write data to a file that is only readable by the current user. Existing
+ * files are truncated and have their permissions tightened.
+ * --- */
+func WriteSecureFile(path string, data []byte) error {
+	outfile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, ReportFilePerm)
+	if err != nil {
+		return err
+	}
+	if err = outfile.Chmod(ReportFilePerm); err != nil {
+		outfile.Close()
+		return err
+	}
+	if _, err = outfile.Write(data); err != nil {
+		outfile.Close()
+		return err
+	}
+	return outfile.Close()
+}
+
+/* ---
+ * Replace the symlink at latestPath with one pointing at target. The link is
+ * relative so the report directory can be moved or shared as a whole.
+ * --- */
+func updateLatestReport(latestPath, target string) error {
+	relTarget, err := filepath.Rel(filepath.Dir(latestPath), target)
+	if err != nil {
+		return err
+	}
+
+	// Create the new link beside the old one and rename it into place so
+	// readers never see a missing pointer.
+	tmpPath := latestPath + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.Symlink(relTarget, tmpPath); err != nil {
+		return err
 	}
-	return reportName, ioutil.WriteFile(reportName, outputJSON, os.ModePerm)
+	return os.Rename(tmpPath, latestPath)
 }
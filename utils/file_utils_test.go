@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteReportFile(t *testing.T) {
+	reportDir := t.TempDir()
+	at := time.Date(2024, 3, 4, 9, 12, 44, 0, time.UTC)
+
+	// Directories made by older versions were world readable.
+	dir := ReportDirectory(reportDir, "us-east-1", at)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(dir, 0755)
+
+	path, err := WriteJSONReportAt(reportDir, "us-east-1", "all_instance_details", map[string]int{"instances": 0}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "all_instance_details_2024-03-04T09-12-44.json"); path != want {
+		t.Errorf("got path %s, want %s", path, want)
+	}
+	for _, checked := range []string{filepath.Dir(dir), dir} {
+		if info, err := os.Stat(checked); err != nil || info.Mode().Perm() != ReportDirPerm {
+			t.Errorf("%s: got mode %v (%v), want %v", checked, info.Mode().Perm(), err, ReportDirPerm)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != ReportFilePerm {
+		t.Errorf("%s: got mode %v (%v), want %v", path, info.Mode().Perm(), err, ReportFilePerm)
+	}
+
+	latest := LatestReportPath(reportDir, "us-east-1", "all_instance_details.json")
+	if target, err := os.Readlink(latest); err != nil || target != filepath.Join(at.Format(reportDateFormat), filepath.Base(path)) {
+		t.Errorf("got latest link to %q (%v)", target, err)
+	}
+}
+
+func TestWriteReportFileLatestLinkFails(t *testing.T) {
+	reportDir := t.TempDir()
+	at := time.Date(2024, 3, 4, 9, 12, 44, 0, time.UTC)
+
+	// A directory where the link should be can not be replaced by it.
+	latest := LatestReportPath(reportDir, "us-east-1", "all_instance_details.json")
+	if err := os.MkdirAll(filepath.Join(latest, "keep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := WriteJSONReportAt(reportDir, "us-east-1", "all_instance_details", []string{}, at)
+	if err != nil {
+		t.Fatalf("got error %v, want the report written with a warning", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "[]" {
+		t.Errorf("got report %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Most instance IDs DescribeInstanceStatus accepts in one call.
+const InstanceStatusBatchSize = 100
+
+/* ---
+ * Create EC2 describe instance status params for the given instances,
+ * including those that are not running.
+ * --- */
+func CreateEC2DescribeInstanceStatusParams(ids []string) *ec2.DescribeInstanceStatusInput {
+	return &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         aws.StringSlice(ids),
+		IncludeAllInstances: aws.Bool(true),
+	}
+}
+
+/* ---
+ * Convert an instance status into its health. Running instances whose
+ * checks have been failing for at least unreachableAfter are marked
+ * unreachable. Completed and cancelled events are left out.
+ * --- */
+func ParseInstanceStatus(status *ec2.InstanceStatus, unreachableAfter time.Duration, now time.Time) datamodels.InstanceHealth {
+	health := datamodels.InstanceHealth{
+		InstanceID:     aws.StringValue(status.InstanceId),
+		SystemStatus:   "not-applicable",
+		InstanceStatus: "not-applicable",
+		Events:         make([]datamodels.MaintenanceEvent, 0),
+	}
+	if status.InstanceState != nil {
+		health.State = aws.StringValue(status.InstanceState.Name)
+	}
+	for _, summary := range []struct {
+		status *ec2.InstanceStatusSummary
+		value  *string
+	}{{status.SystemStatus, &health.SystemStatus}, {status.InstanceStatus, &health.InstanceStatus}} {
+		if summary.status == nil {
+			continue
+		}
+		*summary.value = aws.StringValue(summary.status.Status)
+		for _, detail := range summary.status.Details {
+			since := aws.TimeValue(detail.ImpairedSince)
+			if aws.StringValue(detail.Status) == "failed" && !since.IsZero() && (health.ImpairedSince.IsZero() || since.Before(health.ImpairedSince)) {
+				health.ImpairedSince = since
+			}
+		}
+	}
+	health.Unreachable = health.State == "running" && !health.ImpairedSince.IsZero() && now.Sub(health.ImpairedSince) >= unreachableAfter
+
+	for _, event := range status.Events {
+		description := aws.StringValue(event.Description)
+		if strings.HasPrefix(description, "[Completed]") || strings.HasPrefix(description, "[Canceled]") {
+			continue
+		}
+		health.Events = append(health.Events, datamodels.MaintenanceEvent{
+			Code:        aws.StringValue(event.Code),
+			Description: description,
+			NotBefore:   aws.TimeValue(event.NotBefore),
+			NotAfter:    aws.TimeValue(event.NotAfter),
+		})
+	}
+	return health
+}
+
+/* ---
+ * Print instance health as a table, followed by any maintenance events.
+ * --- */
+func FprintHealthReport(w io.Writer, report datamodels.HealthReport, now time.Time) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tSTATE\tSYSTEM\tINSTANCE\tEVENTS\tPROBLEM")
+	for _, instance := range report.Instances {
+		problem := ""
+		switch {
+		case instance.Unreachable:
+			problem = fmt.Sprintf("unreachable for %s", now.Sub(instance.ImpairedSince).Truncate(time.Minute))
+		case !instance.ImpairedSince.IsZero():
+			problem = fmt.Sprintf("impaired for %s", now.Sub(instance.ImpairedSince).Truncate(time.Minute))
+		case instance.SystemStatus == "impaired" || instance.InstanceStatus == "impaired":
+			problem = "impaired"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", dash(instance.Name), instance.InstanceID, instance.State,
+			instance.SystemStatus, instance.InstanceStatus, len(instance.Events), dash(problem))
+	}
+	writer.Flush()
+
+	header := false
+	for _, instance := range report.Instances {
+		for _, event := range instance.Events {
+			if !header {
+				fmt.Fprintf(w, "\nScheduled events\n----------------\n")
+				header = true
+			}
+			fmt.Fprintf(w, "%s (%s): %s from %s: %s\n", instance.InstanceID, dash(instance.Name), event.Code,
+				event.NotBefore.UTC().Format(time.RFC3339), event.Description)
+		}
+	}
+}
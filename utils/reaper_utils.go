@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"text/tabwriter"
+)
+
+/* ---
+ * Print reaper actions as a table.
+ * --- */
+func FprintReaperReport(w io.Writer, report datamodels.ReaperReport) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tOWNER\tEXPIRY\tSTATE\tACTION\tERROR")
+	for _, entry := range report.Entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Name, entry.InstanceID, dash(entry.Owner), entry.Expiry, entry.State, entry.Action, dash(entry.Error))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"text/tabwriter"
+)
+
+/* ---
+ * Print the exit code of a command on each instance.
+ * --- */
+func FprintExecResults(w io.Writer, report datamodels.ExecReport) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tADDRESS\tEXIT\tDURATION\tERROR")
+	for _, result := range report.Results {
+		exit := "-"
+		if result.ExitCode >= 0 {
+			exit = fmt.Sprint(result.ExitCode)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", dash(result.Name), result.InstanceID, result.Address, exit, result.Duration, dash(result.Error))
+	}
+	writer.Flush()
+}
+
+/* ---
+ * Describe what happened to one transferred file.
+ * --- */
+func TransferFileSummary(file datamodels.TransferFile) string {
+	switch {
+	case file.Error != "":
+		return fmt.Sprintf("%s: %s", file.Path, file.Error)
+	case file.Skipped && file.SkipReason != datamodels.SkipUpToDate:
+		return fmt.Sprintf("%s: skipped (%s)", file.Path, file.SkipReason)
+	case file.Skipped:
+		return fmt.Sprintf("%s: up to date", file.Path)
+	case file.Resumed > 0:
+		return fmt.Sprintf("%s: %s copied (resumed after %s), verified", file.Path, FormatBytes(float64(file.Sent)), FormatBytes(float64(file.Resumed)))
+	}
+	return fmt.Sprintf("%s: %s copied, verified", file.Path, FormatBytes(float64(file.Sent)))
+}
+
+/* ---
+ * Print how many files were copied to or from each instance.
+ * --- */
+func FprintTransferResults(w io.Writer, report datamodels.TransferReport) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tFILES\tCOPIED\tUP TO DATE\tSKIPPED\tFAILED\tDURATION\tERROR")
+	for _, result := range report.Results {
+		copied, upToDate, skipped, failed := 0, 0, 0, 0
+		var bytes int64
+		for _, file := range result.Files {
+			switch {
+			case file.Error != "":
+				failed++
+			case file.Skipped && file.SkipReason == datamodels.SkipUpToDate:
+				upToDate++
+			case file.Skipped:
+				skipped++
+			default:
+				copied++
+				bytes += file.Sent
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d (%s)\t%d\t%d\t%d\t%s\t%s\n", dash(result.Name), result.InstanceID, len(result.Files), copied,
+			FormatBytes(float64(bytes)), upToDate, skipped, failed, result.Duration, dash(result.Error))
+	}
+	writer.Flush()
+}
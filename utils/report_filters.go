@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ---
+ * A single filter expression on instance report fields, e.g.,
+ *   name=analysis-*       state!=stopped
+ *   type=r5.*,m5.*        tag:Project=rnaseq
+ * Patterns are shell globs; a comma separated list matches any of them.
+ * --- */
+type InstanceFilter struct {
+	Field    string
+	TagKey   string
+	Negate   bool
+	Patterns []string
+}
+
+var instanceFilterFields = []string{"name", "id", "state", "type", "az", "tag:<key>"}
+
+/* ---
+ * Parse a filter expression of the form <field>=<patterns> or
+ * <field>!=<patterns>.
+ * --- */
+func ParseInstanceFilter(expr string) (InstanceFilter, error) {
+	filter := InstanceFilter{}
+
+	idx := strings.Index(expr, "=")
+	if idx <= 0 {
+		return filter, fmt.Errorf("Invalid filter %q: expected <field>=<pattern> or <field>!=<pattern>", expr)
+	}
+	field, value := expr[:idx], expr[idx+1:]
+	if strings.HasSuffix(field, "!") {
+		filter.Negate = true
+		field = strings.TrimSuffix(field, "!")
+	}
+
+	switch {
+	case strings.HasPrefix(field, "tag:") && len(field) > len("tag:"):
+		filter.Field = "tag"
+		filter.TagKey = strings.TrimPrefix(field, "tag:")
+	case field == "name" || field == "id" || field == "state" || field == "type" || field == "az":
+		filter.Field = field
+	default:
+		return filter, fmt.Errorf("Invalid filter field %q: expected one of %s", field, strings.Join(instanceFilterFields, ", "))
+	}
+
+	filter.Patterns = strings.Split(value, ",")
+	for _, pattern := range filter.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, fmt.Errorf("Invalid pattern %q in filter %q", pattern, expr)
+		}
+	}
+	return filter, nil
+}
+
+/* ---
+ * Parse a list of filter expressions.
+ * --- */
+func ParseInstanceFilters(exprs []string) ([]InstanceFilter, error) {
+	filters := make([]InstanceFilter, 0)
+	for _, expr := range exprs {
+		filter, err := ParseInstanceFilter(expr)
+		if err != nil {
+			return filters, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+/* ---
+ * Check if an instance matches the filter. Instances without the tag a tag
+ * filter asks for only match negated filters.
+ * --- */
+func (f InstanceFilter) Matches(instance datamodels.EC2InstanceDetails) bool {
+	var value string
+	switch f.Field {
+	case "name":
+		value = instance.Name
+	case "id":
+		value = instance.InstanceID
+	case "state":
+		value = instance.InstanceState
+	case "type":
+		value = instance.InstanceType
+	case "az":
+		value = instance.AvailabilityZone
+	case "tag":
+		tagValue, ok := instance.Tags[f.TagKey]
+		if !ok {
+			return f.Negate
+		}
+		value = tagValue
+	}
+
+	for _, pattern := range f.Patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return !f.Negate
+		}
+	}
+	return f.Negate
+}
+
+/* ---
+ * Keep only the instances in a report that match every filter.
+ * --- */
+func FilterInstanceReport(report datamodels.EC2InstanceReport, filters []InstanceFilter) datamodels.EC2InstanceReport {
+	filtered := report
+	filtered.Metadata = DeriveReportMetadata(report.Metadata)
+	filtered.Instances = make([]datamodels.EC2InstanceDetails, 0)
+
+	for _, instance := range report.Instances {
+		matches := true
+		for _, filter := range filters {
+			if !filter.Matches(instance) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered.Instances = append(filtered.Instances, instance)
+		}
+	}
+	return filtered
+}
+
+/* ---
+ * Parse a selection of 1-based indexes like "1 3 5-7" or "1,3,5-7" into
+ * 0-based indexes. "all" selects everything.
+ * --- */
+func ParseIndexSelection(selection string, count int) ([]int, error) {
+	indexes := make([]int, 0)
+	seen := make(map[int]bool)
+
+	add := func(idx int) error {
+		if idx < 1 || idx > count {
+			return fmt.Errorf("Selection %d is out of range 1-%d", idx, count)
+		}
+		if !seen[idx] {
+			seen[idx] = true
+			indexes = append(indexes, idx-1)
+		}
+		return nil
+	}
+
+	fields := strings.FieldsFunc(selection, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	for _, field := range fields {
+		if strings.ToLower(field) == "all" {
+			for idx := 1; idx <= count; idx++ {
+				add(idx)
+			}
+			continue
+		}
+
+		bounds := strings.SplitN(field, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return indexes, fmt.Errorf("Invalid selection %q", field)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return indexes, fmt.Errorf("Invalid selection %q", field)
+			}
+		}
+		for idx := start; idx <= end; idx++ {
+			if err := add(idx); err != nil {
+				return indexes, err
+			}
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+/* ---
+ * Keep only the instances at the given 0-based indexes.
+ * --- */
+func SelectInstanceReport(report datamodels.EC2InstanceReport, indexes []int) datamodels.EC2InstanceReport {
+	selected := report
+	selected.Metadata = DeriveReportMetadata(report.Metadata)
+	selected.Instances = make([]datamodels.EC2InstanceDetails, 0)
+	for _, idx := range indexes {
+		selected.Instances = append(selected.Instances, report.Instances[idx])
+	}
+	return selected
+}
+
+/* ---
+ * Merge several reports into one, de-duplicating by instance ID. When an
+ * instance appears in more than one report, the last report wins. Reports
+ * from different regions or accounts can not be merged since the result
+ * could not be acted on, and neither can reports without metadata (whose
+ * region is unknown) and reports with it. With force they are merged
+ * anyway: the result keeps the one known region, or has no metadata if the
+ * reports' regions or accounts differ.
+ * --- */
+func MergeInstanceReports(reports []datamodels.EC2InstanceReport, force bool) (datamodels.EC2InstanceReport, error) {
+	merged := datamodels.EC2InstanceReport{
+		SchemaVersion: datamodels.EC2InstanceReportSchemaVersion,
+		Instances:     make([]datamodels.EC2InstanceDetails, 0),
+	}
+
+	unknown := 0
+	conflict := false
+	positions := make(map[string]int)
+	for _, report := range reports {
+		switch {
+		case report.Metadata == nil:
+			unknown++
+		case merged.Metadata == nil && !conflict:
+			merged.Metadata = DeriveReportMetadata(report.Metadata)
+		case conflict:
+		case merged.Metadata.Region != report.Metadata.Region || merged.Metadata.AccountID != report.Metadata.AccountID:
+			if !force {
+				return merged, fmt.Errorf("Can not merge reports from region %s (account %s) and region %s (account %s)",
+					merged.Metadata.Region, merged.Metadata.AccountID, report.Metadata.Region, report.Metadata.AccountID)
+			}
+			conflict = true
+			merged.Metadata = nil
+		}
+
+		for _, instance := range report.Instances {
+			if idx, ok := positions[instance.InstanceID]; ok {
+				merged.Instances[idx] = instance
+				continue
+			}
+			positions[instance.InstanceID] = len(merged.Instances)
+			merged.Instances = append(merged.Instances, instance)
+		}
+	}
+	if unknown > 0 && unknown < len(reports) && !force {
+		return merged, fmt.Errorf("Can not merge %d reports without metadata (region unknown) with reports from region %s", unknown, merged.Metadata.Region)
+	}
+	return merged, nil
+}
+
+/* ---
+ * Split a report into one report per value of "type" or "tag:<key>".
+ * Instances without the tag are grouped under "untagged".
+ * --- */
+func SplitInstanceReport(report datamodels.EC2InstanceReport, splitBy string) (map[string]datamodels.EC2InstanceReport, error) {
+	parts := make(map[string]datamodels.EC2InstanceReport)
+
+	var keyFunc func(datamodels.EC2InstanceDetails) string
+	switch {
+	case splitBy == "type":
+		keyFunc = func(instance datamodels.EC2InstanceDetails) string { return instance.InstanceType }
+	case strings.HasPrefix(splitBy, "tag:") && len(splitBy) > len("tag:"):
+		tagKey := strings.TrimPrefix(splitBy, "tag:")
+		keyFunc = func(instance datamodels.EC2InstanceDetails) string {
+			if value, ok := instance.Tags[tagKey]; ok && value != "" {
+				return value
+			}
+			return "untagged"
+		}
+	default:
+		return parts, fmt.Errorf("Invalid split %q: expected type or tag:<key>", splitBy)
+	}
+
+	for _, instance := range report.Instances {
+		key := keyFunc(instance)
+		part, ok := parts[key]
+		if !ok {
+			part = report
+			part.Metadata = DeriveReportMetadata(report.Metadata)
+			part.Instances = make([]datamodels.EC2InstanceDetails, 0)
+		}
+		part.Instances = append(part.Instances, instance)
+		parts[key] = part
+	}
+	return parts, nil
+}
+
+/* ---
+ * Copy the metadata of a source report for a report derived from it. The
+ * derived report describes the same region and account, but records the
+ * command and time it was made.
+ * --- */
+func DeriveReportMetadata(source *datamodels.ReportMetadata) *datamodels.ReportMetadata {
+	if source == nil {
+		return nil
+	}
+	return NewReportMetadata(source.Region, source.AccountID, source.Profile)
+}
+
+var unsafeReportNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+/* ---
+ * Get a distinct file-safe name for each key of a split report. Keys that
+ * are made safe to the same name (e.g., "rna seq" and "rna/seq") get a
+ * numbered suffix, in key order so the names are stable between runs.
+ * --- */
+func SplitReportNames(parts map[string]datamodels.EC2InstanceReport) map[string]string {
+	keys := make([]string, 0, len(parts))
+	for key := range parts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string)
+	used := make(map[string]bool)
+	for _, key := range keys {
+		base := SafeReportName(key)
+		if base == "" {
+			base = "blank"
+		}
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[name] = true
+		names[key] = name
+	}
+	return names
+}
+
+/* ---
+ * Make a value (e.g., a tag value) safe to use in a report file name.
+ * --- */
+func SafeReportName(value string) string {
+	return strings.Trim(unsafeReportNameChars.ReplaceAllString(value, "_"), "_")
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"fmt"
+	"mdibl_cloud_control/datamodels"
+	"strings"
+	"testing"
+)
+
+/* ---
+ * A report of instances with the given IDs, each tagged with the project
+ * after its colon, e.g., "i-01:rnaseq". No colon means no Project tag.
+ * --- */
+func filterTestReport(region string, ids ...string) datamodels.EC2InstanceReport {
+	report := datamodels.EC2InstanceReport{SchemaVersion: datamodels.EC2InstanceReportSchemaVersion}
+	if region != "" {
+		report.Metadata = &datamodels.ReportMetadata{Region: region, AccountID: "123456789012"}
+	}
+	for _, id := range ids {
+		parts := strings.SplitN(id, ":", 2)
+		instance := datamodels.EC2InstanceDetails{InstanceID: parts[0], Name: "analysis-" + parts[0], InstanceType: "t3.micro", InstanceState: "running", Tags: map[string]string{}}
+		if len(parts) == 2 {
+			instance.Tags["Project"] = parts[1]
+		}
+		report.Instances = append(report.Instances, instance)
+	}
+	return report
+}
+
+func reportIDs(report datamodels.EC2InstanceReport) string {
+	ids := make([]string, 0)
+	for _, instance := range report.Instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestParseInstanceFilter(t *testing.T) {
+	tests := []struct {
+		expr   string
+		filter string
+	}{
+		{"name=analysis-*", "{name  false [analysis-*]}"},
+		{"state!=stopped", "{state  true [stopped]}"},
+		{"type=r5.*,m5.*", "{type  false [r5.* m5.*]}"},
+		{"tag:Project=rnaseq", "{tag Project false [rnaseq]}"},
+		{"tag:Cost Center!=", "{tag Cost Center true []}"},
+		{"az=us-east-1[ab]", "{az  false [us-east-1[ab]]}"},
+	}
+	for _, test := range tests {
+		filter, err := ParseInstanceFilter(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(filter); got != test.filter {
+			t.Errorf("%s: got %s, want %s", test.expr, got, test.filter)
+		}
+	}
+
+	for _, expr := range []string{"", "name", "=x", "owner=me", "tag:=x", "name=[", "!=x"} {
+		if _, err := ParseInstanceFilter(expr); err == nil {
+			t.Errorf("%q: parsed without an error", expr)
+		}
+	}
+}
+
+func TestInstanceFilterMatches(t *testing.T) {
+	instance := datamodels.EC2InstanceDetails{
+		InstanceID:       "i-01",
+		Name:             "analysis-01",
+		InstanceType:     "r5.xlarge",
+		InstanceState:    "running",
+		AvailabilityZone: "us-east-1a",
+		Tags:             map[string]string{"Project": "rnaseq"},
+	}
+	for expr, want := range map[string]bool{
+		"name=analysis-*":     true,
+		"name=web-*":          false,
+		"name!=web-*":         true,
+		"id=i-01":             true,
+		"state=stopped":       false,
+		"state!=stopped":      true,
+		"type=m5.*,r5.*":      true,
+		"az=us-east-1[ab]":    true,
+		"tag:Project=rnaseq":  true,
+		"tag:Project=rna*":    true,
+		"tag:Project!=rnaseq": false,
+		// Instances without the tag only match negated filters.
+		"tag:Owner=*":  false,
+		"tag:Owner!=x": true,
+	} {
+		filter, err := ParseInstanceFilter(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.Matches(instance); got != want {
+			t.Errorf("%s: got %t, want %t", expr, got, want)
+		}
+	}
+}
+
+func TestFilterInstanceReport(t *testing.T) {
+	report := filterTestReport("us-east-1", "i-01:rnaseq", "i-02:atac", "i-03")
+	report.Instances[1].InstanceState = "stopped"
+	filters, err := ParseInstanceFilters([]string{"tag:Project!=atac", "state=running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered := FilterInstanceReport(report, filters)
+	if got := reportIDs(filtered); got != "i-01,i-03" {
+		t.Errorf("got %s, want i-01,i-03", got)
+	}
+	if filtered.Metadata == nil || filtered.Metadata.Region != "us-east-1" || filtered.Metadata == report.Metadata {
+		t.Errorf("got metadata %+v, want new metadata for the same region", filtered.Metadata)
+	}
+	if got := reportIDs(FilterInstanceReport(report, nil)); got != "i-01,i-02,i-03" {
+		t.Errorf("no filters: got %s, want every instance", got)
+	}
+	if len(report.Instances) != 3 {
+		t.Error("filtering changed the source report")
+	}
+}
+
+func TestParseIndexSelection(t *testing.T) {
+	tests := []struct {
+		selection string
+		indexes   string
+	}{
+		{"1 3 5-7", "[0 2 4 5 6]"},
+		{"1,3,5-7", "[0 2 4 5 6]"},
+		{"7, 2\t2", "[1 6]"},
+		{"all", "[0 1 2 3 4 5 6]"},
+		{"ALL 3", "[0 1 2 3 4 5 6]"},
+		{"", "[]"},
+	}
+	for _, test := range tests {
+		indexes, err := ParseIndexSelection(test.selection, 7)
+		if err != nil {
+			t.Errorf("%q: %s", test.selection, err)
+			continue
+		}
+		if got := fmt.Sprint(indexes); got != test.indexes {
+			t.Errorf("%q: got %s, want %s", test.selection, got, test.indexes)
+		}
+	}
+
+	for _, selection := range []string{"0", "8", "1-8", "x", "3-1", "2-x", "-1"} {
+		if _, err := ParseIndexSelection(selection, 7); err == nil {
+			t.Errorf("%q: parsed without an error", selection)
+		}
+	}
+}
+
+func TestSelectInstanceReport(t *testing.T) {
+	report := filterTestReport("us-east-1", "i-01", "i-02", "i-03")
+	if got := reportIDs(SelectInstanceReport(report, []int{0, 2})); got != "i-01,i-03" {
+		t.Errorf("got %s, want i-01,i-03", got)
+	}
+}
+
+func TestMergeInstanceReports(t *testing.T) {
+	east := filterTestReport("us-east-1", "i-01:rnaseq", "i-02")
+	later := filterTestReport("us-east-1", "i-02:atac", "i-03")
+	west := filterTestReport("us-west-2", "i-04")
+	unknown := filterTestReport("", "i-05")
+
+	merged, err := MergeInstanceReports([]datamodels.EC2InstanceReport{east, later}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reportIDs(merged); got != "i-01,i-02,i-03" {
+		t.Errorf("got %s, want i-01,i-02,i-03", got)
+	}
+	if merged.Instances[1].Tags["Project"] != "atac" {
+		t.Error("the last report did not win for a duplicate instance")
+	}
+	if merged.Metadata == nil || merged.Metadata.Region != "us-east-1" {
+		t.Errorf("got metadata %+v, want us-east-1", merged.Metadata)
+	}
+
+	tests := []struct {
+		name    string
+		reports []datamodels.EC2InstanceReport
+		region  string
+	}{
+		{"regions differ", []datamodels.EC2InstanceReport{east, west}, ""},
+		{"metadata missing", []datamodels.EC2InstanceReport{east, unknown}, "us-east-1"},
+		{"metadata missing first", []datamodels.EC2InstanceReport{unknown, east}, "us-east-1"},
+		{"regions differ after one without metadata", []datamodels.EC2InstanceReport{east, unknown, west}, ""},
+	}
+	for _, test := range tests {
+		if _, err := MergeInstanceReports(test.reports, false); err == nil {
+			t.Errorf("%s: merged without force", test.name)
+		}
+		merged, err := MergeInstanceReports(test.reports, true)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		region := ""
+		if merged.Metadata != nil {
+			region = merged.Metadata.Region
+		}
+		if region != test.region {
+			t.Errorf("%s: got region %q with force, want %q", test.name, region, test.region)
+		}
+	}
+
+	// Reports that all lack metadata merge without force.
+	merged, err = MergeInstanceReports([]datamodels.EC2InstanceReport{unknown, filterTestReport("", "i-06")}, false)
+	if err != nil || merged.Metadata != nil || reportIDs(merged) != "i-05,i-06" {
+		t.Errorf("got %s %+v (%v), want i-05,i-06 without metadata", reportIDs(merged), merged.Metadata, err)
+	}
+}
+
+func TestSplitInstanceReport(t *testing.T) {
+	report := filterTestReport("us-east-1", "i-01:rnaseq", "i-02:atac", "i-03", "i-04:rnaseq", "i-05:")
+	report.Instances[1].InstanceType = "r5.xlarge"
+
+	parts, err := SplitInstanceReport(report, "tag:Project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"rnaseq": "i-01,i-04", "atac": "i-02", "untagged": "i-03,i-05"}
+	if len(parts) != len(want) {
+		t.Errorf("got %d parts, want %d", len(parts), len(want))
+	}
+	for key, ids := range want {
+		if got := reportIDs(parts[key]); got != ids {
+			t.Errorf("%s: got %s, want %s", key, got, ids)
+		}
+		if parts[key].Metadata == nil || parts[key].Metadata.Region != "us-east-1" {
+			t.Errorf("%s: got metadata %+v, want us-east-1", key, parts[key].Metadata)
+		}
+	}
+
+	parts, err = SplitInstanceReport(report, "type")
+	if err != nil || reportIDs(parts["r5.xlarge"]) != "i-02" || len(parts["t3.micro"].Instances) != 4 {
+		t.Errorf("split by type: got %v (%v)", parts, err)
+	}
+
+	for _, splitBy := range []string{"", "name", "tag:"} {
+		if _, err := SplitInstanceReport(report, splitBy); err == nil {
+			t.Errorf("%q: split without an error", splitBy)
+		}
+	}
+}
+
+func TestSplitReportNames(t *testing.T) {
+	parts := map[string]datamodels.EC2InstanceReport{"rna seq": {}, "rna/seq": {}, "rna_seq": {}, "atac": {}, "***": {}}
+	want := map[string]string{"***": "blank", "atac": "atac", "rna seq": "rna_seq", "rna/seq": "rna_seq_2", "rna_seq": "rna_seq_3"}
+	names := SplitReportNames(parts)
+	for key, name := range want {
+		if names[key] != name {
+			t.Errorf("%q: got %q, want %q", key, names[key], name)
+		}
+	}
+}
+
+func TestSafeReportName(t *testing.T) {
+	for value, want := range map[string]string{
+		"rnaseq":             "rnaseq",
+		"Genomics Core":      "Genomics_Core",
+		"../../etc":          ".._.._etc",
+		"r5.xlarge":          "r5.xlarge",
+		" lab: smith/jones ": "lab_smith_jones",
+	} {
+		if got := SafeReportName(value); got != want {
+			t.Errorf("%q: got %q, want %q", value, got, want)
+		}
+	}
+}
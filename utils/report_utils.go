@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/* ---
+ * Create the metadata header for a report produced by the running command.
+ * --- */
+func NewReportMetadata(region, accountID, profile string) *datamodels.ReportMetadata {
+	return &datamodels.ReportMetadata{
+		Region:      region,
+		AccountID:   accountID,
+		Profile:     profile,
+		ToolVersion: ToolVersion,
+		CreatedAt:   time.Now().UTC(),
+		Command:     strings.Join(os.Args, " "),
+	}
+}
+
+/* ---
+ * Load an instance report from disk.
+ * --- */
+func LoadInstanceReport(path string) (datamodels.EC2InstanceReport, error) {
+	report := datamodels.EC2InstanceReport{}
+
+	// Make sure the report exists. If it is not present, abort.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return report, fmt.Errorf("No instance report file found at: %s", path)
+	}
+
+	// Read json file
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+
+	// Older reports are upgraded to the current format as they are read.
+	report, _, err = MigrateInstanceReport(jsonData)
+	return report, err
+}
+
+/* ---
+ * Get the schema version of a JSON instance report. Reports written before
+ * versioning was introduced have no schema_version field and are version 1.
+ * --- */
+func InstanceReportSchemaVersion(jsonData []byte) (int, error) {
+	header := struct {
+		SchemaVersion *int `json:"schema_version"`
+	}{}
+	if err := json.Unmarshal(jsonData, &header); err != nil {
+		return 0, err
+	}
+	if header.SchemaVersion == nil {
+		return 1, nil
+	}
+	return *header.SchemaVersion, nil
+}
+
+/* ---
+ * Parse a JSON instance report of any known schema version and upgrade it to
+ * the current version. Returns the upgraded report and the version it was
+ * stored in.
+ * --- */
+func MigrateInstanceReport(jsonData []byte) (datamodels.EC2InstanceReport, int, error) {
+	report := datamodels.EC2InstanceReport{}
+
+	version, err := InstanceReportSchemaVersion(jsonData)
+	if err != nil {
+		return report, 0, err
+	}
+	if version > datamodels.EC2InstanceReportSchemaVersion {
+		return report, version, fmt.Errorf("Report schema version %d is newer than this tool supports (%d)", version, datamodels.EC2InstanceReportSchemaVersion)
+	}
+
+	// Every version so far only adds fields, so the current model can read
+	// all of them. Each step below fills in what the older format lacked.
+	if err := json.Unmarshal(jsonData, &report); err != nil {
+		return report, version, err
+	}
+
+	// Version 1 -> 2: names were URL-escaped and no other tags were kept.
+	if version < 2 {
+		for idx := range report.Instances {
+			instance := &report.Instances[idx]
+			if name, err := url.QueryUnescape(instance.Name); err == nil {
+				instance.Name = name
+			}
+			instance.Tags = make(map[string]string)
+			if instance.Name != "None" {
+				instance.Tags["Name"] = instance.Name
+			}
+			instance.SecurityGroups = make([]datamodels.EC2SecurityGroup, 0)
+			instance.Volumes = make([]datamodels.EC2Volume, 0)
+		}
+	}
+
+	// Version 2 -> 3: reports had no metadata header. There is no way to
+	// recover where they were made, so the metadata is left empty and the
+	// report is assumed to belong to the configured region.
+
+	report.SchemaVersion = datamodels.EC2InstanceReportSchemaVersion
+	return report, version, nil
+}
+
+/* ---
+ * Upgrade an instance report file in place. The original file is kept beside
+ * it as <path>.v<version>.bak. Returns the version the report was stored in.
+ * --- */
+func MigrateInstanceReportFile(path string) (int, error) {
+	jsonData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	report, version, err := MigrateInstanceReport(jsonData)
+	if err != nil || version == datamodels.EC2InstanceReportSchemaVersion {
+		return version, err
+	}
+
+	outputJSON, err := json.Marshal(report)
+	if err != nil {
+		return version, err
+	}
+	if err := WriteSecureFile(fmt.Sprintf("%s.v%d.bak", path, version), jsonData); err != nil {
+		return version, err
+	}
+	return version, WriteSecureFile(path, outputJSON)
+}
+
+/* ---
+ * Work out which region a report should be acted on in. Reports carry the
+ * region and account they were created in; refuse to act on a report from
+ * another account and use the report's region over the configured one.
+ * Reports without metadata are assumed to belong to the configured region.
+ * --- */
+func ReportRegion(report datamodels.EC2InstanceReport, region, accountID string) (string, error) {
+	if report.Metadata == nil {
+		return region, nil
+	}
+
+	if report.Metadata.AccountID != "" {
+		if accountID == "" {
+			return "", fmt.Errorf("Report was created in account %s but the current account could not be determined", report.Metadata.AccountID)
+		}
+		if report.Metadata.AccountID != accountID {
+			return "", fmt.Errorf("Report was created in account %s but the current credentials are for account %s", report.Metadata.AccountID, accountID)
+		}
+	}
+
+	if report.Metadata.Region != "" {
+		return report.Metadata.Region, nil
+	}
+	return region, nil
+}
+
+/* ---
+ * Get the filter expressions that scope a diff to a baseline's instances by
+ * default: tag:<key>=<value> for each of the Project and Owner tags that all
+ * the baseline's instances share. Empty if they share neither.
+ * --- */
+func DefaultDiffScope(baseline datamodels.EC2InstanceReport) []string {
+	scope := make([]string, 0)
+	if len(baseline.Instances) == 0 {
+		return scope
+	}
+	for _, key := range []string{TagProject, TagOwner} {
+		value := baseline.Instances[0].Tags[key]
+		shared := value != "" && !strings.ContainsAny(value, "*?[],\\")
+		for _, instance := range baseline.Instances[1:] {
+			if instance.Tags[key] != value {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			scope = append(scope, fmt.Sprintf("tag:%s=%s", key, value))
+		}
+	}
+	return scope
+}
+
+/* ---
+ * Compare a baseline report against the live instances. Instances are
+ * matched by instance ID. Live instances missing from the baseline are only
+ * reported as extra if they match every scope filter.
+ * --- */
+func DiffInstanceReports(baseline, live datamodels.EC2InstanceReport, scope []InstanceFilter) datamodels.DriftReport {
+	drift := datamodels.DriftReport{
+		Missing:      make([]datamodels.EC2InstanceDetails, 0),
+		Extra:        make([]datamodels.EC2InstanceDetails, 0),
+		StateChanged: make([]datamodels.InstanceChange, 0),
+		Retyped:      make([]datamodels.InstanceChange, 0),
+		IPChanged:    make([]datamodels.InstanceChange, 0),
+	}
+
+	liveByID := make(map[string]datamodels.EC2InstanceDetails)
+	for _, instance := range live.Instances {
+		liveByID[instance.InstanceID] = instance
+	}
+
+	baselineIDs := make(map[string]bool)
+	for _, want := range baseline.Instances {
+		baselineIDs[want.InstanceID] = true
+		have, ok := liveByID[want.InstanceID]
+		if !ok {
+			drift.Missing = append(drift.Missing, want)
+			continue
+		}
+
+		change := func(field, baselineValue, currentValue string) datamodels.InstanceChange {
+			return datamodels.InstanceChange{
+				InstanceID: want.InstanceID,
+				Name:       have.Name,
+				Field:      field,
+				Baseline:   baselineValue,
+				Current:    currentValue,
+			}
+		}
+		if want.InstanceState != have.InstanceState {
+			drift.StateChanged = append(drift.StateChanged, change("instance_state", want.InstanceState, have.InstanceState))
+		}
+		if want.InstanceType != have.InstanceType {
+			drift.Retyped = append(drift.Retyped, change("instance_type", want.InstanceType, have.InstanceType))
+		}
+		if want.PrivateIP != have.PrivateIP {
+			drift.IPChanged = append(drift.IPChanged, change("private_ip", want.PrivateIP, have.PrivateIP))
+		}
+		if want.PublicIP != have.PublicIP {
+			drift.IPChanged = append(drift.IPChanged, change("public_ip", want.PublicIP, have.PublicIP))
+		}
+	}
+
+	for _, instance := range live.Instances {
+		if baselineIDs[instance.InstanceID] {
+			continue
+		}
+		inScope := true
+		for _, filter := range scope {
+			if !filter.Matches(instance) {
+				inScope = false
+				break
+			}
+		}
+		if inScope {
+			drift.Extra = append(drift.Extra, instance)
+		}
+	}
+	return drift
+}
+
+/* ---
+ * Print a drift report to console.
+ * --- */
+func PrintDriftReport(drift datamodels.DriftReport) {
+	FprintDriftReport(os.Stdout, drift)
+}
+
+/* ---
+ * Print a drift report to a writer.
+ * --- */
+func FprintDriftReport(w io.Writer, drift datamodels.DriftReport) {
+	if len(drift.Scope) > 0 {
+		fmt.Fprintf(w, "\nExtra instances checked among those matching: %s\n", strings.Join(drift.Scope, " "))
+	}
+	if !drift.HasDrift() {
+		fmt.Fprintln(w, "\nNo drift from baseline")
+		return
+	}
+
+	printInstances := func(title string, instances []datamodels.EC2InstanceDetails) {
+		if len(instances) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s\n%s\n", title, strings.Repeat("-", len(title)))
+		for _, instance := range instances {
+			fmt.Fprintf(w, "Name: %s, ID: %s, Instance type: %s, State: %s\n", instance.Name, instance.InstanceID, instance.InstanceType, instance.InstanceState)
+		}
+	}
+	printChanges := func(title string, changes []datamodels.InstanceChange) {
+		if len(changes) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s\n%s\n", title, strings.Repeat("-", len(title)))
+		for _, change := range changes {
+			fmt.Fprintf(w, "Name: %s, ID: %s, %s: %q -> %q\n", change.Name, change.InstanceID, change.Field, change.Baseline, change.Current)
+		}
+	}
+
+	printInstances("Missing instances", drift.Missing)
+	printInstances("Extra instances", drift.Extra)
+	printChanges("State changed", drift.StateChanged)
+	printChanges("Instance type changed", drift.Retyped)
+	printChanges("IP address changed", drift.IPChanged)
+}
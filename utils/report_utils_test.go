@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A report as written before schema versions were added: names were URL
+// escaped and there were no tags, metadata or volumes.
+const version1Report = `{"instances": [
+	{"name": "analysis%2001", "instance_id": "i-01", "instance_type": "t3.micro", "instance_state": "running"},
+	{"name": "None", "instance_id": "i-02", "instance_type": "t3.micro", "instance_state": "stopped"}
+]}`
+
+// A version 2 report, with tags but no metadata.
+const version2Report = `{"schema_version": 2, "instances": [
+	{"name": "web 50%", "instance_id": "i-03", "tags": {"Name": "web 50%", "Project": "rnaseq"}, "volumes": [{"volume_id": "vol-01"}]}
+]}`
+
+func TestInstanceReportSchemaVersion(t *testing.T) {
+	for data, want := range map[string]int{
+		version1Report:                      1,
+		version2Report:                      2,
+		`{"schema_version": 3}`:             3,
+		`{"schema_version": 0}`:             0,
+		`{"instances": [], "metadata": {}}`: 1,
+	} {
+		version, err := InstanceReportSchemaVersion([]byte(data))
+		if err != nil || version != want {
+			t.Errorf("%.40s: got version %d (%v), want %d", data, version, err, want)
+		}
+	}
+	if _, err := InstanceReportSchemaVersion([]byte("not json")); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestMigrateInstanceReport(t *testing.T) {
+	report, version, err := MigrateInstanceReport([]byte(version1Report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || report.SchemaVersion != datamodels.EC2InstanceReportSchemaVersion {
+		t.Errorf("got version %d upgraded to %d, want 1 upgraded to %d", version, report.SchemaVersion, datamodels.EC2InstanceReportSchemaVersion)
+	}
+	named, unnamed := report.Instances[0], report.Instances[1]
+	if named.Name != "analysis 01" || named.Tags["Name"] != "analysis 01" {
+		t.Errorf("got name %q and tags %v, want the unescaped name tagged", named.Name, named.Tags)
+	}
+	if unnamed.Name != "None" || len(unnamed.Tags) != 0 || unnamed.Tags == nil {
+		t.Errorf("got name %q and tags %v, want no Name tag for an unnamed instance", unnamed.Name, unnamed.Tags)
+	}
+	if named.Volumes == nil || named.SecurityGroups == nil {
+		t.Error("version 1 instances not given empty volume and security group lists")
+	}
+	if report.Metadata != nil {
+		t.Errorf("got metadata %+v, want none", report.Metadata)
+	}
+
+	// Version 2 names were not escaped, so a % is kept.
+	report, version, err = MigrateInstanceReport([]byte(version2Report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := report.Instances[0]
+	if version != 2 || instance.Name != "web 50%" || instance.Tags["Project"] != "rnaseq" || len(instance.Volumes) != 1 {
+		t.Errorf("version 2: got %d %+v", version, instance)
+	}
+
+	if _, _, err := MigrateInstanceReport([]byte(`{"schema_version": 99}`)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got error %v, want a newer version refused", err)
+	}
+}
+
+func TestMigrateInstanceReportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := ioutil.WriteFile(path, []byte(version1Report), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := MigrateInstanceReportFile(path)
+	if err != nil || version != 1 {
+		t.Fatalf("got version %d (%v), want 1", version, err)
+	}
+	backup, err := ioutil.ReadFile(path + ".v1.bak")
+	if err != nil || string(backup) != version1Report {
+		t.Errorf("original not kept: %q (%v)", backup, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := datamodels.EC2InstanceReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.SchemaVersion != datamodels.EC2InstanceReportSchemaVersion || report.Instances[0].Name != "analysis 01" {
+		t.Errorf("migrated report: got %+v", report)
+	}
+
+	// A current report is left alone.
+	os.Remove(path + ".v1.bak")
+	version, err = MigrateInstanceReportFile(path)
+	if err != nil || version != datamodels.EC2InstanceReportSchemaVersion {
+		t.Errorf("got version %d (%v), want %d", version, err, datamodels.EC2InstanceReportSchemaVersion)
+	}
+	if matches, _ := filepath.Glob(path + ".v*.bak"); len(matches) != 0 {
+		t.Errorf("current report backed up: %v", matches)
+	}
+}
+
+func TestReportRegion(t *testing.T) {
+	withMetadata := datamodels.EC2InstanceReport{Metadata: &datamodels.ReportMetadata{Region: "eu-west-1", AccountID: "123456789012"}}
+	if region, err := ReportRegion(withMetadata, "us-east-1", "123456789012"); err != nil || region != "eu-west-1" {
+		t.Errorf("got %s (%v), want the report's region", region, err)
+	}
+	if _, err := ReportRegion(withMetadata, "us-east-1", "210987654321"); err == nil {
+		t.Error("report from another account accepted")
+	}
+	if region, err := ReportRegion(datamodels.EC2InstanceReport{}, "us-east-1", "123456789012"); err != nil || region != "us-east-1" {
+		t.Errorf("got %s (%v), want the configured region for a report without metadata", region, err)
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+/* ---
+ * Create params to check whether an instance type is offered in the region
+ * --- */
+func CreateInstanceTypeOfferedParams(instanceType string) *ec2.DescribeInstanceTypeOfferingsInput {
+	return &ec2.DescribeInstanceTypeOfferingsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("instance-type"),
+				Values: aws.StringSlice([]string{instanceType}),
+			},
+		},
+	}
+}
+
+/* ---
+ * Create params to describe instance types
+ * --- */
+func CreateDescribeInstanceTypesParams(instanceTypes []string) *ec2.DescribeInstanceTypesInput {
+	return &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice(instanceTypes),
+	}
+}
+
+/* ---
+ * Create params to change the instance type of a stopped instance
+ * --- */
+func CreateEC2ModifyInstanceTypeParams(id, instanceType string, dryrun bool) *ec2.ModifyInstanceAttributeInput {
+	return &ec2.ModifyInstanceAttributeInput{
+		InstanceId:   aws.String(id),
+		InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+		DryRun:       aws.Bool(dryrun),
+	}
+}
+
+/* ---
+ * List the reasons an instance can not be moved to the target instance type.
+ * image may be nil if the instance's AMI is no longer available; current is
+ * the instance's present type. Returns nil if no problems are found.
+ * --- */
+func InstanceTypeIncompatibilities(instance *ec2.Instance, image *ec2.Image, current, target *ec2.InstanceTypeInfo) []string {
+	problems := make([]string, 0)
+	targetType := aws.StringValue(target.InstanceType)
+
+	// Architecture and virtualization type come from the AMI.
+	architecture := aws.StringValue(instance.Architecture)
+	virtualization := aws.StringValue(instance.VirtualizationType)
+	bootMode := aws.StringValue(instance.CurrentInstanceBootMode)
+	if image != nil {
+		if image.Architecture != nil {
+			architecture = *image.Architecture
+		}
+		if image.VirtualizationType != nil {
+			virtualization = *image.VirtualizationType
+		}
+		if bootMode == "" {
+			bootMode = aws.StringValue(image.BootMode)
+		}
+	}
+
+	if target.ProcessorInfo != nil && architecture != "" && !containsString(target.ProcessorInfo.SupportedArchitectures, architecture) {
+		problems = append(problems, fmt.Sprintf("%s does not support the %s architecture", targetType, architecture))
+	}
+	if virtualization != "" && len(target.SupportedVirtualizationTypes) > 0 && !containsString(target.SupportedVirtualizationTypes, virtualization) {
+		problems = append(problems, fmt.Sprintf("%s does not support %s virtualization", targetType, virtualization))
+	}
+	if bootMode != "" && bootMode != "uefi-preferred" && len(target.SupportedBootModes) > 0 && !containsString(target.SupportedBootModes, bootMode) {
+		problems = append(problems, fmt.Sprintf("%s does not support the %s boot mode", targetType, bootMode))
+	}
+
+	// ENA must be enabled on the instance for types that require it.
+	if target.NetworkInfo != nil && aws.StringValue(target.NetworkInfo.EnaSupport) == ec2.EnaSupportRequired && !aws.BoolValue(instance.EnaSupport) {
+		problems = append(problems, fmt.Sprintf("%s requires ENA but it is not enabled on the instance", targetType))
+	}
+
+	// Moving to NVMe storage needs NVMe drivers in the OS, which AWS can not
+	// tell us about, so only allow it from a type that already uses NVMe.
+	if target.EbsInfo != nil && aws.StringValue(target.EbsInfo.NvmeSupport) == ec2.EbsNvmeSupportRequired {
+		if current == nil || current.EbsInfo == nil || aws.StringValue(current.EbsInfo.NvmeSupport) == ec2.EbsNvmeSupportUnsupported {
+			problems = append(problems, fmt.Sprintf("%s exposes EBS volumes as NVMe devices; the instance's OS must have NVMe drivers", targetType))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+func containsString(values []*string, value string) bool {
+	for _, elem := range values {
+		if aws.StringValue(elem) == value {
+			return true
+		}
+	}
+	return false
+}
+
+/* ---
+ * Print the per-instance results of a resize as a table.
+ * --- */
+func FprintResizeReport(w io.Writer, report datamodels.ResizeReport) {
+	fmt.Fprintln(w, "\nResults")
+	fmt.Fprintln(w, "-------")
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tPREVIOUS TYPE\tNEW TYPE\tRESTARTED\tERROR")
+	for _, result := range report.Results {
+		restarted := "no"
+		if result.Restarted {
+			restarted = "yes"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", result.Name, result.InstanceID, dash(result.PreviousType), dash(result.NewType), restarted, dash(result.Error))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Number of attempts made at each EC2 call when none is configured.
+const DefaultMaxAttempts = 5
+
+// EC2 error codes worth retrying. Throttling codes back off for longer.
+var throttleErrorCodes = map[string]bool{
+	"RequestLimitExceeded": true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+}
+
+var retryableErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity": true,
+	"ServiceUnavailable":           true,
+	"Unavailable":                  true,
+	"InternalError":                true,
+	"InternalFailure":              true,
+	"RequestTimeout":               true,
+	"RequestTimeoutException":      true,
+}
+
+/* ---
+ * Decides whether and when failed EC2 calls are retried. Waits grow
+ * exponentially from BaseDelay (ThrottleDelay for throttling errors) up to
+ * MaxDelay, with jitter so parallel calls do not retry in step. Each retry is
+ * logged to Log. Implements the aws-sdk-go request.Retryer interface.
+ * --- */
+type RetryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	ThrottleDelay time.Duration
+	MaxDelay      time.Duration
+	Log           io.Writer
+
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+/* ---
+ * Create a retry policy making up to maxAttempts attempts at each call and
+ * logging retries to log (which may be nil).
+ * --- */
+func NewRetryPolicy(maxAttempts int, log io.Writer) *RetryPolicy {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryPolicy{
+		MaxAttempts:   maxAttempts,
+		BaseDelay:     200 * time.Millisecond,
+		ThrottleDelay: time.Second,
+		MaxDelay:      30 * time.Second,
+		Log:           log,
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+/* ---
+ * Classify an EC2 error. Returns whether it is worth retrying and whether it
+ * means we are being throttled. Errors such as bad parameters, missing
+ * permissions and unknown instance IDs are fatal.
+ * --- */
+func ClassifyEC2Error(err error) (retryable bool, throttle bool) {
+	if err == nil {
+		return false, false
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		code := awsErr.Code()
+		if code == request.CanceledErrorCode {
+			return false, false
+		}
+		if throttleErrorCodes[code] {
+			return true, true
+		}
+		if retryableErrorCodes[code] {
+			return true, false
+		}
+		// Network failures come back as request errors wrapping the cause.
+		if code != request.ErrCodeRequestError && code != request.ErrCodeResponseTimeout {
+			return false, false
+		}
+	}
+	return request.IsErrorRetryable(err), false
+}
+
+func (p *RetryPolicy) MaxRetries() int {
+	return p.MaxAttempts - 1
+}
+
+func (p *RetryPolicy) ShouldRetry(r *request.Request) bool {
+	// Stop if the caller has given up (Ctrl-C or timeout).
+	if r.Context().Err() != nil {
+		return false
+	}
+	retryable, _ := ClassifyEC2Error(r.Error)
+	if !retryable && r.HTTPResponse != nil && r.HTTPResponse.StatusCode >= 500 {
+		retryable = true
+	}
+	return retryable
+}
+
+func (p *RetryPolicy) RetryRules(r *request.Request) time.Duration {
+	_, throttle := ClassifyEC2Error(r.Error)
+	delay := p.backoff(r.RetryCount, throttle)
+	if p.Log != nil {
+		fmt.Fprintf(p.Log, "Retrying %s (attempt %d of %d) in %s: %s\n", r.Operation.Name, r.RetryCount+2, p.MaxAttempts, delay.Round(time.Millisecond), ErrorSummary(r.Error))
+	}
+	return delay
+}
+
+/* ---
+ * Wait before retry number retryCount (starting at 0): half the exponential
+ * delay plus a random amount up to the other half.
+ * --- */
+func (p *RetryPolicy) backoff(retryCount int, throttle bool) time.Duration {
+	delay := p.BaseDelay
+	if throttle {
+		delay = p.ThrottleDelay
+	}
+	for i := 0; i < retryCount && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.random == nil {
+		p.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	half := delay / 2
+	return half + time.Duration(p.random.Int63n(int64(half)+1))
+}
+
+/* ---
+ * One line description of an error for logs and reports.
+ * --- */
+func ErrorSummary(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return fmt.Sprintf("%s: %s", awsErr.Code(), awsErr.Message())
+	}
+	return fmt.Sprint(err)
+}
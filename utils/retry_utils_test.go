@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// A network failure as the SDK reports it.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyEC2Error(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+		throttle  bool
+	}{
+		{nil, false, false},
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil), true, true},
+		{awserr.New("Throttling", "Rate exceeded", nil), true, true},
+		{awserr.New("InsufficientInstanceCapacity", "We currently do not have sufficient capacity.", nil), true, false},
+		{awserr.New("InternalError", "An internal error has occurred", nil), true, false},
+		{awserr.New("Unavailable", "The server is overloaded", nil), true, false},
+		{awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), false, false},
+		{awserr.New("InvalidInstanceID.NotFound", "The instance ID 'i-0123' does not exist", nil), false, false},
+		{awserr.New("InvalidParameterValue", "Invalid value", nil), false, false},
+		{awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), false, false},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", timeoutError{}), true, false},
+		{awserr.New(request.ErrCodeResponseTimeout, "read on body has reached the timeout limit", nil), true, false},
+		// Errors from outside the SDK are left to its own judgement.
+		{errors.New("unexpected EOF"), true, false},
+	}
+	for _, test := range tests {
+		retryable, throttle := ClassifyEC2Error(test.err)
+		if retryable != test.retryable || throttle != test.throttle {
+			t.Errorf("%v: got retryable %t throttle %t, want %t %t", test.err, retryable, throttle, test.retryable, test.throttle)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := NewRetryPolicy(5, nil)
+	tests := []struct {
+		retryCount int
+		throttle   bool
+		max        time.Duration
+	}{
+		{0, false, 200 * time.Millisecond},
+		{1, false, 400 * time.Millisecond},
+		{3, false, 1600 * time.Millisecond},
+		{0, true, time.Second},
+		{2, true, 4 * time.Second},
+		{10, true, 30 * time.Second},
+		{100, false, 30 * time.Second},
+	}
+	for _, test := range tests {
+		for idx := 0; idx < 20; idx++ {
+			delay := policy.backoff(test.retryCount, test.throttle)
+			if delay < test.max/2 || delay > test.max {
+				t.Errorf("retry %d (throttle %t): got %s, want %s to %s", test.retryCount, test.throttle, delay, test.max/2, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	if policy := NewRetryPolicy(0, nil); policy.MaxAttempts != 1 || policy.MaxRetries() != 0 {
+		t.Errorf("got %d attempts, want at least 1", policy.MaxAttempts)
+	}
+	if policy := NewRetryPolicy(DefaultMaxAttempts, nil); policy.MaxRetries() != DefaultMaxAttempts-1 {
+		t.Errorf("got %d retries, want %d", policy.MaxRetries(), DefaultMaxAttempts-1)
+	}
+}
+
+func TestRetryRules(t *testing.T) {
+	var log bytes.Buffer
+	policy := NewRetryPolicy(3, &log)
+	r := &request.Request{
+		Operation:    &request.Operation{Name: "StartInstances"},
+		HTTPRequest:  &http.Request{},
+		HTTPResponse: &http.Response{StatusCode: 503},
+		Error:        awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil),
+	}
+	if !policy.ShouldRetry(r) {
+		t.Error("throttling error not retried")
+	}
+	if delay := policy.RetryRules(r); delay < 500*time.Millisecond || delay > time.Second {
+		t.Errorf("got delay %s, want the throttle delay", delay)
+	}
+	if !strings.HasPrefix(log.String(), "Retrying StartInstances (attempt 2 of 3) in ") || !strings.HasSuffix(log.String(), "RequestLimitExceeded: Request limit exceeded.\n") {
+		t.Errorf("got log %q", log.String())
+	}
+
+	// Unrecognised errors are retried on server failures only.
+	r.Error = awserr.New("SomethingNew", "An error this tool does not know", nil)
+	if !policy.ShouldRetry(r) {
+		t.Error("5xx response not retried")
+	}
+	r.HTTPResponse.StatusCode = 400
+	if policy.ShouldRetry(r) {
+		t.Error("4xx response retried")
+	}
+
+	// Nor once the caller has given up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.SetContext(ctx)
+	r.Error = awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	if policy.ShouldRetry(r) {
+		t.Error("retried after the context was canceled")
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	err := awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", errors.New("cause"))
+	if got := ErrorSummary(err); got != "UnauthorizedOperation: You are not authorized to perform this operation." {
+		t.Errorf("got %q", got)
+	}
+	if got := ErrorSummary(errors.New("plain")); got != "plain" {
+		t.Errorf("got %q", got)
+	}
+}
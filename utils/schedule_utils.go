@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+/* ---
+ * Load the schedule daemon's state file. A missing file gives an empty
+ * state.
+ * --- */
+func LoadSchedulerState(path string) (datamodels.SchedulerState, error) {
+	state := datamodels.SchedulerState{Instances: make(map[string]datamodels.ScheduledInstanceState)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("Unable to read scheduler state %s: %s", path, err)
+	}
+	if state.Instances == nil {
+		state.Instances = make(map[string]datamodels.ScheduledInstanceState)
+	}
+	return state, nil
+}
+
+/* ---
+ * Write the schedule daemon's state file.
+ * --- */
+func WriteSchedulerState(path string, state datamodels.SchedulerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteSecureFile(path, data)
+}
+
+/* ---
+ * Print a scheduled action as a single log line.
+ * --- */
+func FprintScheduledAction(w io.Writer, action datamodels.ScheduledAction) {
+	line := fmt.Sprintf("%s %-7s %s (%s) schedule=%s event=%s@%s state=%s",
+		action.Time.UTC().Format(time.RFC3339), action.Action, action.InstanceID, dash(action.Name),
+		action.Schedule, action.Event, action.EventTime.Format(time.RFC3339), action.State)
+	if action.Reason != "" {
+		line += fmt.Sprintf(" reason=%q", action.Reason)
+	}
+	if action.Error != "" {
+		line += fmt.Sprintf(" error=%q", action.Error)
+	}
+	fmt.Fprintln(w, line)
+}
+
+/* ---
+ * Print instance schedules as a table.
+ * --- */
+func FprintInstanceSchedules(w io.Writer, schedules []datamodels.InstanceSchedule) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tSTATE\tSCHEDULE\tLAST EVENT\tNEXT EVENT")
+	for _, s := range schedules {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", dash(s.Name), s.InstanceID, s.State, s.Schedule, dash(s.LastEvent), dash(s.NextEvent))
+	}
+	writer.Flush()
+}
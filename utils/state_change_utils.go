@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Largest number of instance IDs sent in one start, stop or terminate call.
+const InstanceBatchSize = 200
+
+// Errors that name the instances at fault; the rest of the batch can be retried.
+var instanceErrorCodes = map[string]bool{
+	"InvalidInstanceID.NotFound":  true,
+	"InvalidInstanceID.Malformed": true,
+	"IncorrectInstanceState":      true,
+	"UnsupportedOperation":        true,
+}
+
+var instanceIDPattern = regexp.MustCompile(`i-[0-9a-f]+`)
+
+/* ---
+ * Split instance IDs into batches of at most size IDs.
+ * --- */
+func BatchInstanceIDs(ids []string, size int) [][]string {
+	batches := make([][]string, 0)
+	for len(ids) > size {
+		batches = append(batches, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+/* ---
+ * Split instance IDs into well formed IDs and malformed ones. AWS rejects a
+ * whole batch over a malformed ID without always naming it, so these are
+ * kept out of the calls.
+ * --- */
+func SplitMalformedInstanceIDs(ids []string) ([]string, []string) {
+	valid := make([]string, 0, len(ids))
+	malformed := make([]string, 0)
+	for _, id := range ids {
+		if wholeInstanceIDPattern.MatchString(id) {
+			valid = append(valid, id)
+		} else {
+			malformed = append(malformed, id)
+		}
+	}
+	return valid, malformed
+}
+
+/* ---
+ * Get the instance IDs named in an error caused by particular instances
+ * (unknown IDs, instances in the wrong state). Returns nil for other errors.
+ * --- */
+func FailedInstanceIDs(err error) []string {
+	awsErr, ok := err.(awserr.Error)
+	if !ok || !instanceErrorCodes[awsErr.Code()] {
+		return nil
+	}
+	return instanceIDPattern.FindAllString(awsErr.Message(), -1)
+}
+
+/* ---
+ * Convert the state changes in a start, stop or terminate response into
+ * results keyed by instance ID.
+ * --- */
+func ParseStateChanges(changes []*ec2.InstanceStateChange) map[string]datamodels.InstanceStateResult {
+	results := make(map[string]datamodels.InstanceStateResult)
+	for _, change := range changes {
+		if change == nil || change.InstanceId == nil {
+			continue
+		}
+		result := datamodels.InstanceStateResult{InstanceID: *change.InstanceId}
+		if change.PreviousState != nil && change.PreviousState.Name != nil {
+			result.PreviousState = *change.PreviousState.Name
+		}
+		if change.CurrentState != nil && change.CurrentState.Name != nil {
+			result.CurrentState = *change.CurrentState.Name
+		}
+		results[result.InstanceID] = result
+	}
+	return results
+}
+
+/* ---
+ * Print the per-instance results of a state change as a table.
+ * --- */
+func FprintStateChangeReport(w io.Writer, report datamodels.StateChangeReport) {
+	fmt.Fprintln(w, "\nResults")
+	fmt.Fprintln(w, "-------")
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tPREVIOUS\tCURRENT\tERROR")
+	for _, result := range report.Results {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", result.Name, result.InstanceID, dash(result.PreviousState), dash(result.CurrentState), dash(result.Error))
+	}
+	writer.Flush()
+}
+
+func dash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
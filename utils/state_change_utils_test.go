@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestBatchInstanceIDs(t *testing.T) {
+	ids := make([]string, 0)
+	for idx := 0; idx < 5; idx++ {
+		ids = append(ids, fmt.Sprintf("i-%02d", idx))
+	}
+	tests := []struct {
+		ids     []string
+		size    int
+		batches string
+	}{
+		{ids, 2, "[[i-00 i-01] [i-02 i-03] [i-04]]"},
+		{ids, 5, "[[i-00 i-01 i-02 i-03 i-04]]"},
+		{ids, 200, "[[i-00 i-01 i-02 i-03 i-04]]"},
+		{ids[:4], 2, "[[i-00 i-01] [i-02 i-03]]"},
+		{nil, 2, "[]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(BatchInstanceIDs(test.ids, test.size)); got != test.batches {
+			t.Errorf("%d IDs in batches of %d: got %s, want %s", len(test.ids), test.size, got, test.batches)
+		}
+	}
+}
+
+func TestSplitMalformedInstanceIDs(t *testing.T) {
+	valid, malformed := SplitMalformedInstanceIDs([]string{"i-0123abcd", "i-0123ABCD", "i-", "0123abcd", " i-0123", "i-0123456789abcdef0", ""})
+	if got := strings.Join(valid, ","); got != "i-0123abcd,i-0123456789abcdef0" {
+		t.Errorf("got valid %s", got)
+	}
+	if got := fmt.Sprintf("%q", malformed); got != `["i-0123ABCD" "i-" "0123abcd" " i-0123" ""]` {
+		t.Errorf("got malformed %s", got)
+	}
+}
+
+func TestFailedInstanceIDs(t *testing.T) {
+	tests := []struct {
+		err error
+		ids string
+	}{
+		{awserr.New("InvalidInstanceID.NotFound", "The instance IDs 'i-0123, i-0456abc' do not exist", nil), "i-0123,i-0456abc"},
+		{awserr.New("IncorrectInstanceState", "The instance 'i-0789' is not in a state from which it can be started.", nil), "i-0789"},
+		{awserr.New("UnsupportedOperation", "The instance 'i-0abc' does not have an 'ebs' root device type and cannot be stopped.", nil), "i-0abc"},
+		{awserr.New("UnauthorizedOperation", "You are not authorized to stop i-0123.", nil), ""},
+		{fmt.Errorf("The instance ID 'i-0123' does not exist"), ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(FailedInstanceIDs(test.err), ","); got != test.ids {
+			t.Errorf("%v: got %q, want %q", test.err, got, test.ids)
+		}
+	}
+}
+
+func TestParseStateChanges(t *testing.T) {
+	results := ParseStateChanges([]*ec2.InstanceStateChange{
+		{
+			InstanceId:    aws.String("i-01"),
+			PreviousState: &ec2.InstanceState{Name: aws.String("stopped")},
+			CurrentState:  &ec2.InstanceState{Name: aws.String("pending")},
+		},
+		// Missing fields are left empty rather than failing.
+		{InstanceId: aws.String("i-02"), CurrentState: &ec2.InstanceState{}},
+		{PreviousState: &ec2.InstanceState{Name: aws.String("running")}},
+		nil,
+	})
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	if result := results["i-01"]; result.InstanceID != "i-01" || result.PreviousState != "stopped" || result.CurrentState != "pending" {
+		t.Errorf("i-01: got %+v", result)
+	}
+	if result := results["i-02"]; result.InstanceID != "i-02" || result.PreviousState != "" || result.CurrentState != "" {
+		t.Errorf("i-02: got %+v", result)
+	}
+	if results := ParseStateChanges(nil); results == nil || len(results) != 0 {
+		t.Errorf("got %v for no changes, want an empty map", results)
+	}
+}
@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mdibl_cloud_control/datamodels"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var wholeInstanceIDPattern = regexp.MustCompile(`^i-[0-9a-f]+$`)
+
+// Tags applied to instances at launch.
+const (
+	TagName         = "Name"
+	TagOwner        = "Owner"
+	TagProject      = "Project"
+	TagCreatedBy    = "CreatedBy"
+	TagLaunchReport = "LaunchReport"
+	TagExpiry       = "Expiry"
+)
+
+// Tags used by the reaper. ExpiryAction overrides the reaper's action for an
+// instance; ExpiryWarned records the expiry the owner was last warned about
+// and ExpiryWarnedAt when the warning was sent.
+const (
+	TagExpiryAction   = "ExpiryAction"
+	TagExpiryWarned   = "ExpiryWarned"
+	TagExpiryWarnedAt = "ExpiryWarnedAt"
+)
+
+// Tag giving an instance's office-hours schedule: either the name of a
+// schedule in the schedule config or an inline schedule such as
+// "start=0 8 * * mon-fri; stop=0 19 * * mon-fri; tz=America/New_York".
+const TagSchedule = "Schedule"
+
+// Tags the on-instance agent keeps up to date: the time of its last check,
+// the instance's status (busy, idle or stopping) and what it is busy with.
+const (
+	TagAgentHeartbeat = "AgentHeartbeat"
+	TagAgentStatus    = "AgentStatus"
+	TagAgentDetail    = "AgentDetail"
+)
+
+// Tag recording the scheduled events (see ScheduledEventKey) an instance's
+// owner has been told about, so owners are notified once per event.
+const TagEventNotified = "EventNotified"
+
+// Date form accepted for expiry dates, meaning midnight UTC at the start of
+// the day.
+const expiryDateFormat = "2006-01-02"
+
+// Limits AWS places on tags.
+const (
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+/* ---
+ * Check a tag key and value are ones AWS will accept.
+ * --- */
+func ValidateTag(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("Tag key must not be empty")
+	}
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return fmt.Errorf("Tag key %q uses the reserved aws: prefix", key)
+	}
+	if len(key) > maxTagKeyLength {
+		return fmt.Errorf("Tag key %q is longer than %d characters", key, maxTagKeyLength)
+	}
+	if len(value) > maxTagValueLength {
+		return fmt.Errorf("Value of tag %q is longer than %d characters", key, maxTagValueLength)
+	}
+	return nil
+}
+
+/* ---
+ * Parse tag assignments of the form KEY=VALUE. The value may be empty.
+ * --- */
+func ParseTagAssignments(assignments []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, assignment := range assignments {
+		idx := strings.Index(assignment, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("Invalid tag %q, expected KEY=VALUE", assignment)
+		}
+		key, value := strings.TrimSpace(assignment[:idx]), assignment[idx+1:]
+		if err := ValidateTag(key, value); err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+/* ---
+ * Load a CSV file mapping instance IDs to tag values. The header row names
+ * the tag keys, with the instance IDs in a column named instance_id (or the
+ * first column). Empty cells leave that tag unchanged.
+ *
+ *   instance_id,Project,Owner
+ *   i-0123456789abcdef0,rnaseq,jsmith
+ * --- */
+func LoadTagCSV(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("%s: expected a header row and at least one instance", path)
+	}
+
+	header := rows[0]
+	idColumn := 0
+	for idx, column := range header {
+		if strings.TrimSpace(column) == "instance_id" {
+			idColumn = idx
+		}
+	}
+	for idx, key := range header {
+		if idx != idColumn {
+			if err := ValidateTag(strings.TrimSpace(key), ""); err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+		}
+	}
+
+	tags := make(map[string]map[string]string)
+	for line, row := range rows[1:] {
+		id := strings.TrimSpace(row[idColumn])
+		if !wholeInstanceIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("%s line %d: invalid instance ID %q", path, line+2, id)
+		}
+		if _, ok := tags[id]; !ok {
+			tags[id] = make(map[string]string)
+		}
+		for idx, value := range row {
+			key := strings.TrimSpace(header[idx])
+			if idx == idColumn || value == "" {
+				continue
+			}
+			if err := ValidateTag(key, value); err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", path, line+2, err)
+			}
+			tags[id][key] = value
+		}
+	}
+	return tags, nil
+}
+
+/* ---
+ * Plan the changes needed to give an instance the tags in set and remove the
+ * keys in remove. Tags already holding the wanted value are left alone.
+ * --- */
+func PlanTagChanges(instance datamodels.EC2InstanceDetails, set map[string]string, remove []string) []datamodels.TagChange {
+	changes := make([]datamodels.TagChange, 0)
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		change := datamodels.TagChange{InstanceID: instance.InstanceID, Name: instance.Name, Action: "add", Key: key, NewValue: set[key]}
+		if oldValue, ok := instance.Tags[key]; ok {
+			if oldValue == set[key] {
+				continue
+			}
+			change.Action = "update"
+			change.OldValue = oldValue
+		}
+		changes = append(changes, change)
+	}
+	for _, key := range remove {
+		if oldValue, ok := instance.Tags[key]; ok {
+			changes = append(changes, datamodels.TagChange{InstanceID: instance.InstanceID, Name: instance.Name, Action: "remove", Key: key, OldValue: oldValue})
+		}
+	}
+	return changes
+}
+
+/* ---
+ * Parse an absolute expiry time, as stored in the Expiry tag: an RFC 3339
+ * time or a date (midnight UTC at the start of the day).
+ * --- */
+func ParseExpiryTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if expiry, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiry, nil
+	}
+	if expiry, err := time.Parse(expiryDateFormat, value); err == nil {
+		return expiry, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid expiry %q, expected a date (2006-01-02) or RFC 3339 time", value)
+}
+
+/* ---
+ * Parse an expiry given either as an absolute time (see ParseExpiryTime) or
+ * as a duration from now such as 7d, 36h or 90m.
+ * --- */
+func ParseExpiry(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if expiry, err := ParseExpiryTime(value); err == nil {
+		return expiry, nil
+	}
+	if duration, err := ParseDays(value); err == nil && duration > 0 {
+		return now.Add(duration), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid expiry %q, expected a date (2006-01-02), RFC 3339 time or duration such as 7d or 36h", value)
+}
+
+/* ---
+ * Get a short owner name from a caller ARN: the user name for IAM users and
+ * the session name for assumed roles, e.g.,
+ *   arn:aws:iam::123456789012:user/jsmith                 -> jsmith
+ *   arn:aws:sts::123456789012:assumed-role/Admin/jsmith   -> jsmith
+ * --- */
+func OwnerFromARN(arn string) string {
+	idx := strings.LastIndex(arn, "/")
+	if idx < 0 {
+		idx = strings.LastIndex(arn, ":")
+	}
+	return arn[idx+1:]
+}
+
+/* ---
+ * Create tag specifications applying tags to instances and their volumes as
+ * they are created. Tags with empty values are skipped.
+ * --- */
+func CreateLaunchTagSpecifications(tags map[string]string) []*ec2.TagSpecification {
+	keys := make([]string, 0, len(tags))
+	for key, value := range tags {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	ec2Tags := make([]*ec2.Tag, 0, len(keys))
+	for _, key := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return []*ec2.TagSpecification{
+		&ec2.TagSpecification{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: ec2Tags},
+		&ec2.TagSpecification{ResourceType: aws.String(ec2.ResourceTypeVolume), Tags: ec2Tags},
+	}
+}
+
+/* ---
+ * Create EC2 create tags params
+ * --- */
+func CreateEC2CreateTagsParams(ids []string, key, value string) *ec2.CreateTagsInput {
+	return &ec2.CreateTagsInput{
+		Resources: aws.StringSlice(ids),
+		Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String(key), Value: aws.String(value)}},
+	}
+}
+
+/* ---
+ * Create EC2 create tags params setting several tags at once
+ * --- */
+func CreateEC2SetTagsParams(ids []string, tags map[string]string) *ec2.CreateTagsInput {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	input := &ec2.CreateTagsInput{Resources: aws.StringSlice(ids)}
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return input
+}
+
+/* ---
+ * Create EC2 delete tags params
+ * --- */
+func CreateEC2DeleteTagsParams(ids []string, key string) *ec2.DeleteTagsInput {
+	return &ec2.DeleteTagsInput{
+		Resources: aws.StringSlice(ids),
+		Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String(key)}},
+	}
+}
+
+/* ---
+ * Print tag changes as a table.
+ * --- */
+func FprintTagChanges(w io.Writer, changes []datamodels.TagChange) {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tID\tACTION\tKEY\tOLD VALUE\tNEW VALUE")
+	for _, change := range changes {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", change.Name, change.InstanceID, change.Action, change.Key, dash(change.OldValue), dash(change.NewValue))
+	}
+	writer.Flush()
+}
@@ -0,0 +1,4 @@
+package utils
+
+// Version of the tool recorded in report metadata.
+const ToolVersion = "0.3.0"